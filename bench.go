@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	mgl "github.com/go-gl/mathgl/mgl32"
+
+	"github.com/xopoww/go-raytrace/scenery"
+	"github.com/xopoww/go-raytrace/tracer"
+)
+
+// benchMain implements the "bench" command: random scenes with growing numbers
+// of objects are rendered on the CPU with and without the BVH, and the times are compared
+func benchMain(args []string) {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+
+	OBJECTS := flags.String("objects", "10,100,1000,10000", "comma-separated numbers of objects in the scenes")
+	SEED := flags.Int64("seed", 0, "seed for random scene generation")
+	WIDTH := flags.Int("width", 160, "image width in pixels")
+	HEIGHT := flags.Int("height", 120, "image height in pixels")
+	SAMPLES := flags.Uint("samples", 1, "number of frames for monte carlo denoising")
+	MAX_DEPTH := flags.Uint("depth", 10, "maximum recursion depth for ray tracing")
+	NO_BRUTE_FORCE_ABOVE := flags.Int("max-brute", 10000, "do not render without the BVH scenes with more objects than that")
+
+	flags.Parse(args)
+
+	var counts []int
+	for _, s := range strings.Split(*OBJECTS, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n < 0 {
+			log.Fatalf("invalid number of objects: %q", s)
+		}
+		counts = append(counts, n)
+	}
+
+	camera := scenery.NewCamera(*WIDTH, *HEIGHT)
+	camera.SetView(mgl.Vec3{60.0, 30.0, 60.0}, mgl.Vec3{0.0, 0.0, 0.0})
+	camera.Aperture = 0.0
+
+	opts := tracer.Options{
+		Width:        *WIDTH,
+		Height:       *HEIGHT,
+		Samples:      *SAMPLES,
+		AntiAliasing: 1,
+		MaxDepth:     *MAX_DEPTH,
+		Seed:         *SEED,
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "objects\tbuild\twith BVH\twithout BVH\tspeedup\t")
+	for _, n := range counts {
+		scene := scenery.RandomSceneWithObjects(*SEED, n)
+
+		start := time.Now()
+		t := tracer.New(scene)
+		build := time.Since(start)
+
+		start = time.Now()
+		t.Render(camera, opts)
+		withBVH := time.Since(start)
+
+		without, speedup := "-", "-"
+		if n <= *NO_BRUTE_FORCE_ABOVE {
+			opts.DisableBVH = true
+			start = time.Now()
+			t.Render(camera, opts)
+			withoutBVH := time.Since(start)
+			opts.DisableBVH = false
+
+			without = withoutBVH.Round(time.Millisecond).String()
+			speedup = fmt.Sprintf("%.1fx", float64(withoutBVH)/float64(withBVH))
+		}
+
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t\n",
+			n,
+			build.Round(time.Microsecond),
+			withBVH.Round(time.Millisecond),
+			without,
+			speedup,
+		)
+	}
+	w.Flush()
+}
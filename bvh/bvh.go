@@ -0,0 +1,405 @@
+// Package bvh builds bounding volume hierarchies over sets of primitives
+// given by their bounding boxes. The hierarchy is built with the binned
+// surface area heuristic and stored as a flat array of nodes, which can
+// be uploaded to the GPU as is.
+package bvh
+
+import (
+	"math"
+
+	mgl "github.com/go-gl/mathgl/mgl32"
+)
+
+// Axis-aligned bounding box
+type AABB struct {
+	Min mgl.Vec3
+	Max mgl.Vec3
+}
+
+// EmptyAABB returns a box that contains nothing, so that its union
+// with any other box is that box
+func EmptyAABB() AABB {
+	inf := float32(math.Inf(1))
+	return AABB{
+		Min: mgl.Vec3{inf, inf, inf},
+		Max: mgl.Vec3{-inf, -inf, -inf},
+	}
+}
+
+// InfiniteAABB returns a box that contains everything (the bounds of the infinite planes)
+func InfiniteAABB() AABB {
+	inf := float32(math.Inf(1))
+	return AABB{
+		Min: mgl.Vec3{-inf, -inf, -inf},
+		Max: mgl.Vec3{inf, inf, inf},
+	}
+}
+
+// Unbounded reports whether the box is infinite along some axis
+func (a AABB) Unbounded() bool {
+	for i := 0; i < 3; i++ {
+		if math.IsInf(float64(a.Min[i]), -1) || math.IsInf(float64(a.Max[i]), 1) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewAABB returns the smallest box containing both points
+func NewAABB(a, b mgl.Vec3) AABB {
+	return EmptyAABB().Extend(a).Extend(b)
+}
+
+func (a AABB) Extend(p mgl.Vec3) AABB {
+	for i := 0; i < 3; i++ {
+		a.Min[i] = minf(a.Min[i], p[i])
+		a.Max[i] = maxf(a.Max[i], p[i])
+	}
+	return a
+}
+
+func (a AABB) Union(b AABB) AABB {
+	return a.Extend(b.Min).Extend(b.Max)
+}
+
+// Transform returns the bounding box of the box transformed by the affine matrix
+func (a AABB) Transform(m mgl.Mat4) AABB {
+	if a.Min.X() > a.Max.X() || a.Min.Y() > a.Max.Y() || a.Min.Z() > a.Max.Z() {
+		return a
+	}
+	if a.Unbounded() {
+		// the corners at infinity would give NaNs
+		return InfiniteAABB()
+	}
+	result := EmptyAABB()
+	for i := 0; i < 8; i++ {
+		corner := a.Min
+		for axis := 0; axis < 3; axis++ {
+			if i&(1<<axis) != 0 {
+				corner[axis] = a.Max[axis]
+			}
+		}
+		result = result.Extend(mgl.TransformCoordinate(corner, m))
+	}
+	return result
+}
+
+func (a AABB) Centroid() mgl.Vec3 {
+	return a.Min.Add(a.Max).Mul(0.5)
+}
+
+func (a AABB) SurfaceArea() float32 {
+	d := a.Max.Sub(a.Min)
+	if d.X() < 0.0 || d.Y() < 0.0 || d.Z() < 0.0 {
+		return 0.0
+	}
+	return 2.0 * (d.X()*d.Y() + d.Y()*d.Z() + d.Z()*d.X())
+}
+
+// Intersect returns the interval of ray parameters at which the ray is inside the box.
+// invDir must be the element-wise inverse of the ray direction. The interval is
+// empty (near > far) if the ray misses the box
+func (a AABB) Intersect(origin, invDir mgl.Vec3) (near, far float32) {
+	for i := 0; i < 3; i++ {
+		t0 := (a.Min[i] - origin[i]) * invDir[i]
+		t1 := (a.Max[i] - origin[i]) * invDir[i]
+		if t0 > t1 {
+			t0, t1 = t1, t0
+		}
+		if i == 0 {
+			near, far = t0, t1
+		} else {
+			near, far = maxf(near, t0), minf(far, t1)
+		}
+	}
+	return near, far
+}
+
+func minf(a, b float32) float32 {
+	if b < a {
+		return b
+	}
+	return a
+}
+
+func maxf(a, b float32) float32 {
+	if b > a {
+		return b
+	}
+	return a
+}
+
+// Node of the flattened hierarchy. The first child of an inner node always
+// follows its parent, so only the index of the second child is stored.
+// The layout matches the bvhnode struct of the compute shader (std430)
+type Node struct {
+	Min mgl.Vec3
+	// leaves: index of the first primitive in BVH.Indices; inner nodes: index of the second child
+	Offset int32
+	Max    mgl.Vec3
+	// number of primitives in the leaf, 0 for inner nodes
+	Count int32
+}
+
+func (n Node) Bounds() AABB {
+	return AABB{n.Min, n.Max}
+}
+
+func (n Node) IsLeaf() bool {
+	return n.Count > 0
+}
+
+type BVH struct {
+	// nodes in depth-first order, the root is the first one (if there are any primitives)
+	Nodes []Node
+	// primitive indices, every leaf refers to a contiguous range of them
+	Indices []int32
+}
+
+// Maximum depth of the hierarchy, so traversals can use a fixed size stack
+// (the stack never holds more than MaxDepth + 1 nodes)
+const MaxDepth = 48
+
+const (
+	numBins     = 12
+	maxLeafSize = 4
+	// deeper than that all splits are made in the middle of the range,
+	// which keeps the tree depth under MaxDepth for any realistic scene
+	sahMaxDepth = 24
+
+	traversalCost    = 1.0
+	intersectionCost = 1.0
+)
+
+type builder struct {
+	bounds    []AABB
+	centroids []mgl.Vec3
+	indices   []int32
+	nodes     []Node
+}
+
+// Build builds the hierarchy over the primitives with given bounding boxes. Primitives
+// with unbounded boxes (e.g. infinite planes) would make every node of the hierarchy
+// unbounded, so they are kept out of it: they are put into a leaf with infinite bounds,
+// which is the first child of the root (or the root itself), so every traversal tests them
+func Build(bounds []AABB) *BVH {
+	b := builder{
+		bounds:    bounds,
+		centroids: make([]mgl.Vec3, len(bounds)),
+		indices:   make([]int32, 0, len(bounds)),
+		nodes:     make([]Node, 0, 2*len(bounds)+2),
+	}
+	for i := range bounds {
+		if bounds[i].Unbounded() {
+			b.indices = append(b.indices, int32(i))
+		}
+	}
+	unbounded := len(b.indices)
+	for i := range bounds {
+		if !bounds[i].Unbounded() {
+			b.centroids[i] = bounds[i].Centroid()
+			b.indices = append(b.indices, int32(i))
+		}
+	}
+
+	inf := InfiniteAABB()
+	switch {
+	case unbounded == len(bounds) && unbounded > 0:
+		b.nodes = append(b.nodes, Node{Min: inf.Min, Max: inf.Max, Offset: 0, Count: int32(unbounded)})
+	case unbounded > 0:
+		b.nodes = append(b.nodes,
+			Node{Min: inf.Min, Max: inf.Max},
+			Node{Min: inf.Min, Max: inf.Max, Offset: 0, Count: int32(unbounded)},
+		)
+		b.nodes[0].Offset = b.build(unbounded, len(bounds)-unbounded, 1)
+	case len(bounds) > 0:
+		b.build(0, len(bounds), 0)
+	}
+	return &BVH{
+		Nodes:   b.nodes,
+		Indices: b.indices,
+	}
+}
+
+// Bounds returns the bounding box of the primitives with bounded boxes
+func (t *BVH) Bounds() AABB {
+	if len(t.Nodes) == 0 {
+		return EmptyAABB()
+	}
+	root := t.Nodes[0]
+	if !root.Bounds().Unbounded() {
+		return root.Bounds()
+	}
+	if root.IsLeaf() {
+		return EmptyAABB()
+	}
+	return t.Nodes[root.Offset].Bounds()
+}
+
+// build creates the subtree over indices[first:first+count] and returns the index of its root
+func (b *builder) build(first, count, depth int) int32 {
+	nodeIndex := int32(len(b.nodes))
+	b.nodes = append(b.nodes, Node{})
+
+	bounds, centroidBounds := EmptyAABB(), EmptyAABB()
+	for _, i := range b.indices[first : first+count] {
+		bounds = bounds.Union(b.bounds[i])
+		centroidBounds = centroidBounds.Extend(b.centroids[i])
+	}
+	b.nodes[nodeIndex].Min = bounds.Min
+	b.nodes[nodeIndex].Max = bounds.Max
+
+	mid := -1
+	switch {
+	case count <= 1 || depth >= MaxDepth:
+		break
+	case depth < sahMaxDepth:
+		mid = b.splitSAH(first, count, bounds, centroidBounds)
+		if mid < 0 && count > maxLeafSize {
+			mid = b.splitMiddle(first, count, centroidBounds)
+		}
+	case count > maxLeafSize:
+		mid = b.splitMiddle(first, count, centroidBounds)
+	}
+	if mid < 0 {
+		b.nodes[nodeIndex].Offset = int32(first)
+		b.nodes[nodeIndex].Count = int32(count)
+		return nodeIndex
+	}
+
+	b.build(first, mid-first, depth+1)
+	second := b.build(mid, first+count-mid, depth+1)
+	b.nodes[nodeIndex].Offset = second
+	return nodeIndex
+}
+
+// splitSAH partitions the range by the best split according to the surface area
+// heuristic and returns the start of the second part, or -1 if making a leaf is cheaper
+func (b *builder) splitSAH(first, count int, bounds, centroidBounds AABB) int {
+	type bin struct {
+		bounds AABB
+		count  int
+	}
+
+	bestCost := float32(count) * intersectionCost
+	bestAxis, bestSplit := -1, 0
+	extent := centroidBounds.Max.Sub(centroidBounds.Min)
+	for axis := 0; axis < 3; axis++ {
+		if extent[axis] <= 0.0 {
+			continue
+		}
+		var bins [numBins]bin
+		for i := range bins {
+			bins[i].bounds = EmptyAABB()
+		}
+		for _, i := range b.indices[first : first+count] {
+			k := b.binIndex(b.centroids[i], axis, centroidBounds)
+			bins[k].bounds = bins[k].bounds.Union(b.bounds[i])
+			bins[k].count++
+		}
+
+		// areas and counts to the right of each split
+		var rightArea [numBins]float32
+		var rightCount [numBins]int
+		acc, accCount := EmptyAABB(), 0
+		for k := numBins - 1; k > 0; k-- {
+			acc = acc.Union(bins[k].bounds)
+			accCount += bins[k].count
+			rightArea[k] = acc.SurfaceArea()
+			rightCount[k] = accCount
+		}
+
+		acc, accCount = EmptyAABB(), 0
+		for k := 1; k < numBins; k++ {
+			acc = acc.Union(bins[k-1].bounds)
+			accCount += bins[k-1].count
+			if accCount == 0 || rightCount[k] == 0 {
+				continue
+			}
+			cost := traversalCost + intersectionCost*
+				(acc.SurfaceArea()*float32(accCount)+rightArea[k]*float32(rightCount[k]))/bounds.SurfaceArea()
+			if cost < bestCost {
+				bestCost, bestAxis, bestSplit = cost, axis, k
+			}
+		}
+	}
+	if bestAxis < 0 {
+		return -1
+	}
+
+	return b.partition(first, count, func(i int32) bool {
+		return b.binIndex(b.centroids[i], bestAxis, centroidBounds) < bestSplit
+	})
+}
+
+func (b *builder) binIndex(c mgl.Vec3, axis int, centroidBounds AABB) int {
+	extent := centroidBounds.Max[axis] - centroidBounds.Min[axis]
+	k := int(numBins * (c[axis] - centroidBounds.Min[axis]) / extent)
+	if k >= numBins {
+		k = numBins - 1
+	}
+	return k
+}
+
+// splitMiddle splits the range in two halves of the same size
+// along the axis where the centroids are spread the most
+func (b *builder) splitMiddle(first, count int, centroidBounds AABB) int {
+	extent := centroidBounds.Max.Sub(centroidBounds.Min)
+	axis := 0
+	if extent.Y() > extent[axis] {
+		axis = 1
+	}
+	if extent.Z() > extent[axis] {
+		axis = 2
+	}
+	mid := first + count/2
+	b.nthElement(first, first+count, mid, axis)
+	return mid
+}
+
+// nthElement reorders indices[lo:hi] so that the element at n is the one that
+// would be there if the range were sorted by the centroid coordinate, all elements
+// before it are not greater and all elements after it are not less than it
+func (b *builder) nthElement(lo, hi, n, axis int) {
+	key := func(k int) float32 {
+		return b.centroids[b.indices[k]][axis]
+	}
+	for hi-lo > 1 {
+		pivot := key(lo + (hi-lo)/2)
+		i, j := lo, hi-1
+		for i <= j {
+			for key(i) < pivot {
+				i++
+			}
+			for key(j) > pivot {
+				j--
+			}
+			if i <= j {
+				b.indices[i], b.indices[j] = b.indices[j], b.indices[i]
+				i++
+				j--
+			}
+		}
+		switch {
+		case n <= j:
+			hi = j + 1
+		case n >= i:
+			lo = i
+		default:
+			return
+		}
+	}
+}
+
+// partition moves the indices for which left returns true to the beginning of
+// the range and returns the index of the first one for which it returns false
+func (b *builder) partition(first, count int, left func(int32) bool) int {
+	mid := first
+	for k := first; k < first+count; k++ {
+		if left(b.indices[k]) {
+			b.indices[k], b.indices[mid] = b.indices[mid], b.indices[k]
+			mid++
+		}
+	}
+	return mid
+}
@@ -0,0 +1,164 @@
+package bvh
+
+import (
+	"math/rand"
+	"testing"
+
+	mgl "github.com/go-gl/mathgl/mgl32"
+)
+
+func randomBoxes(rng *rand.Rand, n int) []AABB {
+	boxes := make([]AABB, n)
+	for i := range boxes {
+		p := mgl.Vec3{rng.Float32(), rng.Float32(), rng.Float32()}.Mul(100.0)
+		size := mgl.Vec3{rng.Float32(), rng.Float32(), rng.Float32()}.Mul(5.0)
+		boxes[i] = NewAABB(p, p.Add(size))
+	}
+	return boxes
+}
+
+// checkTree checks that every primitive is in exactly one leaf
+// and that the nodes contain the boxes of their primitives
+func checkTree(t *testing.T, tree *BVH, bounds []AABB) {
+	t.Helper()
+	seen := make([]int, len(bounds))
+	var visit func(ni int32, depth int)
+	visit = func(ni int32, depth int) {
+		if depth > MaxDepth {
+			t.Fatalf("the hierarchy is deeper than %d", MaxDepth)
+		}
+		n := tree.Nodes[ni]
+		if !n.IsLeaf() {
+			for _, child := range []int32{ni + 1, n.Offset} {
+				c := tree.Nodes[child].Bounds()
+				if n.Bounds().Union(c) != n.Bounds() {
+					t.Errorf("node %d does not contain its child %d", ni, child)
+				}
+				visit(child, depth+1)
+			}
+			return
+		}
+		for _, i := range tree.Indices[n.Offset : n.Offset+n.Count] {
+			seen[i]++
+			if n.Bounds().Union(bounds[i]) != n.Bounds() {
+				t.Errorf("leaf %d does not contain primitive %d", ni, i)
+			}
+		}
+	}
+	if len(tree.Nodes) > 0 {
+		visit(0, 0)
+	}
+	for i, k := range seen {
+		if k != 1 {
+			t.Errorf("primitive %d is in %d leaves", i, k)
+		}
+	}
+}
+
+func TestBuild(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, n := range []int{0, 1, 5, 100, 1000} {
+		bounds := randomBoxes(rng, n)
+		tree := Build(bounds)
+		checkTree(t, tree, bounds)
+		if n == 0 {
+			if len(tree.Nodes) != 0 {
+				t.Errorf("no boxes: %d nodes", len(tree.Nodes))
+			}
+			continue
+		}
+		want := EmptyAABB()
+		for _, b := range bounds {
+			want = want.Union(b)
+		}
+		if got := tree.Bounds(); got != want {
+			t.Errorf("%d boxes: bounds %v, want %v", n, got, want)
+		}
+	}
+}
+
+func TestBuildSameCentroids(t *testing.T) {
+	// the centroids cannot be split by the heuristic, so the middle split must keep
+	// the leaves small and the tree shallow
+	bounds := make([]AABB, 100)
+	for i := range bounds {
+		bounds[i] = NewAABB(mgl.Vec3{-1, -1, -1}, mgl.Vec3{1, 1, 1})
+	}
+	tree := Build(bounds)
+	checkTree(t, tree, bounds)
+	for ni, n := range tree.Nodes {
+		if n.IsLeaf() && n.Count > maxLeafSize {
+			t.Errorf("leaf %d has %d primitives", ni, n.Count)
+		}
+	}
+}
+
+func TestIntersect(t *testing.T) {
+	box := NewAABB(mgl.Vec3{-1, -1, -1}, mgl.Vec3{1, 1, 1})
+	for _, tc := range []struct {
+		origin, dir mgl.Vec3
+		hit         bool
+	}{
+		{mgl.Vec3{0, 0, -5}, mgl.Vec3{0, 0, 1}, true},
+		{mgl.Vec3{0, 0, 0}, mgl.Vec3{1, 0, 0}, true},
+		{mgl.Vec3{-5, 0.5, 0}, mgl.Vec3{1, 0, 0}, true},
+		{mgl.Vec3{0, 3, -5}, mgl.Vec3{0, 0, 1}, false},
+	} {
+		invDir := mgl.Vec3{1.0 / tc.dir.X(), 1.0 / tc.dir.Y(), 1.0 / tc.dir.Z()}
+		near, far := box.Intersect(tc.origin, invDir)
+		if hit := near <= far; hit != tc.hit {
+			t.Errorf("ray from %v along %v: [%v, %v], hit = %v, want %v", tc.origin, tc.dir, near, far, hit, tc.hit)
+		}
+	}
+}
+
+func TestBuildUnbounded(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	bounded := randomBoxes(rng, 50)
+	want := EmptyAABB()
+	for _, b := range bounded {
+		want = want.Union(b)
+	}
+	for _, unbounded := range []int{1, 3} {
+		bounds := append([]AABB{}, bounded[:25]...)
+		for i := 0; i < unbounded; i++ {
+			bounds = append(bounds, InfiniteAABB())
+		}
+		bounds = append(bounds, bounded[25:]...)
+
+		tree := Build(bounds)
+		checkTree(t, tree, bounds)
+		// the unbounded primitives are in the first child of the root
+		leaf := tree.Nodes[1]
+		if !leaf.IsLeaf() || int(leaf.Count) != unbounded {
+			t.Fatalf("%d unbounded: the first child of the root is %+v", unbounded, leaf)
+		}
+		for _, i := range tree.Indices[leaf.Offset : leaf.Offset+leaf.Count] {
+			if !bounds[i].Unbounded() {
+				t.Errorf("%d unbounded: bounded primitive %d in the leaf of the unbounded ones", unbounded, i)
+			}
+		}
+		if got := tree.Bounds(); got != want {
+			t.Errorf("%d unbounded: bounds %v, want %v", unbounded, got, want)
+		}
+	}
+
+	tree := Build([]AABB{InfiniteAABB(), InfiniteAABB()})
+	checkTree(t, tree, []AABB{InfiniteAABB(), InfiniteAABB()})
+	if len(tree.Nodes) != 1 || tree.Nodes[0].Count != 2 {
+		t.Errorf("only unbounded primitives: %+v", tree.Nodes)
+	}
+	if got := tree.Bounds(); got != EmptyAABB() {
+		t.Errorf("only unbounded primitives: bounds %v", got)
+	}
+}
+
+func TestTransformUnbounded(t *testing.T) {
+	m := mgl.HomogRotate3DX(0.3).Mul4(mgl.Translate3D(1, 2, 3))
+	if got := InfiniteAABB().Transform(m); got != InfiniteAABB() {
+		t.Errorf("transformed infinite box: %v", got)
+	}
+	if got := EmptyAABB().Transform(m); got != EmptyAABB() {
+		t.Errorf("transformed empty box: %v", got)
+	}
+}
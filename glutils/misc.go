@@ -96,3 +96,17 @@ func FlipImage(src image.Image) image.Image {
 	}
 	return dst
 }
+
+// Fill the shader storage buffer with size bytes of data (a pointer or a slice, see gl.Ptr)
+// and bind it to the binding point. If there is no data, a small zeroed buffer is
+// allocated instead, because an empty buffer cannot be bound
+func StorageBufferData(ssbo uint32, binding uint32, size int, data interface{}) {
+	gl.BindBuffer(gl.SHADER_STORAGE_BUFFER, ssbo)
+	if size == 0 {
+		gl.BufferData(gl.SHADER_STORAGE_BUFFER, 16, gl.Ptr(make([]byte, 16)), gl.STATIC_DRAW)
+	} else {
+		gl.BufferData(gl.SHADER_STORAGE_BUFFER, size, gl.Ptr(data), gl.STATIC_DRAW)
+	}
+	gl.BindBufferBase(gl.SHADER_STORAGE_BUFFER, binding, ssbo)
+	gl.BindBuffer(gl.SHADER_STORAGE_BUFFER, 0)
+}
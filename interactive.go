@@ -0,0 +1,325 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image/png"
+	"log"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/go-gl/gl/v4.6-core/gl"
+	"github.com/go-gl/glfw/v3.3/glfw"
+
+	"github.com/xopoww/go-raytrace/app"
+	"github.com/xopoww/go-raytrace/glutils"
+	"github.com/xopoww/go-raytrace/scenery"
+	"github.com/xopoww/go-raytrace/shaders"
+)
+
+func init() {
+	// This is needed to arrange that main() runs on main thread.
+	// See documentation for functions that are only allowed to be called from the main thread.
+	runtime.LockOSThread()
+}
+
+var (
+	quad = []float32{
+		-1, -1, 0, // top
+		1, -1, 0, // left
+		-1, 1, 0, // right
+		1, -1, 0, // top
+		-1, 1, 0, // left
+		1, 1, 0, // right
+	}
+)
+
+// interactiveMain opens a window and renders the scene on the GPU until it is closed
+func interactiveMain() {
+
+	// Get command line arguments
+	SCENE := flag.String("scene", "", "path to json file with scene description (if not set, a random scene will be generated)")
+	SEED := flag.Int64("seed", -1, "seed for random scene generation (if negative, current UNIX time is used)")
+	WIDTH := flag.Int("width", 640, "screen width in pixels")
+	HEIGHT := flag.Int("height", 480, "scene height in pixels")
+	RESOLUTION := flag.String("resolution", "", "if set, must be one of \"hd\" (1080x720) or \"fullhd\" (1920x1080); overrides width and height options")
+	MONTE_CARLO_FRAME_COUNT := flag.Uint("mcfc", 20, "number of frames for monte carlo denoising")
+	ANTI_ALIASING := flag.Uint("alias", 4, "anti-aliasing parameter")
+	MAX_DEPTH := flag.Uint("depth", 10, "maximum recursion depth for ray tracing")
+
+	flag.Parse()
+
+	setResolution(*RESOLUTION, WIDTH, HEIGHT)
+
+	// Init the scene
+	scene := loadScene(*SCENE, *SEED)
+	useSceneSettings(flag.CommandLine, scene.Render, "mcfc", WIDTH, HEIGHT, MONTE_CARLO_FRAME_COUNT, ANTI_ALIASING, MAX_DEPTH)
+
+	// Initialize GLFW and GL, create window
+	err := glfw.Init()
+	if err != nil {
+		panic(err)
+	}
+	defer glfw.Terminate()
+
+	glfw.WindowHint(glfw.Resizable, glfw.False)
+	glfw.WindowHint(glfw.ContextVersionMajor, 4)
+	glfw.WindowHint(glfw.ContextVersionMinor, 6)
+	glfw.WindowHint(glfw.OpenGLProfile, glfw.OpenGLCoreProfile)
+	glfw.WindowHint(glfw.OpenGLForwardCompatible, glfw.True)
+
+	window, err := glfw.CreateWindow(*WIDTH, *HEIGHT, "Go Ray Tracer", nil, nil)
+	if err != nil {
+		panic(err)
+	}
+	window.MakeContextCurrent()
+	glfw.SwapInterval(1)
+
+	// Initialize Glow
+	if err := gl.Init(); err != nil {
+		panic(err)
+	}
+
+	version := gl.GoStr(gl.GetString(gl.VERSION))
+	log.Println("OpenGL version", version)
+
+	// Create the program with single compute shader
+	compShaderSrc, err := glutils.NewShaderSourceFromTemplate("comp", shaders.Comp, gl.COMPUTE_SHADER, scene)
+	if err != nil {
+		log.Fatalf("Failed to load compute shader source: %s", err)
+	}
+	compProgram, err := glutils.CreateProgram(compShaderSrc)
+	if err != nil {
+		log.Fatalf("Failed to create comp program: %s", err)
+	}
+
+	// Do the same for the quad shaders
+	vertShaderSrc := glutils.NewShaderSource(shaders.Vert, gl.VERTEX_SHADER)
+	fragShaderSrc := glutils.NewShaderSource(shaders.Frag, gl.FRAGMENT_SHADER)
+	quadProgram, err := glutils.CreateProgram(vertShaderSrc, fragShaderSrc)
+	if err != nil {
+		log.Fatalf("Failed to create quad program: %s", err)
+	}
+
+	// Init the event handler
+	eventHandler := app.NewEventHandler()
+	window.SetKeyCallback(eventHandler.KeyCallback())
+
+	screenshotRequested := false
+	eventHandler.AddOption(glfw.KeyF3, &screenshotRequested, app.Switch)
+
+	lowGraphics := false
+	eventHandler.AddOption(glfw.KeyP, &lowGraphics, app.Switch)
+
+	infoRequested := false
+	eventHandler.AddOption(glfw.KeyI, &infoRequested, app.Switch)
+
+	focusRequested := false
+	eventHandler.AddOption(glfw.KeyF, &focusRequested, app.Switch)
+
+	reloadRequested := false
+	eventHandler.AddOption(glfw.KeyR, &reloadRequested, app.Switch)
+
+	// Init the camera
+	camera := scenery.NewCamera(*WIDTH, *HEIGHT)
+	if scene.Camera != nil {
+		camera = *scene.Camera
+		camera.Ratio = float32(*WIDTH) / float32(*HEIGHT)
+	}
+	camera.AttachToEventHandler(eventHandler)
+
+	// Init OpenGL objects
+	vao := glutils.MakeVao(quad)
+	texture := glutils.MakeEmptyTexture(*WIDTH, *HEIGHT)
+
+	sceneBuffers := scenery.NewSceneBuffers()
+	sceneBuffers.Upload(scene)
+
+	var (
+		ssbo         uint32
+		lookatIndex  int32
+		distToLookat float32
+	)
+
+	gl.GenBuffers(1, &ssbo)
+	gl.BindBuffer(gl.SHADER_STORAGE_BUFFER, ssbo)
+	gl.BufferData(gl.SHADER_STORAGE_BUFFER, 8, nil, gl.DYNAMIC_READ)
+	gl.BindBufferBase(gl.SHADER_STORAGE_BUFFER, 5, ssbo)
+	gl.BindBuffer(gl.SHADER_STORAGE_BUFFER, 0)
+
+	// Get uniform locations from programs
+	gl.UseProgram(compProgram)
+	scene.Environment.SetUniforms(compProgram, sceneBuffers.EnvironmentSampled())
+	scene.SetFogUniforms(compProgram)
+	uniformTime := glutils.GetUniformLocation(compProgram, "u_time")
+	uniformFrameI := glutils.MustGetUniformLocation(compProgram, "u_frame_i")
+	uniformMCFC := glutils.MustGetUniformLocation(compProgram, "MONTE_CARLO_FRAME_COUNT")
+	uniformAntiAliasing := glutils.MustGetUniformLocation(compProgram, "ANTI_ALIASING")
+	uniformMaxDepth := glutils.MustGetUniformLocation(compProgram, "MAX_DEPTH")
+	camera.GetUniformLocations(compProgram)
+
+	gl.UseProgram(quadProgram)
+	gl.Uniform1i(glutils.MustGetUniformLocation(quadProgram, "tex"), 0)
+	gl.UseProgram(0)
+
+	glfw.SetTime(0.0)
+	frame_i := uint32(0)
+
+	highGraphicsEnabledFrame := -1
+	// Main loop
+	for !window.ShouldClose() {
+
+		if !lowGraphics && highGraphicsEnabledFrame < 0 {
+			highGraphicsEnabledFrame = int(frame_i)
+		}
+		if lowGraphics && highGraphicsEnabledFrame >= 0 {
+			highGraphicsEnabledFrame = -1
+		}
+
+		// Dispatch compute shader program
+		gl.UseProgram(compProgram)
+		// set time and frame index
+		if uniformTime != -1 {
+			gl.Uniform1f(uniformTime, float32(glfw.GetTime()))
+		}
+		if uniformFrameI != -1 {
+			gl.Uniform1ui(uniformFrameI, frame_i)
+		}
+		// update camera uniforms
+		camera.SetUniforms()
+		// set graphics options
+		if lowGraphics {
+			gl.Uniform1ui(uniformMCFC, 1)
+			gl.Uniform1ui(uniformAntiAliasing, 1)
+			gl.Uniform1ui(uniformMaxDepth, 2)
+		} else {
+			gl.Uniform1ui(uniformMCFC, uint32(*MONTE_CARLO_FRAME_COUNT))
+			gl.Uniform1ui(uniformAntiAliasing, uint32(*ANTI_ALIASING))
+			gl.Uniform1ui(uniformMaxDepth, uint32(*MAX_DEPTH))
+		}
+		gl.BindTexture(gl.TEXTURE_2D, texture)
+		gl.BindImageTexture(0, texture, 0, false, 0, gl.READ_WRITE, gl.RGBA32F)
+		gl.DispatchCompute(uint32(*WIDTH), uint32(*HEIGHT), 1) // TODO: add support of other workgroup sizes
+		gl.BindImageTexture(0, 0, 0, false, 0, gl.READ_WRITE, gl.RGBA32F)
+		gl.MemoryBarrier(gl.SHADER_IMAGE_ACCESS_BARRIER_BIT | gl.BUFFER_UPDATE_BARRIER_BIT)
+		gl.BindTexture(gl.TEXTURE_2D, 0)
+
+		drawNow := uint(frame_i)%(*MONTE_CARLO_FRAME_COUNT) == 0 || lowGraphics
+		if drawNow && frame_i-uint32(highGraphicsEnabledFrame) < uint32(*MONTE_CARLO_FRAME_COUNT) {
+			drawNow = false
+		}
+
+		// Run fullscreen quad rendering program
+		if drawNow {
+			gl.UseProgram(quadProgram)
+			gl.BindVertexArray(vao)
+			gl.BindTexture(gl.TEXTURE_2D, texture)
+			gl.DrawArrays(gl.TRIANGLES, 0, int32(len(quad)/3))
+			gl.BindTexture(gl.TEXTURE_2D, 0)
+			gl.UseProgram(0)
+		}
+
+		// Check for errors
+		if err := glutils.CheckError(); err != nil {
+			log.Fatalf("Fatal error occured: %s", err)
+		}
+
+		// Handle screenshot request
+		if screenshotRequested && drawNow {
+			screenshotRequested = false
+
+			img, err := glutils.GetImage(texture, *WIDTH, *HEIGHT)
+			if err != nil {
+				log.Printf("Failed to take a screenshot: %s", err)
+			} else {
+				log.Println("Took a screenshot")
+				go func() {
+					flippedImg := glutils.FlipImage(img)
+
+					filename := fmt.Sprintf(
+						"screenshot_%s.png",
+						time.Now().Format("02-01-2006_15:04:05"),
+					)
+
+					file, err := os.Create(filename)
+					if err != nil {
+						log.Printf("Failed to save a screenshot: %s", err)
+						return
+					}
+					defer file.Close()
+
+					err = png.Encode(file, flippedImg)
+					if err != nil {
+						log.Printf("Failed to save a screenshot: %s", err)
+						return
+					}
+
+					log.Printf("Saved a screenshot as %q", filename)
+				}()
+			}
+		}
+
+		// Handle info request
+		if infoRequested {
+			gl.BindBuffer(gl.SHADER_STORAGE_BUFFER, ssbo)
+			gl.GetBufferSubData(gl.SHADER_STORAGE_BUFFER, 0, 4, gl.Ptr(&lookatIndex))
+			gl.GetBufferSubData(gl.SHADER_STORAGE_BUFFER, 4, 4, gl.Ptr(&distToLookat))
+			gl.BindBuffer(gl.SHADER_STORAGE_BUFFER, 0)
+
+			log.Printf("You are looking at %s", scene.GetObjectDesription(lookatIndex))
+
+			infoRequested = false
+		}
+
+		// Handle autofocus
+		if focusRequested {
+			gl.BindBuffer(gl.SHADER_STORAGE_BUFFER, ssbo)
+			gl.GetBufferSubData(gl.SHADER_STORAGE_BUFFER, 0, 4, gl.Ptr(&lookatIndex))
+			gl.GetBufferSubData(gl.SHADER_STORAGE_BUFFER, 4, 4, gl.Ptr(&distToLookat))
+			gl.BindBuffer(gl.SHADER_STORAGE_BUFFER, 0)
+
+			if lookatIndex != -1 {
+				camera.FocalDist = distToLookat
+				log.Printf("Focused at the object you are looking at (F = %f)", distToLookat)
+			} else {
+				log.Println("Cannot autofocus on nothing")
+			}
+
+			focusRequested = false
+		}
+
+		// Handle scene reload
+		if reloadRequested {
+			if *SCENE == "" {
+				log.Println("Cannot reload a random scene")
+			} else if newScene, err := readScene(*SCENE); err != nil {
+				log.Printf("Failed to reload the scene: %s", err)
+			} else {
+				scene = newScene
+				sceneBuffers.Upload(scene)
+				gl.UseProgram(compProgram)
+				scene.Environment.SetUniforms(compProgram, sceneBuffers.EnvironmentSampled())
+				scene.SetFogUniforms(compProgram)
+				gl.UseProgram(0)
+				log.Printf("Reloaded the scene from %q", *SCENE)
+			}
+
+			reloadRequested = false
+		}
+
+		if drawNow {
+			window.SwapBuffers()
+		}
+
+		glfw.PollEvents()
+
+		camera.Update()
+
+		frame_i++
+	}
+
+}
@@ -0,0 +1,11 @@
+//go:build !cgo
+// +build !cgo
+
+package main
+
+import "log"
+
+// GLFW and OpenGL are C libraries, so without cgo only the render command is available
+func interactiveMain() {
+	log.Fatalf("The interactive mode needs cgo and OpenGL; use the render command instead")
+}
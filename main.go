@@ -4,321 +4,117 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"image/png"
 	"io/ioutil"
 	"log"
 	"os"
-	"runtime"
+	"path/filepath"
 	"time"
 
-	"github.com/go-gl/gl/v4.6-core/gl"
-	"github.com/go-gl/glfw/v3.3/glfw"
-
-	"github.com/xopoww/go-raytrace/app"
-	"github.com/xopoww/go-raytrace/glutils"
 	"github.com/xopoww/go-raytrace/scenery"
-	"github.com/xopoww/go-raytrace/shaders"
-)
-
-func init() {
-	// This is needed to arrange that main() runs on main thread.
-	// See documentation for functions that are only allowed to be called from the main thread.
-	runtime.LockOSThread()
-}
-
-var (
-	quad = []float32{
-		-1, -1, 0, // top
-		1, -1, 0, // left
-		-1, 1, 0, // right
-		1, -1, 0, // top
-		-1, 1, 0, // left
-		1, 1, 0, // right
-	}
 )
 
 func main() {
 
-	// Get command line arguments
-	SCENE := flag.String("scene", "", "path to json file with scene description (if not set, a random scene will be generated)")
-	SEED := flag.Int64("seed", -1, "seed for random scene generation (if negative, current UNIX time is used)")
-	WIDTH := flag.Int("width", 640, "screen width in pixels")
-	HEIGHT := flag.Int("height", 480, "scene height in pixels")
-	RESOLUTION := flag.String("resolution", "", "if set, must be one of \"hd\" (1080x720) or \"fullhd\" (1920x1080); overrides width and height options")
-	MONTE_CARLO_FRAME_COUNT := flag.Uint("mcfc", 20, "number of frames for monte carlo denoising")
-	ANTI_ALIASING := flag.Uint("alias", 4, "anti-aliasing parameter")
-	MAX_DEPTH := flag.Uint("depth", 10, "maximum recursion depth for ray tracing")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "render":
+			renderMain(os.Args[2:])
+			return
+		case "bench":
+			benchMain(os.Args[2:])
+			return
+		}
+	}
 
-	flag.Parse()
+	interactiveMain()
+}
 
-	switch *RESOLUTION {
+// Override width and height according to the resolution option
+func setResolution(resolution string, width, height *int) {
+	switch resolution {
 	case "":
 		break
 	case "hd":
-		*WIDTH = 1080
-		*HEIGHT = 720
+		*width = 1080
+		*height = 720
 	case "fullhd":
-		*WIDTH = 1920
-		*HEIGHT = 1080
+		*width = 1920
+		*height = 1080
 	default:
-		log.Fatalf("unknown resolution option: %s", *RESOLUTION)
-	}
-
-	// Initialize GLFW and GL, create window
-	err := glfw.Init()
-	if err != nil {
-		panic(err)
+		log.Fatalf("unknown resolution option: %s", resolution)
 	}
-	defer glfw.Terminate()
+}
 
-	glfw.WindowHint(glfw.Resizable, glfw.False)
-	glfw.WindowHint(glfw.ContextVersionMajor, 4)
-	glfw.WindowHint(glfw.ContextVersionMinor, 6)
-	glfw.WindowHint(glfw.OpenGLProfile, glfw.OpenGLCoreProfile)
-	glfw.WindowHint(glfw.OpenGLForwardCompatible, glfw.True)
+// Check if the flag was set on the command line
+func isFlagSet(flags *flag.FlagSet, name string) bool {
+	set := false
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
 
-	window, err := glfw.CreateWindow(*WIDTH, *HEIGHT, "Go Ray Tracer", nil, nil)
-	if err != nil {
-		panic(err)
+// Take the render settings from the scene file, unless they were set on the command line
+func useSceneSettings(flags *flag.FlagSet, rs *scenery.RenderSettings, samplesFlag string, width, height *int, samples, antiAliasing, depth *uint) {
+	if rs == nil {
+		return
 	}
-	window.MakeContextCurrent()
-	glfw.SwapInterval(1)
-
-	// Initialize Glow
-	if err := gl.Init(); err != nil {
-		panic(err)
+	if !isFlagSet(flags, "width") && !isFlagSet(flags, "resolution") && rs.Width > 0 {
+		*width = rs.Width
 	}
+	if !isFlagSet(flags, "height") && !isFlagSet(flags, "resolution") && rs.Height > 0 {
+		*height = rs.Height
+	}
+	if !isFlagSet(flags, samplesFlag) && rs.Samples > 0 {
+		*samples = rs.Samples
+	}
+	if !isFlagSet(flags, "alias") && rs.AntiAliasing > 0 {
+		*antiAliasing = rs.AntiAliasing
+	}
+	if !isFlagSet(flags, "depth") && rs.Depth > 0 {
+		*depth = rs.Depth
+	}
+}
 
-	version := gl.GoStr(gl.GetString(gl.VERSION))
-	log.Println("OpenGL version", version)
-
-	// Init the scene
-	var scene *scenery.Scene
-
-	if *SCENE == "" {
-		if *SEED < 0 {
-			*SEED = time.Now().Unix()
-		}
-		log.Printf("Generating random scene with seed %d", *SEED)
-		scene = scenery.RandomScene(*SEED)
-	} else {
-		scene = scenery.NewScene()
-		file, err := os.Open(*SCENE)
-		if err != nil {
-			log.Fatalf("Failed to open scene file %q: %s", *SCENE, err)
-		}
-		data, err := ioutil.ReadAll(file)
-		if err != nil {
-			log.Fatalf("Failed to read scene file: %s", err)
-		}
-		err = json.Unmarshal(data, scene)
-		if err != nil {
-			log.Fatalf("Failed to parse scene file: %s", err)
+// Load the scene from the file at path or generate a random one if path is empty
+func loadScene(path string, seed int64) *scenery.Scene {
+	if path == "" {
+		if seed < 0 {
+			seed = time.Now().Unix()
 		}
+		log.Printf("Generating random scene with seed %d", seed)
+		return scenery.RandomScene(seed)
 	}
 
-	// Create the program with single compute shader
-	compShaderSrc, err := glutils.NewShaderSourceFromTemplate("comp", shaders.Comp, gl.COMPUTE_SHADER, scene)
+	scene, err := readScene(path)
 	if err != nil {
-		log.Fatalf("Failed to load compute shader source: %s", err)
+		log.Fatalf("Failed to load scene file %q: %s", path, err)
 	}
-	compProgram, err := glutils.CreateProgram(compShaderSrc)
+	return scene
+}
+
+// Read the scene from the file at path (the files it refers to
+// are looked up relative to its directory)
+func readScene(path string) (*scenery.Scene, error) {
+	file, err := os.Open(path)
 	if err != nil {
-		log.Fatalf("Failed to create comp program: %s", err)
+		return nil, err
 	}
-
-	// Do the same for the quad shaders
-	vertShaderSrc := glutils.NewShaderSource(shaders.Vert, gl.VERTEX_SHADER)
-	fragShaderSrc := glutils.NewShaderSource(shaders.Frag, gl.FRAGMENT_SHADER)
-	quadProgram, err := glutils.CreateProgram(vertShaderSrc, fragShaderSrc)
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
 	if err != nil {
-		log.Fatalf("Failed to create quad program: %s", err)
+		return nil, fmt.Errorf("read: %w", err)
 	}
-
-	// Init the event handler
-	eventHandler := app.NewEventHandler()
-	window.SetKeyCallback(eventHandler.KeyCallback())
-
-	screenshotRequested := false
-	eventHandler.AddOption(glfw.KeyF3, &screenshotRequested, app.Switch)
-
-	lowGraphics := false
-	eventHandler.AddOption(glfw.KeyP, &lowGraphics, app.Switch)
-
-	infoRequested := false
-	eventHandler.AddOption(glfw.KeyI, &infoRequested, app.Switch)
-
-	focusRequested := false
-	eventHandler.AddOption(glfw.KeyF, &focusRequested, app.Switch)
-
-	// Init the camera
-	camera := scenery.NewCamera(*WIDTH, *HEIGHT)
-	camera.AttachToEventHandler(eventHandler)
-
-	// Init OpenGL objects
-	vao := glutils.MakeVao(quad)
-	texture := glutils.MakeEmptyTexture(*WIDTH, *HEIGHT)
-
-	var (
-		ssbo         uint32
-		lookatIndex  int32
-		distToLookat float32
-	)
-
-	gl.GenBuffers(1, &ssbo)
-	gl.BindBuffer(gl.SHADER_STORAGE_BUFFER, ssbo)
-	gl.BufferData(gl.SHADER_STORAGE_BUFFER, 8, nil, gl.DYNAMIC_READ)
-	gl.BindBufferBase(gl.SHADER_STORAGE_BUFFER, 5, ssbo)
-	gl.BindBuffer(gl.SHADER_STORAGE_BUFFER, 0)
-
-	// Get uniform locations from programs
-	gl.UseProgram(compProgram)
-	uniformTime := glutils.GetUniformLocation(compProgram, "u_time")
-	uniformFrameI := glutils.MustGetUniformLocation(compProgram, "u_frame_i")
-	uniformMCFC := glutils.MustGetUniformLocation(compProgram, "MONTE_CARLO_FRAME_COUNT")
-	uniformAntiAliasing := glutils.MustGetUniformLocation(compProgram, "ANTI_ALIASING")
-	uniformMaxDepth := glutils.MustGetUniformLocation(compProgram, "MAX_DEPTH")
-	camera.GetUniformLocations(compProgram)
-
-	gl.UseProgram(quadProgram)
-	gl.Uniform1i(glutils.MustGetUniformLocation(quadProgram, "tex"), 0)
-	gl.UseProgram(0)
-
-	glfw.SetTime(0.0)
-	frame_i := uint32(0)
-
-	highGraphicsEnabledFrame := -1
-	// Main loop
-	for !window.ShouldClose() {
-
-		if !lowGraphics && highGraphicsEnabledFrame < 0 {
-			highGraphicsEnabledFrame = int(frame_i)
-		}
-		if lowGraphics && highGraphicsEnabledFrame >= 0 {
-			highGraphicsEnabledFrame = -1
-		}
-
-		// Dispatch compute shader program
-		gl.UseProgram(compProgram)
-		// set time and frame index
-		if uniformTime != -1 {
-			gl.Uniform1f(uniformTime, float32(glfw.GetTime()))
-		}
-		if uniformFrameI != -1 {
-			gl.Uniform1ui(uniformFrameI, frame_i)
-		}
-		// update camera uniforms
-		camera.SetUniforms()
-		// set graphics options
-		if lowGraphics {
-			gl.Uniform1ui(uniformMCFC, 1)
-			gl.Uniform1ui(uniformAntiAliasing, 1)
-			gl.Uniform1ui(uniformMaxDepth, 2)
-		} else {
-			gl.Uniform1ui(uniformMCFC, uint32(*MONTE_CARLO_FRAME_COUNT))
-			gl.Uniform1ui(uniformAntiAliasing, uint32(*ANTI_ALIASING))
-			gl.Uniform1ui(uniformMaxDepth, uint32(*MAX_DEPTH))
-		}
-		gl.BindTexture(gl.TEXTURE_2D, texture)
-		gl.BindImageTexture(0, texture, 0, false, 0, gl.READ_WRITE, gl.RGBA32F)
-		gl.DispatchCompute(uint32(*WIDTH), uint32(*HEIGHT), 1) // TODO: add support of other workgroup sizes
-		gl.BindImageTexture(0, 0, 0, false, 0, gl.READ_WRITE, gl.RGBA32F)
-		gl.MemoryBarrier(gl.SHADER_IMAGE_ACCESS_BARRIER_BIT | gl.BUFFER_UPDATE_BARRIER_BIT)
-		gl.BindTexture(gl.TEXTURE_2D, 0)
-
-		drawNow := uint(frame_i)%(*MONTE_CARLO_FRAME_COUNT) == 0 || lowGraphics
-		if drawNow && frame_i - uint32(highGraphicsEnabledFrame) < uint32(*MONTE_CARLO_FRAME_COUNT) {
-			drawNow = false
-		}
-
-		// Run fullscreen quad rendering program
-		if drawNow {
-			gl.UseProgram(quadProgram)
-			gl.BindVertexArray(vao)
-			gl.BindTexture(gl.TEXTURE_2D, texture)
-			gl.DrawArrays(gl.TRIANGLES, 0, int32(len(quad)/3))
-			gl.BindTexture(gl.TEXTURE_2D, 0)
-			gl.UseProgram(0)
-		}
-
-		// Check for errors
-		if err := glutils.CheckError(); err != nil {
-			log.Fatalf("Fatal error occured: %s", err)
-		}
-
-		// Handle screenshot request
-		if screenshotRequested && drawNow {
-			screenshotRequested = false
-
-			img, err := glutils.GetImage(texture, *WIDTH, *HEIGHT)
-			if err != nil {
-				log.Printf("Failed to take a screenshot: %s", err)
-			} else {
-				log.Println("Took a screenshot")
-				go func() {
-					flippedImg := glutils.FlipImage(img)
-
-					filename := fmt.Sprintf(
-						"screenshot_%s.png",
-						time.Now().Format("02-01-2006_15:04:05"),
-					)
-
-					file, err := os.Create(filename)
-					if err != nil {
-						log.Printf("Failed to save a screenshot: %s", err)
-						return
-					}
-					defer file.Close()
-
-					err = png.Encode(file, flippedImg)
-					if err != nil {
-						log.Printf("Failed to save a screenshot: %s", err)
-						return
-					}
-
-					log.Printf("Saved a screenshot as %q", filename)
-				}()
-			}
-		}
-
-		// Handle info request
-		if infoRequested {
-			gl.BindBuffer(gl.SHADER_STORAGE_BUFFER, ssbo)
-			gl.GetBufferSubData(gl.SHADER_STORAGE_BUFFER, 0, 4, gl.Ptr(&lookatIndex))
-			gl.GetBufferSubData(gl.SHADER_STORAGE_BUFFER, 4, 4, gl.Ptr(&distToLookat))
-			gl.BindBuffer(gl.SHADER_STORAGE_BUFFER, 0)
-
-			log.Printf("You are looking at %s", scene.GetObjectDesription(lookatIndex))
-
-			infoRequested = false
-		}
-
-		// Handle autofocus
-		if focusRequested {
-			gl.BindBuffer(gl.SHADER_STORAGE_BUFFER, ssbo)
-			gl.GetBufferSubData(gl.SHADER_STORAGE_BUFFER, 0, 4, gl.Ptr(&lookatIndex))
-			gl.GetBufferSubData(gl.SHADER_STORAGE_BUFFER, 4, 4, gl.Ptr(&distToLookat))
-			gl.BindBuffer(gl.SHADER_STORAGE_BUFFER, 0)
-
-			if lookatIndex != -1 {
-				camera.FocalDist = distToLookat
-				log.Printf("Focused at the object you are looking at (F = %f)", distToLookat)
-			} else {
-				log.Println("Cannot autofocus on nothing")
-			}
-
-			focusRequested = false
-		}
-
-		if drawNow {
-			window.SwapBuffers()
-		}
-		
-		glfw.PollEvents()
-
-		camera.Update()
-
-		frame_i++
+	scene := scenery.NewScene()
+	err = json.Unmarshal(data, scene)
+	if err != nil {
+		return nil, fmt.Errorf("parse: %w", err)
 	}
-
+	err = scene.LoadAssets(filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("assets: %w", err)
+	}
+	return scene, nil
 }
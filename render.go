@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	mgl "github.com/go-gl/mathgl/mgl32"
+
+	"github.com/xopoww/go-raytrace/scenery"
+	"github.com/xopoww/go-raytrace/tracer"
+)
+
+// vec3Value is a flag.Value for vectors written as "x,y,z"
+type vec3Value mgl.Vec3
+
+func (v *vec3Value) String() string {
+	return fmt.Sprintf("%g,%g,%g", v[0], v[1], v[2])
+}
+
+func (v *vec3Value) Set(s string) error {
+	parts := strings.Split(s, ",")
+	if len(parts) != 3 {
+		return fmt.Errorf("expected 3 comma-separated numbers")
+	}
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 32)
+		if err != nil {
+			return err
+		}
+		v[i] = float32(f)
+	}
+	return nil
+}
+
+// renderMain implements the "render" command: the scene is rendered on the CPU
+// with a fixed number of samples and saved to a file. No window is created,
+// so it works without a display server
+func renderMain(args []string) {
+	flags := flag.NewFlagSet("render", flag.ExitOnError)
+
+	SCENE := flags.String("scene", "", "path to json file with scene description (if not set, a random scene will be generated)")
+	SEED := flags.Int64("seed", -1, "seed for random scene generation (if negative, current UNIX time is used)")
+	WIDTH := flags.Int("width", 640, "image width in pixels")
+	HEIGHT := flags.Int("height", 480, "image height in pixels")
+	RESOLUTION := flags.String("resolution", "", "if set, must be one of \"hd\" (1080x720) or \"fullhd\" (1920x1080); overrides width and height options")
+	SAMPLES := flags.Uint("samples", 20, "number of frames for monte carlo denoising")
+	ANTI_ALIASING := flags.Uint("alias", 4, "anti-aliasing parameter")
+	MAX_DEPTH := flags.Uint("depth", 10, "maximum recursion depth for ray tracing")
+	OUT := flags.String("out", "out.png", "path to the output image (PNG or JPEG, chosen by extension)")
+
+	camera := scenery.NewCamera(1, 1)
+	position := vec3Value(camera.Position)
+	lookat := vec3Value(camera.Lookat)
+	flags.Var(&position, "pos", "camera position")
+	flags.Var(&lookat, "lookat", "point the camera is looking at")
+	FOV := flags.Float64("fov", float64(camera.FOV), "horizontal field of view in degrees")
+	APERTURE := flags.Float64("aperture", float64(camera.Aperture), "camera aperture (0 disables depth of field)")
+	FOCAL_DIST := flags.Float64("focal", float64(camera.FocalDist), "camera focal distance")
+
+	flags.Parse(args)
+
+	setResolution(*RESOLUTION, WIDTH, HEIGHT)
+
+	scene := loadScene(*SCENE, *SEED)
+	useSceneSettings(flags, scene.Render, "samples", WIDTH, HEIGHT, SAMPLES, ANTI_ALIASING, MAX_DEPTH)
+
+	// the camera from the scene file is used as a base for the camera flags
+	if scene.Camera != nil {
+		camera = *scene.Camera
+	}
+	if isFlagSet(flags, "pos") || isFlagSet(flags, "lookat") {
+		if !isFlagSet(flags, "pos") {
+			position = vec3Value(camera.Position)
+		}
+		if !isFlagSet(flags, "lookat") {
+			lookat = vec3Value(camera.Lookat)
+		}
+		camera.SetView(mgl.Vec3(position), mgl.Vec3(lookat))
+	}
+	camera.Ratio = float32(*WIDTH) / float32(*HEIGHT)
+	if isFlagSet(flags, "fov") {
+		camera.FOV = float32(*FOV)
+	}
+	if isFlagSet(flags, "aperture") {
+		camera.Aperture = float32(*APERTURE)
+	}
+	if isFlagSet(flags, "focal") {
+		camera.FocalDist = float32(*FOCAL_DIST)
+	}
+
+	opts := tracer.Options{
+		Width:        *WIDTH,
+		Height:       *HEIGHT,
+		Samples:      *SAMPLES,
+		AntiAliasing: *ANTI_ALIASING,
+		MaxDepth:     *MAX_DEPTH,
+		Seed:         *SEED,
+	}
+
+	log.Printf("Rendering %dx%d image with %d samples per pixel", opts.Width, opts.Height, opts.Samples*opts.AntiAliasing)
+	start := time.Now()
+	img := tracer.New(scene).Render(camera, opts)
+	log.Printf("Rendered in %s", time.Since(start).Round(time.Millisecond))
+
+	if err := saveImage(*OUT, img); err != nil {
+		log.Fatalf("Failed to save the image: %s", err)
+	}
+
+	log.Printf("Saved the image as %q", *OUT)
+}
+
+// saveImage writes the image to the file at path, as JPEG if the extension is .jpg or .jpeg
+// and as PNG otherwise. The file is removed if the image could not be written completely
+func saveImage(path string, img image.Image) (err error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg":
+		return jpeg.Encode(file, img, &jpeg.Options{Quality: 95})
+	default:
+		return png.Encode(file, img)
+	}
+}
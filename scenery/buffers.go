@@ -0,0 +1,505 @@
+//go:build cgo
+// +build cgo
+
+package scenery
+
+import (
+	"unsafe"
+
+	"github.com/go-gl/gl/v4.6-core/gl"
+	mgl "github.com/go-gl/mathgl/mgl32"
+
+	"github.com/xopoww/go-raytrace/bvh"
+	"github.com/xopoww/go-raytrace/glutils"
+)
+
+// Binding points of the scene storage buffers in the compute shader
+const (
+	objectsBinding    = 1
+	materialsBinding  = 2
+	bvhNodesBinding   = 3
+	bvhIndicesBinding = 4
+	// 5 is used by the lookat buffer
+	trianglesBinding = 6
+	lightsBinding    = 7
+	texelsBinding    = 8
+	envCDFBinding    = 9
+	texturesBinding  = 10
+	volumesBinding   = 11
+	densitiesBinding = 12
+	csgNodesBinding  = 13
+	sdfNodesBinding  = 14
+)
+
+// gpuObject has the layout of the object struct from the shader (std430)
+type gpuObject struct {
+	P0   [4]float32
+	P1   [4]float32
+	Body uint32
+	// meshes: index of the root of the mesh hierarchy in the nodes buffer,
+	// volumes: index in the volumes buffer, CSG: index of the first node in the CSG nodes buffer,
+	// SDF: index of the first node in the SDF nodes buffer
+	Root int32
+	// index in the materials buffer (shared by the instances of a prototype)
+	Material int32
+	_        uint32
+	// transform from the world to the object space (column-major as in the shader)
+	ToObject mgl.Mat4
+}
+
+// gpuTriangle has the layout of the triangle struct from the shader (std430);
+// the texture coordinates are stored in the w components of V and N
+type gpuTriangle struct {
+	V [3][4]float32
+	N [3][4]float32
+}
+
+// gpuMaterial has the layout of the material struct from the shader (std430)
+type gpuMaterial struct {
+	Color     [4]float32
+	Kind      uint32
+	Fuzz      float32
+	Eta       float32
+	Intensity float32
+	// coefficients of the medium inside the object (the absorption includes
+	// the Beer-Lambert one of the glass); w of the scattering is the anisotropy
+	Absorption [4]float32
+	Scattering [4]float32
+	// complex index of refraction
+	IORN       [4]float32
+	IORK       [4]float32
+	Roughness  float32
+	Anisotropy float32
+	// principled
+	Metallic           float32
+	Specular           float32
+	Clearcoat          float32
+	ClearcoatRoughness float32
+	Sheen              float32
+	Transmission       float32
+	// emission color times its intensity
+	Emission [4]float32
+	// indices in the textures buffer (-1 if none)
+	ColorTexture     int32
+	RoughnessTexture int32
+	NormalMap        int32
+	Bump             int32
+}
+
+// gpuTexture has the layout of the texinfo struct from the shader (std430)
+type gpuTexture struct {
+	// blended colors (or values in the first component)
+	A          [4]float32
+	B          [4]float32
+	Kind       uint32
+	Scale      float32
+	Turbulence float32
+	// image: index of its first texel in the texels buffer
+	Offset int32
+	Width  int32
+	Height int32
+	Wrap   uint32
+	// bump and normal maps
+	Strength float32
+}
+
+// gpuVolume has the layout of the volume struct from the shader (std430)
+type gpuVolume struct {
+	// resolution of the grid and the index of its first voxel in the densities buffer
+	Grid [4]int32
+	// index of the procedural density in the textures buffer (-1 for grids)
+	Density    int32
+	MaxDensity float32
+	_          [2]uint32
+}
+
+// gpuCSGNode has the layout of the csgnode struct from the shader (std430)
+type gpuCSGNode struct {
+	P0       [4]float32
+	P1       [4]float32
+	Op       uint32
+	Body     uint32
+	Polarity float32
+	// first node: number of the nodes of the body
+	Size   int32
+	ToLeaf mgl.Mat4
+}
+
+// gpuSDFNode has the layout of the sdfnode struct from the shader (std430)
+type gpuSDFNode struct {
+	P0 [4]float32
+	P1 [4]float32
+	Op uint32
+	// first node: number of the nodes of the body
+	Size int32
+	_    [2]uint32
+}
+
+// gpuLight has the layout of the light struct from the shader (std430)
+type gpuLight struct {
+	Position  [4]float32
+	Direction [4]float32
+	// color multiplied by intensity
+	Radiance [4]float32
+	Kind     uint32
+	CosInner float32
+	CosOuter float32
+	_        uint32
+}
+
+func vec4(x, y, z, w float32) [4]float32 {
+	return [4]float32{x, y, z, w}
+}
+
+func newGPUObject(b Body) gpuObject {
+	o := gpuObject{Body: uint32(b.Kind)}
+	switch b.Kind {
+	case Box, Volume:
+		o.P0 = vec4(b.Min.X(), b.Min.Y(), b.Min.Z(), 0.0)
+		o.P1 = vec4(b.Max.X(), b.Max.Y(), b.Max.Z(), 0.0)
+	case Ball:
+		o.P0 = vec4(b.Center.X(), b.Center.Y(), b.Center.Z(), b.Radius)
+	case Plane:
+		o.P0 = vec4(b.Center.X(), b.Center.Y(), b.Center.Z(), 0.0)
+		o.P1 = vec4(b.Normal.X(), b.Normal.Y(), b.Normal.Z(), 0.0)
+	case Disk:
+		o.P0 = vec4(b.Center.X(), b.Center.Y(), b.Center.Z(), b.Radius)
+		o.P1 = vec4(b.Normal.X(), b.Normal.Y(), b.Normal.Z(), 0.0)
+	case Cylinder, Cone, Capsule:
+		o.P0 = vec4(b.Start.X(), b.Start.Y(), b.Start.Z(), b.Radius)
+		o.P1 = vec4(b.End.X(), b.End.Y(), b.End.Z(), b.EndRadius)
+	case Torus:
+		o.P0 = vec4(b.Center.X(), b.Center.Y(), b.Center.Z(), b.Thickness)
+		o.P1 = vec4(b.Radius, 0.0, 0.0, 0.0)
+	case SDF:
+		// the bounds, where the sphere tracing starts and ends
+		bounds := b.Bounds()
+		o.P0 = vec4(bounds.Min.X(), bounds.Min.Y(), bounds.Min.Z(), 0.0)
+		o.P1 = vec4(bounds.Max.X(), bounds.Max.Y(), bounds.Max.Z(), 0.0)
+	}
+	return o
+}
+
+func newGPUSDFNode(n SDFNode) gpuSDFNode {
+	o := gpuSDFNode{Op: uint32(n.Shape)}
+	switch n.Shape {
+	case SDFSphere:
+		o.P0 = vec4(n.Center.X(), n.Center.Y(), n.Center.Z(), n.Radius)
+	case SDFBox:
+		c, h := n.Min.Add(n.Max).Mul(0.5), n.Max.Sub(n.Min).Mul(0.5)
+		o.P0 = vec4(c.X(), c.Y(), c.Z(), n.Radius)
+		o.P1 = vec4(h.X(), h.Y(), h.Z(), 0.0)
+	case SDFTorus:
+		o.P0 = vec4(n.Center.X(), n.Center.Y(), n.Center.Z(), n.Thickness)
+		o.P1 = vec4(n.Radius, 0.0, 0.0, 0.0)
+	case SDFCapsule:
+		o.P0 = vec4(n.Start.X(), n.Start.Y(), n.Start.Z(), n.Radius)
+		o.P1 = vec4(n.End.X(), n.End.Y(), n.End.Z(), 0.0)
+	case SDFMandelbulb:
+		o.P0 = vec4(n.Center.X(), n.Center.Y(), n.Center.Z(), n.Power)
+		o.P1 = vec4(float32(n.Iterations), 0.0, 0.0, 0.0)
+	case SDFSmoothUnion:
+		o.P0 = vec4(n.Smoothness, 0.0, 0.0, 0.0)
+	case SDFRepeat:
+		o.P0 = vec4(n.Period.X(), n.Period.Y(), n.Period.Z(), 0.0)
+		o.P1 = vec4(float32(n.Count[0]), float32(n.Count[1]), float32(n.Count[2]), 0.0)
+	case SDFTwist:
+		o.P0 = vec4(mgl.DegToRad(n.Angle), 0.0, 0.0, 0.0)
+	case SDFEnd:
+		o.P0 = vec4(n.Scale, 0.0, 0.0, 0.0)
+	}
+	return o
+}
+
+func newGPUTriangle(t Triangle) gpuTriangle {
+	var gt gpuTriangle
+	for i := 0; i < 3; i++ {
+		gt.V[i] = vec4(t.Vertices[i].X(), t.Vertices[i].Y(), t.Vertices[i].Z(), t.UVs[i].X())
+		gt.N[i] = vec4(t.Normals[i].X(), t.Normals[i].Y(), t.Normals[i].Z(), t.UVs[i].Y())
+	}
+	return gt
+}
+
+func newGPULight(l Light) gpuLight {
+	r := l.Radiance()
+	o := gpuLight{
+		Position:  vec4(l.Position.X(), l.Position.Y(), l.Position.Z(), 0.0),
+		Direction: vec4(l.Direction.X(), l.Direction.Y(), l.Direction.Z(), 0.0),
+		Radiance:  vec4(r.X(), r.Y(), r.Z(), 0.0),
+		Kind:      uint32(l.Kind),
+	}
+	if l.Kind == SpotLight {
+		o.CosInner, o.CosOuter = l.CosAngles()
+	}
+	return o
+}
+
+func newGPUMaterial(m Material) gpuMaterial {
+	interior := m.InteriorMedium()
+	absorption, scattering := interior.Absorption, interior.Scattering
+	emission := m.PrincipledEmission()
+	return gpuMaterial{
+		Color:      vec4(uiToF(m.Color.R), uiToF(m.Color.G), uiToF(m.Color.B), 1.0),
+		Kind:       uint32(m.Kind),
+		Fuzz:       m.Fuzz,
+		Eta:        m.Eta,
+		Intensity:  m.Intensity,
+		Absorption: vec4(absorption.X(), absorption.Y(), absorption.Z(), 0.0),
+		Scattering: vec4(scattering.X(), scattering.Y(), scattering.Z(), interior.Anisotropy),
+		IORN:       vec4(m.N.X(), m.N.Y(), m.N.Z(), 0.0),
+		IORK:       vec4(m.K.X(), m.K.Y(), m.K.Z(), 0.0),
+		Roughness:  m.Roughness,
+		Anisotropy: m.Anisotropy,
+
+		Metallic:           m.Metallic,
+		Specular:           m.Specular,
+		Clearcoat:          m.Clearcoat,
+		ClearcoatRoughness: m.ClearcoatRoughness,
+		Sheen:              m.Sheen,
+		Transmission:       m.Transmission,
+		Emission:           vec4(emission.X(), emission.Y(), emission.Z(), 0.0),
+		ColorTexture:       -1,
+		RoughnessTexture:   -1,
+		NormalMap:          -1,
+		Bump:               -1,
+	}
+}
+
+func newGPUTexture(t *Texture, colors bool) gpuTexture {
+	gt := gpuTexture{
+		Kind:       uint32(t.Kind),
+		Scale:      t.Scale,
+		Turbulence: t.Turbulence,
+		Wrap:       uint32(t.Wrap),
+		Strength:   t.Strength,
+	}
+	if colors {
+		c0, c1 := t.Colors[0], t.Colors[1]
+		gt.A = vec4(uiToF(c0.R), uiToF(c0.G), uiToF(c0.B), 1.0)
+		gt.B = vec4(uiToF(c1.R), uiToF(c1.G), uiToF(c1.B), 1.0)
+	} else {
+		gt.A = vec4(t.Values[0], t.Values[0], t.Values[0], t.Values[0])
+		gt.B = vec4(t.Values[1], t.Values[1], t.Values[1], t.Values[1])
+	}
+	return gt
+}
+
+// SceneBuffers hold the shader storage buffers with the scene data
+type SceneBuffers struct {
+	objects    uint32
+	materials  uint32
+	bvhNodes   uint32
+	bvhIndices uint32
+	triangles  uint32
+	lights     uint32
+	texels     uint32
+	envCDF     uint32
+	textures   uint32
+	volumes    uint32
+	densities  uint32
+	csgNodes   uint32
+	sdfNodes   uint32
+
+	// whether the sampling distribution of the environment map was uploaded
+	envSampled bool
+}
+
+func NewSceneBuffers() *SceneBuffers {
+	sb := &SceneBuffers{}
+	gl.GenBuffers(1, &sb.objects)
+	gl.GenBuffers(1, &sb.materials)
+	gl.GenBuffers(1, &sb.bvhNodes)
+	gl.GenBuffers(1, &sb.bvhIndices)
+	gl.GenBuffers(1, &sb.triangles)
+	gl.GenBuffers(1, &sb.lights)
+	gl.GenBuffers(1, &sb.texels)
+	gl.GenBuffers(1, &sb.envCDF)
+	gl.GenBuffers(1, &sb.textures)
+	gl.GenBuffers(1, &sb.volumes)
+	gl.GenBuffers(1, &sb.densities)
+	gl.GenBuffers(1, &sb.csgNodes)
+	gl.GenBuffers(1, &sb.sdfNodes)
+	return sb
+}
+
+// Upload replaces the contents of the buffers with the scene data
+// and binds them to their binding points
+func (sb *SceneBuffers) Upload(s *Scene) {
+	// bvh.Node already has the layout of the shader struct
+	tree := s.BVH()
+	nodes := append(make([]bvh.Node, 0, len(tree.Nodes)), tree.Nodes...)
+
+	// the hierarchies of the meshes follow the scene one in the nodes buffer,
+	// with offsets pointing to the nodes and the triangles buffers directly.
+	// Meshes shared by several objects are only uploaded once
+	triangles := make([]gpuTriangle, 0)
+	roots := make(map[*TriangleMesh]int32)
+	meshRoot := func(m *TriangleMesh) int32 {
+		if m == nil || len(m.BVH.Nodes) == 0 {
+			return -1
+		}
+		if root, found := roots[m]; found {
+			return root
+		}
+		root := int32(len(nodes))
+		base := int32(len(triangles))
+		for _, n := range m.BVH.Nodes {
+			if n.IsLeaf() {
+				n.Offset += base
+			} else {
+				n.Offset += root
+			}
+			nodes = append(nodes, n)
+		}
+		for _, t := range m.Triangles {
+			triangles = append(triangles, newGPUTriangle(t))
+		}
+		roots[m] = root
+		return root
+	}
+
+	objects := make([]gpuObject, 0)
+	materials := make([]gpuMaterial, 0)
+	// the environment map (or the baked sky) is stored at the beginning of the texels
+	// buffer, followed by the images of the textures (shared ones are only stored once)
+	texels := make([][4]float32, 0)
+	appendImage := func(img *Image) {
+		for i := 0; i < len(img.Pix); i += 3 {
+			texels = append(texels, vec4(img.Pix[i], img.Pix[i+1], img.Pix[i+2], 0.0))
+		}
+	}
+	if img := s.Environment.Image; s.Environment.Kind != Gradient && img != nil {
+		appendImage(img)
+	}
+	offsets := make(map[*Image]int32)
+
+	textures := make([]gpuTexture, 0)
+	addTexture := func(t *Texture, colors bool) int32 {
+		if t == nil {
+			return -1
+		}
+		gt := newGPUTexture(t, colors)
+		if img := t.Image; img != nil {
+			offset, found := offsets[img]
+			if !found {
+				offset = int32(len(texels))
+				appendImage(img)
+				offsets[img] = offset
+			}
+			gt.Offset, gt.Width, gt.Height = offset, int32(img.Width), int32(img.Height)
+		}
+		textures = append(textures, gt)
+		return int32(len(textures) - 1)
+	}
+	// the voxels of the grids shared by several volumes are only stored once
+	volumes := make([]gpuVolume, 0)
+	densities := make([]float32, 0)
+	gridOffsets := make(map[*DensityGrid]int32)
+	addVolume := func(b Body) int32 {
+		v := gpuVolume{Density: addTexture(b.Density, false), MaxDensity: b.MaxDensity()}
+		if g := b.Grid; b.Density == nil && g != nil {
+			offset, found := gridOffsets[g]
+			if !found {
+				offset = int32(len(densities))
+				densities = append(densities, g.Density...)
+				gridOffsets[g] = offset
+			}
+			v.Grid = [4]int32{int32(g.Size[0]), int32(g.Size[1]), int32(g.Size[2]), offset}
+		}
+		volumes = append(volumes, v)
+		return int32(len(volumes) - 1)
+	}
+	csgNodes := make([]gpuCSGNode, 0)
+	addCSG := func(b Body) int32 {
+		first := int32(len(csgNodes))
+		program := b.CSGProgram()
+		for _, n := range program {
+			node := gpuCSGNode{Op: uint32(n.Operation), Polarity: n.Polarity, ToLeaf: n.ToLeaf}
+			if n.Operation == CSGLeaf {
+				leaf := newGPUObject(n.Body)
+				node.P0, node.P1, node.Body = leaf.P0, leaf.P1, leaf.Body
+			}
+			csgNodes = append(csgNodes, node)
+		}
+		csgNodes[first].Size = int32(len(program))
+		return first
+	}
+	sdfNodes := make([]gpuSDFNode, 0)
+	addSDF := func(b Body) int32 {
+		first := int32(len(sdfNodes))
+		program := b.Shape.Program()
+		for _, n := range program {
+			sdfNodes = append(sdfNodes, newGPUSDFNode(n))
+		}
+		sdfNodes[first].Size = int32(len(program))
+		return first
+	}
+	newObject := func(o Object) gpuObject {
+		obj := newGPUObject(o.Body)
+		obj.ToObject = o.Transform.ToObject()
+		switch o.Body.Kind {
+		case Mesh:
+			obj.Root = meshRoot(o.Body.Mesh)
+		case Volume:
+			obj.Root = addVolume(o.Body)
+		case CSG:
+			obj.Root = addCSG(o.Body)
+		case SDF:
+			obj.Root = addSDF(o.Body)
+		}
+		mat := newGPUMaterial(o.Material)
+		mat.ColorTexture = addTexture(o.Material.ColorTexture, true)
+		mat.RoughnessTexture = addTexture(o.Material.RoughnessTexture, false)
+		mat.NormalMap = addTexture(o.Material.NormalMap, true)
+		mat.Bump = addTexture(o.Material.Bump, false)
+		materials = append(materials, mat)
+		obj.Material = int32(len(materials) - 1)
+		return obj
+	}
+	for _, data := range s.Data {
+		for _, o := range data.Objects {
+			objects = append(objects, newObject(o))
+		}
+	}
+	// the instances of a prototype only differ by the transform
+	prototypes := make(map[string]gpuObject)
+	for _, inst := range s.Instances {
+		obj, found := prototypes[inst.Prototype]
+		if !found {
+			obj = newObject(*s.Prototypes[inst.Prototype])
+			prototypes[inst.Prototype] = obj
+		}
+		obj.ToObject = s.InstanceObject(inst).Transform.ToObject()
+		objects = append(objects, obj)
+	}
+
+	glutils.StorageBufferData(sb.objects, objectsBinding, len(objects)*int(unsafe.Sizeof(gpuObject{})), objects)
+	glutils.StorageBufferData(sb.materials, materialsBinding, len(materials)*int(unsafe.Sizeof(gpuMaterial{})), materials)
+	glutils.StorageBufferData(sb.textures, texturesBinding, len(textures)*int(unsafe.Sizeof(gpuTexture{})), textures)
+	glutils.StorageBufferData(sb.volumes, volumesBinding, len(volumes)*int(unsafe.Sizeof(gpuVolume{})), volumes)
+	glutils.StorageBufferData(sb.densities, densitiesBinding, len(densities)*4, densities)
+	glutils.StorageBufferData(sb.csgNodes, csgNodesBinding, len(csgNodes)*int(unsafe.Sizeof(gpuCSGNode{})), csgNodes)
+	glutils.StorageBufferData(sb.sdfNodes, sdfNodesBinding, len(sdfNodes)*int(unsafe.Sizeof(gpuSDFNode{})), sdfNodes)
+	glutils.StorageBufferData(sb.triangles, trianglesBinding, len(triangles)*int(unsafe.Sizeof(gpuTriangle{})), triangles)
+
+	all := s.AllLights()
+	lights := make([]gpuLight, 0, len(all))
+	for _, l := range all {
+		lights = append(lights, newGPULight(l))
+	}
+	glutils.StorageBufferData(sb.lights, lightsBinding, len(lights)*int(unsafe.Sizeof(gpuLight{})), lights)
+
+	glutils.StorageBufferData(sb.texels, texelsBinding, len(texels)*16, texels)
+	cdf := s.Environment.SamplingCDF()
+	glutils.StorageBufferData(sb.envCDF, envCDFBinding, len(cdf)*4, cdf)
+	sb.envSampled = cdf != nil
+
+	glutils.StorageBufferData(sb.bvhNodes, bvhNodesBinding, len(nodes)*int(unsafe.Sizeof(bvh.Node{})), nodes)
+	glutils.StorageBufferData(sb.bvhIndices, bvhIndicesBinding, len(tree.Indices)*4, tree.Indices)
+}
+
+// EnvironmentSampled reports whether the environment map of the last uploaded
+// scene is importance sampled, i.e. whether its sampling distribution is in the buffers
+func (sb *SceneBuffers) EnvironmentSampled() bool {
+	return sb.envSampled
+}
@@ -1,15 +1,11 @@
 package scenery
 
 import (
+	"encoding/json"
 	"fmt"
 	"math"
 
-	"github.com/go-gl/gl/v4.6-core/gl"
-	"github.com/go-gl/glfw/v3.3/glfw"
 	mgl "github.com/go-gl/mathgl/mgl32"
-
-	"github.com/xopoww/go-raytrace/app"
-	"github.com/xopoww/go-raytrace/glutils"
 )
 
 type Camera struct {
@@ -67,6 +63,88 @@ func NewCamera(width, height int) Camera {
 	return cam
 }
 
+// SetView places the camera at position and turns it towards lookat
+// keeping the up direction as close to the Y axis as possible
+func (cam *Camera) SetView(position, lookat mgl.Vec3) {
+	cam.Position = position
+	cam.Lookat = lookat
+	cam.Up = mgl.Vec3{0.0, 1.0, 0.0}
+	cam.fixValues()
+}
+
+// cameraJSON is the camera section of the scene file
+type cameraJSON struct {
+	Position  *mgl.Vec3 `json:"position,omitempty"`
+	Lookat    *mgl.Vec3 `json:"lookat,omitempty"`
+	Up        *mgl.Vec3 `json:"up,omitempty"`
+	FOV       *float32  `json:"fov,omitempty"`
+	Aperture  *float32  `json:"aperture,omitempty"`
+	FocalDist *float32  `json:"focal_dist,omitempty"`
+}
+
+// Fields missing from the JSON get the same values as in NewCamera.
+// Ratio is always set to 1, so it must be fixed by the caller
+func (cam *Camera) UnmarshalJSON(data []byte) error {
+	var cj cameraJSON
+	err := json.Unmarshal(data, &cj)
+	if err != nil {
+		return err
+	}
+
+	*cam = NewCamera(1, 1)
+	position, lookat := cam.Position, cam.Lookat
+	if cj.Position != nil {
+		position = *cj.Position
+	}
+	if cj.Lookat != nil {
+		lookat = *cj.Lookat
+	}
+	if position == lookat {
+		return fmt.Errorf("position and lookat must differ")
+	}
+	cam.SetView(position, lookat)
+	if cj.Up != nil {
+		cam.Up = *cj.Up
+		// saved cameras already have Up perpendicular to the view direction,
+		// so they are kept as is to be loaded exactly
+		if mgl.Abs(cam.forward().Dot(cam.Up)) > 1e-6 {
+			cam.fixValues()
+		}
+	}
+
+	if cj.FOV != nil {
+		if *cj.FOV <= 0.0 || *cj.FOV >= 180.0 {
+			return fmt.Errorf("fov must be in range (0, 180)")
+		}
+		cam.FOV = *cj.FOV
+	}
+	if cj.Aperture != nil {
+		if *cj.Aperture < 0.0 {
+			return fmt.Errorf("aperture must be positive")
+		}
+		cam.Aperture = *cj.Aperture
+	}
+	if cj.FocalDist != nil {
+		if *cj.FocalDist < minFocalDist {
+			return fmt.Errorf("focal_dist must be at least %f", minFocalDist)
+		}
+		cam.FocalDist = *cj.FocalDist
+	}
+
+	return nil
+}
+
+func (cam Camera) MarshalJSON() ([]byte, error) {
+	return json.Marshal(cameraJSON{
+		Position:  &cam.Position,
+		Lookat:    &cam.Lookat,
+		Up:        &cam.Up,
+		FOV:       &cam.FOV,
+		Aperture:  &cam.Aperture,
+		FocalDist: &cam.FocalDist,
+	})
+}
+
 // check if all fields of the struct are valid and fix if not
 // TODO: maybe fix this somehow else
 func (cam *Camera) fixValues() {
@@ -91,17 +169,10 @@ func (cam *Camera) transformMatrix() mgl.Mat3 {
 	return mgl.Mat3FromCols(cam.forward(), cam.Up, cam.right())
 }
 
-func (cam *Camera) GetUniformLocations(program uint32) {
-	for i := 0; i < 2; i++ {
-		for j := 0; j < 2; j++ {
-			cam.UniformRays[i][j] = glutils.MustGetUniformLocation(program, fmt.Sprintf("ray%d%d", i, j))
-		}
-	}
-	cam.UniformEye = glutils.MustGetUniformLocation(program, "eye")
-	cam.UniformLensRadius = glutils.MustGetUniformLocation(program, "lens_radius")
-}
-
-func (cam *Camera) SetUniforms() {
+// Rays returns the rays from the eye to the corners of the screen,
+// indexed as [x][y] with [0][0] being the bottom-left corner.
+// The length of each ray is equal to the focal distance
+func (cam *Camera) Rays() [2][2]mgl.Vec3 {
 	var cameraRays [2][2]mgl.Vec3
 	forward := cam.forward()
 	right := cam.right()
@@ -117,24 +188,7 @@ func (cam *Camera) SetUniforms() {
 	cameraRays[0][1] = forward.Sub(deltaX).Add(deltaY).Normalize().Mul(cam.FocalDist)
 	cameraRays[1][1] = forward.Add(deltaX).Add(deltaY).Normalize().Mul(cam.FocalDist)
 
-	for i := 0; i < 2; i++ {
-		for j := 0; j < 2; j++ {
-			gl.Uniform3f(
-				cam.UniformRays[i][j],
-				cameraRays[i][j].X(),
-				cameraRays[i][j].Y(),
-				cameraRays[i][j].Z(),
-			)
-		}
-	}
-	gl.Uniform3f(
-		cam.UniformEye,
-		cam.Position.X(),
-		cam.Position.Y(),
-		cam.Position.Z(),
-	)
-
-	gl.Uniform1f(cam.UniformLensRadius, cam.Aperture/2.0)
+	return cameraRays
 }
 
 const (
@@ -249,26 +303,3 @@ func (cam *Camera) Update() {
 		cam.FOV += dFOV
 	}
 }
-
-func (cam *Camera) AttachToEventHandler(eh *app.EventHandler) {
-	eh.AddOption(glfw.KeyW, &cam.moveFor, app.Hold)
-	eh.AddOption(glfw.KeyS, &cam.moveBack, app.Hold)
-	eh.AddOption(glfw.KeyD, &cam.moveRight, app.Hold)
-	eh.AddOption(glfw.KeyA, &cam.moveLeft, app.Hold)
-	eh.AddOption(glfw.KeySpace, &cam.moveUp, app.Hold)
-	eh.AddOption(glfw.KeyLeftShift, &cam.moveDown, app.Hold)
-
-	eh.AddOption(glfw.KeyKP8, &cam.rotUp, app.Hold)
-	eh.AddOption(glfw.KeyKP2, &cam.rotDown, app.Hold)
-	eh.AddOption(glfw.KeyKP6, &cam.rotRight, app.Hold)
-	eh.AddOption(glfw.KeyKP4, &cam.rotLeft, app.Hold)
-	eh.AddOption(glfw.KeyKP9, &cam.rotFor, app.Hold)
-	eh.AddOption(glfw.KeyKP7, &cam.rotBack, app.Hold)
-
-	eh.AddOption(glfw.KeyKPAdd, &cam.zoomIn, app.Hold)
-	eh.AddOption(glfw.KeyKPSubtract, &cam.zoomOut, app.Hold)
-	eh.AddOption(glfw.KeyX, &cam.lensWide, app.Hold)
-	eh.AddOption(glfw.KeyZ, &cam.lensShrink, app.Hold)
-	eh.AddOption(glfw.KeyV, &cam.fovUp, app.Hold)
-	eh.AddOption(glfw.KeyC, &cam.fovDown, app.Hold)
-}
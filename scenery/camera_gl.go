@@ -0,0 +1,73 @@
+//go:build cgo
+// +build cgo
+
+package scenery
+
+import (
+	"fmt"
+
+	"github.com/go-gl/gl/v4.6-core/gl"
+	"github.com/go-gl/glfw/v3.3/glfw"
+
+	"github.com/xopoww/go-raytrace/app"
+	"github.com/xopoww/go-raytrace/glutils"
+)
+
+// The camera uniforms and the keyboard controls of the interactive mode
+// (they need OpenGL and GLFW, so they are only built with cgo)
+
+func (cam *Camera) GetUniformLocations(program uint32) {
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 2; j++ {
+			cam.UniformRays[i][j] = glutils.MustGetUniformLocation(program, fmt.Sprintf("ray%d%d", i, j))
+		}
+	}
+	cam.UniformEye = glutils.MustGetUniformLocation(program, "eye")
+	cam.UniformLensRadius = glutils.MustGetUniformLocation(program, "lens_radius")
+}
+
+func (cam *Camera) SetUniforms() {
+	cameraRays := cam.Rays()
+
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 2; j++ {
+			gl.Uniform3f(
+				cam.UniformRays[i][j],
+				cameraRays[i][j].X(),
+				cameraRays[i][j].Y(),
+				cameraRays[i][j].Z(),
+			)
+		}
+	}
+	gl.Uniform3f(
+		cam.UniformEye,
+		cam.Position.X(),
+		cam.Position.Y(),
+		cam.Position.Z(),
+	)
+
+	gl.Uniform1f(cam.UniformLensRadius, cam.Aperture/2.0)
+}
+
+func (cam *Camera) AttachToEventHandler(eh *app.EventHandler) {
+	eh.AddOption(glfw.KeyW, &cam.moveFor, app.Hold)
+	eh.AddOption(glfw.KeyS, &cam.moveBack, app.Hold)
+	eh.AddOption(glfw.KeyD, &cam.moveRight, app.Hold)
+	eh.AddOption(glfw.KeyA, &cam.moveLeft, app.Hold)
+	eh.AddOption(glfw.KeySpace, &cam.moveUp, app.Hold)
+	eh.AddOption(glfw.KeyLeftShift, &cam.moveDown, app.Hold)
+
+	eh.AddOption(glfw.KeyKP8, &cam.rotUp, app.Hold)
+	eh.AddOption(glfw.KeyKP2, &cam.rotDown, app.Hold)
+	eh.AddOption(glfw.KeyKP6, &cam.rotRight, app.Hold)
+	eh.AddOption(glfw.KeyKP4, &cam.rotLeft, app.Hold)
+	eh.AddOption(glfw.KeyKP9, &cam.rotFor, app.Hold)
+	eh.AddOption(glfw.KeyKP7, &cam.rotBack, app.Hold)
+
+	eh.AddOption(glfw.KeyKPAdd, &cam.zoomIn, app.Hold)
+	eh.AddOption(glfw.KeyKPSubtract, &cam.zoomOut, app.Hold)
+	eh.AddOption(glfw.KeyX, &cam.lensWide, app.Hold)
+	eh.AddOption(glfw.KeyZ, &cam.lensShrink, app.Hold)
+	eh.AddOption(glfw.KeyV, &cam.fovUp, app.Hold)
+	eh.AddOption(glfw.KeyC, &cam.fovDown, app.Hold)
+}
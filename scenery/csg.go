@@ -0,0 +1,198 @@
+package scenery
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	mgl "github.com/go-gl/mathgl/mgl32"
+
+	"github.com/xopoww/go-raytrace/bvh"
+)
+
+// Constructive solid geometry combines solid bodies (boxes, balls, cylinders, cones, capsules
+// and other CSG bodies) with set operations. Each operand has a single interval along the ray where
+// the ray is inside it, so the intervals of the CSG body are found by walking through the boundaries
+// of the operands along the ray and evaluating the operation between them.
+// Other bodies can not be operands: a ray can go through a torus twice, planes are unbounded,
+// disks are flat, meshes need not be closed and volumes have no surface
+
+type CSGOperation int
+
+const (
+	// the operand itself (only used in CSGNode)
+	CSGLeaf CSGOperation = iota
+	Union
+	Intersection
+	// the first operand without the others
+	Difference
+)
+
+var csgOperationNames = [...]string{"leaf", "union", "intersection", "difference"}
+
+func (op CSGOperation) String() string {
+	return csgOperationNames[op]
+}
+
+// MaxCSGLeaves limits the number of the bodies combined in a CSG body (CSG_MAX_LEAVES in the shader)
+const MaxCSGLeaves = 16
+
+type CSGOperand struct {
+	Body Body `json:"body"`
+	// transform from the space of the operand to the one of the CSG body (nil if there is none)
+	Transform *Transform `json:"transform,omitempty"`
+}
+
+func parseCSG(dict map[string]interface{}) (Body, error) {
+	opI, found := dict["operation"]
+	if !found {
+		return Body{}, fmt.Errorf("operation not specified")
+	}
+	opS, ok := opI.(string)
+	if !ok {
+		return Body{}, fmt.Errorf("invalid operation type")
+	}
+	b := Body{Kind: CSG}
+	found = false
+	for op, name := range csgOperationNames {
+		if op != int(CSGLeaf) && name == opS {
+			b.Operation = CSGOperation(op)
+			found = true
+		}
+	}
+	if !found {
+		return Body{}, fmt.Errorf("unknown operation: %s", opS)
+	}
+
+	operandsI, found := dict["operands"]
+	if !found {
+		return Body{}, fmt.Errorf("operands not specified")
+	}
+	operands, ok := operandsI.([]interface{})
+	if !ok {
+		return Body{}, fmt.Errorf("invalid operands type")
+	}
+	for j, o := range operands {
+		dict, ok := o.(map[string]interface{})
+		if !ok {
+			return Body{}, fmt.Errorf("operand %d: invalid type", j)
+		}
+		// a missing body would be decoded as an empty box
+		if _, found := dict["body"]; !found {
+			return Body{}, fmt.Errorf("operand %d: body not specified", j)
+		}
+	}
+	// the operands are parsed as they are
+	data, err := json.Marshal(operands)
+	if err != nil {
+		return Body{}, err
+	}
+	if err := json.Unmarshal(data, &b.Operands); err != nil {
+		return Body{}, fmt.Errorf("operands: %w", err)
+	}
+	if len(b.Operands) < 2 {
+		return Body{}, fmt.Errorf("at least 2 operands required")
+	}
+	for j, o := range b.Operands {
+		switch o.Body.Kind {
+		case Box, Ball, Cylinder, Cone, Capsule, CSG:
+		default:
+			return Body{}, fmt.Errorf("operand %d: only boxes, balls, cylinders, cones, capsules and CSG bodies can be combined", j)
+		}
+	}
+	if len(b.CSGProgram()) > 2*MaxCSGLeaves-1 {
+		return Body{}, fmt.Errorf("more than %d combined bodies", MaxCSGLeaves)
+	}
+	return b, nil
+}
+
+// CSGNode is a node of the CSG tree flattened in the postfix order
+type CSGNode struct {
+	Operation CSGOperation
+	// leaves: the body and the transform from the space
+	// of the CSG body to the one of the leaf
+	Body   Body
+	ToLeaf mgl.Mat4
+	// leaves: -1 if the leaf is subtracted from the body, so its normals point inside the body
+	Polarity float32
+}
+
+// CSGProgram returns the CSG tree of the body flattened in the postfix order: the operations
+// combine the two values computed before them (operations on more than two operands are split
+// into several nodes, e.g. a - b - c is (a - b) - c)
+func (b Body) CSGProgram() []CSGNode {
+	return b.appendCSG(nil, mgl.Ident4(), 1.0)
+}
+
+func (b Body) appendCSG(program []CSGNode, toLeaf mgl.Mat4, polarity float32) []CSGNode {
+	if b.Kind != CSG {
+		return append(program, CSGNode{Operation: CSGLeaf, Body: b, ToLeaf: toLeaf, Polarity: polarity})
+	}
+	for j, o := range b.Operands {
+		p := polarity
+		if b.Operation == Difference && j > 0 {
+			p = -p
+		}
+		program = o.Body.appendCSG(program, o.Transform.ToObject().Mul4(toLeaf), p)
+		if j > 0 {
+			program = append(program, CSGNode{Operation: b.Operation})
+		}
+	}
+	return program
+}
+
+func (o CSGOperand) bounds() bvh.AABB {
+	if o.Transform == nil {
+		return o.Body.Bounds()
+	}
+	return o.Body.Bounds().Transform(o.Transform.ToWorld())
+}
+
+func (b Body) csgBounds() bvh.AABB {
+	result := b.Operands[0].bounds()
+	for _, o := range b.Operands[1:] {
+		ob := o.bounds()
+		switch b.Operation {
+		case Union:
+			result = result.Union(ob)
+		case Intersection:
+			for i := 0; i < 3; i++ {
+				result.Min[i] = mgl.Clamp(ob.Min[i], result.Min[i], result.Max[i])
+				result.Max[i] = mgl.Clamp(ob.Max[i], result.Min[i], result.Max[i])
+			}
+		}
+	}
+	return result
+}
+
+func (b Body) csgDescription() string {
+	operands := make([]string, len(b.Operands))
+	for j, o := range b.Operands {
+		switch o.Body.Kind {
+		case Box:
+			operands[j] = fmt.Sprintf("box(%v, %v)", o.Body.Min, o.Body.Max)
+		case Ball:
+			operands[j] = fmt.Sprintf("ball(%v, %f)", o.Body.Center, o.Body.Radius)
+		case Cylinder:
+			operands[j] = fmt.Sprintf("cylinder(%v, %v, %f)", o.Body.Start, o.Body.End, o.Body.Radius)
+		case Cone:
+			operands[j] = fmt.Sprintf("cone(%v, %v, %f, %f)", o.Body.Start, o.Body.End, o.Body.Radius, o.Body.EndRadius)
+		case Capsule:
+			operands[j] = fmt.Sprintf("capsule(%v, %v, %f)", o.Body.Start, o.Body.End, o.Body.Radius)
+		case CSG:
+			operands[j] = o.Body.csgDescription()
+		}
+		if o.Transform != nil {
+			operands[j] += " with " + o.Transform.description()
+		}
+	}
+	return fmt.Sprintf("%s(%s)", b.Operation, strings.Join(operands, ", "))
+}
+
+func NewCSG(op CSGOperation, operands ...CSGOperand) Body {
+	return Body{
+		Kind:      CSG,
+		Operation: op,
+		Operands:  operands,
+	}
+}
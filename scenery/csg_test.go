@@ -0,0 +1,44 @@
+package scenery
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseCSGErrors(t *testing.T) {
+	ball := `{"body": {"kind": "ball", "center": [0, 0, 0], "radius": 1}}`
+	for _, tc := range []struct {
+		name, body string
+	}{
+		{"missing operation", `{"kind": "csg", "operands": [` + ball + `, ` + ball + `]}`},
+		{"unknown operation", `{"kind": "csg", "operation": "xor", "operands": [` + ball + `, ` + ball + `]}`},
+		{"missing operands", `{"kind": "csg", "operation": "union"}`},
+		{"one operand", `{"kind": "csg", "operation": "union", "operands": [` + ball + `]}`},
+		{"operand without body", `{"kind": "csg", "operation": "union", "operands": [` + ball + `, {"transform": {"translation": [1, 0, 0]}}]}`},
+		{"operand of invalid type", `{"kind": "csg", "operation": "union", "operands": [` + ball + `, 1]}`},
+		{"nested operation missing", `{"kind": "csg", "operation": "union", "operands": [` + ball + `, {"body": {"kind": "csg", "operands": [` + ball + `, ` + ball + `]}}]}`},
+		{"unsupported operand", `{"kind": "csg", "operation": "union", "operands": [` + ball + `, {"body": {"kind": "mesh", "file": "a.obj"}}]}`},
+		{"torus operand", `{"kind": "csg", "operation": "union", "operands": [` + ball + `, {"body": {"kind": "torus", "center": [0, 0, 0], "radius": 1, "thickness": 0.2}}]}`},
+		{"plane operand", `{"kind": "csg", "operation": "intersection", "operands": [` + ball + `, {"body": {"kind": "plane", "point": [0, 0, 0], "normal": [0, 1, 0]}}]}`},
+		{"disk operand", `{"kind": "csg", "operation": "difference", "operands": [` + ball + `, {"body": {"kind": "disk", "center": [0, 0, 0], "normal": [0, 1, 0], "radius": 1}}]}`},
+	} {
+		var b Body
+		if err := json.Unmarshal([]byte(tc.body), &b); err == nil {
+			t.Errorf("%s: no error", tc.name)
+		}
+	}
+
+	for _, operand := range []string{
+		ball,
+		`{"body": {"kind": "box", "min": [-1, -1, -1], "max": [1, 1, 1]}}`,
+		`{"body": {"kind": "cylinder", "start": [0, 0, 0], "end": [0, 1, 0], "radius": 0.5}}`,
+		`{"body": {"kind": "cone", "start": [0, 0, 0], "end": [0, 1, 0], "radius": 0.5, "end_radius": 0}}`,
+		`{"body": {"kind": "capsule", "start": [0, 0, 0], "end": [0, 1, 0], "radius": 0.5}}`,
+	} {
+		var b Body
+		valid := `{"kind": "csg", "operation": "difference", "operands": [` + ball + `, ` + operand + `]}`
+		if err := json.Unmarshal([]byte(valid), &b); err != nil {
+			t.Errorf("valid body with %s: %v", operand, err)
+		}
+	}
+}
@@ -0,0 +1,432 @@
+package scenery
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"math"
+	"time"
+
+	mgl "github.com/go-gl/mathgl/mgl32"
+)
+
+// Environment describes the light that comes from outside of the scene,
+// i.e. the color of the rays that hit nothing
+
+type EnvironmentKind int
+
+const (
+	Gradient EnvironmentKind = iota
+	// equirectangular image around the scene
+	EnvironmentMap
+	// daylight sky with the sun
+	Sky
+)
+
+type Environment struct {
+	Kind EnvironmentKind
+
+	// gradient: colors of the sky straight below and straight above
+	Bottom color.RGBA
+	Top    color.RGBA
+
+	// map: path to the image (HDR, PNG or JPEG), its rotation around
+	// the vertical axis in degrees and the factor its colors are scaled by.
+	// The image is nil until it is loaded by Scene.LoadAssets
+	File      string
+	Rotation  float32
+	Intensity float32
+	Image     *Image
+
+	// sky: turbidity of the air, position of the sun in degrees (see SunDirection)
+	// and color of the ground. If Time is set, the position of the sun is computed
+	// from it and the coordinates of the place. The sky is baked into Image
+	// and scaled by Intensity as well
+	Turbidity    float32
+	SunElevation float32
+	SunAzimuth   float32
+	Time         time.Time
+	Latitude     float32
+	Longitude    float32
+	Ground       color.RGBA
+}
+
+// DefaultEnvironment returns the black-to-white gradient sky
+func DefaultEnvironment() Environment {
+	return Environment{
+		Kind:   Gradient,
+		Bottom: color.RGBA{0x00, 0x00, 0x00, 0xff},
+		Top:    color.RGBA{0xff, 0xff, 0xff, 0xff},
+	}
+}
+
+// NewSky returns the daylight sky with the sun at given elevation and azimuth (in degrees)
+func NewSky(turbidity, elevation, azimuth float32) Environment {
+	env := DefaultEnvironment()
+	env.Kind = Sky
+	env.Intensity = 1.0
+	env.Turbidity = turbidity
+	env.SunElevation = elevation
+	env.SunAzimuth = azimuth
+	env.Ground = color.RGBA{0x80, 0x80, 0x80, 0xff}
+	env.bakeSky()
+	return env
+}
+
+func (env *Environment) UnmarshalJSON(data []byte) error {
+	dict := make(map[string]interface{})
+	err := json.Unmarshal(data, &dict)
+	if err != nil {
+		return err
+	}
+
+	*env = DefaultEnvironment()
+
+	kindI, found := dict["kind"]
+	if !found {
+		return fmt.Errorf("kind not specified")
+	}
+	kindS, ok := kindI.(string)
+	if !ok {
+		return fmt.Errorf("invalid kind type")
+	}
+	switch kindS {
+	case "gradient":
+		env.Kind = Gradient
+	case "map":
+		env.Kind = EnvironmentMap
+		return env.parseMap(dict)
+	case "sky":
+		env.Kind = Sky
+		return env.parseSky(dict)
+	default:
+		return fmt.Errorf("unknown kind: %s", kindS)
+	}
+
+	if bottomI, found := dict["bottom"]; found {
+		env.Bottom, err = colorFromInterface(bottomI)
+		if err != nil {
+			return fmt.Errorf("bottom: %w", err)
+		}
+	}
+	if topI, found := dict["top"]; found {
+		env.Top, err = colorFromInterface(topI)
+		if err != nil {
+			return fmt.Errorf("top: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (env *Environment) parseMap(dict map[string]interface{}) error {
+	fileI, found := dict["file"]
+	if !found {
+		return fmt.Errorf("file not specified")
+	}
+	file, ok := fileI.(string)
+	if !ok {
+		return fmt.Errorf("invalid file type")
+	}
+	env.File = file
+
+	var err error
+	env.Rotation = 0.0
+	if rotI, found := dict["rotation"]; found {
+		env.Rotation, err = floatFromInterface(rotI)
+		if err != nil {
+			return fmt.Errorf("rotation: %w", err)
+		}
+	}
+	return env.parseIntensity(dict)
+}
+
+func (env *Environment) parseIntensity(dict map[string]interface{}) error {
+	env.Intensity = 1.0
+	if intI, found := dict["intensity"]; found {
+		var err error
+		env.Intensity, err = floatFromInterface(intI)
+		if err != nil {
+			return fmt.Errorf("intensity: %w", err)
+		}
+		if env.Intensity < 0.0 {
+			return fmt.Errorf("intensity must be positive")
+		}
+	}
+	return nil
+}
+
+const (
+	skyDateLayout = "2006-01-02"
+	skyTimeLayout = "15:04"
+)
+
+func (env *Environment) parseSky(dict map[string]interface{}) error {
+	if err := env.parseIntensity(dict); err != nil {
+		return err
+	}
+
+	var err error
+	env.Turbidity = 3.0
+	if tI, found := dict["turbidity"]; found {
+		env.Turbidity, err = floatFromInterface(tI)
+		if err != nil {
+			return fmt.Errorf("turbidity: %w", err)
+		}
+		if env.Turbidity < 1.7 || env.Turbidity > 10.0 {
+			return fmt.Errorf("turbidity must be in range [1.7, 10]")
+		}
+	}
+
+	env.Ground = color.RGBA{0x80, 0x80, 0x80, 0xff}
+	if groundI, found := dict["ground"]; found {
+		env.Ground, err = colorFromInterface(groundI)
+		if err != nil {
+			return fmt.Errorf("ground: %w", err)
+		}
+	}
+
+	// the sun is given either by the date, time and place or by its position
+	if dateI, found := dict["date"]; found {
+		if err := env.parseSkyTime(dict, dateI); err != nil {
+			return err
+		}
+	} else {
+		elI, found := dict["sun_elevation"]
+		if !found {
+			return fmt.Errorf("sun_elevation not specified")
+		}
+		env.SunElevation, err = floatFromInterface(elI)
+		if err != nil {
+			return fmt.Errorf("sun_elevation: %w", err)
+		}
+		if env.SunElevation < -90.0 || env.SunElevation > 90.0 {
+			return fmt.Errorf("sun_elevation must be in range [-90, 90]")
+		}
+
+		azI, found := dict["sun_azimuth"]
+		if !found {
+			return fmt.Errorf("sun_azimuth not specified")
+		}
+		env.SunAzimuth, err = floatFromInterface(azI)
+		if err != nil {
+			return fmt.Errorf("sun_azimuth: %w", err)
+		}
+	}
+
+	env.bakeSky()
+	return nil
+}
+
+func (env *Environment) parseSkyTime(dict map[string]interface{}, dateI interface{}) error {
+	dateS, ok := dateI.(string)
+	if !ok {
+		return fmt.Errorf("invalid date type")
+	}
+	timeI, found := dict["time"]
+	if !found {
+		return fmt.Errorf("time not specified")
+	}
+	timeS, ok := timeI.(string)
+	if !ok {
+		return fmt.Errorf("invalid time type")
+	}
+
+	var err error
+	// hours east of UTC
+	timezone := float32(0.0)
+	if tzI, found := dict["timezone"]; found {
+		timezone, err = floatFromInterface(tzI)
+		if err != nil {
+			return fmt.Errorf("timezone: %w", err)
+		}
+	}
+	zone := time.FixedZone("", int(timezone*3600.0))
+	env.Time, err = time.ParseInLocation(skyDateLayout+" "+skyTimeLayout, dateS+" "+timeS, zone)
+	if err != nil {
+		return fmt.Errorf("date and time: %w", err)
+	}
+
+	latI, found := dict["latitude"]
+	if !found {
+		return fmt.Errorf("latitude not specified")
+	}
+	env.Latitude, err = floatFromInterface(latI)
+	if err != nil {
+		return fmt.Errorf("latitude: %w", err)
+	}
+	if env.Latitude < -90.0 || env.Latitude > 90.0 {
+		return fmt.Errorf("latitude must be in range [-90, 90]")
+	}
+
+	lonI, found := dict["longitude"]
+	if !found {
+		return fmt.Errorf("longitude not specified")
+	}
+	env.Longitude, err = floatFromInterface(lonI)
+	if err != nil {
+		return fmt.Errorf("longitude: %w", err)
+	}
+	return nil
+}
+
+// bakeSky computes the position of the sun (if the time is set) and renders the sky into the image
+func (env *Environment) bakeSky() {
+	if !env.Time.IsZero() {
+		env.SunElevation, env.SunAzimuth = SunPosition(env.Time, float64(env.Latitude), float64(env.Longitude))
+	}
+	ground := mgl.Vec3{uiToF(env.Ground.R), uiToF(env.Ground.G), uiToF(env.Ground.B)}
+	env.Image = skyImage(float64(env.Turbidity), env.SunDirection(), ground)
+}
+
+// SunDirection returns the direction to the sun of the sky
+func (env Environment) SunDirection() mgl.Vec3 {
+	return SunDirection(env.SunElevation, env.SunAzimuth)
+}
+
+// SunLight returns the directional light of the sun of the sky
+// (false if the environment is not a sky or the sun is below the horizon)
+func (env Environment) SunLight() (Light, bool) {
+	if env.Kind != Sky {
+		return Light{}, false
+	}
+	e := sunIlluminance(float64(env.Turbidity), env.SunDirection()).Mul(env.Intensity)
+	m := float32(math.Max(float64(e.X()), math.Max(float64(e.Y()), float64(e.Z()))))
+	if m <= 0.0 {
+		return Light{}, false
+	}
+	// the brightest channel is 0xff, so the intensity is its illuminance
+	clr := color.RGBA{uint8(e.X()/m*0xff + 0.5), uint8(e.Y()/m*0xff + 0.5), uint8(e.Z()/m*0xff + 0.5), 0xff}
+	return NewDirectionalLight(clr, m, env.SunDirection().Mul(-1.0)), true
+}
+
+// SunDisk returns the radiance of the visible sun disk (zero if there is no sun)
+// and the cosine of its angular radius
+func (env Environment) SunDisk() (mgl.Vec3, float32) {
+	cosRadius := math.Cos(sunAngularRadius * math.Pi / 180.0)
+	if env.Kind != Sky {
+		return mgl.Vec3{}, float32(cosRadius)
+	}
+	solidAngle := 2.0 * math.Pi * (1.0 - cosRadius)
+	e := sunIlluminance(float64(env.Turbidity), env.SunDirection())
+	return e.Mul(env.Intensity / float32(solidAngle)), float32(cosRadius)
+}
+
+func (env Environment) MarshalJSON() ([]byte, error) {
+	switch env.Kind {
+	case Gradient:
+		return json.Marshal(struct {
+			Kind   string `json:"kind"`
+			Bottom string `json:"bottom"`
+			Top    string `json:"top"`
+		}{"gradient", colorToHex(env.Bottom), colorToHex(env.Top)})
+	case EnvironmentMap:
+		if env.File == "" {
+			return nil, fmt.Errorf("environment map without a file cannot be saved")
+		}
+		return json.Marshal(struct {
+			Kind      string  `json:"kind"`
+			File      string  `json:"file"`
+			Rotation  float32 `json:"rotation"`
+			Intensity float32 `json:"intensity"`
+		}{"map", env.File, env.Rotation, env.Intensity})
+	case Sky:
+		if env.Time.IsZero() {
+			return json.Marshal(struct {
+				Kind         string  `json:"kind"`
+				Turbidity    float32 `json:"turbidity"`
+				Intensity    float32 `json:"intensity"`
+				Ground       string  `json:"ground"`
+				SunElevation float32 `json:"sun_elevation"`
+				SunAzimuth   float32 `json:"sun_azimuth"`
+			}{"sky", env.Turbidity, env.Intensity, colorToHex(env.Ground), env.SunElevation, env.SunAzimuth})
+		}
+		_, offset := env.Time.Zone()
+		return json.Marshal(struct {
+			Kind      string  `json:"kind"`
+			Turbidity float32 `json:"turbidity"`
+			Intensity float32 `json:"intensity"`
+			Ground    string  `json:"ground"`
+			Date      string  `json:"date"`
+			Time      string  `json:"time"`
+			Timezone  float32 `json:"timezone"`
+			Latitude  float32 `json:"latitude"`
+			Longitude float32 `json:"longitude"`
+		}{
+			"sky", env.Turbidity, env.Intensity, colorToHex(env.Ground),
+			env.Time.Format(skyDateLayout), env.Time.Format(skyTimeLayout), float32(offset) / 3600.0,
+			env.Latitude, env.Longitude,
+		})
+	default:
+		return nil, fmt.Errorf("unknown kind: %d", env.Kind)
+	}
+}
+
+// SamplingCDF returns the distribution the environment map is importance sampled
+// with: the cumulative distribution of the rows of the image (Height values)
+// followed by the cumulative distributions of the texels of every row
+// (Width values each). Texels are weighted by their solid angle and the highest
+// luminance around them, since the filtered colors inside a texel depend on its
+// neighbours. Returns nil if the environment has no image or the image is black
+func (env Environment) SamplingCDF() []float32 {
+	img := env.Image
+	if env.Kind == Gradient || img == nil || img.Width == 0 || img.Height == 0 {
+		return nil
+	}
+
+	w, h := img.Width, img.Height
+	luminance := make([]float64, w*h)
+	total := 0.0
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := img.At(x, y)
+			l := 0.2126*float64(c.X()) + 0.7152*float64(c.Y()) + 0.0722*float64(c.Z())
+			luminance[y*w+x] = l
+			total += l
+		}
+	}
+	if total <= 0.0 {
+		return nil
+	}
+	// same wrapping as in the shader
+	neighbourhoodMax := func(x, y int) float64 {
+		m := 0.0
+		for dy := -1; dy <= 1; dy++ {
+			ny := y + dy
+			if ny < 0 || ny >= h {
+				continue
+			}
+			for dx := -1; dx <= 1; dx++ {
+				nx := (x + dx + w) % w
+				m = math.Max(m, luminance[ny*w+nx])
+			}
+		}
+		return m
+	}
+
+	cdf := make([]float32, h+w*h)
+	rows := make([]float64, h)
+	total = 0.0
+	for y := 0; y < h; y++ {
+		sinTheta := math.Sin(math.Pi * (float64(y) + 0.5) / float64(h))
+		row := cdf[h+y*w : h+(y+1)*w]
+		sum := 0.0
+		for x := range row {
+			sum += neighbourhoodMax(x, y) * sinTheta
+			row[x] = float32(sum)
+		}
+		if sum > 0.0 {
+			for x := range row {
+				row[x] /= float32(sum)
+			}
+		}
+		row[len(row)-1] = 1.0
+		total += sum
+		rows[y] = total
+	}
+	for y := range rows {
+		cdf[y] = float32(rows[y] / total)
+	}
+	cdf[h-1] = 1.0
+	return cdf
+}
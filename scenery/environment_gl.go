@@ -0,0 +1,44 @@
+//go:build cgo
+// +build cgo
+
+package scenery
+
+import (
+	"github.com/go-gl/gl/v4.6-core/gl"
+	mgl "github.com/go-gl/mathgl/mgl32"
+
+	"github.com/xopoww/go-raytrace/glutils"
+)
+
+// SetUniforms sets the environment uniforms of the program. The program must be in use.
+// The image of the map and its sampling distribution are uploaded with the other scene
+// data by SceneBuffers, sampled tells if there is a distribution (see SceneBuffers.EnvironmentSampled)
+func (env Environment) SetUniforms(program uint32, sampled bool) {
+	gl.Uniform1ui(glutils.MustGetUniformLocation(program, "env_kind"), uint32(env.Kind))
+
+	bottom := glutils.MustGetUniformLocation(program, "bg_bottom")
+	top := glutils.MustGetUniformLocation(program, "bg_top")
+	gl.Uniform3f(bottom, uiToF(env.Bottom.R), uiToF(env.Bottom.G), uiToF(env.Bottom.B))
+	gl.Uniform3f(top, uiToF(env.Top.R), uiToF(env.Top.G), uiToF(env.Top.B))
+
+	var width, height int32
+	if env.Image != nil {
+		width, height = int32(env.Image.Width), int32(env.Image.Height)
+	}
+	gl.Uniform1i(glutils.MustGetUniformLocation(program, "env_width"), width)
+	gl.Uniform1i(glutils.MustGetUniformLocation(program, "env_height"), height)
+	gl.Uniform1f(glutils.MustGetUniformLocation(program, "env_rotation"), mgl.DegToRad(env.Rotation))
+	gl.Uniform1f(glutils.MustGetUniformLocation(program, "env_intensity"), env.Intensity)
+
+	sunDir := env.SunDirection()
+	sunRadiance, sunCosRadius := env.SunDisk()
+	gl.Uniform3f(glutils.MustGetUniformLocation(program, "sun_dir"), sunDir.X(), sunDir.Y(), sunDir.Z())
+	gl.Uniform3f(glutils.MustGetUniformLocation(program, "sun_radiance"), sunRadiance.X(), sunRadiance.Y(), sunRadiance.Z())
+	gl.Uniform1f(glutils.MustGetUniformLocation(program, "sun_cos_radius"), sunCosRadius)
+
+	sampling := int32(0)
+	if sampled {
+		sampling = 1
+	}
+	gl.Uniform1i(glutils.MustGetUniformLocation(program, "env_sampling"), sampling)
+}
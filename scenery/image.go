@@ -0,0 +1,204 @@
+package scenery
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	mgl "github.com/go-gl/mathgl/mgl32"
+)
+
+// Image is an RGB image with float channels (e.g. an HDR environment map).
+// Rows go from top to bottom
+type Image struct {
+	Width  int
+	Height int
+	// 3 values per pixel
+	Pix []float32
+}
+
+func (img *Image) At(x, y int) mgl.Vec3 {
+	i := 3 * (y*img.Width + x)
+	return mgl.Vec3{img.Pix[i], img.Pix[i+1], img.Pix[i+2]}
+}
+
+// NewImage converts the image to floats, 8-bit channels are mapped to [0, 1]
+func NewImage(src image.Image) *Image {
+	bounds := src.Bounds()
+	img := &Image{
+		Width:  bounds.Dx(),
+		Height: bounds.Dy(),
+		Pix:    make([]float32, 0, 3*bounds.Dx()*bounds.Dy()),
+	}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := src.At(x, y).RGBA()
+			img.Pix = append(img.Pix, float32(r)/0xffff, float32(g)/0xffff, float32(b)/0xffff)
+		}
+	}
+	return img
+}
+
+// LoadImage reads a Radiance HDR (.hdr), PNG or JPEG image
+func LoadImage(path string) (*Image, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if strings.ToLower(filepath.Ext(path)) == ".hdr" {
+		return ReadHDR(file)
+	}
+	src, _, err := image.Decode(file)
+	if err != nil {
+		return nil, err
+	}
+	return NewImage(src), nil
+}
+
+// ReadHDR decodes an image in the Radiance RGBE format, both flat
+// and run-length encoded. Only the standard orientation (-Y H +X W) is supported
+func ReadHDR(r io.Reader) (*Image, error) {
+	br := bufio.NewReader(r)
+
+	magic, err := br.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("header: %w", err)
+	}
+	if !strings.HasPrefix(magic, "#?") {
+		return nil, fmt.Errorf("not a Radiance HDR file")
+	}
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("header: %w", err)
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, "FORMAT=") && line != "FORMAT=32-bit_rle_rgbe" {
+			return nil, fmt.Errorf("unsupported format: %s", strings.TrimPrefix(line, "FORMAT="))
+		}
+	}
+
+	resolution, err := br.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("resolution: %w", err)
+	}
+	var width, height int
+	if _, err := fmt.Sscanf(resolution, "-Y %d +X %d", &height, &width); err != nil {
+		return nil, fmt.Errorf("unsupported resolution string %q", strings.TrimSpace(resolution))
+	}
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("invalid resolution %dx%d", width, height)
+	}
+
+	img := &Image{
+		Width:  width,
+		Height: height,
+		Pix:    make([]float32, 0, 3*width*height),
+	}
+	scanline := make([][4]byte, width)
+	for y := 0; y < height; y++ {
+		if err := readHDRScanline(br, scanline); err != nil {
+			return nil, fmt.Errorf("scanline %d: %w", y, err)
+		}
+		for _, rgbe := range scanline {
+			if rgbe[3] == 0 {
+				img.Pix = append(img.Pix, 0.0, 0.0, 0.0)
+				continue
+			}
+			f := float32(math.Ldexp(1.0, int(rgbe[3])-(128+8)))
+			img.Pix = append(img.Pix, float32(rgbe[0])*f, float32(rgbe[1])*f, float32(rgbe[2])*f)
+		}
+	}
+	return img, nil
+}
+
+func readHDRScanline(br *bufio.Reader, scanline [][4]byte) error {
+	width := len(scanline)
+	var first [4]byte
+	if _, err := io.ReadFull(br, first[:]); err != nil {
+		return err
+	}
+
+	if width < 8 || width > 0x7fff || first[0] != 2 || first[1] != 2 || first[2]&0x80 != 0 {
+		// flat scanline, possibly with old-style runs (pixels 1,1,1,n repeat
+		// the previous pixel n << shift times)
+		shift := uint(0)
+		for x := 0; x < width; {
+			var px [4]byte
+			if x == 0 && shift == 0 {
+				px = first
+			} else if _, err := io.ReadFull(br, px[:]); err != nil {
+				return err
+			}
+			if px[0] == 1 && px[1] == 1 && px[2] == 1 && x > 0 {
+				count := int(px[3]) << shift
+				if x+count > width {
+					return fmt.Errorf("run overflows the scanline")
+				}
+				for k := 0; k < count; k++ {
+					scanline[x] = scanline[x-1]
+					x++
+				}
+				shift += 8
+				continue
+			}
+			scanline[x] = px
+			x++
+			shift = 0
+		}
+		return nil
+	}
+
+	if int(first[2])<<8|int(first[3]) != width {
+		return fmt.Errorf("scanline width mismatch")
+	}
+	// new-style RLE: the four channels are encoded one after another
+	for c := 0; c < 4; c++ {
+		for x := 0; x < width; {
+			count, err := br.ReadByte()
+			if err != nil {
+				return err
+			}
+			if count > 128 {
+				n := int(count) - 128
+				value, err := br.ReadByte()
+				if err != nil {
+					return err
+				}
+				if x+n > width {
+					return fmt.Errorf("run overflows the scanline")
+				}
+				for k := 0; k < n; k++ {
+					scanline[x][c] = value
+					x++
+				}
+				continue
+			}
+			n := int(count)
+			if n == 0 || x+n > width {
+				return fmt.Errorf("invalid run length")
+			}
+			for k := 0; k < n; k++ {
+				value, err := br.ReadByte()
+				if err != nil {
+					return err
+				}
+				scanline[x][c] = value
+				x++
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package scenery
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// hdrFile returns a Radiance HDR file with the given scanline data
+func hdrFile(width, height int, data []byte) []byte {
+	header := fmt.Sprintf("#?RADIANCE\nFORMAT=32-bit_rle_rgbe\n\n-Y %d +X %d\n", height, width)
+	return append([]byte(header), data...)
+}
+
+func checkPixels(t *testing.T, name string, img *Image, want []float32) {
+	t.Helper()
+	if len(img.Pix) != len(want) {
+		t.Fatalf("%s: %d values, want %d", name, len(img.Pix), len(want))
+	}
+	for i := range want {
+		if img.Pix[i] != want[i] {
+			t.Errorf("%s: value %d (pixel %d) = %v, want %v", name, i, i/3, img.Pix[i], want[i])
+		}
+	}
+}
+
+func TestReadHDRFlat(t *testing.T) {
+	// exponent 129 scales the mantissas by 2^(129-136) = 1/128
+	data := []byte{
+		128, 64, 32, 129, 0, 0, 0, 0,
+		255, 255, 255, 130, 16, 8, 4, 125,
+	}
+	img, err := ReadHDR(bytes.NewReader(hdrFile(2, 2, data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Width != 2 || img.Height != 2 {
+		t.Fatalf("size %dx%d, want 2x2", img.Width, img.Height)
+	}
+	checkPixels(t, "flat", img, []float32{
+		1, 0.5, 0.25, 0, 0, 0,
+		255.0 / 64, 255.0 / 64, 255.0 / 64, 16.0 / 2048, 8.0 / 2048, 4.0 / 2048,
+	})
+}
+
+func TestReadHDROldStyleRuns(t *testing.T) {
+	// 1, 1, 1, n repeats the previous pixel n times
+	data := []byte{128, 0, 0, 129, 1, 1, 1, 2, 0, 128, 0, 129}
+	img, err := ReadHDR(bytes.NewReader(hdrFile(4, 1, data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPixels(t, "old-style runs", img, []float32{1, 0, 0, 1, 0, 0, 1, 0, 0, 0, 1, 0})
+}
+
+func TestReadHDRRunLength(t *testing.T) {
+	// every channel of the 8 pixel wide scanline is encoded separately,
+	// counts above 128 are runs of the next byte, others are followed by literal bytes
+	scanline := []byte{2, 2, 0, 8}
+	scanline = append(scanline, 128+8, 128)
+	scanline = append(scanline, 8, 0, 16, 32, 48, 64, 80, 96, 112)
+	scanline = append(scanline, 128+4, 64, 4, 1, 2, 3, 4)
+	scanline = append(scanline, 128+8, 129)
+	img, err := ReadHDR(bytes.NewReader(hdrFile(8, 2, append(append([]byte{}, scanline...), scanline...))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var row []float32
+	for x := 0; x < 8; x++ {
+		b := float32(64)
+		if x >= 4 {
+			b = float32(x - 3)
+		}
+		row = append(row, 1, float32(16*x)/128, b/128)
+	}
+	checkPixels(t, "run-length encoded", img, append(append([]float32{}, row...), row...))
+}
+
+func TestReadHDRErrors(t *testing.T) {
+	flat := hdrFile(2, 2, []byte{128, 64, 32, 129, 0, 0, 0, 0, 255, 255, 255, 130, 16, 8, 4, 125})
+	rle := hdrFile(8, 1, []byte{2, 2, 0, 8, 128 + 8, 128, 128 + 8, 0, 128 + 8, 0, 128 + 8, 129})
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"not an HDR file", []byte("P6\n2 2\n255\n")},
+		{"unsupported format", []byte("#?RADIANCE\nFORMAT=32-bit_rle_xyze\n\n-Y 1 +X 1\n\x80\x80\x80\x81")},
+		{"unsupported orientation", []byte("#?RADIANCE\n\n+Y 1 +X 1\n\x80\x80\x80\x81")},
+		{"zero size", hdrFile(0, 1, nil)},
+		{"wrong scanline width", hdrFile(8, 1, []byte{2, 2, 0, 9, 128 + 8, 128, 128 + 8, 0, 128 + 8, 0, 128 + 8, 129})},
+		{"run overflows the scanline", hdrFile(8, 1, []byte{2, 2, 0, 8, 128 + 9, 128, 128 + 8, 0, 128 + 8, 0, 128 + 8, 129})},
+		{"zero run length", hdrFile(8, 1, []byte{2, 2, 0, 8, 0, 128 + 8, 128, 128 + 8, 0, 128 + 8, 0, 128 + 8, 129})},
+		{"old-style run overflows the scanline", hdrFile(2, 1, []byte{128, 0, 0, 129, 1, 1, 1, 2})},
+	} {
+		if _, err := ReadHDR(bytes.NewReader(tc.data)); err == nil {
+			t.Errorf("%s: no error", tc.name)
+		}
+	}
+
+	// every truncation of a valid file must be reported, not read as a smaller image
+	for name, data := range map[string][]byte{"flat": flat, "run-length encoded": rle} {
+		if _, err := ReadHDR(bytes.NewReader(data)); err != nil {
+			t.Fatalf("%s: the complete file can not be read: %v", name, err)
+		}
+		for n := 0; n < len(data); n++ {
+			if _, err := ReadHDR(bytes.NewReader(data[:n])); err == nil {
+				t.Errorf("%s truncated to %d bytes of %d: no error", name, n, len(data))
+			}
+		}
+	}
+}
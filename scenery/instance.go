@@ -0,0 +1,106 @@
+package scenery
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// Instances place copies of the prototype objects in the scene. The prototypes are
+// stored once (they are not in Scene.Data), and so are their geometry and material
+// in the shader buffers: the objects of the instances only differ by the transform.
+// Instances are indexed after all the other objects, in the order they were added
+
+type Instance struct {
+	Prototype string `json:"instance"`
+	// applied after the transform of the prototype (nil if there is none)
+	Transform *Transform `json:"transform,omitempty"`
+	// overrides the name of the prototype if not empty
+	Name string `json:"name,omitempty"`
+}
+
+func NewInstance(prototype string, transform *Transform) Instance {
+	return Instance{
+		Prototype: prototype,
+		Transform: transform,
+	}
+}
+
+// AddPrototype adds (or replaces) the prototype with given name
+func (s *Scene) AddPrototype(name string, o Object) {
+	if s.Prototypes == nil {
+		s.Prototypes = make(map[string]*Object)
+	}
+	s.Prototypes[name] = &o
+}
+
+func (s *Scene) AddInstance(i Instance) error {
+	if _, found := s.Prototypes[i.Prototype]; !found {
+		return fmt.Errorf("unknown prototype: %q", i.Prototype)
+	}
+	s.Instances = append(s.Instances, i)
+	return nil
+}
+
+// InstanceObject returns the object placed in the scene by the instance
+func (s *Scene) InstanceObject(i Instance) Object {
+	o := *s.Prototypes[i.Prototype]
+	if i.Transform != nil {
+		m := i.Transform.ToWorld().Mul4(o.Transform.ToWorld())
+		o.Transform = &Transform{Matrix: &m}
+	}
+	if i.Name != "" {
+		o.Name = i.Name
+	}
+	return o
+}
+
+// ownObjects returns the objects stored in the scene: the ones from Data
+// followed by the prototypes (sorted by their names)
+func (s *Scene) ownObjects() []*Object {
+	result := make([]*Object, 0)
+	for body := range s.Data {
+		objects := s.Data[body].Objects
+		for i := range objects {
+			result = append(result, &objects[i])
+		}
+	}
+	names := make([]string, 0, len(s.Prototypes))
+	for name := range s.Prototypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		result = append(result, s.Prototypes[name])
+	}
+	return result
+}
+
+// sceneEntry is an element of the array of objects in the scene file:
+// either an object or an instance of a prototype
+type sceneEntry struct {
+	Object   *Object
+	Instance *Instance
+}
+
+func (e *sceneEntry) UnmarshalJSON(data []byte) error {
+	var probe struct {
+		Instance *string `json:"instance"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return err
+	}
+	if probe.Instance != nil {
+		e.Instance = &Instance{}
+		return json.Unmarshal(data, e.Instance)
+	}
+	e.Object = &Object{}
+	return json.Unmarshal(data, e.Object)
+}
+
+func (e sceneEntry) MarshalJSON() ([]byte, error) {
+	if e.Instance != nil {
+		return json.Marshal(e.Instance)
+	}
+	return json.Marshal(e.Object)
+}
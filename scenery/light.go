@@ -0,0 +1,225 @@
+package scenery
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"math"
+
+	mgl "github.com/go-gl/mathgl/mgl32"
+)
+
+// Lights are point-like or infinitely distant light sources. They are not
+// visible themselves and are only found by the shadow rays cast from the
+// surfaces of lambertian objects (next-event estimation)
+
+type LightKind int
+
+const (
+	PointLight LightKind = iota
+	// point light shining into a cone
+	SpotLight
+	// infinitely distant light, e.g. the sun
+	DirectionalLight
+)
+
+type Light struct {
+	Kind  LightKind
+	Color color.RGBA
+	// point and spot lights: radiant intensity, the irradiance at distance d is Intensity / d^2;
+	// directional lights: irradiance
+	Intensity float32
+
+	// point and spot lights
+	Position mgl.Vec3
+	// spot and directional lights: the direction the light travels in
+	Direction mgl.Vec3
+	// spot lights: half-angles of the cone in degrees. The light is at full
+	// intensity inside the inner cone and fades out towards the outer one
+	InnerAngle float32
+	OuterAngle float32
+}
+
+func floatFromInterface(i interface{}) (float32, error) {
+	f, ok := i.(float64)
+	if !ok {
+		return 0.0, fmt.Errorf("invalid type")
+	}
+	return float32(f), nil
+}
+
+func (l *Light) UnmarshalJSON(data []byte) error {
+	dict := make(map[string]interface{})
+	err := json.Unmarshal(data, &dict)
+	if err != nil {
+		return err
+	}
+
+	kindI, found := dict["kind"]
+	if !found {
+		return fmt.Errorf("kind not specified")
+	}
+	kindS, ok := kindI.(string)
+	if !ok {
+		return fmt.Errorf("invalid kind type")
+	}
+	switch kindS {
+	case "point":
+		l.Kind = PointLight
+	case "spot":
+		l.Kind = SpotLight
+	case "directional":
+		l.Kind = DirectionalLight
+	default:
+		return fmt.Errorf("unknown kind: %s", kindS)
+	}
+
+	l.Color = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	if clrI, found := dict["color"]; found {
+		l.Color, err = colorFromInterface(clrI)
+		if err != nil {
+			return fmt.Errorf("color: %w", err)
+		}
+	}
+
+	intI, found := dict["intensity"]
+	if !found {
+		return fmt.Errorf("intensity not specified")
+	}
+	l.Intensity, err = floatFromInterface(intI)
+	if err != nil {
+		return fmt.Errorf("intensity: %w", err)
+	}
+	if l.Intensity < 0.0 {
+		return fmt.Errorf("intensity must be positive")
+	}
+
+	if l.Kind != DirectionalLight {
+		posI, found := dict["position"]
+		if !found {
+			return fmt.Errorf("position not specified")
+		}
+		pos, err := vec3FromInterface(posI)
+		if err != nil {
+			return fmt.Errorf("position: %w", err)
+		}
+		l.Position = mgl.Vec3{pos[0], pos[1], pos[2]}
+	}
+
+	if l.Kind != PointLight {
+		dirI, found := dict["direction"]
+		if !found {
+			return fmt.Errorf("direction not specified")
+		}
+		dir, err := vec3FromInterface(dirI)
+		if err != nil {
+			return fmt.Errorf("direction: %w", err)
+		}
+		l.Direction = mgl.Vec3{dir[0], dir[1], dir[2]}
+		if l.Direction.Len() == 0.0 {
+			return fmt.Errorf("direction must not be zero")
+		}
+		l.Direction = normalizeLoaded(l.Direction)
+	}
+
+	if l.Kind == SpotLight {
+		outerI, found := dict["outer_angle"]
+		if !found {
+			return fmt.Errorf("outer_angle not specified")
+		}
+		l.OuterAngle, err = floatFromInterface(outerI)
+		if err != nil {
+			return fmt.Errorf("outer_angle: %w", err)
+		}
+		if l.OuterAngle <= 0.0 || l.OuterAngle > 180.0 {
+			return fmt.Errorf("outer_angle must be in range (0, 180]")
+		}
+
+		l.InnerAngle = l.OuterAngle
+		if innerI, found := dict["inner_angle"]; found {
+			l.InnerAngle, err = floatFromInterface(innerI)
+			if err != nil {
+				return fmt.Errorf("inner_angle: %w", err)
+			}
+			if l.InnerAngle < 0.0 || l.InnerAngle > l.OuterAngle {
+				return fmt.Errorf("inner_angle must be in range [0, outer_angle]")
+			}
+		}
+	}
+
+	return nil
+}
+
+func (l Light) MarshalJSON() ([]byte, error) {
+	clrS := colorToHex(l.Color)
+	switch l.Kind {
+	case PointLight:
+		return json.Marshal(struct {
+			Kind      string   `json:"kind"`
+			Color     string   `json:"color"`
+			Intensity float32  `json:"intensity"`
+			Position  mgl.Vec3 `json:"position"`
+		}{"point", clrS, l.Intensity, l.Position})
+	case SpotLight:
+		return json.Marshal(struct {
+			Kind       string   `json:"kind"`
+			Color      string   `json:"color"`
+			Intensity  float32  `json:"intensity"`
+			Position   mgl.Vec3 `json:"position"`
+			Direction  mgl.Vec3 `json:"direction"`
+			InnerAngle float32  `json:"inner_angle"`
+			OuterAngle float32  `json:"outer_angle"`
+		}{"spot", clrS, l.Intensity, l.Position, l.Direction, l.InnerAngle, l.OuterAngle})
+	case DirectionalLight:
+		return json.Marshal(struct {
+			Kind      string   `json:"kind"`
+			Color     string   `json:"color"`
+			Intensity float32  `json:"intensity"`
+			Direction mgl.Vec3 `json:"direction"`
+		}{"directional", clrS, l.Intensity, l.Direction})
+	default:
+		return nil, fmt.Errorf("unknown kind: %d", l.Kind)
+	}
+}
+
+// Radiance returns the color of the light scaled by its intensity
+func (l Light) Radiance() mgl.Vec3 {
+	return mgl.Vec3{uiToF(l.Color.R), uiToF(l.Color.G), uiToF(l.Color.B)}.Mul(l.Intensity)
+}
+
+// CosAngles returns the cosines of the inner and outer angles of the spot light cone
+func (l Light) CosAngles() (inner, outer float32) {
+	inner = float32(math.Cos(float64(mgl.DegToRad(l.InnerAngle))))
+	outer = float32(math.Cos(float64(mgl.DegToRad(l.OuterAngle))))
+	return inner, outer
+}
+
+func NewPointLight(c color.RGBA, intensity float32, position mgl.Vec3) Light {
+	return Light{
+		Kind:      PointLight,
+		Color:     c,
+		Intensity: intensity,
+		Position:  position,
+	}
+}
+
+func NewSpotLight(c color.RGBA, intensity float32, position, direction mgl.Vec3, inner, outer float32) Light {
+	return Light{
+		Kind:       SpotLight,
+		Color:      c,
+		Intensity:  intensity,
+		Position:   position,
+		Direction:  direction.Normalize(),
+		InnerAngle: inner,
+		OuterAngle: outer,
+	}
+}
+
+func NewDirectionalLight(c color.RGBA, intensity float32, direction mgl.Vec3) Light {
+	return Light{
+		Kind:      DirectionalLight,
+		Color:     c,
+		Intensity: intensity,
+		Direction: direction.Normalize(),
+	}
+}
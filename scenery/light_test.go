@@ -0,0 +1,80 @@
+package scenery
+
+import (
+	"encoding/json"
+	"image/color"
+	"testing"
+
+	mgl "github.com/go-gl/mathgl/mgl32"
+)
+
+func TestUnmarshalLight(t *testing.T) {
+	white := color.RGBA{0xff, 0xff, 0xff, 0xff}
+	for _, tc := range []struct {
+		name string
+		json string
+		want Light
+	}{
+		{
+			name: "point",
+			json: `{"kind": "point", "color": "ff8000", "intensity": 20, "position": [1, 2, 3]}`,
+			want: NewPointLight(color.RGBA{0xff, 0x80, 0x00, 0xff}, 20, mgl.Vec3{1, 2, 3}),
+		},
+		{
+			name: "point with the default color",
+			json: `{"kind": "point", "intensity": 5, "position": [0, 4, 0]}`,
+			want: NewPointLight(white, 5, mgl.Vec3{0, 4, 0}),
+		},
+		{
+			name: "spot",
+			json: `{"kind": "spot", "intensity": 100, "position": [0, 5, 0], "direction": [0, -1, 0], "inner_angle": 10, "outer_angle": 30}`,
+			want: NewSpotLight(white, 100, mgl.Vec3{0, 5, 0}, mgl.Vec3{0, -1, 0}, 10, 30),
+		},
+		{
+			// the inner angle defaults to the outer one, the direction is normalized
+			name: "spot with the default inner angle",
+			json: `{"kind": "spot", "intensity": 100, "position": [0, 5, 0], "direction": [0, -2, 0], "outer_angle": 30}`,
+			want: NewSpotLight(white, 100, mgl.Vec3{0, 5, 0}, mgl.Vec3{0, -1, 0}, 30, 30),
+		},
+		{
+			name: "directional",
+			json: `{"kind": "directional", "color": "d0e0ff", "intensity": 1.5, "direction": [3, -4, 0]}`,
+			want: NewDirectionalLight(color.RGBA{0xd0, 0xe0, 0xff, 0xff}, 1.5, mgl.Vec3{0.6, -0.8, 0}),
+		},
+	} {
+		var l Light
+		if err := json.Unmarshal([]byte(tc.json), &l); err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if l.Direction.Sub(tc.want.Direction).Len() > 1e-6 {
+			t.Errorf("%s: direction %v, want %v", tc.name, l.Direction, tc.want.Direction)
+		}
+		l.Direction = tc.want.Direction
+		if l != tc.want {
+			t.Errorf("%s: %+v, want %+v", tc.name, l, tc.want)
+		}
+	}
+}
+
+func TestUnmarshalLightErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name, json string
+	}{
+		{"no kind", `{"intensity": 1, "position": [0, 0, 0]}`},
+		{"unknown kind", `{"kind": "area", "intensity": 1, "position": [0, 0, 0]}`},
+		{"no intensity", `{"kind": "point", "position": [0, 0, 0]}`},
+		{"negative intensity", `{"kind": "point", "intensity": -1, "position": [0, 0, 0]}`},
+		{"point without position", `{"kind": "point", "intensity": 1}`},
+		{"spot without direction", `{"kind": "spot", "intensity": 1, "position": [0, 0, 0], "outer_angle": 30}`},
+		{"spot without outer angle", `{"kind": "spot", "intensity": 1, "position": [0, 0, 0], "direction": [0, -1, 0]}`},
+		{"inner angle above the outer one", `{"kind": "spot", "intensity": 1, "position": [0, 0, 0], "direction": [0, -1, 0], "inner_angle": 40, "outer_angle": 30}`},
+		{"zero direction", `{"kind": "directional", "intensity": 1, "direction": [0, 0, 0]}`},
+		{"invalid color", `{"kind": "directional", "color": "white", "intensity": 1, "direction": [0, -1, 0]}`},
+	} {
+		var l Light
+		if err := json.Unmarshal([]byte(tc.json), &l); err == nil {
+			t.Errorf("%s: no error", tc.name)
+		}
+	}
+}
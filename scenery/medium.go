@@ -0,0 +1,108 @@
+package scenery
+
+import (
+	"encoding/json"
+	"fmt"
+
+	mgl "github.com/go-gl/mathgl/mgl32"
+)
+
+// Participating media absorb and scatter the light travelling through them,
+// e.g. the fog filling the scene or the smoke inside an object. The distance
+// at which the ray is scattered is sampled from the exponential distribution
+// (free-path sampling) and the new direction from the Henyey-Greenstein phase function
+
+type Medium struct {
+	// coefficients per unit of distance for the red, green and blue light:
+	// the light is attenuated by exp(-(Absorption + Scattering) * distance)
+	Absorption mgl.Vec3
+	Scattering mgl.Vec3
+	// asymmetry of the phase function in range (-1, 1): positive values
+	// scatter the light forward, negative ones back, 0 is isotropic
+	Anisotropy float32
+}
+
+func NewMedium(absorption, scattering mgl.Vec3, anisotropy float32) Medium {
+	return Medium{
+		Absorption: absorption,
+		Scattering: scattering,
+		Anisotropy: anisotropy,
+	}
+}
+
+// Extinction returns the coefficient the light is attenuated by
+func (m Medium) Extinction() mgl.Vec3 {
+	return m.Absorption.Add(m.Scattering)
+}
+
+// coefficientFromInterface parses the coefficient given either by a number
+// (the same for all colors) or by an array of 3 numbers
+func coefficientFromInterface(i interface{}) (mgl.Vec3, error) {
+	var result mgl.Vec3
+	if f, ok := i.(float64); ok {
+		result = mgl.Vec3{float32(f), float32(f), float32(f)}
+	} else {
+		v, err := vec3FromInterface(i)
+		if err != nil {
+			return mgl.Vec3{}, err
+		}
+		result = mgl.Vec3{v[0], v[1], v[2]}
+	}
+	if result.X() < 0.0 || result.Y() < 0.0 || result.Z() < 0.0 {
+		return mgl.Vec3{}, fmt.Errorf("must not be negative")
+	}
+	return result, nil
+}
+
+func (m *Medium) parse(dict map[string]interface{}) error {
+	*m = Medium{}
+	var err error
+	if absI, found := dict["absorption"]; found {
+		m.Absorption, err = coefficientFromInterface(absI)
+		if err != nil {
+			return fmt.Errorf("absorption: %w", err)
+		}
+	}
+	if scatI, found := dict["scattering"]; found {
+		m.Scattering, err = coefficientFromInterface(scatI)
+		if err != nil {
+			return fmt.Errorf("scattering: %w", err)
+		}
+	}
+	if m.Extinction() == (mgl.Vec3{}) {
+		return fmt.Errorf("neither absorption nor scattering specified")
+	}
+	if gI, found := dict["anisotropy"]; found {
+		m.Anisotropy, err = floatFromInterface(gI)
+		if err != nil {
+			return fmt.Errorf("anisotropy: %w", err)
+		}
+		if m.Anisotropy <= -1.0 || m.Anisotropy >= 1.0 {
+			return fmt.Errorf("anisotropy must be in range (-1, 1)")
+		}
+	}
+	return nil
+}
+
+func (m *Medium) UnmarshalJSON(data []byte) error {
+	dict := make(map[string]interface{})
+	err := json.Unmarshal(data, &dict)
+	if err != nil {
+		return err
+	}
+	return m.parse(dict)
+}
+
+type mediumJSON struct {
+	Absorption mgl.Vec3 `json:"absorption"`
+	Scattering mgl.Vec3 `json:"scattering"`
+	Anisotropy float32  `json:"anisotropy"`
+}
+
+func (m Medium) MarshalJSON() ([]byte, error) {
+	return json.Marshal(mediumJSON{m.Absorption, m.Scattering, m.Anisotropy})
+}
+
+func (m Medium) description() string {
+	return fmt.Sprintf("absorption = %v, scattering = %v, anisotropy = %f", m.Absorption, m.Scattering, m.Anisotropy)
+}
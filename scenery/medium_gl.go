@@ -0,0 +1,22 @@
+//go:build cgo
+// +build cgo
+
+package scenery
+
+import (
+	"github.com/go-gl/gl/v4.6-core/gl"
+
+	"github.com/xopoww/go-raytrace/glutils"
+)
+
+// SetFogUniforms sets the uniforms of the fog filling the bounding box of the scene
+// (zero coefficients if there is none). The program must be in use
+func (s *Scene) SetFogUniforms(program uint32) {
+	var fog Medium
+	if s.Fog != nil {
+		fog = *s.Fog
+	}
+	gl.Uniform3f(glutils.MustGetUniformLocation(program, "fog_absorption"), fog.Absorption.X(), fog.Absorption.Y(), fog.Absorption.Z())
+	gl.Uniform3f(glutils.MustGetUniformLocation(program, "fog_scattering"), fog.Scattering.X(), fog.Scattering.Y(), fog.Scattering.Z())
+	gl.Uniform1f(glutils.MustGetUniformLocation(program, "fog_anisotropy"), fog.Anisotropy)
+}
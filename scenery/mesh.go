@@ -0,0 +1,249 @@
+package scenery
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	mgl "github.com/go-gl/mathgl/mgl32"
+
+	"github.com/xopoww/go-raytrace/bvh"
+)
+
+type Triangle struct {
+	Vertices [3]mgl.Vec3
+	// per-vertex normals used for smooth shading
+	Normals [3]mgl.Vec3
+	// per-vertex texture coordinates (zero if the mesh has none)
+	UVs [3]mgl.Vec2
+}
+
+func (t Triangle) Bounds() bvh.AABB {
+	return bvh.NewAABB(t.Vertices[0], t.Vertices[1]).Extend(t.Vertices[2])
+}
+
+// FaceNormal returns the normal of the triangle plane (counter-clockwise winding)
+func (t Triangle) FaceNormal() mgl.Vec3 {
+	e1 := t.Vertices[1].Sub(t.Vertices[0])
+	e2 := t.Vertices[2].Sub(t.Vertices[0])
+	return e1.Cross(e2).Normalize()
+}
+
+type TriangleMesh struct {
+	// triangles in the order of the BVH leaves
+	Triangles []Triangle
+	// hierarchy over the triangles, its leaves refer to Triangles directly
+	BVH *bvh.BVH
+}
+
+// NewTriangleMesh builds the BVH over the triangles. The triangles are
+// reordered, so the mesh must be created again after changing them
+func NewTriangleMesh(triangles []Triangle) *TriangleMesh {
+	bounds := make([]bvh.AABB, len(triangles))
+	for i, t := range triangles {
+		bounds[i] = t.Bounds()
+	}
+	tree := bvh.Build(bounds)
+
+	m := &TriangleMesh{
+		Triangles: make([]Triangle, len(triangles)),
+		BVH:       tree,
+	}
+	for i, j := range tree.Indices {
+		m.Triangles[i] = triangles[j]
+		tree.Indices[i] = int32(i)
+	}
+	return m
+}
+
+func (m *TriangleMesh) Bounds() bvh.AABB {
+	if len(m.BVH.Nodes) == 0 {
+		return bvh.EmptyAABB()
+	}
+	return m.BVH.Nodes[0].Bounds()
+}
+
+// LoadOBJ reads a mesh from a Wavefront OBJ file. If flat is set, the vertex
+// normals are replaced with face normals
+func LoadOBJ(path string, flat bool) (*TriangleMesh, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	triangles, err := ReadOBJ(file)
+	if err != nil {
+		return nil, err
+	}
+	if flat {
+		for i := range triangles {
+			n := triangles[i].FaceNormal()
+			triangles[i].Normals = [3]mgl.Vec3{n, n, n}
+		}
+	}
+	return NewTriangleMesh(triangles), nil
+}
+
+// ReadOBJ parses the geometry from a Wavefront OBJ file: vertices, texture coordinates,
+// normals and polygonal faces (which are split into triangles). Other statements are ignored.
+// Vertices of the faces without normals get normals averaged over adjacent faces. Degenerate
+// (zero-area) faces are skipped
+func ReadOBJ(r io.Reader) ([]Triangle, error) {
+	type corner struct {
+		v, vt, vn int
+	}
+
+	var (
+		positions []mgl.Vec3
+		uvs       []mgl.Vec2
+		normals   []mgl.Vec3
+		faces     [][3]corner
+	)
+
+	// resolve 1-based (or negative, relative to the end) index
+	resolve := func(s string, n int) (int, error) {
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, err
+		}
+		if i < 0 {
+			i += n
+		} else {
+			i--
+		}
+		if i < 0 || i >= n {
+			return 0, fmt.Errorf("index %s out of range", s)
+		}
+		return i, nil
+	}
+
+	parseVec3 := func(fields []string) (mgl.Vec3, error) {
+		var v mgl.Vec3
+		if len(fields) < 3 {
+			return v, fmt.Errorf("expected 3 coordinates")
+		}
+		for i := 0; i < 3; i++ {
+			f, err := strconv.ParseFloat(fields[i], 32)
+			if err != nil {
+				return v, err
+			}
+			v[i] = float32(f)
+		}
+		return v, nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "v":
+			v, err := parseVec3(fields[1:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			positions = append(positions, v)
+		case "vt":
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("line %d: expected texture coordinates", lineNo)
+			}
+			// v defaults to 0, the third (depth) coordinate is ignored
+			var vt mgl.Vec2
+			for i := 0; i < 2 && i+1 < len(fields); i++ {
+				f, err := strconv.ParseFloat(fields[i+1], 32)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w", lineNo, err)
+				}
+				vt[i] = float32(f)
+			}
+			uvs = append(uvs, vt)
+		case "vn":
+			vn, err := parseVec3(fields[1:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			normals = append(normals, vn)
+		case "f":
+			if len(fields) < 4 {
+				return nil, fmt.Errorf("line %d: face must have at least 3 vertices", lineNo)
+			}
+			polygon := make([]corner, 0, len(fields)-1)
+			for _, field := range fields[1:] {
+				// v, v/vt, v//vn or v/vt/vn
+				parts := strings.Split(field, "/")
+				c := corner{vt: -1, vn: -1}
+				var err error
+				c.v, err = resolve(parts[0], len(positions))
+				if err == nil && len(parts) >= 2 && parts[1] != "" {
+					c.vt, err = resolve(parts[1], len(uvs))
+				}
+				if err == nil && len(parts) == 3 && parts[2] != "" {
+					c.vn, err = resolve(parts[2], len(normals))
+				}
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w", lineNo, err)
+				}
+				polygon = append(polygon, c)
+			}
+			for i := 1; i+1 < len(polygon); i++ {
+				faces = append(faces, [3]corner{polygon[0], polygon[i], polygon[i+1]})
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	triangles := make([]Triangle, 0, len(faces))
+	// degenerate (zero-area) faces have no normal and can not be hit, so they are skipped
+	kept := faces[:0]
+	// area-weighted sums of the normals of the faces adjacent to the vertices
+	vertexNormals := make([]mgl.Vec3, len(positions))
+	for _, face := range faces {
+		var t Triangle
+		for k, c := range face {
+			t.Vertices[k] = positions[c.v]
+			if c.vt >= 0 {
+				t.UVs[k] = uvs[c.vt]
+			}
+		}
+		e1 := t.Vertices[1].Sub(t.Vertices[0])
+		e2 := t.Vertices[2].Sub(t.Vertices[0])
+		n := e1.Cross(e2)
+		if n.Len() == 0.0 {
+			continue
+		}
+		for _, c := range face {
+			vertexNormals[c.v] = vertexNormals[c.v].Add(n)
+		}
+		triangles = append(triangles, t)
+		kept = append(kept, face)
+	}
+	for i, face := range kept {
+		for k, c := range face {
+			var n mgl.Vec3
+			if c.vn >= 0 {
+				n = normals[c.vn]
+			} else {
+				n = vertexNormals[c.v]
+			}
+			if n.Len() == 0.0 {
+				n = triangles[i].FaceNormal()
+			}
+			triangles[i].Normals[k] = n.Normalize()
+		}
+	}
+
+	return triangles, nil
+}
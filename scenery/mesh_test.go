@@ -0,0 +1,176 @@
+package scenery
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	mgl "github.com/go-gl/mathgl/mgl32"
+)
+
+func vecClose(a, b mgl.Vec3) bool {
+	return a.Sub(b).Len() <= 1e-5
+}
+
+func hasNaN(v mgl.Vec3) bool {
+	return math.IsNaN(float64(v.X())) || math.IsNaN(float64(v.Y())) || math.IsNaN(float64(v.Z()))
+}
+
+func TestReadOBJ(t *testing.T) {
+	up := mgl.Vec3{0, 0, 1}
+	for _, tc := range []struct {
+		name string
+		obj  string
+		// expected triangles (only the fields that are set are checked)
+		vertices [][3]mgl.Vec3
+		normals  [][3]mgl.Vec3
+		uvs      [][3]mgl.Vec2
+	}{
+		{
+			name: "positive indices",
+			obj: `v 0 0 0
+v 1 0 0
+v 0 1 0
+f 1 2 3`,
+			vertices: [][3]mgl.Vec3{{{0, 0, 0}, {1, 0, 0}, {0, 1, 0}}},
+			normals:  [][3]mgl.Vec3{{up, up, up}},
+		},
+		{
+			name: "negative indices",
+			obj: `v 5 5 5
+v 0 0 0
+v 1 0 0
+v 0 1 0
+f -3 -2 -1`,
+			vertices: [][3]mgl.Vec3{{{0, 0, 0}, {1, 0, 0}, {0, 1, 0}}},
+		},
+		{
+			name: "normals without texture coordinates",
+			obj: `v 0 0 0
+v 1 0 0
+v 0 1 0
+vn 1 0 0
+vn 0 2 0
+f 1//1 2//2 3//1`,
+			normals: [][3]mgl.Vec3{{{1, 0, 0}, {0, 1, 0}, {1, 0, 0}}},
+		},
+		{
+			name: "texture coordinates and normals",
+			obj: `v 0 0 0
+v 1 0 0
+v 0 1 0
+vt 0 0
+vt 1 0
+vt 0 1
+vn 0 0 1
+f 1/1/1 2/2/1 3/3/1`,
+			normals: [][3]mgl.Vec3{{up, up, up}},
+			uvs:     [][3]mgl.Vec2{{{0, 0}, {1, 0}, {0, 1}}},
+		},
+		{
+			name: "polygon fan",
+			obj: `v 0 0 0
+v 1 0 0
+v 1 1 0
+v 0 1 0
+v -1 1 0
+f 1 2 3 4 5`,
+			vertices: [][3]mgl.Vec3{
+				{{0, 0, 0}, {1, 0, 0}, {1, 1, 0}},
+				{{0, 0, 0}, {1, 1, 0}, {0, 1, 0}},
+				{{0, 0, 0}, {0, 1, 0}, {-1, 1, 0}},
+			},
+			normals: [][3]mgl.Vec3{{up, up, up}, {up, up, up}, {up, up, up}},
+		},
+		{
+			// the shared vertices get the average of the normals of the two faces
+			name: "missing normals",
+			obj: `v 0 0 0
+v 1 0 0
+v 0 1 0
+v 0 0 1
+f 1 2 3
+f 1 4 2`,
+			normals: [][3]mgl.Vec3{
+				{mgl.Vec3{0, 1, 1}.Normalize(), mgl.Vec3{0, 1, 1}.Normalize(), up},
+				{mgl.Vec3{0, 1, 1}.Normalize(), {0, 1, 0}, mgl.Vec3{0, 1, 1}.Normalize()},
+			},
+		},
+		{
+			name: "degenerate faces",
+			obj: `v 0 0 0
+v 1 0 0
+v 2 0 0
+v 0 1 0
+f 1 2 3
+f 1 1 4
+f 1 2 4`,
+			vertices: [][3]mgl.Vec3{{{0, 0, 0}, {1, 0, 0}, {0, 1, 0}}},
+			normals:  [][3]mgl.Vec3{{up, up, up}},
+		},
+		{
+			name: "comments and other statements",
+			obj: `# a triangle
+o triangle
+v 0 0 0 # origin
+v 1 0 0
+v 0 1 0
+usemtl default
+s off
+f 1 2 3`,
+			vertices: [][3]mgl.Vec3{{{0, 0, 0}, {1, 0, 0}, {0, 1, 0}}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			triangles, err := ReadOBJ(strings.NewReader(tc.obj))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, tri := range triangles {
+				for _, n := range tri.Normals {
+					if hasNaN(n) {
+						t.Errorf("NaN normal in %+v", tri)
+					}
+				}
+			}
+			n := len(tc.vertices)
+			if n == 0 {
+				n = len(tc.normals)
+			}
+			if len(triangles) != n {
+				t.Fatalf("%d triangles, want %d", len(triangles), n)
+			}
+			for i, tri := range triangles {
+				for k := 0; k < 3; k++ {
+					if tc.vertices != nil && !vecClose(tri.Vertices[k], tc.vertices[i][k]) {
+						t.Errorf("triangle %d, vertex %d = %v, want %v", i, k, tri.Vertices[k], tc.vertices[i][k])
+					}
+					if tc.normals != nil && !vecClose(tri.Normals[k], tc.normals[i][k]) {
+						t.Errorf("triangle %d, normal %d = %v, want %v", i, k, tri.Normals[k], tc.normals[i][k])
+					}
+					if tc.uvs != nil && tri.UVs[k] != tc.uvs[i][k] {
+						t.Errorf("triangle %d, uv %d = %v, want %v", i, k, tri.UVs[k], tc.uvs[i][k])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestReadOBJErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name, obj string
+	}{
+		{"index out of range", "v 0 0 0\nv 1 0 0\nv 0 1 0\nf 1 2 4"},
+		{"zero index", "v 0 0 0\nv 1 0 0\nv 0 1 0\nf 0 1 2"},
+		{"negative index out of range", "v 0 0 0\nv 1 0 0\nv 0 1 0\nf -4 -2 -1"},
+		{"normal out of range", "v 0 0 0\nv 1 0 0\nv 0 1 0\nvn 0 0 1\nf 1//1 2//2 3//1"},
+		{"too few vertices", "v 0 0 0\nv 1 0 0\nf 1 2"},
+		{"invalid coordinate", "v 0 x 0"},
+		{"missing coordinate", "v 0 0"},
+	} {
+		if _, err := ReadOBJ(strings.NewReader(tc.obj)); err == nil {
+			t.Errorf("%s: no error", tc.name)
+		}
+	}
+}
@@ -1,26 +1,59 @@
 package scenery
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"image/color"
 	"math"
 	"math/rand"
+	"path/filepath"
 
 	mgl "github.com/go-gl/mathgl/mgl32"
+
+	"github.com/xopoww/go-raytrace/bvh"
 )
 
+// Scene holds the objects grouped by the kind of their bodies (indexed by BodyKind).
+// The objects are indexed in the shader in the same order: all boxes, then all balls,
+// then all meshes, all volumes, all CSG bodies, all SDF bodies, all planes, all disks,
+// all cylinders, all cones, all capsules, all tori and then all instances
 type Scene struct {
-	Data [2]struct {
-		Num       uint32
-		Descs     []string
-		Colors    []string
-		Materials []MaterialKind
-		Fuzzs     []float32
-		Etas      []float32
-
-		Names []string
+	Data [12]struct {
+		Objects []Object
 	}
+	// objects placed by the instances (by name) and the instances themselves
+	Prototypes map[string]*Object
+	Instances  []Instance
+
+	// Camera and Render are nil unless set in the scene file
+	Camera      *Camera
+	Render      *RenderSettings
+	Environment Environment
+	Lights      []Light
+	// nil if the scene has no fog
+	Fog *Medium
+}
+
+// RenderSettings hold the quality settings of the shot. Zero values mean "not set"
+type RenderSettings struct {
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+
+	Depth        uint `json:"depth,omitempty"`
+	AntiAliasing uint `json:"anti_aliasing,omitempty"`
+	Samples      uint `json:"samples,omitempty"`
+}
+
+// sceneDocument is the object form of the scene file
+type sceneDocument struct {
+	Camera      *Camera            `json:"camera,omitempty"`
+	Render      *RenderSettings    `json:"render,omitempty"`
+	Environment *Environment       `json:"environment,omitempty"`
+	Lights      []Light            `json:"lights,omitempty"`
+	Fog         *Medium            `json:"fog,omitempty"`
+	Prototypes  map[string]*Object `json:"prototypes,omitempty"`
+	Objects     []sceneEntry       `json:"objects"`
 }
 
 func (s *Scene) GetObjectDesription(index int32) string {
@@ -28,74 +61,335 @@ func (s *Scene) GetObjectDesription(index int32) string {
 		return "nothing"
 	}
 
-	for body, data := range s.Data {
-		if index >= int32(data.Num) {
-			index -= int32(data.Num)
+	for _, data := range s.Data {
+		if index >= int32(len(data.Objects)) {
+			index -= int32(len(data.Objects))
 			continue
 		}
+		return objectDescription(data.Objects[index])
+	}
+	if index < int32(len(s.Instances)) {
+		inst := s.Instances[index]
+		return fmt.Sprintf("an instance of %q: %s", inst.Prototype, objectDescription(s.InstanceObject(inst)))
+	}
 
-		bodyS := [...]string{"box", "ball"}[body]
-		materialS := [...]string{"mirror", "lambertian", "glass"}[data.Materials[index]]
+	return "[invalid object index]"
+}
 
-		nameS := data.Names[index]
-		if nameS != "" {
-			nameS = "(" + nameS + ") "
-		}
+func objectDescription(obj Object) string {
+	bodyS := [...]string{"box", "ball", "mesh", "volume", "csg body", "sdf body", "plane", "disk", "cylinder", "cone", "capsule", "torus"}[obj.Body.Kind]
+	materialS := [...]string{"mirror", "lambertian", "glass", "emissive", "metal", "rough glass", "principled", "medium"}[obj.Material.Kind]
 
-		result := fmt.Sprintf("a %s %s %s(color = %s", materialS, bodyS, nameS, data.Colors[index])
-		if data.Materials[index] != Lambertian {
-			result += fmt.Sprintf(
-				", eta = %f, fuzz = %f",
-				data.Etas[index],
-				data.Fuzzs[index],
-			)
-		}
-		return result + ")"
+	nameS := obj.Name
+	if nameS != "" {
+		nameS = "(" + nameS + ") "
 	}
 
-	return "[invalid object index]"
+	result := fmt.Sprintf(
+		"a %s %s %s(color = %s", materialS, bodyS, nameS,
+		colorDescription(obj.Material.Color, obj.Material.ColorTexture),
+	)
+	roughnessS := valueDescription(obj.Material.Roughness, obj.Material.RoughnessTexture)
+	switch obj.Material.Kind {
+	case Mirror, Glass:
+		result += fmt.Sprintf(
+			", eta = %f, fuzz = %f",
+			obj.Material.Eta,
+			obj.Material.Fuzz,
+		)
+	case Emissive:
+		result += fmt.Sprintf(", intensity = %f", obj.Material.Intensity)
+	case Metal:
+		result += fmt.Sprintf(
+			", roughness = %s, anisotropy = %f, n = %v, k = %v",
+			roughnessS,
+			obj.Material.Anisotropy,
+			obj.Material.N,
+			obj.Material.K,
+		)
+	case RoughGlass:
+		result += fmt.Sprintf(
+			", roughness = %s, anisotropy = %f, eta = %f",
+			roughnessS,
+			obj.Material.Anisotropy,
+			obj.Material.Eta,
+		)
+	case Principled:
+		m := obj.Material
+		result += fmt.Sprintf(
+			", metallic = %f, roughness = %s, specular = %f, clearcoat = %f, sheen = %f, transmission = %f",
+			m.Metallic, roughnessS, m.Specular, m.Clearcoat, m.Sheen, m.Transmission,
+		)
+		if m.Intensity > 0.0 && m.Emission != (color.RGBA{0x00, 0x00, 0x00, 0xff}) {
+			result += fmt.Sprintf(", emission = %s * %f", colorToString(m.Emission), m.Intensity)
+		}
+	}
+	if obj.Material.NormalMap != nil {
+		result += ", normal map = " + mapDescription(obj.Material.NormalMap)
+	}
+	if obj.Material.Bump != nil {
+		result += ", bump = " + mapDescription(obj.Material.Bump)
+	}
+	if obj.Material.AbsorptionCoefficient() != (mgl.Vec3{}) {
+		result += fmt.Sprintf(
+			", absorption = %s per %f",
+			colorToString(obj.Material.Absorption),
+			obj.Material.AbsorptionDistance,
+		)
+	}
+	if obj.Material.Medium != nil {
+		result += ", medium: " + obj.Material.Medium.description()
+	}
+	switch obj.Body.Kind {
+	case Volume:
+		result += ", " + volumeDescription(obj.Body)
+	case CSG:
+		result += ", csg = " + obj.Body.csgDescription()
+	case SDF:
+		result += ", sdf = " + obj.Body.Shape.description()
+	case Plane:
+		result += fmt.Sprintf(", point = %v, normal = %v", obj.Body.Center, obj.Body.Normal)
+	case Disk:
+		result += fmt.Sprintf(", center = %v, normal = %v, radius = %f", obj.Body.Center, obj.Body.Normal, obj.Body.Radius)
+	case Cylinder, Capsule:
+		result += fmt.Sprintf(", start = %v, end = %v, radius = %f", obj.Body.Start, obj.Body.End, obj.Body.Radius)
+	case Cone:
+		result += fmt.Sprintf(
+			", start = %v, end = %v, radius = %f, end radius = %f",
+			obj.Body.Start, obj.Body.End, obj.Body.Radius, obj.Body.EndRadius,
+		)
+	case Torus:
+		result += fmt.Sprintf(", center = %v, radius = %f, thickness = %f", obj.Body.Center, obj.Body.Radius, obj.Body.Thickness)
+	}
+	if obj.Transform != nil {
+		result += ", transform: " + obj.Transform.description()
+	}
+	return result + ")"
 }
 
+// The scene file is either a plain array of objects or a document with optional camera,
+// render, environment, lights, fog and prototypes sections and an array of objects
 func (s *Scene) UnmarshalJSON(data []byte) error {
-	objects := make([]Object, 0)
-	err := json.Unmarshal(data, &objects)
+	doc := sceneDocument{Objects: make([]sceneEntry, 0)}
+	var err error
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(data, &doc.Objects)
+	} else {
+		err = json.Unmarshal(data, &doc)
+	}
 	if err != nil {
 		return err
 	}
 
-	for _, obj := range objects {
-		s.AddObject(obj)
+	// the scene is replaced, not merged with the objects it already has
+	for i := range s.Data {
+		s.Data[i].Objects = nil
+	}
+	s.Instances = nil
+
+	s.Camera = doc.Camera
+	s.Render = doc.Render
+	if doc.Environment != nil {
+		s.Environment = *doc.Environment
+	} else {
+		s.Environment = DefaultEnvironment()
+	}
+	s.Lights = doc.Lights
+	s.Fog = doc.Fog
+	s.Prototypes = doc.Prototypes
+	for name, proto := range s.Prototypes {
+		if proto == nil {
+			return fmt.Errorf("prototype %q: null", name)
+		}
+	}
+	for _, entry := range doc.Objects {
+		if entry.Instance == nil {
+			s.AddObject(*entry.Object)
+		} else if err := s.AddInstance(*entry.Instance); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// Scenes without camera, render, environment, lights, fog and prototypes sections are written as plain arrays
+func (s Scene) MarshalJSON() ([]byte, error) {
+	doc := sceneDocument{
+		Camera:     s.Camera,
+		Render:     s.Render,
+		Lights:     s.Lights,
+		Fog:        s.Fog,
+		Prototypes: s.Prototypes,
+		Objects:    make([]sceneEntry, 0),
+	}
+	for _, data := range s.Data {
+		for i := range data.Objects {
+			doc.Objects = append(doc.Objects, sceneEntry{Object: &data.Objects[i]})
+		}
+	}
+	for i := range s.Instances {
+		doc.Objects = append(doc.Objects, sceneEntry{Instance: &s.Instances[i]})
+	}
+	if s.Environment != DefaultEnvironment() {
+		env := s.Environment
+		doc.Environment = &env
+	}
+
+	if doc.Camera == nil && doc.Render == nil && doc.Environment == nil && len(doc.Lights) == 0 && doc.Fog == nil && len(doc.Prototypes) == 0 {
+		return json.Marshal(doc.Objects)
+	}
+	return json.Marshal(doc)
+}
+
 func NewScene() *Scene {
-	return &Scene{}
+	return &Scene{
+		Environment: DefaultEnvironment(),
+	}
+}
+
+func (s *Scene) AddLight(l Light) {
+	s.Lights = append(s.Lights, l)
+}
+
+// AllLights returns the lights of the scene followed by the sun of the sky (if there is one)
+func (s *Scene) AllLights() []Light {
+	sun, ok := s.Environment.SunLight()
+	if !ok {
+		return s.Lights
+	}
+	lights := make([]Light, 0, len(s.Lights)+1)
+	lights = append(lights, s.Lights...)
+	return append(lights, sun)
 }
 
 func (s *Scene) AddObject(o Object) {
-	s.Data[o.Body_.kind].Num++
-	s.Data[o.Body_.kind].Descs = append(s.Data[o.Body_.kind].Descs, o.Body_.desc)
-	s.Data[o.Body_.kind].Colors = append(s.Data[o.Body_.kind].Colors, colorToString(o.Material_.color))
-	s.Data[o.Body_.kind].Materials = append(s.Data[o.Body_.kind].Materials, o.Material_.kind)
-	s.Data[o.Body_.kind].Fuzzs = append(s.Data[o.Body_.kind].Fuzzs, o.Material_.fuzz)
-	s.Data[o.Body_.kind].Etas = append(s.Data[o.Body_.kind].Etas, o.Material_.eta)
-	s.Data[o.Body_.kind].Names = append(s.Data[o.Body_.kind].Names, o.Name)
+	s.Data[o.Body.Kind].Objects = append(s.Data[o.Body.Kind].Objects, o)
+}
+
+// BVH builds the bounding volume hierarchy over the objects of the scene
+// (indexed in the same order as in the shader)
+func (s *Scene) BVH() *bvh.BVH {
+	bounds := make([]bvh.AABB, 0)
+	for _, data := range s.Data {
+		for _, o := range data.Objects {
+			bounds = append(bounds, o.Bounds())
+		}
+	}
+	for _, i := range s.Instances {
+		bounds = append(bounds, s.InstanceObject(i).Bounds())
+	}
+	return bvh.Build(bounds)
+}
+
+// LoadAssets loads the files the scene refers to (e.g. the meshes, the density grids,
+// the image textures and the environment map). Relative paths are resolved against dir.
+// Objects with the same file share the loaded data
+func (s *Scene) LoadAssets(dir string) error {
+	resolve := func(path string) string {
+		if filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(dir, path)
+	}
+
+	if s.Environment.Kind == EnvironmentMap && s.Environment.Image == nil {
+		img, err := LoadImage(resolve(s.Environment.File))
+		if err != nil {
+			return fmt.Errorf("environment %q: %w", s.Environment.File, err)
+		}
+		s.Environment.Image = img
+	}
+
+	type meshKey struct {
+		path string
+		flat bool
+	}
+	meshes := make(map[meshKey]*TriangleMesh)
+
+	objects := s.ownObjects()
+	for _, o := range objects {
+		body := &o.Body
+		if body.Kind != Mesh || body.Mesh != nil {
+			continue
+		}
+		path := resolve(body.File)
+		key := meshKey{path, body.Flat}
+		if mesh, found := meshes[key]; found {
+			body.Mesh = mesh
+			continue
+		}
+		mesh, err := LoadOBJ(path, body.Flat)
+		if err != nil {
+			return fmt.Errorf("mesh %q: %w", body.File, err)
+		}
+		meshes[key] = mesh
+		body.Mesh = mesh
+	}
+
+	grids := make(map[string]*DensityGrid)
+	for _, o := range objects {
+		body := &o.Body
+		if body.Kind != Volume || body.Density != nil || body.Grid != nil {
+			continue
+		}
+		path := resolve(body.File)
+		if grid, found := grids[path]; found {
+			body.Grid = grid
+			continue
+		}
+		grid, err := LoadDensityGrid(path)
+		if err != nil {
+			return fmt.Errorf("volume %q: %w", body.File, err)
+		}
+		grids[path] = grid
+		body.Grid = grid
+	}
+
+	images := make(map[string]*Image)
+	for _, o := range objects {
+		m := o.Material
+		for _, t := range [...]*Texture{m.ColorTexture, m.RoughnessTexture, m.NormalMap, m.Bump} {
+			if t == nil || t.Kind != ImageTexture || t.Image != nil {
+				continue
+			}
+			path := resolve(t.File)
+			if img, found := images[path]; found {
+				t.Image = img
+				continue
+			}
+			img, err := LoadImage(path)
+			if err != nil {
+				return fmt.Errorf("texture %q: %w", t.File, err)
+			}
+			images[path] = img
+			t.Image = img
+		}
+	}
+	return nil
 }
 
-// TODO: fix field/type naming
 type Object struct {
-	Body_     Body     `json:"body"`
-	Material_ Material `json:"material"`
-	Name      string   `json:"name"`
+	Body     Body     `json:"body"`
+	Material Material `json:"material"`
+	Name     string   `json:"name,omitempty"`
+	// nil if the body is placed in the world as it is
+	Transform *Transform `json:"transform,omitempty"`
+}
+
+// Bounds returns the axis-aligned bounding box of the transformed body
+func (o Object) Bounds() bvh.AABB {
+	if o.Transform == nil {
+		return o.Body.Bounds()
+	}
+	return o.Body.Bounds().Transform(o.Transform.ToWorld())
 }
 
 func NewObject(body Body, material Material) Object {
 	return Object{
-		Body_:     body,
-		Material_: material,
-		Name:      "",
+		Body:     body,
+		Material: material,
+		Name:     "",
 	}
 }
 
@@ -107,17 +401,80 @@ const (
 	Mirror MaterialKind = iota
 	Lambertian
 	Glass
+	// emits light of its color, scaled by the intensity, and reflects nothing
+	Emissive
+	// rough conductor with the GGX distribution of microfacets
+	Metal
+	// rough glass with the GGX distribution of microfacets
+	RoughGlass
+	// combination of the above controlled by a few parameters
+	// (after the Disney principled BRDF)
+	Principled
+	// participating medium filling the body, which has no visible surface
+	Participating
 )
 
 func (mk MaterialKind) String() string {
-	return [...]string{"Mirror", "Lambertian", "Glass"}[mk] + "Material"
+	return [...]string{"Mirror", "Lambertian", "Glass", "Emissive", "Metal", "RoughGlass", "Principled", "Participating"}[mk] + "Material"
+}
+
+// complex indices of refraction (n + ik) of some metals for the red, green and blue light
+var metalPresets = map[string][2]mgl.Vec3{
+	"gold":      {{0.143, 0.374, 1.442}, {3.983, 2.385, 1.603}},
+	"copper":    {{0.200, 0.924, 1.102}, {3.912, 2.452, 2.142}},
+	"aluminium": {{1.657, 0.880, 0.521}, {9.224, 6.270, 4.837}},
+	"silver":    {{0.155, 0.117, 0.138}, {4.828, 3.122, 2.147}},
+	"iron":      {{2.912, 2.950, 2.585}, {3.089, 2.932, 2.767}},
+}
+
+// MetalPreset returns the complex index of refraction of the metal with given name
+// (gold, copper, aluminium, silver or iron)
+func MetalPreset(name string) (n, k mgl.Vec3, ok bool) {
+	ior, ok := metalPresets[name]
+	return ior[0], ior[1], ok
 }
 
 type Material struct {
-	kind  MaterialKind
-	color color.RGBA
-	fuzz  float32
-	eta   float32
+	Kind  MaterialKind
+	Color color.RGBA
+	// if not nil, the color comes from the texture (and Color is its average)
+	ColorTexture *Texture
+	// if not nil, the shading normal is tilted by the normal map (an image)
+	// and by the bump map (any texture)
+	NormalMap *Texture
+	Bump      *Texture
+	// only used by mirror and glass materials
+	Fuzz float32
+	Eta  float32
+	// only used by emissive materials
+	Intensity float32
+	// only used by glass and rough glass materials: the color of white light after
+	// it has travelled AbsorptionDistance inside the object (white means no absorption)
+	Absorption         color.RGBA
+	AbsorptionDistance float32
+	// only used by metal and rough glass materials: roughness and anisotropy
+	// (in range [0, 1]; the highlights are stretched along the tangent)
+	Roughness  float32
+	Anisotropy float32
+	// if not nil, the roughness comes from the texture (and Roughness is its average)
+	RoughnessTexture *Texture
+	// only used by metal materials: complex index of refraction (n + ik)
+	// for the red, green and blue light. The color tints the reflection
+	N mgl.Vec3
+	K mgl.Vec3
+	// only used by principled materials (together with the color, roughness and
+	// anisotropy; the eta is the one of the transmitting base). All parameters are
+	// in range [0, 1]. The material emits the emission color scaled by the intensity
+	Metallic           float32
+	Specular           float32
+	Clearcoat          float32
+	ClearcoatRoughness float32
+	Sheen              float32
+	Transmission       float32
+	Emission           color.RGBA
+	// the medium inside the object: always set for participating materials,
+	// optional for glass and rough glass ones (e.g. milky glass)
+	Medium *Medium
 }
 
 func (m *Material) UnmarshalJSON(data []byte) error {
@@ -137,29 +494,102 @@ func (m *Material) UnmarshalJSON(data []byte) error {
 	}
 	switch kindS {
 	case "mirror":
-		m.kind = Mirror
+		m.Kind = Mirror
 	case "lambertian":
-		m.kind = Lambertian
+		m.Kind = Lambertian
 	case "glass":
-		m.kind = Glass
+		m.Kind = Glass
+	case "emissive":
+		m.Kind = Emissive
+	case "metal":
+		m.Kind = Metal
+	case "rough_glass":
+		m.Kind = RoughGlass
+	case "principled":
+		m.Kind = Principled
+	case "medium":
+		m.Kind = Participating
 	default:
 		return fmt.Errorf("unknown kind: %s", kindS)
 	}
 
+	m.Medium = nil
+	if m.Kind == Participating {
+		// the medium is described by the material itself and has no surface to color
+		m.Medium = &Medium{}
+		if err := m.Medium.parse(dict); err != nil {
+			return err
+		}
+		m.Color = color.RGBA{0xff, 0xff, 0xff, 0xff}
+		m.ColorTexture, m.RoughnessTexture, m.NormalMap, m.Bump = nil, nil, nil, nil
+		return nil
+	}
+
+	m.ColorTexture, m.RoughnessTexture = nil, nil
 	clrI, found := dict["color"]
-	if !found {
+	if _, isTexture := clrI.(map[string]interface{}); isTexture {
+		m.ColorTexture, err = colorTextureFromInterface(clrI)
+		if err != nil {
+			return fmt.Errorf("color: %w", err)
+		}
+		m.Color = m.ColorTexture.Average()
+	} else if found {
+		m.Color, err = colorFromInterface(clrI)
+		if err != nil {
+			return fmt.Errorf("color: %w", err)
+		}
+	} else if m.Kind == Metal {
+		// the color of the metal comes from its index of refraction
+		m.Color = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	} else {
 		return fmt.Errorf("color not specified")
 	}
-	clrS, ok := clrI.(string)
-	if !ok {
-		return fmt.Errorf("invalid color type")
+
+	m.NormalMap, m.Bump = nil, nil
+	if nmI, found := dict["normal_map"]; found {
+		m.NormalMap, err = mapFromInterface(nmI)
+		if err != nil {
+			return fmt.Errorf("normal_map: %w", err)
+		}
+		if m.NormalMap.Kind != ImageTexture {
+			return fmt.Errorf("normal_map must be an image")
+		}
 	}
-	_, err = fmt.Sscanf(clrS, "%02x%02x%02x", &m.color.R, &m.color.G, &m.color.B)
-	if err != nil {
-		return fmt.Errorf("failed to parse color: %w", err)
+	if bumpI, found := dict["bump"]; found {
+		m.Bump, err = mapFromInterface(bumpI)
+		if err != nil {
+			return fmt.Errorf("bump: %w", err)
+		}
 	}
 
-	if m.kind != Lambertian {
+	if m.Kind == Emissive {
+		intI, found := dict["intensity"]
+		if !found {
+			return fmt.Errorf("intensity not specified")
+		}
+		intF, ok := intI.(float64)
+		if !ok {
+			return fmt.Errorf("invalid intensity type")
+		}
+		if intF < 0.0 {
+			return fmt.Errorf("intensity must be positive")
+		}
+		m.Intensity = float32(intF)
+	}
+
+	if m.Kind == Metal || m.Kind == RoughGlass || m.Kind == Principled {
+		if err := m.parseMicrofacet(dict); err != nil {
+			return err
+		}
+	}
+
+	if m.Kind == Principled {
+		if err := m.parsePrincipled(dict); err != nil {
+			return err
+		}
+	}
+
+	if m.Kind == Mirror || m.Kind == Glass {
 		fzI, found := dict["fuzz"]
 		if !found {
 			return fmt.Errorf("fuzz not specified")
@@ -171,8 +601,10 @@ func (m *Material) UnmarshalJSON(data []byte) error {
 		if fzF < 0.0 || fzF > 1.0 {
 			return fmt.Errorf("fuzz must be in range [0, 1]")
 		}
-		m.fuzz = float32(fzF)
+		m.Fuzz = float32(fzF)
+	}
 
+	if m.Kind == Mirror || m.Kind == Glass || m.Kind == RoughGlass {
 		etaI, found := dict["eta"]
 		if !found {
 			return fmt.Errorf("eta not specified")
@@ -184,45 +616,425 @@ func (m *Material) UnmarshalJSON(data []byte) error {
 		if etaF < 0.0 {
 			return fmt.Errorf("eta must be positive")
 		}
-		m.eta = float32(etaF)
+		m.Eta = float32(etaF)
+	}
+
+	if m.Kind == Glass || m.Kind == RoughGlass {
+		m.Absorption = color.RGBA{0xff, 0xff, 0xff, 0xff}
+		if absI, found := dict["absorption"]; found {
+			m.Absorption, err = colorFromInterface(absI)
+			if err != nil {
+				return fmt.Errorf("absorption: %w", err)
+			}
+		}
+		m.AbsorptionDistance = 1.0
+		if distI, found := dict["absorption_distance"]; found {
+			distF, ok := distI.(float64)
+			if !ok {
+				return fmt.Errorf("invalid absorption_distance type")
+			}
+			if distF <= 0.0 {
+				return fmt.Errorf("absorption_distance must be positive")
+			}
+			m.AbsorptionDistance = float32(distF)
+		}
+
+		if medI, found := dict["medium"]; found {
+			medDict, ok := medI.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("invalid medium type")
+			}
+			m.Medium = &Medium{}
+			if err := m.Medium.parse(medDict); err != nil {
+				return fmt.Errorf("medium: %w", err)
+			}
+		}
 	}
 
 	return nil
 }
 
+func (m *Material) parseMicrofacet(dict map[string]interface{}) error {
+	rI, found := dict["roughness"]
+	if !found {
+		return fmt.Errorf("roughness not specified")
+	}
+	if _, isTexture := rI.(map[string]interface{}); isTexture {
+		var err error
+		m.RoughnessTexture, err = valueTextureFromInterface(rI)
+		if err != nil {
+			return fmt.Errorf("roughness: %w", err)
+		}
+		rI = float64(m.RoughnessTexture.Values[0]+m.RoughnessTexture.Values[1]) / 2.0
+	}
+	rF, ok := rI.(float64)
+	if !ok {
+		return fmt.Errorf("invalid roughness type")
+	}
+	if rF < 0.0 || rF > 1.0 {
+		return fmt.Errorf("roughness must be in range [0, 1]")
+	}
+	m.Roughness = float32(rF)
+
+	m.Anisotropy = 0.0
+	if aI, found := dict["anisotropy"]; found {
+		aF, ok := aI.(float64)
+		if !ok {
+			return fmt.Errorf("invalid anisotropy type")
+		}
+		if aF < 0.0 || aF > 1.0 {
+			return fmt.Errorf("anisotropy must be in range [0, 1]")
+		}
+		m.Anisotropy = float32(aF)
+	}
+
+	if m.Kind != Metal {
+		return nil
+	}
+	if presetI, found := dict["preset"]; found {
+		preset, ok := presetI.(string)
+		if !ok {
+			return fmt.Errorf("invalid preset type")
+		}
+		m.N, m.K, ok = MetalPreset(preset)
+		if !ok {
+			return fmt.Errorf("unknown preset: %s", preset)
+		}
+		return nil
+	}
+	nI, found := dict["n"]
+	if !found {
+		return fmt.Errorf("neither preset nor n specified")
+	}
+	n, err := vec3FromInterface(nI)
+	if err != nil {
+		return fmt.Errorf("n: %w", err)
+	}
+	kI, found := dict["k"]
+	if !found {
+		return fmt.Errorf("k not specified")
+	}
+	k, err := vec3FromInterface(kI)
+	if err != nil {
+		return fmt.Errorf("k: %w", err)
+	}
+	for i := 0; i < 3; i++ {
+		if n[i] <= 0.0 || k[i] < 0.0 {
+			return fmt.Errorf("n must be positive and k must not be negative")
+		}
+	}
+	m.N = mgl.Vec3{n[0], n[1], n[2]}
+	m.K = mgl.Vec3{k[0], k[1], k[2]}
+	return nil
+}
+
+func (m *Material) parsePrincipled(dict map[string]interface{}) error {
+	params := []struct {
+		key   string
+		value *float32
+		def   float32
+	}{
+		{"metallic", &m.Metallic, 0.0},
+		{"specular", &m.Specular, 0.5},
+		{"clearcoat", &m.Clearcoat, 0.0},
+		{"clearcoat_roughness", &m.ClearcoatRoughness, 0.03},
+		{"sheen", &m.Sheen, 0.0},
+		{"transmission", &m.Transmission, 0.0},
+	}
+	for _, p := range params {
+		*p.value = p.def
+		vI, found := dict[p.key]
+		if !found {
+			continue
+		}
+		vF, ok := vI.(float64)
+		if !ok {
+			return fmt.Errorf("invalid %s type", p.key)
+		}
+		if vF < 0.0 || vF > 1.0 {
+			return fmt.Errorf("%s must be in range [0, 1]", p.key)
+		}
+		*p.value = float32(vF)
+	}
+
+	m.Eta = 1.5
+	if etaI, found := dict["eta"]; found {
+		etaF, ok := etaI.(float64)
+		if !ok {
+			return fmt.Errorf("invalid eta type")
+		}
+		if etaF <= 0.0 {
+			return fmt.Errorf("eta must be positive")
+		}
+		m.Eta = float32(etaF)
+	}
+
+	var err error
+	m.Emission = color.RGBA{0x00, 0x00, 0x00, 0xff}
+	if emI, found := dict["emission"]; found {
+		m.Emission, err = colorFromInterface(emI)
+		if err != nil {
+			return fmt.Errorf("emission: %w", err)
+		}
+	}
+	m.Intensity = 1.0
+	if intI, found := dict["emission_intensity"]; found {
+		intF, ok := intI.(float64)
+		if !ok {
+			return fmt.Errorf("invalid emission_intensity type")
+		}
+		if intF < 0.0 {
+			return fmt.Errorf("emission_intensity must be positive")
+		}
+		m.Intensity = float32(intF)
+	}
+	return nil
+}
+
+// PrincipledEmission returns the light emitted by the principled material
+// (zero for other materials)
+func (m Material) PrincipledEmission() mgl.Vec3 {
+	if m.Kind != Principled {
+		return mgl.Vec3{}
+	}
+	return mgl.Vec3{uiToF(m.Emission.R), uiToF(m.Emission.G), uiToF(m.Emission.B)}.Mul(m.Intensity)
+}
+
+// AbsorptionCoefficient returns the coefficient of the Beer-Lambert law for each
+// color channel: light is attenuated by exp(-coefficient * distance) inside the object
+func (m Material) AbsorptionCoefficient() mgl.Vec3 {
+	if (m.Kind != Glass && m.Kind != RoughGlass) || m.AbsorptionDistance <= 0.0 {
+		return mgl.Vec3{}
+	}
+	var result mgl.Vec3
+	for i, c := range [3]uint8{m.Absorption.R, m.Absorption.G, m.Absorption.B} {
+		// black glass lets through a little light, otherwise the coefficient is infinite
+		if c == 0 {
+			c = 1
+		}
+		result[i] = float32(-math.Log(float64(uiToF(c)))) / m.AbsorptionDistance
+	}
+	return result
+}
+
+// InteriorMedium returns the medium inside the object: the one of the material together
+// with the Beer-Lambert absorption of the glass (zero coefficients if there is none)
+func (m Material) InteriorMedium() Medium {
+	var result Medium
+	if m.Medium != nil {
+		result = *m.Medium
+	}
+	result.Absorption = result.Absorption.Add(m.AbsorptionCoefficient())
+	return result
+}
+
+func (m Material) MarshalJSON() ([]byte, error) {
+	data, err := m.marshalParameters()
+	hasMedium := m.Medium != nil && m.Kind != Participating
+	if err != nil || (m.NormalMap == nil && m.Bump == nil && !hasMedium) {
+		return data, err
+	}
+	var medium *Medium
+	if hasMedium {
+		medium = m.Medium
+	}
+	// the maps (and the medium of the glass) are the same for all kinds,
+	// so they are appended to the object
+	maps, err := json.Marshal(struct {
+		NormalMap interface{} `json:"normal_map,omitempty"`
+		Bump      interface{} `json:"bump,omitempty"`
+		Medium    *Medium     `json:"medium,omitempty"`
+	}{mapJSON(m.NormalMap), mapJSON(m.Bump), medium})
+	if err != nil {
+		return nil, err
+	}
+	return append(append(data[:len(data)-1], ','), maps[1:]...), nil
+}
+
+func (m Material) marshalParameters() ([]byte, error) {
+	var kindS string
+	switch m.Kind {
+	case Mirror:
+		kindS = "mirror"
+	case Lambertian:
+		kindS = "lambertian"
+	case Glass:
+		kindS = "glass"
+	case Emissive:
+		kindS = "emissive"
+	case Metal:
+		kindS = "metal"
+	case RoughGlass:
+		kindS = "rough_glass"
+	case Principled:
+		kindS = "principled"
+	case Participating:
+		kindS = "medium"
+	default:
+		return nil, fmt.Errorf("unknown kind: %d", m.Kind)
+	}
+	clr := colorJSON(m.Color, m.ColorTexture)
+	roughness := valueJSON(m.Roughness, m.RoughnessTexture)
+
+	switch m.Kind {
+	case Participating:
+		var medium Medium
+		if m.Medium != nil {
+			medium = *m.Medium
+		}
+		return json.Marshal(struct {
+			Kind string `json:"kind"`
+			mediumJSON
+		}{kindS, mediumJSON{medium.Absorption, medium.Scattering, medium.Anisotropy}})
+	case Lambertian:
+		return json.Marshal(struct {
+			Kind  string      `json:"kind"`
+			Color interface{} `json:"color"`
+		}{kindS, clr})
+	case Emissive:
+		return json.Marshal(struct {
+			Kind      string      `json:"kind"`
+			Color     interface{} `json:"color"`
+			Intensity float32     `json:"intensity"`
+		}{kindS, clr, m.Intensity})
+	case Glass:
+		return json.Marshal(struct {
+			Kind               string      `json:"kind"`
+			Color              interface{} `json:"color"`
+			Fuzz               float32     `json:"fuzz"`
+			Eta                float32     `json:"eta"`
+			Absorption         string      `json:"absorption"`
+			AbsorptionDistance float32     `json:"absorption_distance"`
+		}{kindS, clr, m.Fuzz, m.Eta, colorToHex(m.Absorption), m.AbsorptionDistance})
+	case Metal:
+		return json.Marshal(struct {
+			Kind       string      `json:"kind"`
+			Color      interface{} `json:"color"`
+			Roughness  interface{} `json:"roughness"`
+			Anisotropy float32     `json:"anisotropy"`
+			N          [3]float32  `json:"n"`
+			K          [3]float32  `json:"k"`
+		}{kindS, clr, roughness, m.Anisotropy, m.N, m.K})
+	case RoughGlass:
+		return json.Marshal(struct {
+			Kind               string      `json:"kind"`
+			Color              interface{} `json:"color"`
+			Roughness          interface{} `json:"roughness"`
+			Anisotropy         float32     `json:"anisotropy"`
+			Eta                float32     `json:"eta"`
+			Absorption         string      `json:"absorption"`
+			AbsorptionDistance float32     `json:"absorption_distance"`
+		}{kindS, clr, roughness, m.Anisotropy, m.Eta, colorToHex(m.Absorption), m.AbsorptionDistance})
+	case Principled:
+		return json.Marshal(struct {
+			Kind               string      `json:"kind"`
+			Color              interface{} `json:"color"`
+			Metallic           float32     `json:"metallic"`
+			Roughness          interface{} `json:"roughness"`
+			Anisotropy         float32     `json:"anisotropy"`
+			Specular           float32     `json:"specular"`
+			Clearcoat          float32     `json:"clearcoat"`
+			ClearcoatRoughness float32     `json:"clearcoat_roughness"`
+			Sheen              float32     `json:"sheen"`
+			Transmission       float32     `json:"transmission"`
+			Eta                float32     `json:"eta"`
+			Emission           string      `json:"emission"`
+			EmissionIntensity  float32     `json:"emission_intensity"`
+		}{
+			kindS, clr, m.Metallic, roughness, m.Anisotropy, m.Specular, m.Clearcoat, m.ClearcoatRoughness,
+			m.Sheen, m.Transmission, m.Eta, colorToHex(m.Emission), m.Intensity,
+		})
+	}
+	return json.Marshal(struct {
+		Kind  string      `json:"kind"`
+		Color interface{} `json:"color"`
+		Fuzz  float32     `json:"fuzz"`
+		Eta   float32     `json:"eta"`
+	}{kindS, clr, m.Fuzz, m.Eta})
+}
+
 func NewMirror(c color.RGBA, fuzz, eta float32) Material {
 	return Material{
-		kind:  Mirror,
-		color: c,
-		fuzz:  fuzz,
-		eta:   eta,
+		Kind:  Mirror,
+		Color: c,
+		Fuzz:  fuzz,
+		Eta:   eta,
 	}
 }
 
 func NewLambertian(c color.RGBA) Material {
 	return Material{
-		kind:  Lambertian,
-		color: c,
-		fuzz:  0,
-		eta:   0.0,
+		Kind:  Lambertian,
+		Color: c,
+		Fuzz:  0,
+		Eta:   0.0,
 	}
 }
 
 func NewGlass(c color.RGBA, fuzz, eta float32) Material {
 	return Material{
-		kind:  Glass,
-		color: c,
-		fuzz:  fuzz,
-		eta:   eta,
+		Kind:               Glass,
+		Color:              c,
+		Fuzz:               fuzz,
+		Eta:                eta,
+		Absorption:         color.RGBA{0xff, 0xff, 0xff, 0xff},
+		AbsorptionDistance: 1.0,
 	}
 }
 
-func uiToF(i uint8) float32 {
-	return float32(i) / float32(0xff)
+func NewMetal(c color.RGBA, roughness, anisotropy float32, n, k mgl.Vec3) Material {
+	return Material{
+		Kind:       Metal,
+		Color:      c,
+		Roughness:  roughness,
+		Anisotropy: anisotropy,
+		N:          n,
+		K:          k,
+	}
 }
 
-func colorToString(c color.RGBA) string {
-	return fmt.Sprintf("{%f, %f, %f}", uiToF(c.R), uiToF(c.G), uiToF(c.B))
+func NewRoughGlass(c color.RGBA, roughness, anisotropy, eta float32) Material {
+	return Material{
+		Kind:               RoughGlass,
+		Color:              c,
+		Roughness:          roughness,
+		Anisotropy:         anisotropy,
+		Eta:                eta,
+		Absorption:         color.RGBA{0xff, 0xff, 0xff, 0xff},
+		AbsorptionDistance: 1.0,
+	}
+}
+
+// NewPrincipled returns the principled material with the default parameters
+// (a plastic-like dielectric)
+func NewPrincipled(c color.RGBA, roughness float32) Material {
+	return Material{
+		Kind:               Principled,
+		Color:              c,
+		Roughness:          roughness,
+		Eta:                1.5,
+		Specular:           0.5,
+		ClearcoatRoughness: 0.03,
+		Emission:           color.RGBA{0x00, 0x00, 0x00, 0xff},
+		Intensity:          1.0,
+	}
+}
+
+// NewParticipating returns the material of the body filled with the medium
+func NewParticipating(medium Medium) Material {
+	return Material{
+		Kind:   Participating,
+		Color:  color.RGBA{0xff, 0xff, 0xff, 0xff},
+		Medium: &medium,
+	}
+}
+
+func NewEmissive(c color.RGBA, intensity float32) Material {
+	return Material{
+		Kind:      Emissive,
+		Color:     c,
+		Intensity: intensity,
+	}
 }
 
 // Bodies (geometry of the object)
@@ -232,39 +1044,117 @@ type BodyKind int
 const (
 	Box BodyKind = iota
 	Ball
+	Mesh
+	// box filled with the medium of varying density
+	Volume
+	// combination of other bodies
+	CSG
+	// signed distance field
+	SDF
+	// half-space below the plane (opposite to the normal)
+	Plane
+	Disk
+	// capped cylinder
+	Cylinder
+	// capped cone, possibly truncated
+	Cone
+	Capsule
+	// torus around the y axis
+	Torus
 )
 
 type Body struct {
-	kind BodyKind
-	desc string
+	Kind BodyKind
+
+	// box and volume geometry
+	Min mgl.Vec3
+	Max mgl.Vec3
+
+	// ball geometry (also the center of the disk and the torus and a point of the plane)
+	Center mgl.Vec3
+	Radius float32
+
+	// plane and disk: unit normal
+	Normal mgl.Vec3
+	// cylinder, cone and capsule: centers of the ends. Radius is the one at the start,
+	// EndRadius is the one at the end of the cone
+	Start     mgl.Vec3
+	End       mgl.Vec3
+	EndRadius float32
+	// torus: radius of the tube (Radius is the one of the ring)
+	Thickness float32
+
+	// mesh geometry: path to the OBJ file and whether to use face normals
+	// instead of the vertex ones. The triangles are nil until the mesh
+	// is loaded by Scene.LoadAssets
+	File string
+	Flat bool
+	Mesh *TriangleMesh
+
+	// volume density: either the procedural texture or the grid from File
+	// (nil until it is loaded by Scene.LoadAssets)
+	Density *Texture
+	Grid    *DensityGrid
+
+	// CSG: the operation and its operands
+	Operation CSGOperation
+	Operands  []CSGOperand
+
+	// SDF: the tree of the field
+	Shape *SDFNode
 }
 
-func parseBox(dict map[string]interface{}) (string, error) {
+func parseBox(dict map[string]interface{}) (Body, error) {
 	minI, found := dict["min"]
 	if !found {
-		return "", fmt.Errorf("min not specified")
+		return Body{}, fmt.Errorf("min not specified")
 	}
 	min, err := vec3FromInterface(minI)
 	if err != nil {
-		return "", fmt.Errorf("min: %w", err)
+		return Body{}, fmt.Errorf("min: %w", err)
 	}
 
 	maxI, found := dict["max"]
 	if !found {
-		return "", fmt.Errorf("max not specified")
+		return Body{}, fmt.Errorf("max not specified")
 	}
 	max, err := vec3FromInterface(maxI)
 	if err != nil {
-		return "", fmt.Errorf("max: %w", err)
+		return Body{}, fmt.Errorf("max: %w", err)
 	}
 
-	return fmt.Sprintf(
-		"{{%f, %f, %f},{%f, %f, %f}}",
-		min[0], min[1], min[2],
-		max[0], max[1], max[2],
+	return NewBox(
+		mgl.Vec3{min[0], min[1], min[2]},
+		mgl.Vec3{max[0], max[1], max[2]},
 	), nil
 }
 
+func uiToF(i uint8) float32 {
+	return float32(i) / float32(0xff)
+}
+
+func colorToString(c color.RGBA) string {
+	return fmt.Sprintf("{%f, %f, %f}", uiToF(c.R), uiToF(c.G), uiToF(c.B))
+}
+
+// parse a color written as a hex string, e.g. "ff8000"
+func colorFromInterface(i interface{}) (color.RGBA, error) {
+	s, ok := i.(string)
+	if !ok {
+		return color.RGBA{}, fmt.Errorf("invalid type")
+	}
+	c := color.RGBA{A: 0xff}
+	_, err := fmt.Sscanf(s, "%02x%02x%02x", &c.R, &c.G, &c.B)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("failed to parse: %w", err)
+	}
+	return c, nil
+}
+
+func colorToHex(c color.RGBA) string {
+	return fmt.Sprintf("%02x%02x%02x", c.R, c.G, c.B)
+}
+
 func vec3FromInterface(i interface{}) ([]float32, error) {
 	arr, ok := i.([]interface{})
 	if !ok || len(arr) != 3 {
@@ -281,33 +1171,168 @@ func vec3FromInterface(i interface{}) ([]float32, error) {
 	return vec, nil
 }
 
-func parseBall(dict map[string]interface{}) (string, error) {
+// Unit vectors read from files are normalized only if their length differs from 1
+// by more than that, so that the vectors saved by MarshalJSON are loaded exactly
+const unitEpsilon = 1e-6
+
+func normalizeLoaded(v mgl.Vec3) mgl.Vec3 {
+	if l := v.Len(); l < 1.0-unitEpsilon || l > 1.0+unitEpsilon {
+		return v.Normalize()
+	}
+	return v
+}
+
+func parseBall(dict map[string]interface{}) (Body, error) {
 	cI, found := dict["center"]
 	if !found {
-		return "", fmt.Errorf("center not specified")
+		return Body{}, fmt.Errorf("center not specified")
 	}
 	c, err := vec3FromInterface(cI)
 	if err != nil {
-		return "", fmt.Errorf("center: %w", err)
+		return Body{}, fmt.Errorf("center: %w", err)
 	}
 
 	rI, found := dict["radius"]
 	if !found {
-		return "", fmt.Errorf("radius not specified")
+		return Body{}, fmt.Errorf("radius not specified")
 	}
 	r, ok := rI.(float64)
 	if !ok {
-		return "", fmt.Errorf("invalid radius type")
+		return Body{}, fmt.Errorf("invalid radius type")
 	}
 	if r < 0.0 {
-		return "", fmt.Errorf("radius must be positive")
+		return Body{}, fmt.Errorf("radius must be positive")
 	}
 
-	return fmt.Sprintf(
-		"{{%f, %f, %f}, %f}",
-		c[0], c[1], c[2],
-		float32(r),
-	), nil
+	return NewBall(mgl.Vec3{c[0], c[1], c[2]}, float32(r)), nil
+}
+
+func normalFromDict(dict map[string]interface{}) (mgl.Vec3, error) {
+	n, err := vecFromDict(dict, "normal")
+	if err != nil {
+		return mgl.Vec3{}, err
+	}
+	if n.Len() == 0.0 {
+		return mgl.Vec3{}, fmt.Errorf("normal must not be zero")
+	}
+	return n.Normalize(), nil
+}
+
+func parsePlane(dict map[string]interface{}) (Body, error) {
+	point, err := vecFromDict(dict, "point")
+	if err != nil {
+		return Body{}, err
+	}
+	normal, err := normalFromDict(dict)
+	if err != nil {
+		return Body{}, err
+	}
+	return NewPlane(point, normal), nil
+}
+
+func parseDisk(dict map[string]interface{}) (Body, error) {
+	center, err := vecFromDict(dict, "center")
+	if err != nil {
+		return Body{}, err
+	}
+	normal, err := normalFromDict(dict)
+	if err != nil {
+		return Body{}, err
+	}
+	radius, err := positiveFromDict(dict, "radius")
+	if err != nil {
+		return Body{}, err
+	}
+	return NewDisk(center, normal, radius), nil
+}
+
+// parseSegment parses the ends and the radius of cylinders, cones and capsules
+func parseSegment(dict map[string]interface{}) (start, end mgl.Vec3, radius float32, err error) {
+	if start, err = vecFromDict(dict, "start"); err != nil {
+		return
+	}
+	if end, err = vecFromDict(dict, "end"); err != nil {
+		return
+	}
+	if start == end {
+		err = fmt.Errorf("start and end must differ")
+		return
+	}
+	radius, err = positiveFromDict(dict, "radius")
+	return
+}
+
+func parseCylinder(dict map[string]interface{}) (Body, error) {
+	start, end, radius, err := parseSegment(dict)
+	if err != nil {
+		return Body{}, err
+	}
+	return NewCylinder(start, end, radius), nil
+}
+
+func parseCone(dict map[string]interface{}) (Body, error) {
+	start, end, radius, err := parseSegment(dict)
+	if err != nil {
+		return Body{}, err
+	}
+	endRadius := float32(0.0)
+	if rI, found := dict["end_radius"]; found {
+		if endRadius, err = floatFromInterface(rI); err != nil {
+			return Body{}, fmt.Errorf("end_radius: %w", err)
+		}
+		if endRadius < 0.0 {
+			return Body{}, fmt.Errorf("end_radius must not be negative")
+		}
+	}
+	return NewCone(start, end, radius, endRadius), nil
+}
+
+func parseCapsule(dict map[string]interface{}) (Body, error) {
+	start, end, radius, err := parseSegment(dict)
+	if err != nil {
+		return Body{}, err
+	}
+	return NewCapsule(start, end, radius), nil
+}
+
+func parseTorus(dict map[string]interface{}) (Body, error) {
+	center, err := vecFromDict(dict, "center")
+	if err != nil {
+		return Body{}, err
+	}
+	radius, err := positiveFromDict(dict, "radius")
+	if err != nil {
+		return Body{}, err
+	}
+	thickness, err := positiveFromDict(dict, "thickness")
+	if err != nil {
+		return Body{}, err
+	}
+	if thickness >= radius {
+		return Body{}, fmt.Errorf("thickness must be less than radius")
+	}
+	return NewTorus(center, radius, thickness), nil
+}
+
+func parseMesh(dict map[string]interface{}) (Body, error) {
+	fileI, found := dict["file"]
+	if !found {
+		return Body{}, fmt.Errorf("file not specified")
+	}
+	file, ok := fileI.(string)
+	if !ok {
+		return Body{}, fmt.Errorf("invalid file type")
+	}
+
+	flat := false
+	if flatI, found := dict["flat"]; found {
+		flat, ok = flatI.(bool)
+		if !ok {
+			return Body{}, fmt.Errorf("invalid flat type")
+		}
+	}
+
+	return Body{Kind: Mesh, File: file, Flat: flat}, nil
 }
 
 func (b *Body) UnmarshalJSON(data []byte) error {
@@ -327,11 +1352,29 @@ func (b *Body) UnmarshalJSON(data []byte) error {
 	}
 	switch kindS {
 	case "box":
-		b.kind = Box
-		b.desc, err = parseBox(dict)
+		*b, err = parseBox(dict)
 	case "ball":
-		b.kind = Ball
-		b.desc, err = parseBall(dict)
+		*b, err = parseBall(dict)
+	case "mesh":
+		*b, err = parseMesh(dict)
+	case "volume":
+		*b, err = parseVolume(dict)
+	case "csg":
+		*b, err = parseCSG(dict)
+	case "sdf":
+		*b, err = parseSDF(dict)
+	case "plane":
+		*b, err = parsePlane(dict)
+	case "disk":
+		*b, err = parseDisk(dict)
+	case "cylinder":
+		*b, err = parseCylinder(dict)
+	case "cone":
+		*b, err = parseCone(dict)
+	case "capsule":
+		*b, err = parseCapsule(dict)
+	case "torus":
+		*b, err = parseTorus(dict)
 	default:
 		return fmt.Errorf("unknown kind: %s", kindS)
 	}
@@ -339,25 +1382,232 @@ func (b *Body) UnmarshalJSON(data []byte) error {
 	return err
 }
 
+// Bounds returns the axis-aligned bounding box of the body
+func (b Body) Bounds() bvh.AABB {
+	switch b.Kind {
+	case Box, Volume:
+		return bvh.NewAABB(b.Min, b.Max)
+	case Ball:
+		r := mgl.Vec3{b.Radius, b.Radius, b.Radius}
+		return bvh.NewAABB(b.Center.Sub(r), b.Center.Add(r))
+	case Mesh:
+		// meshes without triangles are never hit, any point will do
+		if b.Mesh == nil || len(b.Mesh.Triangles) == 0 {
+			return bvh.AABB{}
+		}
+		return b.Mesh.Bounds()
+	case CSG:
+		return b.csgBounds()
+	case SDF:
+		// with a margin, so that the rays starting on the surface start inside the bounds
+		bounds := b.Shape.Bounds()
+		margin := mgl.Vec3{sdfBoundsMargin, sdfBoundsMargin, sdfBoundsMargin}
+		return bvh.AABB{Min: bounds.Min.Sub(margin), Max: bounds.Max.Add(margin)}
+	case Plane:
+		// the planes are kept out of the BVH and tested by every ray
+		return bvh.InfiniteAABB()
+	case Disk:
+		e := diskExtent(b.Normal, b.Radius).Add(mgl.Vec3{flatMargin, flatMargin, flatMargin})
+		return bvh.NewAABB(b.Center.Sub(e), b.Center.Add(e))
+	case Cylinder, Cone:
+		axis := b.End.Sub(b.Start).Normalize()
+		e0, e1 := diskExtent(axis, b.Radius), diskExtent(axis, b.EndRadius)
+		return bvh.NewAABB(b.Start.Sub(e0), b.Start.Add(e0)).Union(bvh.NewAABB(b.End.Sub(e1), b.End.Add(e1)))
+	case Capsule:
+		r := mgl.Vec3{b.Radius, b.Radius, b.Radius}
+		a := bvh.NewAABB(b.Start, b.End)
+		return bvh.AABB{Min: a.Min.Sub(r), Max: a.Max.Add(r)}
+	case Torus:
+		e := mgl.Vec3{b.Radius + b.Thickness, b.Thickness, b.Radius + b.Thickness}
+		return bvh.NewAABB(b.Center.Sub(e), b.Center.Add(e))
+	default:
+		return bvh.EmptyAABB()
+	}
+}
+
+func (b Body) MarshalJSON() ([]byte, error) {
+	switch b.Kind {
+	case Box:
+		return json.Marshal(struct {
+			Kind string   `json:"kind"`
+			Min  mgl.Vec3 `json:"min"`
+			Max  mgl.Vec3 `json:"max"`
+		}{"box", b.Min, b.Max})
+	case Ball:
+		return json.Marshal(struct {
+			Kind   string   `json:"kind"`
+			Center mgl.Vec3 `json:"center"`
+			Radius float32  `json:"radius"`
+		}{"ball", b.Center, b.Radius})
+	case Mesh:
+		if b.File == "" {
+			return nil, fmt.Errorf("mesh without a file cannot be saved")
+		}
+		return json.Marshal(struct {
+			Kind string `json:"kind"`
+			File string `json:"file"`
+			Flat bool   `json:"flat,omitempty"`
+		}{"mesh", b.File, b.Flat})
+	case Volume:
+		if b.Density == nil && b.File == "" {
+			return nil, fmt.Errorf("volume without a file cannot be saved")
+		}
+		var density interface{}
+		if b.Density != nil {
+			density = valueJSON(0.0, b.Density)
+		}
+		return json.Marshal(struct {
+			Kind    string      `json:"kind"`
+			Min     mgl.Vec3    `json:"min"`
+			Max     mgl.Vec3    `json:"max"`
+			File    string      `json:"file,omitempty"`
+			Density interface{} `json:"density,omitempty"`
+		}{"volume", b.Min, b.Max, b.File, density})
+	case CSG:
+		return json.Marshal(struct {
+			Kind      string       `json:"kind"`
+			Operation string       `json:"operation"`
+			Operands  []CSGOperand `json:"operands"`
+		}{"csg", b.Operation.String(), b.Operands})
+	case SDF:
+		return json.Marshal(struct {
+			Kind  string   `json:"kind"`
+			Shape *SDFNode `json:"shape"`
+		}{"sdf", b.Shape})
+	case Plane:
+		return json.Marshal(struct {
+			Kind   string   `json:"kind"`
+			Point  mgl.Vec3 `json:"point"`
+			Normal mgl.Vec3 `json:"normal"`
+		}{"plane", b.Center, b.Normal})
+	case Disk:
+		return json.Marshal(struct {
+			Kind   string   `json:"kind"`
+			Center mgl.Vec3 `json:"center"`
+			Normal mgl.Vec3 `json:"normal"`
+			Radius float32  `json:"radius"`
+		}{"disk", b.Center, b.Normal, b.Radius})
+	case Cylinder, Capsule:
+		return json.Marshal(struct {
+			Kind   string   `json:"kind"`
+			Start  mgl.Vec3 `json:"start"`
+			End    mgl.Vec3 `json:"end"`
+			Radius float32  `json:"radius"`
+		}{[...]string{Cylinder: "cylinder", Capsule: "capsule"}[b.Kind], b.Start, b.End, b.Radius})
+	case Cone:
+		return json.Marshal(struct {
+			Kind      string   `json:"kind"`
+			Start     mgl.Vec3 `json:"start"`
+			End       mgl.Vec3 `json:"end"`
+			Radius    float32  `json:"radius"`
+			EndRadius float32  `json:"end_radius"`
+		}{"cone", b.Start, b.End, b.Radius, b.EndRadius})
+	case Torus:
+		return json.Marshal(struct {
+			Kind      string   `json:"kind"`
+			Center    mgl.Vec3 `json:"center"`
+			Radius    float32  `json:"radius"`
+			Thickness float32  `json:"thickness"`
+		}{"torus", b.Center, b.Radius, b.Thickness})
+	default:
+		return nil, fmt.Errorf("unknown kind: %d", b.Kind)
+	}
+}
+
 func NewBox(min, max mgl.Vec3) Body {
 	return Body{
-		kind: Box,
-		desc: fmt.Sprintf(
-			"{{%f, %f, %f},{%f, %f, %f}}",
-			min.X(), min.Y(), min.Z(),
-			max.X(), max.Y(), max.Z(),
-		),
+		Kind: Box,
+		Min:  min,
+		Max:  max,
 	}
 }
 
 func NewBall(center mgl.Vec3, radius float32) Body {
 	return Body{
-		kind: Ball,
-		desc: fmt.Sprintf(
-			"{{%f, %f, %f}, %f}",
-			center.X(), center.Y(), center.Z(),
-			radius,
-		),
+		Kind:   Ball,
+		Center: center,
+		Radius: radius,
+	}
+}
+
+// flatMargin is the thickness of the bounds of the flat bodies
+const flatMargin = 0.001
+
+// diskExtent returns the half of the size of the bounds of the circle with given normal
+func diskExtent(normal mgl.Vec3, radius float32) mgl.Vec3 {
+	var e mgl.Vec3
+	for i := range e {
+		e[i] = radius * float32(math.Sqrt(math.Max(0.0, 1.0-float64(normal[i]*normal[i]))))
+	}
+	return e
+}
+
+// NewPlane returns the half-space below the plane through the point (the normal
+// must be a unit vector)
+func NewPlane(point, normal mgl.Vec3) Body {
+	return Body{
+		Kind:   Plane,
+		Center: point,
+		Normal: normal,
+	}
+}
+
+func NewDisk(center, normal mgl.Vec3, radius float32) Body {
+	return Body{
+		Kind:   Disk,
+		Center: center,
+		Normal: normal,
+		Radius: radius,
+	}
+}
+
+func NewCylinder(start, end mgl.Vec3, radius float32) Body {
+	return Body{
+		Kind:      Cylinder,
+		Start:     start,
+		End:       end,
+		Radius:    radius,
+		EndRadius: radius,
+	}
+}
+
+// NewCone returns the cone with the radius at the start and the end radius at the end
+// (zero for the apex)
+func NewCone(start, end mgl.Vec3, radius, endRadius float32) Body {
+	return Body{
+		Kind:      Cone,
+		Start:     start,
+		End:       end,
+		Radius:    radius,
+		EndRadius: endRadius,
+	}
+}
+
+func NewCapsule(start, end mgl.Vec3, radius float32) Body {
+	return Body{
+		Kind:      Capsule,
+		Start:     start,
+		End:       end,
+		Radius:    radius,
+		EndRadius: radius,
+	}
+}
+
+func NewTorus(center mgl.Vec3, radius, thickness float32) Body {
+	return Body{
+		Kind:      Torus,
+		Center:    center,
+		Radius:    radius,
+		Thickness: thickness,
+	}
+}
+
+// NewMesh returns a mesh body made of the triangles (it has no file,
+// so it cannot be saved to JSON)
+func NewMesh(mesh *TriangleMesh) Body {
+	return Body{
+		Kind: Mesh,
+		Mesh: mesh,
 	}
 }
 
@@ -369,12 +1619,18 @@ const (
 )
 
 func RandomScene(seed int64) *Scene {
+	return RandomSceneWithObjects(seed, nObjects)
+}
+
+// RandomSceneWithObjects generates a scene like RandomScene, but with n random objects
+// placed on the floor (the floor and the walls are not counted)
+func RandomSceneWithObjects(seed int64, n int) *Scene {
 	rand.Seed(seed)
 	s := NewScene()
 	s.AddObject(NewObject(
-		NewBox(
-			mgl.Vec3{-maxDist, -1.0, -maxDist},
-			mgl.Vec3{maxDist, 0.0, maxDist},
+		NewPlane(
+			mgl.Vec3{0.0, 0.0, 0.0},
+			mgl.Vec3{0.0, 1.0, 0.0},
 		),
 		NewLambertian(
 			color.RGBA{0x66, 0x66, 0x66, 0xFF},
@@ -398,7 +1654,7 @@ func RandomScene(seed int64) *Scene {
 			color.RGBA{0xDD, 0xDD, 0xDD, 0xFF},
 		),
 	))
-	for i := 0; i < nObjects; i++ {
+	for i := 0; i < n; i++ {
 		pos := mgl.Vec2{rand.Float32() - 0.5, rand.Float32() - 0.5}.Mul(maxDist * 2.0)
 		size := minSize + rand.Float32()*(maxSize-minSize)
 
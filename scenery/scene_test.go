@@ -0,0 +1,99 @@
+package scenery
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// roundTrip saves the scene, loads it back into a zero Scene and checks
+// that saving the loaded scene gives exactly the same bytes
+func roundTrip(t *testing.T, s *Scene) *Scene {
+	t.Helper()
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var loaded Scene
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		t.Fatalf("unmarshal: %v\n%s", err, data)
+	}
+	again, err := json.Marshal(&loaded)
+	if err != nil {
+		t.Fatalf("marshal the loaded scene: %v", err)
+	}
+	if !bytes.Equal(data, again) {
+		t.Errorf("the scene is saved differently after loading:\n%s\n%s", data, again)
+	}
+	return &loaded
+}
+
+func TestSceneRoundTrip(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range append([]string{"../demoscene.json", "../cornellbox.json"}, files...) {
+		t.Run(file, func(t *testing.T) {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var s Scene
+			if err := json.Unmarshal(data, &s); err != nil {
+				t.Fatalf("load: %v", err)
+			}
+			if loaded := roundTrip(t, &s); !reflect.DeepEqual(&s, loaded) {
+				t.Errorf("the scene changed after saving and loading:\n%+v\n%+v", s, *loaded)
+			}
+		})
+	}
+}
+
+func TestRandomSceneRoundTrip(t *testing.T) {
+	for _, seed := range []int64{1, 42, 1234} {
+		s := RandomScene(seed)
+		if loaded := roundTrip(t, s); !reflect.DeepEqual(s, loaded) {
+			t.Errorf("seed %d: the scene changed after saving and loading:\n%+v\n%+v", seed, *s, *loaded)
+		}
+	}
+}
+
+func TestUnmarshalDefaults(t *testing.T) {
+	var s Scene
+	if err := json.Unmarshal([]byte(`[{"body": {"kind": "ball", "center": [0, 0, 0], "radius": 1}, "material": {"kind": "lambertian", "color": "ffffff"}}]`), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Environment != DefaultEnvironment() {
+		t.Errorf("environment = %+v, want the default one", s.Environment)
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0] != '[' {
+		t.Errorf("the scene without sections is not written as an array: %s", data)
+	}
+
+	// loading into a scene replaces its objects
+	if err := json.Unmarshal(data, &s); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.Data[Ball].Objects); n != 1 {
+		t.Errorf("%d balls after loading the scene again, want 1", n)
+	}
+
+	// and its instances
+	instanced := []byte(`{"prototypes": {"ball": {"body": {"kind": "ball", "center": [0, 0, 0], "radius": 1}, "material": {"kind": "lambertian", "color": "ffffff"}}}, "objects": [{"instance": "ball"}]}`)
+	for i := 0; i < 2; i++ {
+		if err := json.Unmarshal(instanced, &s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(s.Instances); n != 1 {
+		t.Errorf("%d instances after loading the scene twice, want 1", n)
+	}
+}
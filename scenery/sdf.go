@@ -0,0 +1,506 @@
+package scenery
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+
+	mgl "github.com/go-gl/mathgl/mgl32"
+
+	"github.com/xopoww/go-raytrace/bvh"
+)
+
+// Signed distance fields describe the bodies by the distance to their surface (negative
+// inside). The fields are built from primitives combined by operators and rendered by sphere
+// tracing: the ray advances by the distance at its end, which never crosses the surface.
+// The operators that stretch the space (twist) scale the distances down to keep them safe
+
+type SDFShape int
+
+const (
+	SDFSphere SDFShape = iota
+	SDFBox
+	SDFTorus
+	SDFCapsule
+	SDFMandelbulb
+	// union of the operands blended over the smoothness distance
+	SDFSmoothUnion
+	// copies of the operand on a grid
+	SDFRepeat
+	// the operand rotated around the y axis proportionally to the height
+	SDFTwist
+	// the end of the operand of repeat or twist (only used in programs)
+	SDFEnd
+)
+
+var sdfShapeNames = [...]string{
+	"sphere", "box", "torus", "capsule", "mandelbulb", "smooth_union", "repeat", "twist", "end",
+}
+
+func (s SDFShape) String() string {
+	return sdfShapeNames[s]
+}
+
+// MaxSDFNodes limits the length of the program of an SDF body (SDF_MAX_NODES in the shader)
+const MaxSDFNodes = 32
+
+const maxMandelbulbIterations = 32
+
+// the margin of the bounds of the SDF bodies
+const sdfBoundsMargin = 0.001
+
+// the escape radius of the mandelbulb: the points farther from its center are not in it
+const mandelbulbRadius = 2.0
+
+type SDFNode struct {
+	Shape SDFShape
+
+	// sphere, torus and mandelbulb
+	Center mgl.Vec3
+	// box corners
+	Min mgl.Vec3
+	Max mgl.Vec3
+	// capsule: ends of the segment
+	Start mgl.Vec3
+	End   mgl.Vec3
+	// sphere and capsule: radius, box: radius of the rounded edges, torus: radius of the ring
+	Radius float32
+	// torus: radius of the tube
+	Thickness float32
+	// mandelbulb
+	Power      float32
+	Iterations int
+	// smooth union
+	Smoothness float32
+	// repeat: distance between the copies and the number of copies on each side of the operand
+	Period mgl.Vec3
+	Count  [3]int
+	// twist: rotation in degrees per unit of height
+	Angle float32
+	// end: factor of the distances of the operand
+	Scale float32
+
+	// smooth union: at least two, repeat and twist: one
+	Operands []SDFNode
+}
+
+// MandelbulbPreset returns the classic mandelbulb of power 8 with the center at the origin
+func MandelbulbPreset() SDFNode {
+	return SDFNode{Shape: SDFMandelbulb, Power: 8.0, Iterations: 8}
+}
+
+var sdfPresets = map[string]func() SDFNode{
+	"mandelbulb": MandelbulbPreset,
+}
+
+func vecFromDict(dict map[string]interface{}, key string) (mgl.Vec3, error) {
+	vI, found := dict[key]
+	if !found {
+		return mgl.Vec3{}, fmt.Errorf("%s not specified", key)
+	}
+	v, err := vec3FromInterface(vI)
+	if err != nil {
+		return mgl.Vec3{}, fmt.Errorf("%s: %w", key, err)
+	}
+	return mgl.Vec3{v[0], v[1], v[2]}, nil
+}
+
+func positiveFromDict(dict map[string]interface{}, key string) (float32, error) {
+	fI, found := dict[key]
+	if !found {
+		return 0.0, fmt.Errorf("%s not specified", key)
+	}
+	f, err := floatFromInterface(fI)
+	if err != nil {
+		return 0.0, fmt.Errorf("%s: %w", key, err)
+	}
+	if f <= 0.0 {
+		return 0.0, fmt.Errorf("%s must be positive", key)
+	}
+	return f, nil
+}
+
+func (n *SDFNode) parseOperand(dict map[string]interface{}) error {
+	oI, found := dict["operand"]
+	if !found {
+		return fmt.Errorf("operand not specified")
+	}
+	oDict, ok := oI.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("invalid operand type")
+	}
+	n.Operands = make([]SDFNode, 1)
+	if err := n.Operands[0].parse(oDict); err != nil {
+		return fmt.Errorf("operand: %w", err)
+	}
+	return nil
+}
+
+func (n *SDFNode) parse(dict map[string]interface{}) error {
+	kindI, found := dict["kind"]
+	if !found {
+		return fmt.Errorf("kind not specified")
+	}
+	kindS, ok := kindI.(string)
+	if !ok {
+		return fmt.Errorf("invalid kind type")
+	}
+	*n = SDFNode{}
+	found = false
+	for shape, name := range sdfShapeNames {
+		if SDFShape(shape) != SDFEnd && name == kindS {
+			n.Shape = SDFShape(shape)
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("unknown kind: %s", kindS)
+	}
+
+	var err error
+	switch n.Shape {
+	case SDFSphere:
+		if n.Center, err = vecFromDict(dict, "center"); err != nil {
+			return err
+		}
+		n.Radius, err = positiveFromDict(dict, "radius")
+		return err
+
+	case SDFBox:
+		if n.Min, err = vecFromDict(dict, "min"); err != nil {
+			return err
+		}
+		if n.Max, err = vecFromDict(dict, "max"); err != nil {
+			return err
+		}
+		size := n.Max.Sub(n.Min)
+		if size.X() <= 0.0 || size.Y() <= 0.0 || size.Z() <= 0.0 {
+			return fmt.Errorf("max must be greater than min")
+		}
+		if rI, found := dict["rounding"]; found {
+			if n.Radius, err = floatFromInterface(rI); err != nil {
+				return fmt.Errorf("rounding: %w", err)
+			}
+			smallest := math.Min(float64(size.X()), math.Min(float64(size.Y()), float64(size.Z())))
+			if n.Radius < 0.0 || 2.0*float64(n.Radius) > smallest {
+				return fmt.Errorf("rounding must be between 0 and half of the smallest side")
+			}
+		}
+		return nil
+
+	case SDFTorus:
+		if n.Center, err = vecFromDict(dict, "center"); err != nil {
+			return err
+		}
+		if n.Radius, err = positiveFromDict(dict, "radius"); err != nil {
+			return err
+		}
+		n.Thickness, err = positiveFromDict(dict, "thickness")
+		return err
+
+	case SDFCapsule:
+		if n.Start, err = vecFromDict(dict, "start"); err != nil {
+			return err
+		}
+		if n.End, err = vecFromDict(dict, "end"); err != nil {
+			return err
+		}
+		n.Radius, err = positiveFromDict(dict, "radius")
+		return err
+
+	case SDFMandelbulb:
+		*n = MandelbulbPreset()
+		if _, found := dict["center"]; found {
+			if n.Center, err = vecFromDict(dict, "center"); err != nil {
+				return err
+			}
+		}
+		if _, found := dict["power"]; found {
+			if n.Power, err = positiveFromDict(dict, "power"); err != nil {
+				return err
+			}
+			if n.Power < 2.0 {
+				return fmt.Errorf("power must be at least 2")
+			}
+		}
+		if _, found := dict["iterations"]; found {
+			it, err := positiveFromDict(dict, "iterations")
+			if err != nil {
+				return err
+			}
+			n.Iterations = int(it)
+			if float32(n.Iterations) != it || n.Iterations > maxMandelbulbIterations {
+				return fmt.Errorf("iterations must be an integer from 1 to %d", maxMandelbulbIterations)
+			}
+		}
+		return nil
+
+	case SDFSmoothUnion:
+		if n.Smoothness, err = positiveFromDict(dict, "smoothness"); err != nil {
+			return err
+		}
+		oI, found := dict["operands"]
+		if !found {
+			return fmt.Errorf("operands not specified")
+		}
+		operands, ok := oI.([]interface{})
+		if !ok {
+			return fmt.Errorf("invalid operands type")
+		}
+		if len(operands) < 2 {
+			return fmt.Errorf("at least 2 operands required")
+		}
+		n.Operands = make([]SDFNode, len(operands))
+		for j := range operands {
+			oDict, ok := operands[j].(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("operand %d: invalid type", j)
+			}
+			if err := n.Operands[j].parse(oDict); err != nil {
+				return fmt.Errorf("operand %d: %w", j, err)
+			}
+		}
+		return nil
+
+	case SDFRepeat:
+		if n.Period, err = vecFromDict(dict, "period"); err != nil {
+			return err
+		}
+		if n.Period.X() <= 0.0 || n.Period.Y() <= 0.0 || n.Period.Z() <= 0.0 {
+			return fmt.Errorf("period must be positive")
+		}
+		count, err := vecFromDict(dict, "count")
+		if err != nil {
+			return err
+		}
+		for i := range count {
+			n.Count[i] = int(count[i])
+			if float32(n.Count[i]) != count[i] || n.Count[i] < 0 {
+				return fmt.Errorf("count must be made of non-negative integers")
+			}
+		}
+		return n.parseOperand(dict)
+
+	case SDFTwist:
+		aI, found := dict["angle"]
+		if !found {
+			return fmt.Errorf("angle not specified")
+		}
+		if n.Angle, err = floatFromInterface(aI); err != nil {
+			return fmt.Errorf("angle: %w", err)
+		}
+		return n.parseOperand(dict)
+	}
+	return nil
+}
+
+func (n *SDFNode) UnmarshalJSON(data []byte) error {
+	dict := make(map[string]interface{})
+	err := json.Unmarshal(data, &dict)
+	if err != nil {
+		return err
+	}
+	return n.parse(dict)
+}
+
+type sdfNodeJSON struct {
+	Kind       string    `json:"kind"`
+	Center     *mgl.Vec3 `json:"center,omitempty"`
+	Min        *mgl.Vec3 `json:"min,omitempty"`
+	Max        *mgl.Vec3 `json:"max,omitempty"`
+	Start      *mgl.Vec3 `json:"start,omitempty"`
+	End        *mgl.Vec3 `json:"end,omitempty"`
+	Radius     *float32  `json:"radius,omitempty"`
+	Rounding   *float32  `json:"rounding,omitempty"`
+	Thickness  *float32  `json:"thickness,omitempty"`
+	Power      *float32  `json:"power,omitempty"`
+	Iterations *int      `json:"iterations,omitempty"`
+	Smoothness *float32  `json:"smoothness,omitempty"`
+	Period     *mgl.Vec3 `json:"period,omitempty"`
+	Count      *[3]int   `json:"count,omitempty"`
+	Angle      *float32  `json:"angle,omitempty"`
+	Operand    *SDFNode  `json:"operand,omitempty"`
+	Operands   []SDFNode `json:"operands,omitempty"`
+}
+
+func (n SDFNode) MarshalJSON() ([]byte, error) {
+	result := sdfNodeJSON{Kind: n.Shape.String()}
+	switch n.Shape {
+	case SDFSphere:
+		result.Center, result.Radius = &n.Center, &n.Radius
+	case SDFBox:
+		result.Min, result.Max, result.Rounding = &n.Min, &n.Max, &n.Radius
+	case SDFTorus:
+		result.Center, result.Radius, result.Thickness = &n.Center, &n.Radius, &n.Thickness
+	case SDFCapsule:
+		result.Start, result.End, result.Radius = &n.Start, &n.End, &n.Radius
+	case SDFMandelbulb:
+		result.Center, result.Power, result.Iterations = &n.Center, &n.Power, &n.Iterations
+	case SDFSmoothUnion:
+		result.Smoothness, result.Operands = &n.Smoothness, n.Operands
+	case SDFRepeat:
+		result.Period, result.Count, result.Operand = &n.Period, &n.Count, &n.Operands[0]
+	case SDFTwist:
+		result.Angle, result.Operand = &n.Angle, &n.Operands[0]
+	default:
+		return nil, fmt.Errorf("unknown kind: %d", n.Shape)
+	}
+	return json.Marshal(result)
+}
+
+func parseSDF(dict map[string]interface{}) (Body, error) {
+	shapeI, hasShape := dict["shape"]
+	presetI, hasPreset := dict["preset"]
+	b := Body{Kind: SDF}
+	switch {
+	case hasShape && hasPreset:
+		return Body{}, fmt.Errorf("both shape and preset specified")
+	case hasShape:
+		shape, ok := shapeI.(map[string]interface{})
+		if !ok {
+			return Body{}, fmt.Errorf("invalid shape type")
+		}
+		b.Shape = &SDFNode{}
+		if err := b.Shape.parse(shape); err != nil {
+			return Body{}, fmt.Errorf("shape: %w", err)
+		}
+	case hasPreset:
+		preset, ok := presetI.(string)
+		if !ok {
+			return Body{}, fmt.Errorf("invalid preset type")
+		}
+		newPreset, found := sdfPresets[preset]
+		if !found {
+			return Body{}, fmt.Errorf("unknown preset: %s", preset)
+		}
+		shape := newPreset()
+		b.Shape = &shape
+	default:
+		return Body{}, fmt.Errorf("neither shape nor preset specified")
+	}
+	if len(b.Shape.Program()) > MaxSDFNodes {
+		return Body{}, fmt.Errorf("more than %d nodes", MaxSDFNodes)
+	}
+	return b, nil
+}
+
+// Program returns the tree flattened for the evaluation in the postfix order: the primitives
+// compute their distances, the smooth unions combine the two distances computed before them
+// (unions of more operands are split into several nodes as in CSGProgram), repeat and twist
+// change the point for the nodes of their operand, and the end after it restores the point
+// and scales the distance
+func (n SDFNode) Program() []SDFNode {
+	return n.appendProgram(nil)
+}
+
+func (n SDFNode) appendProgram(program []SDFNode) []SDFNode {
+	node := n
+	node.Operands = nil
+	switch n.Shape {
+	case SDFSmoothUnion:
+		for j, o := range n.Operands {
+			program = o.appendProgram(program)
+			if j > 0 {
+				program = append(program, node)
+			}
+		}
+		return program
+	case SDFRepeat, SDFTwist:
+		program = append(program, node)
+		program = n.Operands[0].appendProgram(program)
+		return append(program, SDFNode{Shape: SDFEnd, Scale: n.distanceScale()})
+	}
+	return append(program, node)
+}
+
+// distanceScale returns the factor which keeps the distances of the operand safe. The twist
+// moves the points at the distance r from the axis faster by the rotation, at most by
+// the angle (in radians) times r per unit of height
+func (n SDFNode) distanceScale() float32 {
+	if n.Shape != SDFTwist {
+		return 1.0
+	}
+	rate := mgl.Abs(mgl.DegToRad(n.Angle))
+	return 1.0 / (1.0 + rate*radiusXZ(n.Operands[0].Bounds()))
+}
+
+// radiusXZ returns the distance from the y axis to the farthest point of the box
+func radiusXZ(a bvh.AABB) float32 {
+	x := math.Max(math.Abs(float64(a.Min.X())), math.Abs(float64(a.Max.X())))
+	z := math.Max(math.Abs(float64(a.Min.Z())), math.Abs(float64(a.Max.Z())))
+	return float32(math.Sqrt(x*x + z*z))
+}
+
+// Bounds returns the axis-aligned bounding box of the field
+func (n SDFNode) Bounds() bvh.AABB {
+	vec := func(f float32) mgl.Vec3 {
+		return mgl.Vec3{f, f, f}
+	}
+	switch n.Shape {
+	case SDFSphere:
+		return bvh.NewAABB(n.Center.Sub(vec(n.Radius)), n.Center.Add(vec(n.Radius)))
+	case SDFBox:
+		return bvh.NewAABB(n.Min, n.Max)
+	case SDFTorus:
+		e := mgl.Vec3{n.Radius + n.Thickness, n.Thickness, n.Radius + n.Thickness}
+		return bvh.NewAABB(n.Center.Sub(e), n.Center.Add(e))
+	case SDFCapsule:
+		a := bvh.NewAABB(n.Start, n.End)
+		return bvh.NewAABB(a.Min.Sub(vec(n.Radius)), a.Max.Add(vec(n.Radius)))
+	case SDFMandelbulb:
+		return bvh.NewAABB(n.Center.Sub(vec(mandelbulbRadius)), n.Center.Add(vec(mandelbulbRadius)))
+	case SDFSmoothUnion:
+		// the blending adds at most a quarter of the smoothness to the distances
+		a := bvh.EmptyAABB()
+		for _, o := range n.Operands {
+			a = a.Union(o.Bounds())
+		}
+		return bvh.NewAABB(a.Min.Sub(vec(n.Smoothness/4.0)), a.Max.Add(vec(n.Smoothness/4.0)))
+	case SDFRepeat:
+		a := n.Operands[0].Bounds()
+		var offset mgl.Vec3
+		for i := range offset {
+			offset[i] = n.Period[i] * float32(n.Count[i])
+		}
+		return bvh.NewAABB(a.Min.Sub(offset), a.Max.Add(offset))
+	case SDFTwist:
+		a := n.Operands[0].Bounds()
+		r := radiusXZ(a)
+		return bvh.NewAABB(mgl.Vec3{-r, a.Min.Y(), -r}, mgl.Vec3{r, a.Max.Y(), r})
+	}
+	return bvh.EmptyAABB()
+}
+
+func (n SDFNode) description() string {
+	switch n.Shape {
+	case SDFSphere:
+		return fmt.Sprintf("sphere(%v, %f)", n.Center, n.Radius)
+	case SDFBox:
+		return fmt.Sprintf("box(%v, %v, rounding = %f)", n.Min, n.Max, n.Radius)
+	case SDFTorus:
+		return fmt.Sprintf("torus(%v, %f, thickness = %f)", n.Center, n.Radius, n.Thickness)
+	case SDFCapsule:
+		return fmt.Sprintf("capsule(%v, %v, %f)", n.Start, n.End, n.Radius)
+	case SDFMandelbulb:
+		return fmt.Sprintf("mandelbulb(%v, power = %f, iterations = %d)", n.Center, n.Power, n.Iterations)
+	case SDFSmoothUnion:
+		operands := make([]string, len(n.Operands))
+		for j, o := range n.Operands {
+			operands[j] = o.description()
+		}
+		return fmt.Sprintf("smooth_union(%s, smoothness = %f)", strings.Join(operands, ", "), n.Smoothness)
+	case SDFRepeat:
+		return fmt.Sprintf("repeat(%s, period = %v, count = %v)", n.Operands[0].description(), n.Period, n.Count)
+	case SDFTwist:
+		return fmt.Sprintf("twist(%s, angle = %f)", n.Operands[0].description(), n.Angle)
+	}
+	return "end"
+}
+
+func NewSDF(shape SDFNode) Body {
+	return Body{
+		Kind:  SDF,
+		Shape: &shape,
+	}
+}
@@ -0,0 +1,53 @@
+package scenery
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSDFRoundTrip(t *testing.T) {
+	for _, body := range []string{
+		`{"kind": "sdf", "preset": "mandelbulb"}`,
+		`{"kind": "sdf", "shape": {"kind": "smooth_union", "smoothness": 0.5, "operands": [{"kind": "sphere", "center": [0, 1, 0], "radius": 0.7}, {"kind": "torus", "center": [0, 1.8, 0], "radius": 0.6, "thickness": 0.15}]}}`,
+		`{"kind": "sdf", "shape": {"kind": "twist", "angle": 60, "operand": {"kind": "box", "min": [-0.4, 0, -0.4], "max": [0.4, 2.5, 0.4], "rounding": 0.05}}}`,
+		`{"kind": "sdf", "shape": {"kind": "repeat", "period": [1, 1, 1], "count": [5, 0, 5], "operand": {"kind": "capsule", "start": [0, 0.2, -0.2], "end": [0, 0.2, 0.2], "radius": 0.2}}}`,
+	} {
+		var b Body
+		if err := json.Unmarshal([]byte(body), &b); err != nil {
+			t.Errorf("%s: %v", body, err)
+			continue
+		}
+		data, err := json.Marshal(b)
+		if err != nil {
+			t.Errorf("%s: marshal: %v", body, err)
+			continue
+		}
+		var loaded Body
+		if err := json.Unmarshal(data, &loaded); err != nil {
+			t.Errorf("%s: unmarshal %s: %v", body, data, err)
+		} else if !reflect.DeepEqual(b, loaded) {
+			t.Errorf("%s: the body changed after saving and loading: %s", body, data)
+		}
+	}
+}
+
+func TestParseSDFErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name, body string
+	}{
+		{"neither shape nor preset", `{"kind": "sdf"}`},
+		{"both shape and preset", `{"kind": "sdf", "preset": "mandelbulb", "shape": {"kind": "sphere", "center": [0, 0, 0], "radius": 1}}`},
+		{"unknown preset", `{"kind": "sdf", "preset": "teapot"}`},
+		{"missing kind", `{"kind": "sdf", "shape": {"center": [0, 0, 0], "radius": 1}}`},
+		{"old shape tag", `{"kind": "sdf", "shape": {"shape": "sphere", "center": [0, 0, 0], "radius": 1}}`},
+		{"unknown kind", `{"kind": "sdf", "shape": {"kind": "cube", "center": [0, 0, 0]}}`},
+		{"missing radius", `{"kind": "sdf", "shape": {"kind": "sphere", "center": [0, 0, 0]}}`},
+		{"missing operand", `{"kind": "sdf", "shape": {"kind": "twist", "angle": 30}}`},
+	} {
+		var b Body
+		if err := json.Unmarshal([]byte(tc.body), &b); err == nil {
+			t.Errorf("%s: no error", tc.name)
+		}
+	}
+}
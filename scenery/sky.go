@@ -0,0 +1,203 @@
+package scenery
+
+import (
+	"math"
+	"time"
+
+	mgl "github.com/go-gl/mathgl/mgl32"
+)
+
+// Analytic daylight model of Preetham et al. ("A Practical Analytic Model
+// for Daylight", 1999). The sky is baked into an equirectangular image, so
+// it is rendered and sampled exactly like an environment map; the sun is
+// a directional light plus a small disk drawn on top of the sky
+
+const (
+	// sky luminance is measured in units of 33 kcd/m^2, so that the zenith
+	// of a clear day sky has a value about 0.5 and the ground lit by
+	// the sun high above is not overexposed
+	skyScale = 0.03
+	// illuminance of the sun outside of the atmosphere (~128 klx)
+	sunExtraterrestrial = 128.0 * skyScale
+	// angular radius of the sun disk in degrees
+	sunAngularRadius = 0.265
+
+	skyImageWidth  = 512
+	skyImageHeight = 256
+)
+
+// SunDirection returns the direction from the scene to the sun. The elevation
+// is measured from the horizon, the azimuth from the north (-z axis)
+// towards the east (+x axis), both in degrees
+func SunDirection(elevation, azimuth float32) mgl.Vec3 {
+	el := float64(mgl.DegToRad(elevation))
+	az := float64(mgl.DegToRad(azimuth))
+	return mgl.Vec3{
+		float32(math.Sin(az) * math.Cos(el)),
+		float32(math.Sin(el)),
+		float32(-math.Cos(az) * math.Cos(el)),
+	}
+}
+
+// SunPosition returns the elevation and the azimuth of the sun (in degrees) seen
+// at the moment t from the point with given latitude and longitude (in degrees,
+// positive to the north and to the east). Uses the NOAA approximations
+func SunPosition(t time.Time, latitude, longitude float64) (elevation, azimuth float32) {
+	t = t.UTC()
+	hours := float64(t.Hour()) + float64(t.Minute())/60.0 + float64(t.Second())/3600.0
+	g := 2.0 * math.Pi / 365.0 * (float64(t.YearDay()-1) + (hours-12.0)/24.0)
+
+	// equation of time (in minutes) and declination of the sun
+	eqTime := 229.18 * (0.000075 + 0.001868*math.Cos(g) - 0.032077*math.Sin(g) -
+		0.014615*math.Cos(2*g) - 0.040849*math.Sin(2*g))
+	decl := 0.006918 - 0.399912*math.Cos(g) + 0.070257*math.Sin(g) -
+		0.006758*math.Cos(2*g) + 0.000907*math.Sin(2*g) -
+		0.002697*math.Cos(3*g) + 0.00148*math.Sin(3*g)
+
+	solarMinutes := hours*60.0 + eqTime + 4.0*longitude
+	hourAngle := (solarMinutes/4.0 - 180.0) * math.Pi / 180.0
+	lat := latitude * math.Pi / 180.0
+
+	cosZenith := math.Sin(lat)*math.Sin(decl) + math.Cos(lat)*math.Cos(decl)*math.Cos(hourAngle)
+	zenith := math.Acos(math.Max(-1.0, math.Min(1.0, cosZenith)))
+	az := math.Atan2(math.Sin(hourAngle), math.Cos(hourAngle)*math.Sin(lat)-math.Tan(decl)*math.Cos(lat)) + math.Pi
+
+	return float32(90.0 - zenith*180.0/math.Pi), float32(math.Mod(az*180.0/math.Pi, 360.0))
+}
+
+// coefficients of the Perez distribution function
+type perez [5]float64
+
+func (p perez) f(cosTheta, gamma float64) float64 {
+	cosGamma := math.Cos(gamma)
+	return (1.0 + p[0]*math.Exp(p[1]/cosTheta)) *
+		(1.0 + p[2]*math.Exp(p[3]*gamma) + p[4]*cosGamma*cosGamma)
+}
+
+type preetham struct {
+	sun mgl.Vec3
+	// distributions and zenith values of the luminance and the chromaticity
+	perezY, perezX, perezYc perez
+	zenith                  [3]float64
+	// relative to the zenith: perez(0, thetaS)
+	norm [3]float64
+}
+
+func newPreetham(turbidity float64, sun mgl.Vec3) preetham {
+	t := turbidity
+	// the model is only defined for the sun above the horizon
+	thetaS := math.Acos(math.Max(float64(sun.Y()), 0.0))
+
+	p := preetham{
+		sun:     sun,
+		perezY:  perez{0.1787*t - 1.4630, -0.3554*t + 0.4275, -0.0227*t + 5.3251, 0.1206*t - 2.5771, -0.0670*t + 0.3703},
+		perezX:  perez{-0.0193*t - 0.2592, -0.0665*t + 0.0008, -0.0004*t + 0.2125, -0.0641*t - 0.8989, -0.0033*t + 0.0452},
+		perezYc: perez{-0.0167*t - 0.2608, -0.0950*t + 0.0092, -0.0079*t + 0.2102, -0.0441*t - 1.6537, -0.0109*t + 0.0529},
+	}
+
+	chi := (4.0/9.0 - t/120.0) * (math.Pi - 2.0*thetaS)
+	p.zenith[0] = (4.0453*t-4.9710)*math.Tan(chi) - 0.2155*t + 2.4192
+
+	th := [4]float64{thetaS * thetaS * thetaS, thetaS * thetaS, thetaS, 1.0}
+	chroma := func(m [3][4]float64) float64 {
+		var r [3]float64
+		for i := range m {
+			for j := range th {
+				r[i] += m[i][j] * th[j]
+			}
+		}
+		return t*t*r[0] + t*r[1] + r[2]
+	}
+	p.zenith[1] = chroma([3][4]float64{
+		{0.00166, -0.00375, 0.00209, 0.0},
+		{-0.02903, 0.06377, -0.03202, 0.00394},
+		{0.11693, -0.21196, 0.06052, 0.25886},
+	})
+	p.zenith[2] = chroma([3][4]float64{
+		{0.00275, -0.00610, 0.00317, 0.0},
+		{-0.04214, 0.08970, -0.04153, 0.00516},
+		{0.15346, -0.26756, 0.06670, 0.26688},
+	})
+
+	for i, d := range [3]perez{p.perezY, p.perezX, p.perezYc} {
+		p.norm[i] = d.f(1.0, thetaS)
+	}
+	return p
+}
+
+// radiance of the sky in the direction (which must be above the horizon) in linear sRGB
+func (p *preetham) radiance(dir mgl.Vec3) mgl.Vec3 {
+	cosTheta := math.Max(float64(dir.Y()), 0.01)
+	gamma := math.Acos(math.Max(-1.0, math.Min(1.0, float64(dir.Dot(p.sun)))))
+
+	Y := p.zenith[0] * p.perezY.f(cosTheta, gamma) / p.norm[0]
+	x := p.zenith[1] * p.perezX.f(cosTheta, gamma) / p.norm[1]
+	y := p.zenith[2] * p.perezYc.f(cosTheta, gamma) / p.norm[2]
+
+	// xyY -> XYZ -> linear sRGB
+	X := x / y * Y
+	Z := (1.0 - x - y) / y * Y
+	rgb := mgl.Vec3{
+		float32(3.2406*X - 1.5372*Y - 0.4986*Z),
+		float32(-0.9689*X + 1.8758*Y + 0.0415*Z),
+		float32(0.0557*X - 0.2040*Y + 1.0570*Z),
+	}
+	for i := range rgb {
+		rgb[i] = float32(math.Max(float64(rgb[i]), 0.0)) * skyScale
+	}
+	return rgb
+}
+
+// sunIlluminance returns the illuminance from the sun at the ground for each color
+// channel, attenuated by the Rayleigh scattering and the aerosols of the atmosphere
+func sunIlluminance(turbidity float64, sun mgl.Vec3) mgl.Vec3 {
+	if sun.Y() <= 0.0 {
+		return mgl.Vec3{}
+	}
+	zenith := math.Acos(float64(sun.Y())) * 180.0 / math.Pi
+	// Kasten and Young formula for the relative air mass
+	airMass := 1.0 / (float64(sun.Y()) + 0.50572*math.Pow(96.07995-zenith, -1.6364))
+	beta := 0.04608*turbidity - 0.04586
+
+	var result mgl.Vec3
+	// wavelengths of red, green and blue in micrometers
+	for i, lambda := range [3]float64{0.68, 0.55, 0.44} {
+		rayleigh := 0.008735 * math.Pow(lambda, -4.08)
+		aerosol := beta * math.Pow(lambda, -1.3)
+		result[i] = float32(sunExtraterrestrial * math.Exp(-airMass*(rayleigh+aerosol)))
+	}
+	return result
+}
+
+// skyImage bakes the sky (without the sun disk) into an equirectangular image with
+// the same mapping as the environment maps. Directions below the horizon get
+// the color of the horizon multiplied by the ground color
+func skyImage(turbidity float64, sun mgl.Vec3, ground mgl.Vec3) *Image {
+	p := newPreetham(turbidity, sun)
+	img := &Image{
+		Width:  skyImageWidth,
+		Height: skyImageHeight,
+		Pix:    make([]float32, 0, 3*skyImageWidth*skyImageHeight),
+	}
+	for y := 0; y < img.Height; y++ {
+		theta := math.Pi * (float64(y) + 0.5) / float64(img.Height)
+		for x := 0; x < img.Width; x++ {
+			phi := (2.0*(float64(x)+0.5)/float64(img.Width) - 1.0) * math.Pi
+			dir := mgl.Vec3{
+				float32(math.Sin(theta) * math.Sin(phi)),
+				float32(math.Cos(theta)),
+				float32(-math.Sin(theta) * math.Cos(phi)),
+			}
+			var c mgl.Vec3
+			if dir.Y() >= 0.0 {
+				c = p.radiance(dir)
+			} else {
+				horizon := mgl.Vec3{dir.X(), 0.0, dir.Z()}.Normalize()
+				c = p.radiance(horizon)
+				c = mgl.Vec3{c[0] * ground[0], c[1] * ground[1], c[2] * ground[2]}
+			}
+			img.Pix = append(img.Pix, c[0], c[1], c[2])
+		}
+	}
+	return img
+}
@@ -0,0 +1,392 @@
+package scenery
+
+import (
+	"fmt"
+	"image/color"
+)
+
+// Textures give the color (or the roughness) of the material at every point
+// of its surface. Procedural textures compute a pattern in range [0, 1] from
+// the position of the point in the scene, which blends two colors (or two values).
+// Image textures are looked up by the texture coordinates of the point.
+// Bump maps tilt the normal by the slope of the pattern, normal maps are images
+// of the normals in the tangent space of the surface
+
+type TextureKind int
+
+const (
+	// 3D checkerboard of cubic cells
+	Checker TextureKind = iota
+	// Perlin gradient noise
+	Noise
+	// stripes across the x axis distorted by turbulence
+	Marble
+	// rings around the y axis distorted by noise
+	Wood
+	// PNG or JPEG image
+	ImageTexture
+)
+
+var textureKindNames = [...]string{"checker", "noise", "marble", "wood", "image"}
+
+// WrapMode tells how the texture coordinates outside of [0, 1] are mapped to the image
+type WrapMode int
+
+const (
+	Repeat WrapMode = iota
+	// the texels at the edges are repeated
+	Clamp
+	// every other copy of the image is mirrored
+	MirroredRepeat
+)
+
+var wrapModeNames = [...]string{"repeat", "clamp", "mirror"}
+
+func (wm WrapMode) String() string {
+	return wrapModeNames[wm]
+}
+
+func (tk TextureKind) String() string {
+	return textureKindNames[tk]
+}
+
+type Texture struct {
+	Kind TextureKind
+	// size of the pattern: the side of a checker cell, the period
+	// of the marble stripes and the wood rings, the features of the noise.
+	// Images are scaled in the texture coordinates, e.g. repeated twice
+	// across the face of a box with scale 0.5
+	Scale float32
+	// marble and wood: how much the stripes and the rings are distorted
+	Turbulence float32
+
+	// colors blended by color textures and values (of the roughness)
+	// blended by the other ones
+	Colors [2]color.RGBA
+	Values [2]float32
+
+	// image: path to the file, its wrap mode and the image itself (nil until
+	// it is loaded by Scene.LoadAssets). Values are blended by the luminance of the image
+	File  string
+	Wrap  WrapMode
+	Image *Image
+
+	// bump and normal maps: how much the normal is tilted. The slope of the bumps
+	// is the strength times the change of the pattern over its scale (or the difference
+	// of the luminance of neighbouring texels for images)
+	Strength float32
+}
+
+func NewColorTexture(kind TextureKind, scale float32, c0, c1 color.RGBA) *Texture {
+	return &Texture{
+		Kind:       kind,
+		Scale:      scale,
+		Turbulence: 1.0,
+		Colors:     [2]color.RGBA{c0, c1},
+	}
+}
+
+func NewValueTexture(kind TextureKind, scale float32, v0, v1 float32) *Texture {
+	return &Texture{
+		Kind:       kind,
+		Scale:      scale,
+		Turbulence: 1.0,
+		Values:     [2]float32{v0, v1},
+	}
+}
+
+func NewImageTexture(file string, scale float32, wrap WrapMode) *Texture {
+	return &Texture{
+		Kind:       ImageTexture,
+		Scale:      scale,
+		Turbulence: 1.0,
+		File:       file,
+		Wrap:       wrap,
+		Strength:   1.0,
+	}
+}
+
+// NewBumpMap returns the procedural bump map, e.g. of noise for hammered metal
+func NewBumpMap(kind TextureKind, scale, strength float32) *Texture {
+	return &Texture{
+		Kind:       kind,
+		Scale:      scale,
+		Turbulence: 1.0,
+		Strength:   strength,
+	}
+}
+
+// Average returns the color in the middle between the two colors of the texture
+// (white for images)
+func (t *Texture) Average() color.RGBA {
+	if t.Kind == ImageTexture {
+		return color.RGBA{0xff, 0xff, 0xff, 0xff}
+	}
+	avg := func(a, b uint8) uint8 {
+		return uint8((uint16(a) + uint16(b) + 1) / 2)
+	}
+	c0, c1 := t.Colors[0], t.Colors[1]
+	return color.RGBA{avg(c0.R, c1.R), avg(c0.G, c1.G), avg(c0.B, c1.B), 0xff}
+}
+
+func (t *Texture) parse(dict map[string]interface{}) error {
+	kindI, found := dict["kind"]
+	if !found {
+		return fmt.Errorf("kind not specified")
+	}
+	kindS, ok := kindI.(string)
+	if !ok {
+		return fmt.Errorf("invalid kind type")
+	}
+	found = false
+	for kind, name := range textureKindNames {
+		if name == kindS {
+			t.Kind = TextureKind(kind)
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("unknown kind: %s", kindS)
+	}
+
+	var err error
+	// images cover the whole surface by default
+	t.Scale = 1.0
+	scaleI, found := dict["scale"]
+	if found {
+		t.Scale, err = floatFromInterface(scaleI)
+		if err != nil {
+			return fmt.Errorf("scale: %w", err)
+		}
+		if t.Scale <= 0.0 {
+			return fmt.Errorf("scale must be positive")
+		}
+	} else if t.Kind != ImageTexture {
+		return fmt.Errorf("scale not specified")
+	}
+
+	if t.Kind == ImageTexture {
+		if err := t.parseImage(dict); err != nil {
+			return err
+		}
+	}
+
+	t.Turbulence = 1.0
+	if turbI, found := dict["turbulence"]; found {
+		t.Turbulence, err = floatFromInterface(turbI)
+		if err != nil {
+			return fmt.Errorf("turbulence: %w", err)
+		}
+		if t.Turbulence < 0.0 {
+			return fmt.Errorf("turbulence must not be negative")
+		}
+	}
+	return nil
+}
+
+// mapFromInterface parses the bump or normal map
+func mapFromInterface(i interface{}) (*Texture, error) {
+	dict, ok := i.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid type")
+	}
+	t := &Texture{}
+	if err := t.parse(dict); err != nil {
+		return nil, err
+	}
+	t.Strength = 1.0
+	if strI, found := dict["strength"]; found {
+		var err error
+		t.Strength, err = floatFromInterface(strI)
+		if err != nil {
+			return nil, fmt.Errorf("strength: %w", err)
+		}
+		if t.Strength < 0.0 {
+			return nil, fmt.Errorf("strength must not be negative")
+		}
+	}
+	return t, nil
+}
+
+func (t *Texture) parseImage(dict map[string]interface{}) error {
+	fileI, found := dict["file"]
+	if !found {
+		return fmt.Errorf("file not specified")
+	}
+	file, ok := fileI.(string)
+	if !ok {
+		return fmt.Errorf("invalid file type")
+	}
+	t.File = file
+
+	t.Wrap = Repeat
+	if wrapI, found := dict["wrap"]; found {
+		wrapS, ok := wrapI.(string)
+		if !ok {
+			return fmt.Errorf("invalid wrap type")
+		}
+		found = false
+		for mode, name := range wrapModeNames {
+			if name == wrapS {
+				t.Wrap = WrapMode(mode)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown wrap: %s", wrapS)
+		}
+	}
+	return nil
+}
+
+// pairFromDict returns the array of two elements with given key
+func pairFromDict(dict map[string]interface{}, key string) ([]interface{}, error) {
+	pairI, found := dict[key]
+	if !found {
+		return nil, fmt.Errorf("%s not specified", key)
+	}
+	pair, ok := pairI.([]interface{})
+	if !ok || len(pair) != 2 {
+		return nil, fmt.Errorf("%s: not array of length 2", key)
+	}
+	return pair, nil
+}
+
+// colorTextureFromInterface parses the texture which blends two colors
+func colorTextureFromInterface(i interface{}) (*Texture, error) {
+	dict, ok := i.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid type")
+	}
+	t := &Texture{}
+	if err := t.parse(dict); err != nil {
+		return nil, err
+	}
+	if t.Kind == ImageTexture {
+		return t, nil
+	}
+	pair, err := pairFromDict(dict, "colors")
+	if err != nil {
+		return nil, err
+	}
+	for j := range pair {
+		t.Colors[j], err = colorFromInterface(pair[j])
+		if err != nil {
+			return nil, fmt.Errorf("colors: %w", err)
+		}
+	}
+	return t, nil
+}
+
+// valueTextureFromInterface parses the texture which blends two values in range [0, 1]
+func valueTextureFromInterface(i interface{}) (*Texture, error) {
+	dict, ok := i.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid type")
+	}
+	t := &Texture{}
+	if err := t.parse(dict); err != nil {
+		return nil, err
+	}
+	pair, err := pairFromDict(dict, "values")
+	if err != nil {
+		return nil, err
+	}
+	for j := range pair {
+		t.Values[j], err = floatFromInterface(pair[j])
+		if err != nil {
+			return nil, fmt.Errorf("values: %w", err)
+		}
+		if t.Values[j] < 0.0 || t.Values[j] > 1.0 {
+			return nil, fmt.Errorf("values must be in range [0, 1]")
+		}
+	}
+	return t, nil
+}
+
+type textureJSON struct {
+	Kind       string    `json:"kind"`
+	Scale      float32   `json:"scale"`
+	Turbulence *float32  `json:"turbulence,omitempty"`
+	Colors     []string  `json:"colors,omitempty"`
+	Values     []float32 `json:"values,omitempty"`
+	File       string    `json:"file,omitempty"`
+	Wrap       string    `json:"wrap,omitempty"`
+	Strength   *float32  `json:"strength,omitempty"`
+}
+
+func newTextureJSON(t *Texture) textureJSON {
+	result := textureJSON{
+		Kind:  t.Kind.String(),
+		Scale: t.Scale,
+	}
+	if t.Kind == ImageTexture {
+		result.File = t.File
+		result.Wrap = t.Wrap.String()
+	} else {
+		turbulence := t.Turbulence
+		result.Turbulence = &turbulence
+	}
+	return result
+}
+
+// colorJSON returns the value of the color key of the material: the hex string
+// of the color or the texture (if it is not nil)
+func colorJSON(c color.RGBA, t *Texture) interface{} {
+	if t == nil {
+		return colorToHex(c)
+	}
+	result := newTextureJSON(t)
+	if t.Kind != ImageTexture {
+		result.Colors = []string{colorToHex(t.Colors[0]), colorToHex(t.Colors[1])}
+	}
+	return result
+}
+
+// valueJSON is the same as colorJSON for the textures of values
+func valueJSON(v float32, t *Texture) interface{} {
+	if t == nil {
+		return v
+	}
+	result := newTextureJSON(t)
+	result.Values = []float32{t.Values[0], t.Values[1]}
+	return result
+}
+
+// mapJSON returns the value of the bump or normal map key of the material (nil if there is no map)
+func mapJSON(t *Texture) interface{} {
+	if t == nil {
+		return nil
+	}
+	result := newTextureJSON(t)
+	strength := t.Strength
+	result.Strength = &strength
+	return result
+}
+
+func colorDescription(c color.RGBA, t *Texture) string {
+	if t == nil {
+		return colorToString(c)
+	}
+	if t.Kind == ImageTexture {
+		return fmt.Sprintf("image(%q, scale = %f, wrap = %s)", t.File, t.Scale, t.Wrap)
+	}
+	return fmt.Sprintf("%s(scale = %f, %s, %s)", t.Kind, t.Scale, colorToString(t.Colors[0]), colorToString(t.Colors[1]))
+}
+
+func valueDescription(v float32, t *Texture) string {
+	if t == nil {
+		return fmt.Sprintf("%f", v)
+	}
+	if t.Kind == ImageTexture {
+		return fmt.Sprintf("image(%q, scale = %f, wrap = %s, %f, %f)", t.File, t.Scale, t.Wrap, t.Values[0], t.Values[1])
+	}
+	return fmt.Sprintf("%s(scale = %f, %f, %f)", t.Kind, t.Scale, t.Values[0], t.Values[1])
+}
+
+func mapDescription(t *Texture) string {
+	if t.Kind == ImageTexture {
+		return fmt.Sprintf("image(%q, scale = %f, wrap = %s, strength = %f)", t.File, t.Scale, t.Wrap, t.Strength)
+	}
+	return fmt.Sprintf("%s(scale = %f, strength = %f)", t.Kind, t.Scale, t.Strength)
+}
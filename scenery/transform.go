@@ -0,0 +1,200 @@
+package scenery
+
+import (
+	"encoding/json"
+	"fmt"
+
+	mgl "github.com/go-gl/mathgl/mgl32"
+)
+
+// Transforms place the bodies in the scene: the body is defined in its own (object)
+// space, and the transform maps it to the world. Rays are transformed into the object
+// space to be intersected with the body (the ray parameter stays the same, so the
+// distances need no conversion) and the normals are transformed back to the world
+
+type Transform struct {
+	// the body is scaled first, then rotated and then translated
+	Translation mgl.Vec3
+	Rotation    mgl.Quat
+	Scale       mgl.Vec3
+	// affine matrix used instead of the above (nil if not given)
+	Matrix *mgl.Mat4
+}
+
+func NewTransform(translation mgl.Vec3, rotation mgl.Quat, scale mgl.Vec3) *Transform {
+	return &Transform{
+		Translation: translation,
+		Rotation:    rotation,
+		Scale:       scale,
+	}
+}
+
+// ToWorld returns the matrix of the transform from the object space to the world
+func (t *Transform) ToWorld() mgl.Mat4 {
+	if t == nil {
+		return mgl.Ident4()
+	}
+	if t.Matrix != nil {
+		return *t.Matrix
+	}
+	tr := mgl.Translate3D(t.Translation.X(), t.Translation.Y(), t.Translation.Z())
+	sc := mgl.Scale3D(t.Scale.X(), t.Scale.Y(), t.Scale.Z())
+	return tr.Mul4(t.Rotation.Normalize().Mat4()).Mul4(sc)
+}
+
+// ToObject returns the matrix of the transform from the world to the object space
+func (t *Transform) ToObject() mgl.Mat4 {
+	return t.ToWorld().Inv()
+}
+
+// eulerToQuat returns the rotation by the angles (in degrees) around the x,
+// the y and the z axes, in that order
+func eulerToQuat(angles mgl.Vec3) mgl.Quat {
+	qx := mgl.QuatRotate(mgl.DegToRad(angles.X()), mgl.Vec3{1.0, 0.0, 0.0})
+	qy := mgl.QuatRotate(mgl.DegToRad(angles.Y()), mgl.Vec3{0.0, 1.0, 0.0})
+	qz := mgl.QuatRotate(mgl.DegToRad(angles.Z()), mgl.Vec3{0.0, 0.0, 1.0})
+	return qz.Mul(qy).Mul(qx)
+}
+
+// matrixFromInterface parses the matrix written as an array of 4 rows. It must be affine
+// (the last row is 0, 0, 0, 1) and invertible
+func matrixFromInterface(i interface{}) (mgl.Mat4, error) {
+	rows, ok := i.([]interface{})
+	if !ok || len(rows) != 4 {
+		return mgl.Mat4{}, fmt.Errorf("not array of 4 rows")
+	}
+	var m mgl.Mat4
+	for r := range rows {
+		row, ok := rows[r].([]interface{})
+		if !ok || len(row) != 4 {
+			return mgl.Mat4{}, fmt.Errorf("row %d: not array of length 4", r)
+		}
+		for c := range row {
+			f, ok := row[c].(float64)
+			if !ok {
+				return mgl.Mat4{}, fmt.Errorf("row %d: wrong type", r)
+			}
+			m.Set(r, c, float32(f))
+		}
+	}
+	if m.Row(3) != (mgl.Vec4{0.0, 0.0, 0.0, 1.0}) {
+		return mgl.Mat4{}, fmt.Errorf("last row must be [0, 0, 0, 1]")
+	}
+	if m.Det() == 0.0 {
+		return mgl.Mat4{}, fmt.Errorf("not invertible")
+	}
+	return m, nil
+}
+
+func (t *Transform) parse(dict map[string]interface{}) error {
+	*t = Transform{Rotation: mgl.QuatIdent(), Scale: mgl.Vec3{1.0, 1.0, 1.0}}
+	var err error
+	if mI, found := dict["matrix"]; found {
+		if len(dict) > 1 {
+			return fmt.Errorf("matrix cannot be combined with other keys")
+		}
+		m, err := matrixFromInterface(mI)
+		if err != nil {
+			return fmt.Errorf("matrix: %w", err)
+		}
+		t.Matrix = &m
+		return nil
+	}
+
+	if tI, found := dict["translation"]; found {
+		v, err := vec3FromInterface(tI)
+		if err != nil {
+			return fmt.Errorf("translation: %w", err)
+		}
+		t.Translation = mgl.Vec3{v[0], v[1], v[2]}
+	}
+
+	rI, hasRotation := dict["rotation"]
+	qI, hasQuaternion := dict["quaternion"]
+	switch {
+	case hasRotation && hasQuaternion:
+		return fmt.Errorf("both rotation and quaternion specified")
+	case hasRotation:
+		v, err := vec3FromInterface(rI)
+		if err != nil {
+			return fmt.Errorf("rotation: %w", err)
+		}
+		t.Rotation = eulerToQuat(mgl.Vec3{v[0], v[1], v[2]})
+	case hasQuaternion:
+		arr, ok := qI.([]interface{})
+		if !ok || len(arr) != 4 {
+			return fmt.Errorf("quaternion: not array of length 4")
+		}
+		var q [4]float32
+		for j := range arr {
+			q[j], err = floatFromInterface(arr[j])
+			if err != nil {
+				return fmt.Errorf("quaternion: %w", err)
+			}
+		}
+		t.Rotation = mgl.Quat{W: q[3], V: mgl.Vec3{q[0], q[1], q[2]}}
+		if t.Rotation.Len() == 0.0 {
+			return fmt.Errorf("quaternion must not be zero")
+		}
+		// the same tolerance as for the unit vectors (see normalizeLoaded)
+		if l := t.Rotation.Len(); l < 1.0-unitEpsilon || l > 1.0+unitEpsilon {
+			t.Rotation = t.Rotation.Normalize()
+		}
+	}
+
+	if sI, found := dict["scale"]; found {
+		if f, ok := sI.(float64); ok {
+			t.Scale = mgl.Vec3{float32(f), float32(f), float32(f)}
+		} else {
+			v, err := vec3FromInterface(sI)
+			if err != nil {
+				return fmt.Errorf("scale: %w", err)
+			}
+			t.Scale = mgl.Vec3{v[0], v[1], v[2]}
+		}
+		if t.Scale.X()*t.Scale.Y()*t.Scale.Z() == 0.0 {
+			return fmt.Errorf("scale must not be zero")
+		}
+	}
+	return nil
+}
+
+func (t *Transform) UnmarshalJSON(data []byte) error {
+	dict := make(map[string]interface{})
+	err := json.Unmarshal(data, &dict)
+	if err != nil {
+		return err
+	}
+	return t.parse(dict)
+}
+
+func (t Transform) MarshalJSON() ([]byte, error) {
+	if t.Matrix != nil {
+		return json.Marshal(struct {
+			Matrix [4]mgl.Vec4 `json:"matrix"`
+		}{t.rows()})
+	}
+	q := t.Rotation
+	return json.Marshal(struct {
+		Translation mgl.Vec3   `json:"translation"`
+		Quaternion  [4]float32 `json:"quaternion"`
+		Scale       mgl.Vec3   `json:"scale"`
+	}{t.Translation, [4]float32{q.X(), q.Y(), q.Z(), q.W}, t.Scale})
+}
+
+// rows returns the rows of the matrix of the transform
+func (t *Transform) rows() [4]mgl.Vec4 {
+	m := t.ToWorld()
+	return [4]mgl.Vec4{m.Row(0), m.Row(1), m.Row(2), m.Row(3)}
+}
+
+func (t *Transform) description() string {
+	if t.Matrix != nil {
+		return fmt.Sprintf("matrix = %v", t.rows())
+	}
+	q := t.Rotation
+	return fmt.Sprintf(
+		"translation = %v, quaternion = %v, scale = %v",
+		t.Translation, [4]float32{q.X(), q.Y(), q.Z(), q.W}, t.Scale,
+	)
+}
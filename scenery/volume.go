@@ -0,0 +1,271 @@
+package scenery
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	mgl "github.com/go-gl/mathgl/mgl32"
+)
+
+// Heterogeneous media: the box of a volume body is filled with the medium of its
+// material, whose coefficients are multiplied by the density at every point. The density
+// is either given by a grid of voxels loaded from a file or by a procedural texture.
+// Free paths in such media are sampled by delta tracking and the transmittance
+// of shadow rays is estimated by ratio tracking: both add fictitious (null) collisions
+// to make the medium homogeneous with the maximum density, so they are unbiased
+
+// DensityGrid holds the densities at the centers of the voxels the box of the volume
+// is divided into, x changes fastest, then y, then z. The density between the centers
+// is interpolated trilinearly, outside of them the one of the nearest voxel is used
+type DensityGrid struct {
+	Size    [3]int
+	Density []float32
+}
+
+// maxGridVoxels limits the size of the grids read from the files
+const maxGridVoxels = 1 << 27
+
+func NewDensityGrid(size [3]int, density []float32) (*DensityGrid, error) {
+	n := 1
+	for _, s := range size {
+		if s <= 0 {
+			return nil, fmt.Errorf("resolution must be positive")
+		}
+		if n *= s; n > maxGridVoxels {
+			return nil, fmt.Errorf("too many voxels")
+		}
+	}
+	if len(density) != n {
+		return nil, fmt.Errorf("expected %d densities, got %d", n, len(density))
+	}
+	for _, d := range density {
+		if d < 0.0 || math.IsNaN(float64(d)) || math.IsInf(float64(d), 0) {
+			return nil, fmt.Errorf("densities must be finite and not negative")
+		}
+	}
+	return &DensityGrid{Size: size, Density: density}, nil
+}
+
+// At returns the density of the voxel, the coordinates are clamped to the grid
+func (g *DensityGrid) At(x, y, z int) float32 {
+	clampi := func(i, n int) int {
+		if i < 0 {
+			return 0
+		}
+		if i >= n {
+			return n - 1
+		}
+		return i
+	}
+	x, y, z = clampi(x, g.Size[0]), clampi(y, g.Size[1]), clampi(z, g.Size[2])
+	return g.Density[(z*g.Size[1]+y)*g.Size[0]+x]
+}
+
+// Lookup returns the density at the point given relative to the box of the volume
+// (from 0 at its minimum corner to 1 at the maximum one)
+func (g *DensityGrid) Lookup(p mgl.Vec3) float32 {
+	var base [3]int
+	var frac [3]float32
+	for i := range base {
+		c := p[i]*float32(g.Size[i]) - 0.5
+		f := float32(math.Floor(float64(c)))
+		base[i], frac[i] = int(f), c-f
+	}
+	lerp := func(a, b, t float32) float32 {
+		return a + (b-a)*t
+	}
+	var yz [2][2]float32
+	for dz := 0; dz < 2; dz++ {
+		for dy := 0; dy < 2; dy++ {
+			x0 := g.At(base[0], base[1]+dy, base[2]+dz)
+			x1 := g.At(base[0]+1, base[1]+dy, base[2]+dz)
+			yz[dz][dy] = lerp(x0, x1, frac[0])
+		}
+	}
+	return lerp(lerp(yz[0][0], yz[0][1], frac[1]), lerp(yz[1][0], yz[1][1], frac[1]), frac[2])
+}
+
+// Max returns the maximum density of the grid
+func (g *DensityGrid) Max() float32 {
+	result := float32(0.0)
+	for _, d := range g.Density {
+		if d > result {
+			result = d
+		}
+	}
+	return result
+}
+
+// LoadDensityGrid reads a density grid from a JSON file (.json)
+// or from a raw one (any other extension)
+func LoadDensityGrid(path string) (*DensityGrid, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		return ReadDensityGridJSON(file)
+	}
+	return ReadDensityGridRaw(file)
+}
+
+// ReadDensityGridJSON decodes a density grid written as a JSON object with
+// the resolution and the densities of the voxels, e.g.
+// {"resolution": [2, 1, 1], "density": [0.0, 1.0]}
+func ReadDensityGridJSON(r io.Reader) (*DensityGrid, error) {
+	var doc struct {
+		Resolution *[3]int   `json:"resolution"`
+		Density    []float32 `json:"density"`
+	}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	if doc.Resolution == nil {
+		return nil, fmt.Errorf("resolution not specified")
+	}
+	return NewDensityGrid(*doc.Resolution, doc.Density)
+}
+
+// ReadDensityGridRaw decodes a density grid in the raw format: the resolution
+// as three little-endian 32-bit unsigned integers followed by the densities
+// of the voxels as little-endian 32-bit floats
+func ReadDensityGridRaw(r io.Reader) (*DensityGrid, error) {
+	var header [3]uint32
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("header: %w", err)
+	}
+	var size [3]int
+	n := uint64(1)
+	for i, s := range header {
+		size[i] = int(s)
+		n *= uint64(s)
+	}
+	if n == 0 || n > maxGridVoxels {
+		return nil, fmt.Errorf("invalid resolution %v", header)
+	}
+	density := make([]float32, n)
+	if err := binary.Read(r, binary.LittleEndian, density); err != nil {
+		return nil, fmt.Errorf("densities: %w", err)
+	}
+	return NewDensityGrid(size, density)
+}
+
+// WriteDensityGridRaw encodes the grid in the format read by ReadDensityGridRaw
+func WriteDensityGridRaw(w io.Writer, g *DensityGrid) error {
+	header := [3]uint32{uint32(g.Size[0]), uint32(g.Size[1]), uint32(g.Size[2])}
+	if err := binary.Write(w, binary.LittleEndian, header); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, g.Density)
+}
+
+// densityTextureFromInterface parses the procedural texture of the density. Unlike the
+// values of the roughness, the values may be out of range [0, 1]: the negative densities
+// are clamped to zero, which cuts the medium into separate clouds
+func densityTextureFromInterface(i interface{}) (*Texture, error) {
+	dict, ok := i.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid type")
+	}
+	t := &Texture{}
+	if err := t.parse(dict); err != nil {
+		return nil, err
+	}
+	if t.Kind == ImageTexture {
+		return nil, fmt.Errorf("density cannot be an image")
+	}
+	pair, err := pairFromDict(dict, "values")
+	if err != nil {
+		return nil, err
+	}
+	for j := range pair {
+		t.Values[j], err = floatFromInterface(pair[j])
+		if err != nil {
+			return nil, fmt.Errorf("values: %w", err)
+		}
+	}
+	if t.Values[0] <= 0.0 && t.Values[1] <= 0.0 {
+		return nil, fmt.Errorf("density must be positive somewhere")
+	}
+	return t, nil
+}
+
+func parseVolume(dict map[string]interface{}) (Body, error) {
+	b, err := parseBox(dict)
+	if err != nil {
+		return Body{}, err
+	}
+	b.Kind = Volume
+
+	fileI, hasFile := dict["file"]
+	densityI, hasDensity := dict["density"]
+	switch {
+	case hasFile && hasDensity:
+		return Body{}, fmt.Errorf("both file and density specified")
+	case hasFile:
+		file, ok := fileI.(string)
+		if !ok {
+			return Body{}, fmt.Errorf("invalid file type")
+		}
+		b.File = file
+	case hasDensity:
+		b.Density, err = densityTextureFromInterface(densityI)
+		if err != nil {
+			return Body{}, fmt.Errorf("density: %w", err)
+		}
+	default:
+		return Body{}, fmt.Errorf("neither file nor density specified")
+	}
+	return b, nil
+}
+
+// MaxDensity returns the maximum density of the volume (zero if its grid is not loaded)
+func (b Body) MaxDensity() float32 {
+	if b.Density != nil {
+		return float32(math.Max(float64(b.Density.Values[0]), float64(b.Density.Values[1])))
+	}
+	if b.Grid != nil {
+		return b.Grid.Max()
+	}
+	return 0.0
+}
+
+// NewVolume returns a volume body filled with the medium of the density given
+// by the procedural texture (its values are the densities blended by the pattern)
+func NewVolume(min, max mgl.Vec3, density *Texture) Body {
+	return Body{
+		Kind:    Volume,
+		Min:     min,
+		Max:     max,
+		Density: density,
+	}
+}
+
+// NewGridVolume returns a volume body filled with the medium of the density given by
+// the grid (it has no file, so it cannot be saved to JSON)
+func NewGridVolume(min, max mgl.Vec3, grid *DensityGrid) Body {
+	return Body{
+		Kind: Volume,
+		Min:  min,
+		Max:  max,
+		Grid: grid,
+	}
+}
+
+func volumeDescription(b Body) string {
+	if b.Density != nil {
+		return "density = " + valueDescription(0.0, b.Density)
+	}
+	if b.Grid != nil {
+		return fmt.Sprintf("density = grid(%q, %dx%dx%d)", b.File, b.Grid.Size[0], b.Grid.Size[1], b.Grid.Size[2])
+	}
+	return fmt.Sprintf("density = grid(%q)", b.File)
+}
@@ -0,0 +1,170 @@
+package scenery
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	mgl "github.com/go-gl/mathgl/mgl32"
+)
+
+// rawGrid encodes the header and the densities as in the raw format
+func rawGrid(header [3]uint32, density []float32) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, header)
+	binary.Write(&buf, binary.LittleEndian, density)
+	return buf.Bytes()
+}
+
+func TestReadDensityGridJSON(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		doc  string
+		want *DensityGrid
+	}{
+		{"valid", `{"resolution": [2, 1, 1], "density": [0.0, 1.5]}`, &DensityGrid{Size: [3]int{2, 1, 1}, Density: []float32{0.0, 1.5}}},
+		{"missing resolution", `{"density": [0.0, 1.0]}`, nil},
+		{"too few densities", `{"resolution": [2, 2, 1], "density": [0.0, 1.0, 2.0]}`, nil},
+		{"too many densities", `{"resolution": [1, 1, 1], "density": [0.0, 1.0]}`, nil},
+		{"zero resolution", `{"resolution": [0, 1, 1], "density": []}`, nil},
+		{"negative resolution", `{"resolution": [-1, 1, 1], "density": [1.0]}`, nil},
+		{"negative density", `{"resolution": [2, 1, 1], "density": [0.5, -1.0]}`, nil},
+		{"invalid json", `{"resolution": [1, 1, 1], "density": [1.0`, nil},
+	} {
+		got, err := ReadDensityGridJSON(strings.NewReader(tc.doc))
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("%s: no error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestReadDensityGridRaw(t *testing.T) {
+	nan := float32(math.NaN())
+	inf := float32(math.Inf(1))
+	valid := rawGrid([3]uint32{2, 1, 2}, []float32{0.0, 1.0, 2.0, 3.0})
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want *DensityGrid
+	}{
+		{"valid", valid, &DensityGrid{Size: [3]int{2, 1, 2}, Density: []float32{0.0, 1.0, 2.0, 3.0}}},
+		{"short header", valid[:8], nil},
+		{"too few densities", valid[:len(valid)-4], nil},
+		{"zero resolution", rawGrid([3]uint32{2, 0, 2}, nil), nil},
+		{"too many voxels", rawGrid([3]uint32{1 << 10, 1 << 10, 1 << 10}, nil), nil},
+		{"negative density", rawGrid([3]uint32{1, 1, 2}, []float32{1.0, -0.5}), nil},
+		{"NaN density", rawGrid([3]uint32{1, 1, 2}, []float32{1.0, nan}), nil},
+		{"infinite density", rawGrid([3]uint32{1, 1, 2}, []float32{inf, 1.0}), nil},
+	} {
+		got, err := ReadDensityGridRaw(bytes.NewReader(tc.data))
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("%s: no error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestDensityGridRawRoundTrip(t *testing.T) {
+	g, err := NewDensityGrid([3]int{3, 2, 1}, []float32{0, 1, 2, 3, 4, 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := WriteDensityGridRaw(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadDensityGridRaw(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, g) {
+		t.Errorf("%+v, want %+v", got, g)
+	}
+}
+
+func TestLoadDensityGrid(t *testing.T) {
+	dir := t.TempDir()
+	jsonPath := filepath.Join(dir, "grid.JSON")
+	rawPath := filepath.Join(dir, "grid.raw")
+	if err := os.WriteFile(jsonPath, []byte(`{"resolution": [1, 1, 2], "density": [1.0, 2.0]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(rawPath, rawGrid([3]uint32{1, 1, 2}, []float32{1.0, 2.0}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := &DensityGrid{Size: [3]int{1, 1, 2}, Density: []float32{1.0, 2.0}}
+	for _, path := range []string{jsonPath, rawPath} {
+		got, err := LoadDensityGrid(path)
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: %+v, want %+v", path, got, want)
+		}
+	}
+	if _, err := LoadDensityGrid(filepath.Join(dir, "missing.raw")); err == nil {
+		t.Errorf("no error for a missing file")
+	}
+}
+
+func TestDensityGridLookup(t *testing.T) {
+	// the densities at the corners of the unit cube are x + 2y + 4z
+	cube, err := NewDensityGrid([3]int{2, 2, 2}, []float32{0, 1, 2, 3, 4, 5, 6, 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := NewDensityGrid([3]int{4, 1, 1}, []float32{0, 4, 8, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		grid *DensityGrid
+		p    mgl.Vec3
+		want float32
+	}{
+		// the centers of the voxels are at 0.25 and 0.75 of the box
+		{"center of the first voxel", cube, mgl.Vec3{0.25, 0.25, 0.25}, 0},
+		{"center of the last voxel", cube, mgl.Vec3{0.75, 0.75, 0.75}, 7},
+		{"center of a voxel", cube, mgl.Vec3{0.75, 0.25, 0.75}, 5},
+		{"middle of the cube", cube, mgl.Vec3{0.5, 0.5, 0.5}, 3.5},
+		{"middle of an edge", cube, mgl.Vec3{0.5, 0.25, 0.25}, 0.5},
+		{"middle of a face", cube, mgl.Vec3{0.5, 0.5, 0.75}, 5.5},
+		{"trilinear", cube, mgl.Vec3{0.375, 0.625, 0.5}, 0.25 + 2*0.75 + 4*0.5},
+		// outside of the centers the nearest voxel is used
+		{"corner of the box", cube, mgl.Vec3{0, 0, 0}, 0},
+		{"opposite corner of the box", cube, mgl.Vec3{1, 1, 1}, 7},
+		{"edge of the box", cube, mgl.Vec3{1, 0, 0.5}, 1 + 2},
+		{"outside of the box", cube, mgl.Vec3{-1, 2, 0.25}, 2},
+		{"between the voxels", line, mgl.Vec3{0.25, 0.5, 0.5}, 2},
+		{"at the voxel", line, mgl.Vec3{0.625, 0.5, 0.5}, 8},
+		{"before the last voxel", line, mgl.Vec3{0.75, 0.5, 0.5}, 6},
+		{"end of the line", line, mgl.Vec3{1, 0.5, 0.5}, 4},
+	} {
+		if got := tc.grid.Lookup(tc.p); mgl.Abs(got-tc.want) > 1e-5 {
+			t.Errorf("%s: Lookup(%v) = %v, want %v", tc.name, tc.p, got, tc.want)
+		}
+	}
+	if m := line.Max(); m != 8 {
+		t.Errorf("Max() = %v, want 8", m)
+	}
+}
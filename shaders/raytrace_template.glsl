@@ -25,6 +25,7 @@ layout(binding = 5) buffer SSBO {
 // ===== Helper structs and functions
 
 #define FLOAT_DELTA 0.0001
+#define PI 3.14159265358979
 
 // floating point equality test
 bool fleq(const float f1, const float f2) {
@@ -127,6 +128,15 @@ vec3 random_in_unit_sphere() {
   return v;
 }
 
+// uniformly distributed on the unit sphere
+vec3 random_unit_vector() {
+  vec3 v;
+  do {
+    v = random_in_unit_sphere();
+  } while (length(v) <= FLOAT_DELTA);
+  return normalize(v);
+}
+
 vec2 random_in_unit_disk() {
   vec2 v;
   do {
@@ -159,32 +169,190 @@ struct ball {
   float radius;
 };
 
+// vertices and vertex normals; the w components of the vertex
+// and the normal are the u and v texture coordinates of the vertex
+struct triangle {
+  vec4 v0;
+  vec4 v1;
+  vec4 v2;
+  vec4 n0;
+  vec4 n1;
+  vec4 n2;
+};
+
+
+// ===== Scene data
+//
+// Scene data is read from shader storage buffers, so the scene can
+// be changed without recompiling the program
+
+const uint BoxBody      = 0x00000000u;
+const uint BallBody     = 0x00000001u;
+const uint MeshBody     = 0x00000002u;
+const uint VolumeBody   = 0x00000003u;
+const uint CSGBody      = 0x00000004u;
+const uint SDFBody      = 0x00000005u;
+const uint PlaneBody    = 0x00000006u;
+const uint DiskBody     = 0x00000007u;
+const uint CylinderBody = 0x00000008u;
+const uint ConeBody     = 0x00000009u;
+const uint CapsuleBody  = 0x0000000Au;
+const uint TorusBody    = 0x0000000Bu;
+
+// geometry of the object, the meaning of p0 and p1 depends on the body:
+//   box:    p0.xyz = min, p1.xyz = max
+//   ball:   p0.xyz = center, p0.w = radius
+//   mesh:   root = index of the root of the mesh hierarchy in bvh_nodes (-1 if empty)
+//   volume: p0.xyz = min, p1.xyz = max, root = index in volumes
+//   csg:    root = index of the first node in csg_nodes
+//   sdf:    p0.xyz = min, p1.xyz = max of the bounds, root = index of the first node in sdf_nodes
+//   plane:  p0.xyz = point, p1.xyz = normal (the body is the half-space below the plane)
+//   disk:   p0.xyz = center, p0.w = radius, p1.xyz = normal
+//   cylinder, cone, capsule: p0.xyz = start, p0.w = radius at the start,
+//           p1.xyz = end, p1.w = radius at the end (the same for the cylinder and the capsule)
+//   torus:  p0.xyz = center, p0.w = thickness, p1.x = radius (around the y axis)
+// The body is defined in the object space, to_object transforms the world to it.
+// Objects may share the material (the instances of a prototype do)
+struct object {
+  vec4 p0;
+  vec4 p1;
+  uint body;
+  int root;
+  int material; // index in materials
+  mat4 to_object;
+};
+
+layout(std430, binding = 1) readonly buffer Objects {
+  object objects[];
+};
+
+struct material {
+  vec4 color;
+  uint kind;
+  float fuzz;
+  float eta;
+  float intensity;
+  // coefficients of the medium inside the object (the absorption includes
+  // the Beer-Lambert one of the glass); w of the scattering is the anisotropy
+  vec4 absorption;
+  vec4 scattering;
+  vec4 ior_n;      // complex index of refraction (metal)
+  vec4 ior_k;
+  float roughness;
+  float anisotropy;
+  // principled
+  float metallic;
+  float specular;
+  float clearcoat;
+  float clearcoat_roughness;
+  float sheen;
+  float transmission;
+  vec4 emission;
+  // indices in textures (-1 if none)
+  int color_texture;
+  int roughness_texture;
+  int normal_map;
+  int bump;
+};
+
+layout(std430, binding = 2) readonly buffer Materials {
+  material materials[];
+};
+
+// bounding volume hierarchy over the objects; the first child
+// of an inner node always follows its parent
+struct bvhnode {
+  vec3 min;
+  int offset; // leaves: first index in bvh_indices, inner nodes: second child
+  vec3 max;
+  int count;  // number of objects in the leaf, 0 for inner nodes
+};
+
+layout(std430, binding = 3) readonly buffer BVHNodes {
+  bvhnode bvh_nodes[];
+};
 
-// ===== Body instances declaration
+layout(std430, binding = 4) readonly buffer BVHIndices {
+  int bvh_indices[];
+};
 
-{{with index .Data 0}}
-#define NUM_BOXES {{.Num}}
-{{if .Num}}
-const box boxes[NUM_BOXES] = {
-  {{range .Descs}}
-  {{.}},
-  {{end}}
+const uint CSGLeaf         = 0x00000000u;
+const uint CSGUnion        = 0x00000001u;
+const uint CSGIntersection = 0x00000002u;
+const uint CSGDifference   = 0x00000003u;
+
+// CSG trees flattened in the postfix order: the operations combine the two values
+// computed before them. Leaves are boxes, balls, cylinders, cones or capsules (p0 and p1
+// as in object) in their own space, to_leaf transforms the space of the CSG body to it
+struct csgnode {
+  vec4 p0;
+  vec4 p1;
+  uint op;
+  uint body;
+  float polarity; // -1 for the subtracted leaves, their normals point inside the body
+  int size;       // first node: number of the nodes of the body
+  mat4 to_leaf;
 };
-{{end}}
-{{end}}
-
-{{with index .Data 1}}
-#define NUM_BALLS {{.Num}}
-{{if .Num}}
-const ball balls[NUM_BALLS] = {
-  {{range .Descs}}
-  {{.}},
-  {{end}}
+
+layout(std430, binding = 13) readonly buffer CSGNodes {
+  csgnode csg_nodes[];
 };
-{{end}}
-{{end}}
 
-#define NUM_OBJECTS NUM_BOXES + NUM_BALLS
+const uint SDFSphere      = 0x00000000u;
+const uint SDFBox         = 0x00000001u;
+const uint SDFTorus       = 0x00000002u;
+const uint SDFCapsule     = 0x00000003u;
+const uint SDFMandelbulb  = 0x00000004u;
+const uint SDFSmoothUnion = 0x00000005u;
+const uint SDFRepeat      = 0x00000006u;
+const uint SDFTwist       = 0x00000007u;
+const uint SDFEnd         = 0x00000008u;
+
+// signed distance fields flattened in the postfix order (see scenery.SDFNode.Program):
+//   sphere:       p0.xyz = center, p0.w = radius
+//   box:          p0.xyz = center, p0.w = rounding, p1.xyz = half of the size
+//   torus:        p0.xyz = center, p0.w = thickness, p1.x = radius
+//   capsule:      p0.xyz = start, p0.w = radius, p1.xyz = end
+//   mandelbulb:   p0.xyz = center, p0.w = power, p1.x = iterations
+//   smooth union: p0.x = smoothness
+//   repeat:       p0.xyz = period, p1.xyz = count
+//   twist:        p0.x = angle (radians per unit of height)
+//   end:          p0.x = factor of the distance
+struct sdfnode {
+  vec4 p0;
+  vec4 p1;
+  uint op;
+  int size; // first node: number of the nodes of the body
+};
+
+layout(std430, binding = 14) readonly buffer SDFNodes {
+  sdfnode sdf_nodes[];
+};
+
+// triangles of all meshes. The hierarchies of the meshes are stored in
+// bvh_nodes after the scene one, their leaves refer to the triangles directly
+layout(std430, binding = 6) readonly buffer Triangles {
+  triangle triangles[];
+};
+
+const uint PointLight       = 0x00000000u;
+const uint SpotLight        = 0x00000001u;
+const uint DirectionalLight = 0x00000002u;
+
+// position is only used by point and spot lights, direction (the one
+// the light travels in) by spot and directional ones
+struct light {
+  vec4 position;
+  vec4 direction;
+  vec4 radiance;  // color multiplied by intensity
+  uint kind;
+  float cos_inner;
+  float cos_outer;
+};
+
+layout(std430, binding = 7) readonly buffer Lights {
+  light lights[];
+};
 
 
 // ===== Body intersection functions
@@ -236,6 +404,441 @@ vec3 _normalBall(vec3 point, const ball b) {
   return normalize(point - b.center);
 }
 
+// the ray enters the half-space below the plane or leaves it at the plane
+vec2 _intersectPlane(vec3 origin, vec3 dir, vec3 point, vec3 normal) {
+  float inf = 1.0 / 0.0;
+  float dn = dot(dir, normal);
+  float side = dot(origin - point, normal);
+  if (dn == 0.0) {
+    return side < 0.0 ? vec2(-inf, inf) : vec2(inf, inf);
+  }
+  float t = -side / dn;
+  return dn < 0.0 ? vec2(t, inf) : vec2(-inf, t);
+}
+
+// the disk is flat, so the ray enters and leaves it at the same point
+vec2 _intersectDisk(vec3 origin, vec3 dir, vec3 center, vec3 normal, float radius) {
+  float dn = dot(dir, normal);
+  if (dn == 0.0) {
+    return vec2(1.0 / 0.0, 1.0 / 0.0);
+  }
+  float t = dot(center - origin, normal) / dn;
+  vec3 p = origin + t * dir - center;
+  if (dot(p, p) > radius * radius) {
+    return vec2(1.0 / 0.0, 1.0 / 0.0);
+  }
+  return vec2(t, t);
+}
+
+// the common part of the intervals ((inf, inf) if there is none)
+vec2 _overlap(vec2 a, vec2 b) {
+  vec2 result = vec2(max(a.x, b.x), min(a.y, b.y));
+  return result.x > result.y ? vec2(1.0 / 0.0, 1.0 / 0.0) : result;
+}
+
+// the smallest interval containing both intervals, the empty ones are skipped
+vec2 _envelope(vec2 a, vec2 b) {
+  float inf = 1.0 / 0.0;
+  if (a.x > a.y || a.x == inf) {
+    return b;
+  }
+  if (b.x > b.y || b.x == inf) {
+    return a;
+  }
+  return vec2(min(a.x, b.x), max(a.y, b.y));
+}
+
+// the capped cone with the radii r0 at the start and r1 at the end (the cylinder if they are
+// equal): the part of the infinite cone between the planes of the caps. Within them the cone
+// is convex, so the result is a single interval
+vec2 _intersectCone(vec3 origin, vec3 dir, vec3 start, vec3 end, float r0, float r1) {
+  float inf = 1.0 / 0.0;
+  vec3 ba = end - start;
+  float height = length(ba);
+  vec3 axis = ba / height;
+  float k = (r1 - r0) / height;
+  vec3 w = origin - start;
+  float hd = dot(dir, axis);
+  float hw = dot(w, axis);
+
+  // between the planes of the caps
+  vec2 slab = vec2(-inf, inf);
+  if (hd != 0.0) {
+    float t0 = -hw / hd;
+    float t1 = (height - hw) / hd;
+    slab = vec2(min(t0, t1), max(t0, t1));
+  } else if (hw < 0.0 || hw > height) {
+    return vec2(inf, inf);
+  }
+
+  // inside the infinite cone: a t^2 + b t + c <= 0, where the radius at the point is r0 + k h
+  float rw = r0 + k * hw;
+  float a = dot(dir, dir) - (1.0 + k * k) * hd * hd;
+  float b = 2.0 * (dot(w, dir) - hw * hd - k * hd * rw);
+  float c = dot(w, w) - hw * hw - rw * rw;
+  if (a == 0.0) {
+    if (b > 0.0) {
+      return _overlap(slab, vec2(-inf, -c / b));
+    } else if (b < 0.0) {
+      return _overlap(slab, vec2(-c / b, inf));
+    }
+    return c <= 0.0 ? slab : vec2(inf, inf);
+  }
+  float d2 = b * b - 4.0 * a * c;
+  if (d2 < 0.0) {
+    return a < 0.0 ? slab : vec2(inf, inf);
+  }
+  float s = sqrt(d2);
+  float t1 = min((-b - s) / (2.0 * a), (-b + s) / (2.0 * a));
+  float t2 = max((-b - s) / (2.0 * a), (-b + s) / (2.0 * a));
+  if (a > 0.0) {
+    return _overlap(slab, vec2(t1, t2));
+  }
+  // the ray crosses the other half of the double cone, which lies outside of the caps
+  return _envelope(_overlap(slab, vec2(-inf, t1)), _overlap(slab, vec2(t2, inf)));
+}
+
+// -1 if the point is on the cap at the start of the cone, 1 if it is on the one at the end
+// and 0 if it is on the side
+float _coneCap(vec3 point, vec3 start, vec3 end, float r0, float r1) {
+  vec3 ba = end - start;
+  float height = length(ba);
+  float k = (r1 - r0) / height;
+  vec3 w = point - start;
+  float h = dot(w, ba) / height;
+  // the distances to the planes of the caps and to the side
+  float dStart = abs(h);
+  float dEnd = abs(height - h);
+  float dSide = abs(length(w - ba * (h / height)) - (r0 + k * h)) / sqrt(1.0 + k * k);
+  // the tip of the cone has no cap
+  if (r0 == 0.0) {
+    dStart = 1.0 / 0.0;
+  }
+  if (r1 == 0.0) {
+    dEnd = 1.0 / 0.0;
+  }
+  if (dStart < dEnd && dStart < dSide) {
+    return -1.0;
+  } else if (dEnd < dSide) {
+    return 1.0;
+  }
+  return 0.0;
+}
+
+vec3 _normalCone(vec3 point, vec3 start, vec3 end, float r0, float r1) {
+  vec3 ba = end - start;
+  float height = length(ba);
+  vec3 axis = ba / height;
+  float c = _coneCap(point, start, end, r0, r1);
+  if (c != 0.0) {
+    return c * axis;
+  }
+  // the gradient of the equation of the cone
+  float k = (r1 - r0) / height;
+  vec3 w = point - start;
+  float h = dot(w, axis);
+  return normalize(w - h * axis - k * (r0 + k * h) * axis);
+}
+
+// the capsule is the union of the cylinder and the balls at its ends, which is convex
+vec2 _intersectCapsule(vec3 origin, vec3 dir, vec3 start, vec3 end, float radius) {
+  vec2 result = _intersectCone(origin, dir, start, end, radius, radius);
+  result = _envelope(result, _intersectBall(origin, dir, ball(start, radius)));
+  return _envelope(result, _intersectBall(origin, dir, ball(end, radius)));
+}
+
+vec3 _normalCapsule(vec3 point, vec3 start, vec3 end) {
+  vec3 ba = end - start;
+  float h = clamp(dot(point - start, ba) / dot(ba, ba), 0.0, 1.0);
+  return normalize(point - start - h * ba);
+}
+
+// the largest real root of x^3 + a x^2 + b x + c = 0
+float _largestCubicRoot(float a, float b, float c) {
+  float p = b - a * a / 3.0;
+  float q = 2.0 * a * a * a / 27.0 - a * b / 3.0 + c;
+  float disc = q * q / 4.0 + p * p * p / 27.0;
+  if (disc >= 0.0) {
+    float s = sqrt(disc);
+    float u = -q / 2.0 + s;
+    float v = -q / 2.0 - s;
+    return sign(u) * pow(abs(u), 1.0 / 3.0) + sign(v) * pow(abs(v), 1.0 / 3.0) - a / 3.0;
+  }
+  // three real roots (trigonometric solution)
+  float r = sqrt(-p / 3.0);
+  float phi = acos(clamp(-q / (2.0 * r * r * r), -1.0, 1.0));
+  return 2.0 * r * cos(phi / 3.0) - a / 3.0;
+}
+
+// relative tolerance of the quartic solver: the discriminants pushed below zero by rounding
+// are those of the tangent roots, and the resolvent roots that small are zero
+#define QUARTIC_EPSILON 0.00001
+
+// the real roots of x^4 + a x^3 + b x^2 + c x + d = 0 in increasing order (Ferrari's method,
+// the roots are refined by Newton's method); returns their number, which is even: the tangent
+// double roots are returned twice
+int _solveQuartic(float a, float b, float c, float d, out vec4 roots) {
+  // depressed quartic y^4 + p y^2 + q y + r = 0 for x = y - a/4
+  float p = b - 3.0 * a * a / 8.0;
+  float q = c - a * b / 2.0 + a * a * a / 8.0;
+  float r = d - a * c / 4.0 + a * a * b / 16.0 - 3.0 * a * a * a * a / 256.0;
+  // the magnitude of y^2
+  float scale = abs(p) + sqrt(abs(r));
+
+  int count = 0;
+  roots = vec4(1.0 / 0.0);
+  // (y^2 + p/2 + m)^2 = (s y - q/(2s))^2 for s^2 = 2m, where m is a root of the resolvent cubic
+  float m = _largestCubicRoot(p, p * p / 4.0 - r, -q * q / 8.0);
+  if (m <= QUARTIC_EPSILON * scale) {
+    // biquadratic (q is zero too): y^2 is a root of z^2 + p z + r = 0
+    float d2 = p * p - 4.0 * r;
+    if (d2 < -QUARTIC_EPSILON * scale * scale) {
+      return 0;
+    }
+    vec2 z = vec2(-p - sqrt(max(d2, 0.0)), -p + sqrt(max(d2, 0.0))) / 2.0;
+    for (int i = 0; i < 2; i++) {
+      if (z[i] >= -QUARTIC_EPSILON * scale) {
+        roots[count++] = -sqrt(max(z[i], 0.0));
+        roots[count++] = sqrt(max(z[i], 0.0));
+      }
+    }
+  } else {
+    float s = sqrt(2.0 * m);
+    vec2 bs = vec2(-s, s);
+    vec2 cs = vec2(p / 2.0 + m + q / (2.0 * s), p / 2.0 + m - q / (2.0 * s));
+    for (int i = 0; i < 2; i++) {
+      float d2 = bs[i] * bs[i] - 4.0 * cs[i];
+      if (d2 >= -QUARTIC_EPSILON * (bs[i] * bs[i] + 4.0 * abs(cs[i]))) {
+        roots[count++] = (-bs[i] - sqrt(max(d2, 0.0))) / 2.0;
+        roots[count++] = (-bs[i] + sqrt(max(d2, 0.0))) / 2.0;
+      }
+    }
+  }
+
+  for (int i = 0; i < count; i++) {
+    float x = roots[i] - a / 4.0;
+    for (int j = 0; j < 2; j++) {
+      float f = (((x + a) * x + b) * x + c) * x + d;
+      float df = ((4.0 * x + 3.0 * a) * x + 2.0 * b) * x + c;
+      if (df != 0.0) {
+        x -= f / df;
+      }
+    }
+    roots[i] = x;
+  }
+  // insertion sort
+  for (int i = 1; i < count; i++) {
+    float x = roots[i];
+    int j = i - 1;
+    while (j >= 0 && roots[j] > x) {
+      roots[j + 1] = roots[j];
+      j--;
+    }
+    roots[j + 1] = x;
+  }
+  return count;
+}
+
+// solves the quartic equation of the torus around the y axis. Its roots come in pairs
+// (entry and exit), the first interval that ends in front of the origin is returned
+vec2 _intersectTorus(vec3 origin, vec3 dir, vec3 center, float radius, float thickness) {
+  float inf = 1.0 / 0.0;
+  // the ray is normalized and moved to the bounding sphere for the precision
+  float scale = length(dir);
+  vec3 u = dir / scale;
+  vec3 o = origin - center;
+  vec2 bound = _intersectBall(o, u, ball(vec3(0.0), radius + thickness));
+  if (bound.x == inf || bound.y <= 0.0) {
+    return vec2(inf, inf);
+  }
+  float t0 = max(bound.x, 0.0);
+  o += t0 * u;
+
+  // (|p|^2 + R^2 - r^2)^2 = 4 R^2 (x^2 + z^2)
+  float r2 = radius * radius;
+  float n = dot(o, u);
+  float k = dot(o, o) + r2 - thickness * thickness;
+  vec4 roots;
+  int count = _solveQuartic(
+    4.0 * n,
+    4.0 * n * n + 2.0 * k - 4.0 * r2 * dot(u.xz, u.xz),
+    4.0 * n * k - 8.0 * r2 * dot(o.xz, u.xz),
+    k * k - 4.0 * r2 * dot(o.xz, o.xz),
+    roots
+  );
+  for (int i = 0; i + 1 < count; i += 2) {
+    float exit = (t0 + roots[i + 1]) / scale;
+    if (exit > FLOAT_DELTA) {
+      return vec2((t0 + roots[i]) / scale, exit);
+    }
+  }
+  return vec2(inf, inf);
+}
+
+// the normal points from the nearest point of the ring
+vec3 _normalTorus(vec3 point, vec3 center, float radius) {
+  vec3 q = point - center;
+  return normalize(q - radius * normalize(vec3(q.x, 0.0, q.z)));
+}
+
+// Moller-Trumbore algorithm; bary is set to the barycentric
+// coordinates of the hit point with respect to v1 and v2
+float _intersectTriangle(vec3 origin, vec3 dir, const triangle t, out vec2 bary) {
+  vec3 e1 = t.v1.xyz - t.v0.xyz;
+  vec3 e2 = t.v2.xyz - t.v0.xyz;
+  vec3 p = cross(dir, e2);
+  float det = dot(e1, p);
+  if (det == 0.0) {
+    return 1.0 / 0.0;
+  }
+  vec3 s = origin - t.v0.xyz;
+  float u = dot(s, p) / det;
+  vec3 q = cross(s, e1);
+  float v = dot(dir, q) / det;
+  if (u < 0.0 || v < 0.0 || u + v > 1.0) {
+    return 1.0 / 0.0;
+  }
+  bary = vec2(u, v);
+  return dot(e2, q) / det;
+}
+
+vec3 _normalTriangle(const triangle t, vec2 bary) {
+  return normalize(t.n0.xyz * (1.0 - bary.x - bary.y) + t.n1.xyz * bary.x + t.n2.xyz * bary.y);
+}
+
+// Texture coordinates: (0, 0) is the bottom-left corner of the image and (1, 1) is the top-right one
+
+// the whole image is on every face, seen unmirrored from outside
+// and upright on the side faces (on the top one it faces -z)
+vec2 _uvBox(vec3 point, vec3 normal, const box b, out vec3 tangent, out vec3 bitangent) {
+  vec3 p = (point - b.min) / (b.max - b.min);
+  bitangent = vec3(0.0, 1.0, 0.0);
+  if (normal.x > 0.5) {
+    tangent = vec3(0.0, 0.0, -1.0);
+    return vec2(1.0 - p.z, p.y);
+  } else if (normal.x < -0.5) {
+    tangent = vec3(0.0, 0.0, 1.0);
+    return vec2(p.z, p.y);
+  } else if (normal.y > 0.5) {
+    tangent = vec3(1.0, 0.0, 0.0);
+    bitangent = vec3(0.0, 0.0, -1.0);
+    return vec2(p.x, 1.0 - p.z);
+  } else if (normal.y < -0.5) {
+    tangent = vec3(1.0, 0.0, 0.0);
+    bitangent = vec3(0.0, 0.0, 1.0);
+    return vec2(p.x, p.z);
+  } else if (normal.z > 0.5) {
+    tangent = vec3(1.0, 0.0, 0.0);
+    return vec2(p.x, p.y);
+  }
+  tangent = vec3(-1.0, 0.0, 0.0);
+  return vec2(1.0 - p.x, p.y);
+}
+
+// longitude and latitude; the middle of the image faces +z
+vec2 _uvBall(vec3 normal, out vec3 tangent, out vec3 bitangent) {
+  tangent = vec3(normal.z, 0.0, -normal.x);
+  bitangent = vec3(0.0, 1.0, 0.0);
+  return vec2(0.5 + atan(normal.x, normal.z) / (2.0 * PI), 0.5 + asin(clamp(normal.y, -1.0, 1.0)) / PI);
+}
+
+// the directions of u and v on the plane with given normal: v goes up
+// (or towards -z on the horizontal planes, as on the top face of the box)
+void _planeBasis(vec3 normal, out vec3 tangent, out vec3 bitangent) {
+  bitangent = vec3(0.0, 1.0, 0.0) - normal.y * normal;
+  if (length(bitangent) < 0.001) {
+    bitangent = vec3(0.0, 0.0, -normal.y);
+  }
+  bitangent = normalize(bitangent);
+  tangent = cross(bitangent, normal);
+}
+
+// the image is repeated every unit from the point of the plane
+vec2 _uvPlane(vec3 point, vec3 origin, vec3 normal, out vec3 tangent, out vec3 bitangent) {
+  _planeBasis(normal, tangent, bitangent);
+  vec3 p = point - origin;
+  return vec2(dot(p, tangent), dot(p, bitangent));
+}
+
+// the whole image is on the disk
+vec2 _uvDisk(vec3 point, vec3 center, vec3 normal, float radius, out vec3 tangent, out vec3 bitangent) {
+  return 0.5 + _uvPlane(point, center, normal, tangent, bitangent) * (0.5 / radius);
+}
+
+// the image is wrapped around the side from the start to the end (v goes from 0 to 1),
+// the caps have the whole image each
+vec2 _uvCone(vec3 point, vec3 start, vec3 end, float r0, float r1, out vec3 tangent, out vec3 bitangent) {
+  vec3 ba = end - start;
+  float height = length(ba);
+  vec3 axis = ba / height;
+  vec3 t, b;
+  _planeBasis(axis, t, b);
+  vec3 w = point - start;
+  float c = _coneCap(point, start, end, r0, r1);
+  if (c < 0.0) {
+    tangent = t;
+    bitangent = -b;
+    return 0.5 + vec2(dot(w, t), -dot(w, b)) * (0.5 / r0);
+  } else if (c > 0.0) {
+    w = point - end;
+    tangent = t;
+    bitangent = b;
+    return 0.5 + vec2(dot(w, t), dot(w, b)) * (0.5 / r1);
+  }
+  float h = dot(w, axis);
+  vec3 radial = normalize(w - h * axis);
+  float k = (r1 - r0) / height;
+  tangent = cross(axis, radial);
+  bitangent = normalize(axis + k * radial);
+  return vec2(0.5 + atan(dot(radial, b), dot(radial, t)) / (2.0 * PI), h / height);
+}
+
+// same as on the side of the cylinder, v goes from the pole at the start to the one at the end
+vec2 _uvCapsule(vec3 point, vec3 start, vec3 end, float radius, out vec3 tangent, out vec3 bitangent) {
+  vec3 ba = end - start;
+  float height = length(ba);
+  vec3 axis = ba / height;
+  vec3 t, b;
+  _planeBasis(axis, t, b);
+  vec3 w = point - start;
+  float h = dot(w, axis);
+  vec3 radial = normalize(w - h * axis);
+  tangent = cross(axis, radial);
+  bitangent = axis;
+  return vec2(0.5 + atan(dot(radial, b), dot(radial, t)) / (2.0 * PI), (h + radius) / (height + 2.0 * radius));
+}
+
+// u goes around the y axis as on the ball, v around the tube from its inner side
+vec2 _uvTorus(vec3 point, vec3 center, float radius, out vec3 tangent, out vec3 bitangent) {
+  vec3 q = point - center;
+  vec3 radial = normalize(vec3(q.x, 0.0, q.z));
+  float psi = atan(q.y, length(q.xz) - radius);
+  tangent = vec3(radial.z, 0.0, -radial.x);
+  bitangent = -sin(psi) * radial + vec3(0.0, cos(psi), 0.0);
+  return vec2(0.5 + atan(q.x, q.z) / (2.0 * PI), 0.5 + psi / (2.0 * PI));
+}
+
+// the directions are found from the texture coordinates of the vertices
+// (they are zero if the coordinates are degenerate)
+vec2 _uvTriangle(const triangle t, vec2 bary, out vec3 tangent, out vec3 bitangent) {
+  vec2 uv0 = vec2(t.v0.w, t.n0.w);
+  vec2 uv1 = vec2(t.v1.w, t.n1.w);
+  vec2 uv2 = vec2(t.v2.w, t.n2.w);
+  vec3 e1 = t.v1.xyz - t.v0.xyz;
+  vec3 e2 = t.v2.xyz - t.v0.xyz;
+  vec2 d1 = uv1 - uv0;
+  vec2 d2 = uv2 - uv0;
+  float det = d1.x * d2.y - d2.x * d1.y;
+  if (det == 0.0) {
+    tangent = vec3(0.0);
+    bitangent = vec3(0.0);
+  } else {
+    tangent = (e1 * d2.y - e2 * d1.y) / det;
+    bitangent = (e2 * d1.x - e1 * d2.x) / det;
+  }
+  return uv0 * (1.0 - bary.x - bary.y) + uv1 * bary.x + uv2 * bary.y;
+}
+
 
 // ==== Global intersection function
 
@@ -244,97 +847,540 @@ vec3 _normalBall(vec3 point, const ball b) {
 struct hitinfo {
   vec2 lambda;
   int oi;
+  // meshes: index of the triangle and barycentric coordinates of the hit point
+  int prim;
+  vec2 bary;
+  // texture coordinates of the hit point and the directions in which
+  // they grow along the surface (only set by uvObject)
+  vec2 uv;
+  vec3 tangent;
+  vec3 bitangent;
 };
 
+// check if the ray hits the box before the distance of far_limit
+bool _intersectAABB(vec3 origin, vec3 inv_dir, vec3 bmin, vec3 bmax, float far_limit) {
+  vec3 t0 = (bmin - origin) * inv_dir;
+  vec3 t1 = (bmax - origin) * inv_dir;
+  vec3 tsmall = min(t0, t1);
+  vec3 tbig = max(t0, t1);
+  float tNear = max(max(tsmall.x, tsmall.y), tsmall.z);
+  float tFar = min(min(tbig.x, tbig.y), tbig.z);
+  return tNear <= tFar && tFar > 0.0 && tNear <= far_limit;
+}
+
+// must be greater than bvh.MaxDepth
+#define BVH_STACK_SIZE 64
+
+// Meshes are surfaces, so only the entry point is known: the exit one is set to infinity.
+// Hits closer than FLOAT_DELTA are ignored, so that scattered rays do not hit
+// the triangle they start from
+vec2 _intersectMesh(vec3 origin, vec3 dir, int root, out int prim, out vec2 bary) {
+  float closest = 1.0 / 0.0;
+  if (root < 0) {
+    return vec2(closest, closest);
+  }
+
+  vec3 inv_dir = 1.0 / dir;
+  int stack[BVH_STACK_SIZE];
+  int sp = 0;
+  stack[sp++] = root;
+  while (sp > 0) {
+    int ni = stack[--sp];
+    bvhnode node = bvh_nodes[ni];
+    if (!_intersectAABB(origin, inv_dir, node.min, node.max, closest)) {
+      continue;
+    }
+    if (node.count == 0) {
+      stack[sp++] = node.offset;
+      stack[sp++] = ni + 1;
+      continue;
+    }
+    for (int j = node.offset; j < node.offset + node.count; j++) {
+      vec2 b;
+      float t = _intersectTriangle(origin, dir, triangles[j], b);
+      if (t > FLOAT_DELTA && t < closest) {
+        closest = t;
+        prim = j;
+        bary = b;
+      }
+    }
+  }
+  return vec2(closest, 1.0 / 0.0);
+}
+
+// must not be less than scenery.MaxCSGLeaves
+#define CSG_MAX_LEAVES 16
+
+vec2 _intersectLeaf(vec3 origin, vec3 dir, int ni) {
+  csgnode n = csg_nodes[ni];
+  origin = (n.to_leaf * vec4(origin, 1.0)).xyz;
+  dir = mat3(n.to_leaf) * dir;
+  vec2 lambda;
+  switch (n.body) {
+  case BoxBody:
+    lambda = _intersectBox(origin, dir, box(n.p0.xyz, n.p1.xyz));
+    break;
+  case CylinderBody:
+  case ConeBody:
+    lambda = _intersectCone(origin, dir, n.p0.xyz, n.p1.xyz, n.p0.w, n.p1.w);
+    break;
+  case CapsuleBody:
+    lambda = _intersectCapsule(origin, dir, n.p0.xyz, n.p1.xyz, n.p0.w);
+    break;
+  default:
+    lambda = _intersectBall(origin, dir, ball(n.p0.xyz, n.p0.w));
+  }
+  return lambda.x <= lambda.y ? lambda : vec2(1.0 / 0.0);
+}
+
+// whether the ray is inside the CSG body right after the ray parameter t
+// (the leaves are inside from the entry to the exit, excluding the latter)
+bool _insideCSG(int first, int size, float t, vec2 intervals[CSG_MAX_LEAVES]) {
+  bool stack[CSG_MAX_LEAVES];
+  int sp = 0;
+  int leaf = 0;
+  for (int ni = first; ni < first + size; ni++) {
+    uint op = csg_nodes[ni].op;
+    if (op == CSGLeaf) {
+      stack[sp++] = intervals[leaf].x <= t && t < intervals[leaf].y;
+      leaf++;
+      continue;
+    }
+    bool b = stack[--sp];
+    bool a = stack[--sp];
+    stack[sp++] = op == CSGUnion ? a || b : op == CSGIntersection ? a && b : a && !b;
+  }
+  return stack[0];
+}
+
+// The boundaries of the leaves are visited along the ray, and the interval of the body
+// is the first one (between the boundaries where the ray gets inside the body and out of it)
+// which ends in front of the origin. prim is set to the index of the leaf the ray hits:
+// the one at the entry, or the one at the exit if the origin is inside
+vec2 _intersectCSG(vec3 origin, vec3 dir, int first, out int prim) {
+  int size = csg_nodes[first].size;
+  vec2 intervals[CSG_MAX_LEAVES];
+  int leaves[CSG_MAX_LEAVES];
+  int count = 0;
+  for (int ni = first; ni < first + size; ni++) {
+    if (csg_nodes[ni].op == CSGLeaf) {
+      intervals[count] = _intersectLeaf(origin, dir, ni);
+      leaves[count++] = ni;
+    }
+  }
+
+  float t = -1.0 / 0.0;
+  bool inside = _insideCSG(first, size, t, intervals);
+  float entry = t;
+  int entry_leaf = -1;
+  for (int k = 0; k <= 2 * count; k++) {
+    float next = 1.0 / 0.0;
+    int next_leaf = -1;
+    for (int j = 0; j < count; j++) {
+      float b = intervals[j].x > t ? intervals[j].x : intervals[j].y > t ? intervals[j].y : 1.0 / 0.0;
+      if (b < next) {
+        next = b;
+        next_leaf = leaves[j];
+      }
+    }
+    if (next_leaf < 0) {
+      break;
+    }
+    bool now = _insideCSG(first, size, next, intervals);
+    if (now && !inside) {
+      entry = next;
+      entry_leaf = next_leaf;
+    } else if (inside && !now && next > FLOAT_DELTA) {
+      prim = entry > FLOAT_DELTA ? entry_leaf : next_leaf;
+      return vec2(entry, next);
+    }
+    inside = now;
+    t = next;
+  }
+  return vec2(1.0 / 0.0, 1.0 / 0.0);
+}
+
+// the normal of the leaf at the point in its own space
+vec3 _normalLeaf(vec3 point, const csgnode n) {
+  switch (n.body) {
+  case BoxBody:
+    return _normalBox(point, box(n.p0.xyz, n.p1.xyz));
+  case CylinderBody:
+  case ConeBody:
+    return _normalCone(point, n.p0.xyz, n.p1.xyz, n.p0.w, n.p1.w);
+  case CapsuleBody:
+    return _normalCapsule(point, n.p0.xyz, n.p1.xyz);
+  default:
+    return _normalBall(point, ball(n.p0.xyz, n.p0.w));
+  }
+}
+
+// the normal of the CSG body at the point on the surface of the leaf
+vec3 _normalCSG(vec3 point, int ni) {
+  csgnode n = csg_nodes[ni];
+  point = (n.to_leaf * vec4(point, 1.0)).xyz;
+  return normalize(transpose(mat3(n.to_leaf)) * _normalLeaf(point, n)) * n.polarity;
+}
+
+// the texture coordinates of the leaf at the point, they follow the leaf as in uvObject
+vec2 _uvCSG(vec3 point, int ni, out vec3 tangent, out vec3 bitangent) {
+  csgnode n = csg_nodes[ni];
+  point = (n.to_leaf * vec4(point, 1.0)).xyz;
+  vec2 uv;
+  switch (n.body) {
+  case BoxBody: {
+    box b = box(n.p0.xyz, n.p1.xyz);
+    uv = _uvBox(point, _normalBox(point, b), b, tangent, bitangent);
+    break;
+  }
+  case CylinderBody:
+  case ConeBody:
+    uv = _uvCone(point, n.p0.xyz, n.p1.xyz, n.p0.w, n.p1.w, tangent, bitangent);
+    break;
+  case CapsuleBody:
+    uv = _uvCapsule(point, n.p0.xyz, n.p1.xyz, n.p0.w, tangent, bitangent);
+    break;
+  default:
+    uv = _uvBall(_normalBall(point, ball(n.p0.xyz, n.p0.w)), tangent, bitangent);
+  }
+  mat3 to_csg = inverse(mat3(n.to_leaf));
+  tangent = to_csg * tangent;
+  bitangent = to_csg * bitangent;
+  return uv;
+}
+
+// must not be less than scenery.MaxSDFNodes
+#define SDF_MAX_NODES 32
+// the ray hits the surface closer than that (in the object space)
+#define SDF_EPSILON 0.0001
+// the step of the differences for the gradient
+#define SDF_NORMAL_DELTA 0.0005
+#define SDF_MAX_STEPS 512
+
+float _sdfBox(vec3 p, vec3 center, vec3 half_size, float rounding) {
+  vec3 q = abs(p - center) - (half_size - rounding);
+  return length(max(q, 0.0)) + min(max(q.x, max(q.y, q.z)), 0.0) - rounding;
+}
+
+float _sdfTorus(vec3 p, vec3 center, float radius, float thickness) {
+  vec3 q = p - center;
+  return length(vec2(length(q.xz) - radius, q.y)) - thickness;
+}
+
+float _sdfCapsule(vec3 p, vec3 start, vec3 end, float radius) {
+  vec3 pa = p - start;
+  vec3 ba = end - start;
+  float l = dot(ba, ba);
+  float h = l > 0.0 ? clamp(dot(pa, ba) / l, 0.0, 1.0) : 0.0;
+  return length(pa - ba * h) - radius;
+}
+
+// the distance estimate of the mandelbulb from the derivative of its iterations
+float _sdfMandelbulb(vec3 p, float power, int iterations) {
+  vec3 z = p;
+  float dr = 1.0;
+  float r = 0.0;
+  for (int i = 0; i < iterations; i++) {
+    r = length(z);
+    if (r > 2.0) {
+      break;
+    }
+    float theta = r > 0.0 ? acos(clamp(z.y / r, -1.0, 1.0)) : 0.0;
+    // atan(0, 0) is undefined
+    float phi = z.x != 0.0 || z.z != 0.0 ? atan(z.z, z.x) : 0.0;
+    dr = pow(r, power - 1.0) * power * dr + 1.0;
+    float zr = pow(r, power);
+    theta *= power;
+    phi *= power;
+    z = zr * vec3(sin(theta) * cos(phi), cos(theta), sin(theta) * sin(phi)) + p;
+  }
+  r = max(r, 1e-10);
+  return 0.5 * log(r) * r / dr;
+}
+
+// the distance from the point to the surface of the field
+float _sdf(int first, vec3 p) {
+  int size = sdf_nodes[first].size;
+  float distances[SDF_MAX_NODES];
+  vec3 points[SDF_MAX_NODES];
+  int dp = 0;
+  int pp = 0;
+  for (int ni = first; ni < first + size; ni++) {
+    sdfnode n = sdf_nodes[ni];
+    switch (n.op) {
+    case SDFSphere:
+      distances[dp++] = length(p - n.p0.xyz) - n.p0.w;
+      break;
+    case SDFBox:
+      distances[dp++] = _sdfBox(p, n.p0.xyz, n.p1.xyz, n.p0.w);
+      break;
+    case SDFTorus:
+      distances[dp++] = _sdfTorus(p, n.p0.xyz, n.p1.x, n.p0.w);
+      break;
+    case SDFCapsule:
+      distances[dp++] = _sdfCapsule(p, n.p0.xyz, n.p1.xyz, n.p0.w);
+      break;
+    case SDFMandelbulb:
+      distances[dp++] = _sdfMandelbulb(p - n.p0.xyz, n.p0.w, int(n.p1.x));
+      break;
+    case SDFSmoothUnion: {
+      float b = distances[--dp];
+      float a = distances[dp - 1];
+      float k = n.p0.x;
+      float h = max(k - abs(a - b), 0.0) / k;
+      distances[dp - 1] = min(a, b) - h * h * k * 0.25;
+      break;
+    }
+    case SDFRepeat:
+      points[pp++] = p;
+      p -= n.p0.xyz * clamp(floor(p / n.p0.xyz + 0.5), -n.p1.xyz, n.p1.xyz);
+      break;
+    case SDFTwist: {
+      points[pp++] = p;
+      float a = n.p0.x * p.y;
+      float c = cos(a);
+      float s = sin(a);
+      p = vec3(c * p.x - s * p.z, p.y, s * p.x + c * p.z);
+      break;
+    }
+    case SDFEnd:
+      p = points[--pp];
+      distances[dp - 1] *= n.p0.x;
+      break;
+    }
+  }
+  return distances[0];
+}
+
+// the gradient of the field (by the differences at the vertices of a tetrahedron)
+vec3 _normalSDF(vec3 point, int first) {
+  const vec2 k = vec2(1.0, -1.0);
+  return normalize(
+    k.xyy * _sdf(first, point + k.xyy * SDF_NORMAL_DELTA) +
+    k.yyx * _sdf(first, point + k.yyx * SDF_NORMAL_DELTA) +
+    k.yxy * _sdf(first, point + k.yxy * SDF_NORMAL_DELTA) +
+    k.xxx * _sdf(first, point + k.xxx * SDF_NORMAL_DELTA)
+  );
+}
+
+// The distance to the surface is returned as the entry point (the exit one is infinite,
+// as for meshes). The sphere tracing is limited by the bounds of the body. The ray starting
+// on the surface goes to the side its direction points to and is only stopped by the surface
+// after leaving it
+vec2 _intersectSDF(vec3 origin, vec3 dir, int first, const box bounds) {
+  vec2 lambda = _intersectBox(origin, dir, bounds);
+  if (lambda.x > lambda.y || lambda.y <= 0.0) {
+    return vec2(1.0 / 0.0, 1.0 / 0.0);
+  }
+  float scale = length(dir);
+  float t = max(lambda.x, 0.0);
+  float side = 1.0;
+  bool left = true;
+  if (lambda.x <= 0.0) {
+    float d = _sdf(first, origin);
+    if (abs(d) < SDF_EPSILON) {
+      d = dot(_normalSDF(origin, first), dir);
+      left = false;
+    }
+    side = d < 0.0 ? -1.0 : 1.0;
+  }
+  for (int i = 0; i < SDF_MAX_STEPS && t <= lambda.y; i++) {
+    float d = side * _sdf(first, origin + dir * t);
+    if (d < SDF_EPSILON) {
+      if (left) {
+        return vec2(t, 1.0 / 0.0);
+      }
+    } else {
+      left = true;
+    }
+    t += max(d, SDF_EPSILON) / scale;
+  }
+  return vec2(1.0 / 0.0, 1.0 / 0.0);
+}
+
+// prim is only set for meshes and CSG bodies (the index of the leaf), bary for meshes. The ray
+// is transformed into the object space without normalizing the direction, so the ray parameters
+// are the same as in the world
+vec2 intersectObject(vec3 origin, vec3 dir, int oi, out int prim, out vec2 bary) {
+  object o = objects[oi];
+  origin = (o.to_object * vec4(origin, 1.0)).xyz;
+  dir = mat3(o.to_object) * dir;
+  switch (o.body) {
+  case BoxBody:
+  case VolumeBody:
+    return _intersectBox(origin, dir, box(o.p0.xyz, o.p1.xyz));
+  case BallBody:
+    return _intersectBall(origin, dir, ball(o.p0.xyz, o.p0.w));
+  case MeshBody:
+    return _intersectMesh(origin, dir, o.root, prim, bary);
+  case CSGBody:
+    return _intersectCSG(origin, dir, o.root, prim);
+  case SDFBody:
+    return _intersectSDF(origin, dir, o.root, box(o.p0.xyz, o.p1.xyz));
+  case PlaneBody:
+    return _intersectPlane(origin, dir, o.p0.xyz, o.p1.xyz);
+  case DiskBody:
+    return _intersectDisk(origin, dir, o.p0.xyz, o.p1.xyz, o.p0.w);
+  case CylinderBody:
+  case ConeBody:
+    return _intersectCone(origin, dir, o.p0.xyz, o.p1.xyz, o.p0.w, o.p1.w);
+  case CapsuleBody:
+    return _intersectCapsule(origin, dir, o.p0.xyz, o.p1.xyz, o.p0.w);
+  case TorusBody:
+    return _intersectTorus(origin, dir, o.p0.xyz, o.p1.x, o.p0.w);
+  default:
+    return vec2(1.0 / 0.0, 1.0 / 0.0);
+  }
+}
+
 bool intersectObjects(vec3 origin, vec3 dir, out hitinfo info) {
   float smallest = MAX_SCENE_BOUNDS;
   bool found = false;
-  
-  {{with index .Data 0}}
-  {{if .Num}}
-  // handle boxes
-  for (int i = 0; i < NUM_BOXES; i++) {
-    vec2 lambda = _intersectBox(origin, dir, boxes[i]);
-    if (lambda.x > 0.0 && lambda.x < lambda.y && lambda.x < smallest) {
-      info.lambda = lambda;
-      info.oi = i;
-      smallest = lambda.x;
-      found = true;
-    }
-  }
-  {{end}}
-  {{end}}
-
-  {{with index .Data 1}}
-  {{if .Num}}
-  // handle balls
-  for (int i = 0; i < NUM_BALLS; i++) {
-    vec2 lambda = _intersectBall(origin, dir, balls[i]);
-    if (lambda.x > 0.0 && lambda.x < lambda.y && lambda.x < smallest) {
-      info.lambda = lambda;
-      info.oi = i + NUM_BOXES;
-      smallest = lambda.x;
-      found = true;
-    }
-  }
-  {{end}}
-  {{end}}
+  if (bvh_nodes.length() == 0) {
+    return false;
+  }
+
+  vec3 inv_dir = 1.0 / dir;
+  int stack[BVH_STACK_SIZE];
+  int sp = 0;
+  stack[sp++] = 0;
+  while (sp > 0) {
+    int ni = stack[--sp];
+    bvhnode node = bvh_nodes[ni];
+    // the distance to a box can be a bit larger than the one to a body touching it,
+    // FLOAT_DELTA keeps such boxes, so that equally close objects in them are not skipped
+    if (!_intersectAABB(origin, inv_dir, node.min, node.max, smallest + FLOAT_DELTA)) {
+      continue;
+    }
+    if (node.count == 0) {
+      stack[sp++] = node.offset;
+      stack[sp++] = ni + 1;
+      continue;
+    }
+    for (int j = node.offset; j < node.offset + node.count; j++) {
+      int i = bvh_indices[j];
+      int prim;
+      vec2 bary;
+      vec2 lambda = intersectObject(origin, dir, i, prim, bary);
+      if (lambda.x <= FLOAT_DELTA) {
+        // the origin is inside the body (or on its surface), the ray hits it from inside
+        lambda.x = lambda.y;
+      }
+      // ties (e.g. coplanar faces) go to the object with the smaller index,
+      // so that the result does not depend on the order of the tests
+      bool closer = lambda.x < smallest || (found && lambda.x == smallest && i < info.oi);
+      if (lambda.x > FLOAT_DELTA && lambda.x <= lambda.y && closer) {
+        info.lambda = lambda;
+        info.oi = i;
+        info.prim = prim;
+        info.bary = bary;
+        smallest = lambda.x;
+        found = true;
+      }
+    }
+  }
   return found;
 }
 
-vec3 normalObject(vec3 point, int oi) {
-  if (oi < NUM_BOXES) {
-    {{with index .Data 0}}{{if .Num}}
-    return _normalBox(point, boxes[oi]);
-    {{end}}{{end}}
-  } else {
-    {{with index .Data 1}}{{if .Num}}
-    return _normalBall(point, balls[oi - NUM_BOXES]);
-    {{end}}{{end}}
+// the normal at the point in the object space
+vec3 _normalLocal(const object o, vec3 point, hitinfo info) {
+  switch (o.body) {
+  case BoxBody:
+  case VolumeBody:
+    return _normalBox(point, box(o.p0.xyz, o.p1.xyz));
+  case BallBody:
+    return _normalBall(point, ball(o.p0.xyz, o.p0.w));
+  case MeshBody:
+    return _normalTriangle(triangles[info.prim], info.bary);
+  case CSGBody:
+    return _normalCSG(point, info.prim);
+  case SDFBody:
+    return _normalSDF(point, o.root);
+  case PlaneBody:
+  case DiskBody:
+    return o.p1.xyz;
+  case CylinderBody:
+  case ConeBody:
+    return _normalCone(point, o.p0.xyz, o.p1.xyz, o.p0.w, o.p1.w);
+  case CapsuleBody:
+    return _normalCapsule(point, o.p0.xyz, o.p1.xyz);
+  case TorusBody:
+    return _normalTorus(point, o.p0.xyz, o.p1.x);
+  default:
+    return vec3(0.0);
   }
 }
 
+vec3 normalObject(vec3 point, hitinfo info) {
+  object o = objects[info.oi];
+  vec3 local = (o.to_object * vec4(point, 1.0)).xyz;
+  // normals are transformed by the inverse transpose of the transform to the world
+  return normalize(transpose(mat3(o.to_object)) * _normalLocal(o, local, info));
+}
 
-// ==== Materials
-
-const vec3 colors[NUM_OBJECTS] = {
-  {{range .Data}}
-  {{range .Colors}}
-  {{.}},
-  {{end}}
-  {{end}}
-};
-
-const float fuzzs[NUM_OBJECTS] = {
-  {{range .Data}}
-  {{range .Fuzzs}}
-  {{.}},
-  {{end}}
-  {{end}}
-};
-
-const float etas[NUM_OBJECTS] = {
-  {{range .Data}}
-  {{range .Etas}}
-  {{.}},
-  {{end}}
-  {{end}}
-};
+// sets the texture coordinates of the hit point and the directions in which they grow.
+// They are computed in the object space, so the textures follow the transformed body
+void uvObject(vec3 point, inout hitinfo info) {
+  object o = objects[info.oi];
+  point = (o.to_object * vec4(point, 1.0)).xyz;
+  vec3 normal = _normalLocal(o, point, info);
+  switch (o.body) {
+  case BoxBody:
+  case VolumeBody:
+  case SDFBody: // projected from the faces of the bounds
+    info.uv = _uvBox(point, normal, box(o.p0.xyz, o.p1.xyz), info.tangent, info.bitangent);
+    break;
+  case BallBody:
+    info.uv = _uvBall(normal, info.tangent, info.bitangent);
+    break;
+  case MeshBody:
+    info.uv = _uvTriangle(triangles[info.prim], info.bary, info.tangent, info.bitangent);
+    break;
+  case CSGBody:
+    info.uv = _uvCSG(point, info.prim, info.tangent, info.bitangent);
+    break;
+  case PlaneBody:
+    info.uv = _uvPlane(point, o.p0.xyz, normal, info.tangent, info.bitangent);
+    break;
+  case DiskBody:
+    info.uv = _uvDisk(point, o.p0.xyz, normal, o.p0.w, info.tangent, info.bitangent);
+    break;
+  case CylinderBody:
+  case ConeBody:
+    info.uv = _uvCone(point, o.p0.xyz, o.p1.xyz, o.p0.w, o.p1.w, info.tangent, info.bitangent);
+    break;
+  case CapsuleBody:
+    info.uv = _uvCapsule(point, o.p0.xyz, o.p1.xyz, o.p0.w, info.tangent, info.bitangent);
+    break;
+  case TorusBody:
+    info.uv = _uvTorus(point, o.p0.xyz, o.p1.x, info.tangent, info.bitangent);
+    break;
+  default:
+    info.uv = vec2(0.0);
+    info.tangent = vec3(0.0);
+    info.bitangent = vec3(0.0);
+  }
+  mat3 to_world = inverse(mat3(o.to_object));
+  info.tangent = to_world * info.tangent;
+  info.bitangent = to_world * info.bitangent;
+}
 
-const uint MirrorMaterial     = 0x00000001u;
-const uint LambertianMaterial = 0x00000002u;
-const uint GlassMaterial      = 0x00000003u;
 
-const uint materials[NUM_OBJECTS] = {
-  {{range .Data}}
-  {{range .Materials}}
-  {{.}},
-  {{end}}
-  {{end}}
-};
+// ==== Materials
 
+const uint MirrorMaterial     = 0x00000000u;
+const uint LambertianMaterial = 0x00000001u;
+const uint GlassMaterial      = 0x00000002u;
+const uint EmissiveMaterial   = 0x00000003u;
+const uint MetalMaterial      = 0x00000004u;
+const uint RoughGlassMaterial = 0x00000005u;
+const uint PrincipledMaterial = 0x00000006u;
+const uint ParticipatingMaterial = 0x00000007u;
+
+// the scattered directions have the cosine distribution
+// (the one of a perfectly diffuse surface)
 vec3 _scatterLambertian(vec3 normal) {
-  vec3 scattered = normal + random_in_unit_sphere();
+  vec3 scattered = normal + random_unit_vector();
   if (fleq(length(scattered), 0.0)) {
     scattered = normal;
   }
@@ -349,71 +1395,1054 @@ vec3 _scatterMirror(vec3 incident, vec3 normal, float fuzz, float eta) {
   }
 }
 
+// Schlick's approximation of the Fresnel reflectance. The cosine is the one
+// of the angle on the side of the less dense medium
+float _schlick(float cos_theta, float eta) {
+  float r0 = (1.0 - eta) / (1.0 + eta);
+  r0 *= r0;
+  return r0 + (1.0 - r0) * pow(1.0 - cos_theta, 5.0);
+}
+
+// Microfacets with the GGX (Trowbridge-Reitz) distribution. The directions are
+// in the local frame of the surface: x is the tangent, y is the bitangent
+// and z is the normal
+
+// the tangents go around the vertical axis
+void _tangentFrame(vec3 normal, out vec3 tangent, out vec3 bitangent) {
+  vec3 up = abs(normal.y) < 0.999 ? vec3(0.0, 1.0, 0.0) : vec3(1.0, 0.0, 0.0);
+  tangent = normalize(cross(up, normal));
+  bitangent = cross(normal, tangent);
+}
+
+vec3 _toLocal(vec3 v, vec3 tangent, vec3 bitangent, vec3 normal) {
+  return vec3(dot(v, tangent), dot(v, bitangent), dot(v, normal));
+}
+
+vec3 _fromLocal(vec3 v, vec3 tangent, vec3 bitangent, vec3 normal) {
+  return v.x * tangent + v.y * bitangent + v.z * normal;
+}
+
+// widths of the distribution along the tangent and the bitangent
+vec2 _ggxAlpha(float roughness, float anisotropy) {
+  float aspect = sqrt(1.0 - 0.9 * anisotropy);
+  float alpha = roughness * roughness;
+  return max(vec2(alpha / aspect, alpha * aspect), vec2(0.001));
+}
+
+// distribution of the microfacet normals
+float _ggxD(vec3 m, vec2 alpha) {
+  vec3 s = vec3(m.x / alpha.x, m.y / alpha.y, m.z);
+  float d = dot(s, s);
+  return 1.0 / (PI * alpha.x * alpha.y * d * d);
+}
+
+// Smith's masking function is 1 / (1 + lambda)
+float _ggxLambda(vec3 w, vec2 alpha) {
+  float a2 = (alpha.x * alpha.x * w.x * w.x + alpha.y * alpha.y * w.y * w.y) / max(w.z * w.z, FLOAT_DELTA);
+  return (sqrt(1.0 + a2) - 1.0) / 2.0;
+}
+
+// samples a normal of the microfacets visible from wo (Heitz, 2018); wo.z must be positive
+vec3 _sampleGGX(vec3 wo, vec2 alpha) {
+  vec3 vh = normalize(vec3(alpha.x * wo.x, alpha.y * wo.y, wo.z));
+  float lensq = vh.x * vh.x + vh.y * vh.y;
+  vec3 t1 = lensq > 0.0 ? vec3(-vh.y, vh.x, 0.0) / sqrt(lensq) : vec3(1.0, 0.0, 0.0);
+  vec3 t2 = cross(vh, t1);
+  float r = sqrt(random());
+  float phi = 2.0 * PI * random();
+  float p1 = r * cos(phi);
+  float p2 = r * sin(phi);
+  float s = (1.0 + vh.z) / 2.0;
+  p2 = (1.0 - s) * sqrt(1.0 - p1 * p1) + s * p2;
+  vec3 nh = p1 * t1 + p2 * t2 + sqrt(max(0.0, 1.0 - p1 * p1 - p2 * p2)) * vh;
+  return normalize(vec3(alpha.x * nh.x, alpha.y * nh.y, max(0.0, nh.z)));
+}
+
+// Fresnel reflectance of a conductor with the complex index of refraction n + ik
+vec3 _fresnelConductor(float cos_theta, vec3 n, vec3 k) {
+  float cos2 = cos_theta * cos_theta;
+  float sin2 = 1.0 - cos2;
+  vec3 t0 = n * n - k * k - sin2;
+  vec3 a2b2 = sqrt(t0 * t0 + 4.0 * n * n * k * k);
+  vec3 t1 = a2b2 + cos2;
+  vec3 a = sqrt(max((a2b2 + t0) / 2.0, 0.0));
+  vec3 t2 = 2.0 * cos_theta * a;
+  vec3 rs = (t1 - t2) / (t1 + t2);
+  vec3 t3 = cos2 * a2b2 + sin2 * sin2;
+  vec3 t4 = t2 * sin2;
+  vec3 rp = rs * (t3 - t4) / (t3 + t4);
+  return (rp + rs) / 2.0;
+}
+
+// the ray is either reflected or refracted with the probability of the Fresnel reflectance
 vec3 _scatterGlass(vec3 incident, vec3 normal, float fuzz, float eta) {
-  vec3 scattered = refract(normalize(incident), normal, 1.0 / eta);
+  incident = normalize(incident);
+  vec3 scattered = refract(incident, normal, 1.0 / eta);
   if (fleq(length(scattered), 0.0)) {
+    // total internal reflection
     scattered = reflect(incident, normal);
+  } else {
+    float cos_theta = eta > 1.0 ? -dot(incident, normal) : -dot(scattered, normal);
+    if (random() < _schlick(cos_theta, eta)) {
+      scattered = reflect(incident, normal);
+    }
   }
   return scattered + random_in_unit_sphere() * fuzz;
 }
 
-vec3 scatter(vec3 incident, vec3 normal, int oi) {
-  switch (materials[oi]) {
+// the microfacet normals are sampled from the visible ones, so the weight of the
+// reflected ray is the Fresnel reflectance times the masking of the reflected ray
+vec3 _scatterMetal(vec3 incident, vec3 normal, const material m, out vec3 weight) {
+  vec3 t, b;
+  _tangentFrame(normal, t, b);
+  vec3 wo = -_toLocal(normalize(incident), t, b, normal);
+  vec2 alpha = _ggxAlpha(m.roughness, m.anisotropy);
+  vec3 h = _sampleGGX(wo, alpha);
+  vec3 wi = reflect(-wo, h);
+  weight = vec3(0.0);
+  if (wi.z <= 0.0) {
+    return vec3(0.0);
+  }
+  float lambda_o = _ggxLambda(wo, alpha);
+  float g = (1.0 + lambda_o) / (1.0 + lambda_o + _ggxLambda(wi, alpha));
+  weight = m.color.rgb * _fresnelConductor(dot(wo, h), m.ior_n.rgb, m.ior_k.rgb) * g;
+  return _fromLocal(wi, t, b, normal);
+}
+
+// same as the glass, but the microfacet normal is used instead of the normal
+vec3 _scatterRoughGlass(vec3 incident, vec3 normal, const material m, float eta, out vec3 weight) {
+  vec3 t, b;
+  _tangentFrame(normal, t, b);
+  vec3 wo = -_toLocal(normalize(incident), t, b, normal);
+  vec2 alpha = _ggxAlpha(m.roughness, m.anisotropy);
+  vec3 h = _sampleGGX(wo, alpha);
+  vec3 wi = refract(-wo, h, 1.0 / eta);
+  // total internal reflection
+  bool reflected = fleq(length(wi), 0.0);
+  if (!reflected) {
+    float cos_theta = eta > 1.0 ? dot(wo, h) : -dot(wi, h);
+    reflected = random() < _schlick(cos_theta, eta);
+  }
+  if (reflected) {
+    wi = reflect(-wo, h);
+  }
+  weight = vec3(0.0);
+  if ((wi.z > 0.0) != reflected) {
+    // scattered to the wrong side of the surface
+    return vec3(0.0);
+  }
+  float lambda_o = _ggxLambda(wo, alpha);
+  weight = m.color.rgb * (1.0 + lambda_o) / (1.0 + lambda_o + _ggxLambda(wi, alpha));
+  return _fromLocal(wi, t, b, normal);
+}
+
+// index of refraction of a dielectric with given reflectance at normal incidence
+vec3 _iorFromReflectance(vec3 f0) {
+  vec3 s = sqrt(min(f0, vec3(0.99)));
+  return (1.0 + s) / (1.0 - s);
+}
+
+// The specular layers are chosen at least this often, otherwise
+// the highlights of the lights are sampled rarely and are noisy
+#define MIN_SPECULAR_PROBABILITY 0.25
+
+// The principled material is a mix of the simpler ones: a clear coat over either
+// a metal or a dielectric base, which is a rough glass or a specular layer over
+// a diffuse one. One of them is chosen at every hit, roughly with the probability
+// of its contribution (the reflectance for the specular layers); the scale
+// of the chosen material is its contribution divided by the probability
+material principledLobe(const material m, vec3 incident, vec3 normal, out float scale) {
+  material lobe = m;
+  lobe.absorption = vec4(0.0);
+  scale = 1.0;
+  float cos_theta = dot(normalize(incident), normal);
+  if (cos_theta > 0.0 && m.transmission > 0.0) {
+    // only the transmitted rays get inside
+    lobe.kind = RoughGlassMaterial;
+    return lobe;
+  }
+  cos_theta = abs(cos_theta);
+
+  // the specular lobes have their own Fresnel reflectance, the layers
+  // under them are weighted by the transmittance of the one above
+  float f = m.clearcoat * _schlick(cos_theta, 1.5);
+  float p = m.clearcoat > 0.0 ? max(f, MIN_SPECULAR_PROBABILITY) : 0.0;
+  if (random() < p) {
+    lobe.kind = MetalMaterial;
+    lobe.color = vec4(1.0);
+    lobe.roughness = m.clearcoat_roughness;
+    lobe.anisotropy = 0.0;
+    lobe.ior_n = vec4(1.5);
+    lobe.ior_k = vec4(0.0);
+    scale = m.clearcoat / p;
+    return lobe;
+  }
+  scale = (1.0 - f) / (1.0 - p);
+
+  if (random() < m.metallic) {
+    lobe.kind = MetalMaterial;
+    lobe.color = vec4(1.0);
+    lobe.ior_n = vec4(_iorFromReflectance(m.color.rgb), 0.0);
+    lobe.ior_k = vec4(0.0);
+    return lobe;
+  }
+  if (random() < m.transmission) {
+    lobe.kind = RoughGlassMaterial;
+    return lobe;
+  }
+  float eta = _iorFromReflectance(vec3(0.08 * m.specular)).x;
+  f = _schlick(cos_theta, eta);
+  p = m.specular > 0.0 ? max(f, MIN_SPECULAR_PROBABILITY) : 0.0;
+  if (random() < p) {
+    lobe.kind = MetalMaterial;
+    lobe.color = vec4(1.0);
+    lobe.ior_n = vec4(eta);
+    lobe.ior_k = vec4(0.0);
+    scale /= p;
+    return lobe;
+  }
+  scale *= (1.0 - f) / (1.0 - p);
+  lobe.kind = LambertianMaterial;
+  // the sheen brightens the diffuse layer at grazing angles
+  lobe.color.rgb += m.sheen * pow(1.0 - cos_theta, 5.0);
+  return lobe;
+}
+
+// scatter returns the scattered direction (zero if the ray is absorbed)
+// and the fraction of the light coming along it in weight
+vec3 scatter(vec3 incident, vec3 normal, const material m, out vec3 weight) {
+  weight = m.color.rgb;
+  switch (m.kind) {
   case MirrorMaterial:
-    return _scatterMirror(incident, normal, fuzzs[oi], etas[oi]);
+    return _scatterMirror(incident, normal, m.fuzz, m.eta);
   case LambertianMaterial:
     return _scatterLambertian(normal);
   case GlassMaterial:
-    float eta = etas[oi];
+  case RoughGlassMaterial:
+    float eta = m.eta;
     if (dot(incident, normal) > 0.0) {
       normal *= -1.0;
       eta = 1.0 / eta;
     }
-    return _scatterGlass(incident, normal, fuzzs[oi], eta);
+    if (m.kind == GlassMaterial) {
+      return _scatterGlass(incident, normal, m.fuzz, eta);
+    }
+    return _scatterRoughGlass(incident, normal, m, eta, weight);
+  case MetalMaterial:
+    if (dot(incident, normal) > 0.0) {
+      normal *= -1.0;
+    }
+    return _scatterMetal(incident, normal, m, weight);
   default:
     return vec3(0.0);
   }
 }
 
 
-// ===== Main tracing functions
+// ===== Environment
+
+const uint GradientEnvironment = 0x00000000u;
+const uint MapEnvironment      = 0x00000001u;
+const uint SkyEnvironment      = 0x00000002u;
+
+uniform uint env_kind;
+
+// gradient
+uniform vec3 bg_bottom;
+uniform vec3 bg_top;
+
+// map (and sky, which is baked into the same kind of image):
+// equirectangular image stored at the beginning of texels
+uniform int env_width;
+uniform int env_height;
+uniform float env_rotation;  // around the y axis, in radians
+uniform float env_intensity;
+// whether env_cdf holds the distribution for importance sampling
+uniform bool env_sampling;
+
+// sky: direction to the sun, radiance of its disk and cosine of its angular radius.
+// The sun also is the last of the lights
+uniform vec3 sun_dir;
+uniform vec3 sun_radiance;
+uniform float sun_cos_radius;
+
+layout(std430, binding = 8) readonly buffer Texels {
+  vec4 texels[];
+};
+
+// cumulative distributions of the rows of the environment map (env_height values)
+// and of the texels in every row (env_width values each)
+layout(std430, binding = 9) readonly buffer EnvCDF {
+  float env_cdf[];
+};
+
+// the map wraps around horizontally and is clamped vertically
+vec3 _envTexel(int x, int y) {
+  if (x < 0) {
+    x += env_width;
+  } else if (x >= env_width) {
+    x -= env_width;
+  }
+  y = clamp(y, 0, env_height - 1);
+  return texels[y * env_width + x].rgb;
+}
+
+// bilinear filtering
+vec3 _envLookup(vec2 uv) {
+  vec2 p = uv * vec2(env_width, env_height) - 0.5;
+  ivec2 i = ivec2(floor(p));
+  vec2 f = p - vec2(i);
+  return mix(
+    mix(_envTexel(i.x, i.y), _envTexel(i.x + 1, i.y), f.x),
+    mix(_envTexel(i.x, i.y + 1), _envTexel(i.x + 1, i.y + 1), f.x),
+    f.y
+  );
+}
+
+// the center of the (unrotated) map is in the -z direction, the top row is straight up
+vec2 _envUV(vec3 dir) {
+  dir = normalize(dir);
+  float phi = atan(dir.x, -dir.z) - env_rotation;
+  float theta = acos(clamp(dir.y, -1.0, 1.0));
+  return vec2(fract(phi / (2.0 * PI) + 0.5), theta / PI);
+}
+
+vec3 _envDir(vec2 uv) {
+  float phi = (uv.x - 0.5) * 2.0 * PI + env_rotation;
+  float theta = uv.y * PI;
+  return vec3(sin(theta) * sin(phi), cos(theta), -sin(theta) * cos(phi));
+}
+
+// color of the environment without the sun disk
+vec3 env_color(vec3 dir) {
+  switch (env_kind) {
+  case MapEnvironment:
+  case SkyEnvironment:
+    return _envLookup(_envUV(dir)) * env_intensity;
+  default:
+    float brightness = (dir.y / length(dir) + 1.0) / 2.0;
+    return mix(bg_bottom, bg_top, brightness);
+  }
+}
+
+vec3 sun_disk(vec3 dir) {
+  if (env_kind == SkyEnvironment && dot(normalize(dir), sun_dir) > sun_cos_radius) {
+    return sun_radiance;
+  }
+  return vec3(0.0);
+}
+
+// index of the first of count values of env_cdf starting at first which is greater than u
+int _searchCDF(int first, int count, float u) {
+  int lo = 0;
+  int hi = count - 1;
+  while (lo < hi) {
+    int mid = (lo + hi) / 2;
+    if (env_cdf[first + mid] > u) {
+      hi = mid;
+    } else {
+      lo = mid + 1;
+    }
+  }
+  return lo;
+}
+
+float _cdfStep(int first, int i) {
+  return env_cdf[first + i] - (i > 0 ? env_cdf[first + i - 1] : 0.0);
+}
+
+// importance sampling of the environment map: returns a direction
+// and its probability density (with respect to the solid angle)
+vec3 _sampleEnvironment(out float pdf) {
+  int y = _searchCDF(0, env_height, random());
+  int row = env_height + y * env_width;
+  int x = _searchCDF(row, env_width, random());
+  vec2 uv = (vec2(x, y) + vec2(random(), random())) / vec2(env_width, env_height);
+  float sin_theta = max(sin(uv.y * PI), FLOAT_DELTA);
+  pdf = _cdfStep(0, y) * _cdfStep(row, x) * float(env_width * env_height) / (2.0 * PI * PI * sin_theta);
+  return _envDir(uv);
+}
+
+
+// ===== Textures
+
+const uint CheckerTexture = 0x00000000u;
+const uint NoiseTexture   = 0x00000001u;
+const uint MarbleTexture  = 0x00000002u;
+const uint WoodTexture    = 0x00000003u;
+const uint ImageTexture   = 0x00000004u;
+
+const uint RepeatWrap = 0x00000000u;
+const uint ClampWrap  = 0x00000001u;
+const uint MirrorWrap = 0x00000002u;
+
+// a and b are the colors (or the values in every component) blended by the pattern.
+// Images are stored in texels starting from offset (width * height texels, rows
+// from top to bottom); the patterns of images for the values are their luminance
+struct texinfo {
+  vec4 a;
+  vec4 b;
+  uint kind;
+  float scale;
+  float turbulence;
+  int offset;
+  int width;
+  int height;
+  uint wrap;
+  float strength; // bump and normal maps
+};
+
+layout(std430, binding = 10) readonly buffer Textures {
+  texinfo textures[];
+};
+
+// x mod n for negative x as well (% is undefined for them in GLSL)
+int _floorMod(int x, int n) {
+  return x - n * int(floor(float(x) / float(n)));
+}
+
+int _wrapTexel(int x, int size, uint wrap) {
+  if (wrap == ClampWrap) {
+    return clamp(x, 0, size - 1);
+  }
+  if (wrap == MirrorWrap) {
+    x = _floorMod(x, 2 * size);
+    return x < size ? x : 2 * size - 1 - x;
+  }
+  return _floorMod(x, size);
+}
+
+vec3 _imageTexel(const texinfo t, int x, int y) {
+  x = _wrapTexel(x, t.width, t.wrap);
+  y = _wrapTexel(y, t.height, t.wrap);
+  return texels[t.offset + y * t.width + x].rgb;
+}
+
+// bilinear filtering between the centers of the texels
+vec3 _imageLookup(const texinfo t, vec2 uv) {
+  if (t.width == 0 || t.height == 0) {
+    // the image is not loaded
+    return vec3(1.0);
+  }
+  vec2 p = vec2(uv.x, 1.0 - uv.y) * vec2(t.width, t.height) - 0.5;
+  ivec2 i = ivec2(floor(p));
+  vec2 f = p - floor(p);
+  return mix(
+    mix(_imageTexel(t, i.x, i.y), _imageTexel(t, i.x + 1, i.y), f.x),
+    mix(_imageTexel(t, i.x, i.y + 1), _imageTexel(t, i.x + 1, i.y + 1), f.x),
+    f.y
+  );
+}
+
+// gradients of the Perlin noise: the directions to the edges of a cube
+const vec3 _noiseGradients[12] = vec3[](
+  vec3(1.0, 1.0, 0.0), vec3(-1.0, 1.0, 0.0), vec3(1.0, -1.0, 0.0), vec3(-1.0, -1.0, 0.0),
+  vec3(1.0, 0.0, 1.0), vec3(-1.0, 0.0, 1.0), vec3(1.0, 0.0, -1.0), vec3(-1.0, 0.0, -1.0),
+  vec3(0.0, 1.0, 1.0), vec3(0.0, -1.0, 1.0), vec3(0.0, 1.0, -1.0), vec3(0.0, -1.0, -1.0)
+);
+
+// dot product of the gradient at the corner of the cell with the offset of the point from it
+float _gradientDot(ivec3 corner, vec3 p) {
+  return dot(_noiseGradients[hash(uvec3(corner)) % 12u], p - vec3(corner));
+}
+
+// Perlin gradient noise (roughly in range [-1, 1]) with cells of size 1
+float _noise(vec3 p) {
+  ivec3 c = ivec3(floor(p));
+  vec3 f = p - floor(p);
+  vec3 u = f * f * f * (f * (f * 6.0 - 15.0) + 10.0);
+  return mix(
+    mix(
+      mix(_gradientDot(c, p), _gradientDot(c + ivec3(1, 0, 0), p), u.x),
+      mix(_gradientDot(c + ivec3(0, 1, 0), p), _gradientDot(c + ivec3(1, 1, 0), p), u.x),
+      u.y
+    ),
+    mix(
+      mix(_gradientDot(c + ivec3(0, 0, 1), p), _gradientDot(c + ivec3(1, 0, 1), p), u.x),
+      mix(_gradientDot(c + ivec3(0, 1, 1), p), _gradientDot(c + ivec3(1, 1, 1), p), u.x),
+      u.y
+    ),
+    u.z
+  );
+}
+
+#define TURBULENCE_OCTAVES 5
+
+// sum of the absolute values of the noise at growing frequencies
+float _turbulence(vec3 p) {
+  float sum = 0.0;
+  float weight = 1.0;
+  for (int i = 0; i < TURBULENCE_OCTAVES; i++) {
+    sum += weight * abs(_noise(p));
+    weight *= 0.5;
+    p *= 2.0;
+  }
+  return sum;
+}
+
+// the pattern of the texture at the point with given texture coordinates, in range [0, 1]
+float _pattern(const texinfo t, vec3 p, vec2 uv) {
+  if (t.kind == ImageTexture) {
+    return dot(_imageLookup(t, uv / t.scale), vec3(0.2126, 0.7152, 0.0722));
+  }
+  p /= t.scale;
+  if (t.kind == CheckerTexture) {
+    ivec3 c = ivec3(floor(p));
+    return float((c.x + c.y + c.z) & 1);
+  } else if (t.kind == NoiseTexture) {
+    return clamp(0.5 + 0.5 * _noise(p), 0.0, 1.0);
+  } else if (t.kind == MarbleTexture) {
+    // stripes across the x axis
+    return 0.5 + 0.5 * sin(2.0 * PI * (p.x + t.turbulence * _turbulence(p)));
+  } else if (t.kind == WoodTexture) {
+    // rings around the y axis, the noise is stretched along the fibres
+    return fract(length(p.xz) + 0.3 * t.turbulence * _noise(p * vec3(2.0, 0.2, 2.0)));
+  }
+  return 0.0;
+}
+
+// applyTextures replaces the textured parameters of the material with their values
+// at the hit point. Procedural textures are evaluated in the object space (so that they
+// follow the transformed body) slightly inside the surface, so that faces lying on the
+// boundaries of the checker cells get a single color
+material applyTextures(material m, vec3 point, hitinfo info) {
+  object o = objects[info.oi];
+  point = (o.to_object * vec4(point, 1.0)).xyz;
+  vec3 normal = _normalLocal(o, point, info);
+  if (m.color_texture >= 0) {
+    texinfo t = textures[m.color_texture];
+    if (t.kind == ImageTexture) {
+      m.color = vec4(_imageLookup(t, info.uv / t.scale), 1.0);
+    } else {
+      m.color = mix(t.a, t.b, _pattern(t, point - normal * t.scale * 0.001, info.uv));
+    }
+  }
+  if (m.roughness_texture >= 0) {
+    texinfo t = textures[m.roughness_texture];
+    m.roughness = mix(t.a.x, t.b.x, _pattern(t, point - normal * t.scale * 0.001, info.uv));
+  }
+  return m;
+}
+
+// shadingNormal returns the normal tilted by the bump map and the normal map of
+// the material, in the tangent space of the surface: the tangent points to growing u
+// and the bitangent to growing v. The normal is not changed if the ray would hit the
+// surface from the other side of the tilted one
+vec3 shadingNormal(const material m, vec3 point, vec3 normal, vec3 incident, hitinfo info) {
+  if (m.normal_map < 0 && m.bump < 0) {
+    return normal;
+  }
+  vec3 t = info.tangent - normal * dot(normal, info.tangent);
+  vec3 b;
+  if (length(t) < FLOAT_DELTA) {
+    // the texture coordinates do not change along the surface
+    _tangentFrame(normal, t, b);
+  } else {
+    t = normalize(t);
+    b = cross(normal, t);
+    if (dot(b, info.bitangent) < 0.0) {
+      b = -b;
+    }
+  }
+
+  vec3 shading = normal;
+  if (m.bump >= 0) {
+    texinfo tx = textures[m.bump];
+    // slope of the bumps along the tangent and the bitangent,
+    // the pattern is evaluated in the object space
+    vec2 slope;
+    mat4 to_object = objects[info.oi].to_object;
+    vec3 local = (to_object * vec4(point, 1.0)).xyz;
+    float h = _pattern(tx, local, info.uv);
+    if (tx.kind == ImageTexture) {
+      // differences of the heights of neighbouring texels
+      vec2 du = vec2(tx.scale / float(max(tx.width, 1)), 0.0);
+      vec2 dv = vec2(0.0, tx.scale / float(max(tx.height, 1)));
+      slope = vec2(_pattern(tx, local, info.uv + du) - h, _pattern(tx, local, info.uv + dv) - h);
+    } else {
+      // differences over a hundredth of the scale (relative to the scale)
+      float e = tx.scale * 0.01;
+      vec3 dt = mat3(to_object) * (t * e);
+      vec3 db = mat3(to_object) * (b * e);
+      slope = vec2(_pattern(tx, local + dt, info.uv) - h, _pattern(tx, local + db, info.uv) - h) * 100.0;
+    }
+    slope *= tx.strength;
+    shading = normalize(normal - t * slope.x - b * slope.y);
+  }
+  if (m.normal_map >= 0) {
+    texinfo tx = textures[m.normal_map];
+    vec3 n = _imageLookup(tx, info.uv / tx.scale) * 2.0 - 1.0;
+    n.xy *= tx.strength;
+    // the frame follows the bumps
+    float handedness = dot(cross(normal, t), b);
+    t = normalize(t - shading * dot(shading, t));
+    b = cross(shading, t);
+    if (handedness < 0.0) {
+      b = -b;
+    }
+    shading = normalize(t * n.x + b * n.y + shading * max(n.z, 0.0));
+  }
+
+  if (dot(shading, incident) * dot(normal, incident) <= 0.0) {
+    return normal;
+  }
+  return shading;
+}
+
+
+// ===== Participating media
+//
+// The medium a ray travels in is given by the index of the object it is inside
+// (the medium is the one of its material), -1 means the fog, which fills the
+// bounding box of the scene. Media do not nest: leaving an object always gets
+// the ray into the fog
+
+uniform vec3 fog_absorption;
+uniform vec3 fog_scattering;
+uniform float fog_anisotropy;
+
+// heterogeneous media fill the volume bodies: the coefficients of the medium
+// are multiplied by the density, either procedural or interpolated trilinearly
+// between the centers of the voxels of the grid (x changes fastest, then y, then z)
+struct volume {
+  ivec4 grid;        // resolution, w = index of the first voxel in densities
+  int density;       // index of the procedural density in textures (-1 for grids)
+  float max_density;
+};
+
+layout(std430, binding = 11) readonly buffer Volumes {
+  volume volumes[];
+};
+
+layout(std430, binding = 12) readonly buffer Densities {
+  float densities[];
+};
 
-vec3 bg_color(vec3 dir) {
-  float brightness = (dir.y / length(dir) + 1.0) / 2.0;
-  return vec3(brightness);
+void _medium(int mi, out vec3 absorption, out vec3 scattering, out float anisotropy) {
+  if (mi < 0) {
+    absorption = fog_absorption;
+    scattering = fog_scattering;
+    anisotropy = fog_anisotropy;
+    return;
+  }
+  material m = materials[objects[mi].material];
+  absorption = m.absorption.rgb;
+  scattering = m.scattering.rgb;
+  anisotropy = m.scattering.w;
+}
+
+bool _heterogeneous(int mi) {
+  return mi >= 0 && objects[mi].body == VolumeBody;
 }
 
-ray3 trace_step(ray3 r, out vec3 color) {
+float _voxel(const volume v, ivec3 c) {
+  c = clamp(c, ivec3(0), v.grid.xyz - 1);
+  return densities[v.grid.w + (c.z * v.grid.y + c.y) * v.grid.x + c.x];
+}
+
+// density of the heterogeneous medium at the point
+float _density(int mi, vec3 point) {
+  object o = objects[mi];
+  volume v = volumes[o.root];
+  vec3 local = (o.to_object * vec4(point, 1.0)).xyz;
+  if (v.density >= 0) {
+    texinfo t = textures[v.density];
+    return max(mix(t.a.x, t.b.x, _pattern(t, local, vec2(0.0))), 0.0);
+  }
+  vec3 c = (local - o.p0.xyz) / (o.p1.xyz - o.p0.xyz) * vec3(v.grid.xyz) - 0.5;
+  ivec3 b = ivec3(floor(c));
+  vec3 f = c - floor(c);
+  float d00 = mix(_voxel(v, b), _voxel(v, b + ivec3(1, 0, 0)), f.x);
+  float d10 = mix(_voxel(v, b + ivec3(0, 1, 0)), _voxel(v, b + ivec3(1, 1, 0)), f.x);
+  float d01 = mix(_voxel(v, b + ivec3(0, 0, 1)), _voxel(v, b + ivec3(1, 0, 1)), f.x);
+  float d11 = mix(_voxel(v, b + ivec3(0, 1, 1)), _voxel(v, b + ivec3(1, 1, 1)), f.x);
+  return mix(mix(d00, d10, f.y), mix(d01, d11, f.y), f.z);
+}
+
+// the maximum extinction of the heterogeneous medium
+float _majorant(int mi, vec3 extinction) {
+  return volumes[objects[mi].root].max_density * max(max(extinction.r, extinction.g), extinction.b);
+}
+
+// must be large enough for the tentative collisions along the paths through the densest volumes
+#define MAX_NULL_COLLISIONS 1024
+
+// ratio tracking: the transmittance of the heterogeneous medium is estimated by the product
+// of the probabilities of the null collisions at the tentative collisions sampled with the majorant
+vec3 _ratioTracking(int mi, vec3 origin, vec3 dir, float dist, vec3 extinction) {
+  vec3 result = vec3(1.0);
+  float majorant = _majorant(mi, extinction);
+  if (majorant <= 0.0) {
+    return result;
+  }
+  float t = 0.0;
+  for (int k = 0; k < MAX_NULL_COLLISIONS; k++) {
+    t -= log(1.0 - random()) / majorant;
+    if (t >= dist) {
+      break;
+    }
+    result *= 1.0 - extinction * _density(mi, origin + dir * t) / majorant;
+  }
+  return result;
+}
+
+// delta tracking: tentative collisions are sampled with the majorant, and each one is either
+// a real scattering or a null collision, chosen by the average scattering coefficient at the point.
+// As in sampleMedium, the absorption and the colors of the medium go to the weight
+float _deltaTracking(int mi, vec3 origin, vec3 dir, float dist, vec3 absorption, vec3 scattering, out vec3 weight) {
+  weight = vec3(1.0);
+  float majorant = _majorant(mi, absorption + scattering);
+  if (majorant <= 0.0) {
+    return dist;
+  }
+  float t = 0.0;
+  for (int k = 0; k < MAX_NULL_COLLISIONS; k++) {
+    t -= log(1.0 - random()) / majorant;
+    if (t >= dist) {
+      break;
+    }
+    float d = _density(mi, origin + dir * t);
+    vec3 s = scattering * d;
+    float p = (s.r + s.g + s.b) / (3.0 * majorant);
+    if (random() < p) {
+      weight *= s / (p * majorant);
+      return t;
+    }
+    weight *= (majorant - (absorption + scattering) * d) / ((1.0 - p) * majorant);
+  }
+  return dist;
+}
+
+// the part of the segment of the ray from 0 to dist (dir must be normalized) which is in the medium
+vec2 _mediumSegment(int mi, vec3 origin, vec3 dir, float dist) {
+  if (mi >= 0) {
+    return vec2(0.0, dist);
+  }
+  if (bvh_nodes.length() == 0) {
+    return vec2(0.0);
+  }
+  // the root is unbounded if there are infinite planes, they are in its first child
+  // and the rest of the scene is in the second one (see bvh.Build)
+  bvhnode root = bvh_nodes[0];
+  if (any(isinf(root.min)) || any(isinf(root.max))) {
+    if (root.count > 0) {
+      return vec2(0.0);
+    }
+    root = bvh_nodes[root.offset];
+  }
+  vec2 t = _intersectBox(origin, dir, box(root.min, root.max));
+  return vec2(max(t.x, 0.0), min(t.y, dist));
+}
+
+// transmittance of the medium along the segment of the ray from 0 to dist
+vec3 _mediumTransmittance(int mi, vec3 origin, vec3 dir, float dist) {
+  vec3 absorption, scattering;
+  float g;
+  _medium(mi, absorption, scattering, g);
+  vec3 extinction = absorption + scattering;
+  if (extinction == vec3(0.0)) {
+    return vec3(1.0);
+  }
+  if (_heterogeneous(mi)) {
+    return _ratioTracking(mi, origin, dir, dist, extinction);
+  }
+  vec2 seg = _mediumSegment(mi, origin, dir, dist);
+  return exp(-extinction * max(seg.y - seg.x, 0.0));
+}
+
+// sampleMedium returns the distance at which the ray is scattered by the medium
+// (dist if it gets through to the end of the segment). The distance is sampled with
+// the average scattering coefficient, and the absorption is applied as it is,
+// so the weight (the transmittance divided by the probability of the sample, times
+// the scattering coefficient if the ray is scattered) is 1 for grey media without absorption
+float sampleMedium(int mi, vec3 origin, vec3 dir, float dist, out vec3 weight) {
+  weight = vec3(1.0);
+  vec3 absorption, scattering;
+  float g;
+  _medium(mi, absorption, scattering, g);
+  if (absorption + scattering == vec3(0.0)) {
+    return dist;
+  }
+  if (_heterogeneous(mi)) {
+    return _deltaTracking(mi, origin, dir, dist, absorption, scattering, weight);
+  }
+  vec2 seg = _mediumSegment(mi, origin, dir, dist);
+  if (seg.x >= seg.y) {
+    return dist;
+  }
+  float s = (scattering.r + scattering.g + scattering.b) / 3.0;
+  float t = s > 0.0 ? seg.x - log(1.0 - random()) / s : seg.y;
+  if (t < seg.y) {
+    weight = exp(-(absorption + scattering - s) * (t - seg.x)) * scattering / s;
+    return t;
+  }
+  weight = exp(-(absorption + scattering - s) * (seg.y - seg.x));
+  return dist;
+}
+
+// Henyey-Greenstein phase function of the angle between the directions
+// of the incident and the scattered light
+float _phaseHG(float cos_theta, float g) {
+  float d = 1.0 + g * g - 2.0 * g * cos_theta;
+  return (1.0 - g * g) / (4.0 * PI * d * sqrt(d));
+}
+
+vec3 _samplePhaseHG(vec3 dir, float g) {
+  float u = random();
+  float cos_theta;
+  if (abs(g) < 0.001) {
+    cos_theta = 1.0 - 2.0 * u;
+  } else {
+    float sq = (1.0 - g * g) / (1.0 + g - 2.0 * g * u);
+    cos_theta = (1.0 + g * g - sq * sq) / (2.0 * g);
+  }
+  float sin_theta = sqrt(max(0.0, 1.0 - cos_theta * cos_theta));
+  float phi = 2.0 * PI * random();
+  vec3 t, b;
+  _tangentFrame(dir, t, b);
+  return _fromLocal(vec3(sin_theta * cos(phi), sin_theta * sin(phi), cos_theta), t, b, dir);
+}
+
+// must be greater than the number of media boundaries between the shaded point and a light
+#define MAX_MEDIUM_CROSSINGS 8
+
+// transmittance along the shadow ray from the point in the medium mi (dir must be normalized):
+// zero if the ray is blocked by a surface before dist, otherwise the product of the transmittances
+// of the media it travels through (the boundaries of participating media do not block it)
+vec3 _shadowTransmittance(vec3 point, vec3 dir, float dist, int mi) {
+  vec3 result = vec3(1.0);
+  for (int k = 0; k < MAX_MEDIUM_CROSSINGS; k++) {
+    hitinfo i;
+    bool hit = intersectObjects(point, dir, i) && i.lambda.x < dist;
+    result *= _mediumTransmittance(mi, point, dir, hit ? i.lambda.x : dist);
+    if (!hit) {
+      return result;
+    }
+    if (materials[objects[i.oi].material].kind != ParticipatingMaterial) {
+      return vec3(0.0);
+    }
+    point += dir * i.lambda.x;
+    dist -= i.lambda.x;
+    mi = dot(dir, normalObject(point, i)) < 0.0 ? i.oi : -1;
+  }
+  return vec3(0.0);
+}
+
+
+// ===== Direct lighting
+
+// light arriving at the point in the medium mi from the light source (zero if it is in shadow)
+vec3 _lightIncoming(vec3 point, int mi, const light l, out vec3 to_light) {
+  float dist;
+  vec3 radiance = l.radiance.rgb;
+  if (l.kind == DirectionalLight) {
+    to_light = -l.direction.xyz;
+    dist = MAX_SCENE_BOUNDS;
+  } else {
+    to_light = l.position.xyz - point;
+    dist = length(to_light);
+    to_light /= dist;
+    radiance /= dist * dist;
+    if (l.kind == SpotLight) {
+      radiance *= smoothstep(l.cos_outer, l.cos_inner, dot(-to_light, l.direction.xyz));
+    }
+  }
+  if (radiance == vec3(0.0)) {
+    return radiance;
+  }
+  return radiance * _shadowTransmittance(point, to_light, dist, mi);
+}
+
+// light from the light sources reflected by a lambertian surface towards the viewer
+// (next-event estimation: the lights are sampled with shadow rays, since the
+// scattered rays never hit them; neither do they see the sun disk). If the environment
+// is importance sampled, its light is also included here, so the scattered ray must ignore it.
+// mi is the medium on the side of the incident ray
+vec3 directLambertian(vec3 point, int mi, vec3 incident, vec3 normal, vec3 albedo) {
+  if (dot(incident, normal) > 0.0) {
+    normal *= -1.0;
+  }
+  vec3 result = vec3(0.0);
+  for (int li = 0; li < lights.length(); li++) {
+    vec3 to_light;
+    vec3 incoming = _lightIncoming(point, mi, lights[li], to_light);
+    float cos_theta = dot(normal, to_light);
+    if (cos_theta > 0.0) {
+      result += incoming * cos_theta;
+    }
+  }
+
+  if (env_sampling) {
+    float pdf;
+    vec3 dir = _sampleEnvironment(pdf);
+    float cos_theta = dot(normal, dir);
+    if (cos_theta > 0.0 && pdf > 0.0) {
+      result += env_color(dir) * _shadowTransmittance(point, dir, MAX_SCENE_BOUNDS, mi) * cos_theta / pdf;
+    }
+  }
+  return result * albedo / PI;
+}
+
+// light from the light sources reflected by a metal towards the viewer. The environment
+// is not sampled here (the scattered rays find it much better for smooth metals)
+vec3 directMetal(vec3 point, int mi, vec3 incident, vec3 normal, const material m) {
+  if (dot(incident, normal) > 0.0) {
+    normal *= -1.0;
+  }
+  vec3 t, b;
+  _tangentFrame(normal, t, b);
+  vec3 wo = -_toLocal(normalize(incident), t, b, normal);
+  vec2 alpha = _ggxAlpha(m.roughness, m.anisotropy);
+  vec3 result = vec3(0.0);
+  for (int li = 0; li < lights.length(); li++) {
+    vec3 to_light;
+    vec3 incoming = _lightIncoming(point, mi, lights[li], to_light);
+    vec3 wi = _toLocal(to_light, t, b, normal);
+    if (wi.z <= 0.0 || wo.z <= 0.0) {
+      continue;
+    }
+    vec3 h = normalize(wo + wi);
+    float g = 1.0 / (1.0 + _ggxLambda(wo, alpha) + _ggxLambda(wi, alpha));
+    // the BRDF times the cosine of wi: F * D * G / (4 * cos(wo))
+    vec3 f = _fresnelConductor(dot(wo, h), m.ior_n.rgb, m.ior_k.rgb) * _ggxD(h, alpha) * g / (4.0 * wo.z);
+    result += incoming * f;
+  }
+  return result * m.color.rgb;
+}
+
+// light from the light sources scattered by the medium towards the viewer; the environment
+// is sampled as well if it is importance sampled (as for the lambertian surfaces)
+vec3 directMedium(vec3 point, int mi, vec3 dir) {
+  vec3 absorption, scattering;
+  float g;
+  _medium(mi, absorption, scattering, g);
+  vec3 result = vec3(0.0);
+  for (int li = 0; li < lights.length(); li++) {
+    vec3 to_light;
+    vec3 incoming = _lightIncoming(point, mi, lights[li], to_light);
+    result += incoming * _phaseHG(dot(dir, to_light), g);
+  }
+
+  if (env_sampling) {
+    float pdf;
+    vec3 env_dir = _sampleEnvironment(pdf);
+    if (pdf > 0.0) {
+      vec3 transmittance = _shadowTransmittance(point, env_dir, MAX_SCENE_BOUNDS, mi);
+      result += env_color(env_dir) * transmittance * _phaseHG(dot(dir, env_dir), g) / pdf;
+    }
+  }
+  return result;
+}
+
+
+// ===== Main tracing functions
+
+// trace_step finds where the ray hits the scene and returns the scattered ray
+// (with zero direction if the path ends there). The light emitted towards
+// the origin of the ray is returned in emitted and the fraction of the light
+// coming along the scattered ray is returned in color. skip_sun and skip_env tell
+// whether the light sources (of which only the sun disk can be seen) and the
+// environment have already been sampled at the origin of the ray, they are
+// updated for the scattered one. medium is the one the ray travels in, it is
+// updated when the ray crosses the surface of an object
+ray3 trace_step(ray3 r, out vec3 color, out vec3 emitted, inout bool skip_sun, inout bool skip_env, inout int medium) {
   hitinfo i;
-  if (intersectObjects(r.origin, r.dir, i)) {
+  color = vec3(0.0);
+  emitted = vec3(0.0);
+  bool hit = intersectObjects(r.origin, r.dir, i);
+  float len = length(r.dir);
+  float dist = (hit ? i.lambda.x : MAX_SCENE_BOUNDS) * len;
+  vec3 transmittance;
+  float t = sampleMedium(medium, r.origin, r.dir / len, dist, transmittance);
+  if (t < dist) {
+    // the ray is scattered by the medium before it gets to the surface
+    vec3 point = r.origin + r.dir / len * t;
+    vec3 absorption, scattering;
+    float g;
+    _medium(medium, absorption, scattering, g);
+    color = transmittance;
+    emitted = directMedium(point, medium, r.dir / len) * transmittance;
+    skip_sun = true;
+    skip_env = env_sampling;
+    return ray3(point, _samplePhaseHG(r.dir / len, g));
+  }
+
+  if (hit) {
     vec3 point = r.origin + r.dir * i.lambda.x;
-    vec3 normal = normalObject(point, i.oi);
-    color = colors[i.oi];
-    vec3 scattered = scatter(r.dir, normal, i.oi);
+    vec3 normal = normalObject(point, i);
+    material m = materials[objects[i.oi].material];
+    if (m.kind == ParticipatingMaterial) {
+      // the surface of the medium is invisible
+      medium = dot(r.dir, normal) < 0.0 ? i.oi : -1;
+      color = transmittance;
+      return ray3(point, r.dir);
+    }
+    uvObject(point, i);
+    m = applyTextures(m, point, i);
+    if (m.kind == EmissiveMaterial) {
+      emitted = m.color.rgb * m.intensity * transmittance;
+      return ray3(vec3(0.0), vec3(0.0));
+    }
+    vec3 outer = normal;
+    normal = shadingNormal(m, point, normal, r.dir, i);
+    float scale = 1.0;
+    if (m.kind == PrincipledMaterial) {
+      emitted = m.emission.rgb;
+      m = principledLobe(m, r.dir, normal, scale);
+    }
+    skip_sun = false;
+    skip_env = false;
+    if (m.kind == LambertianMaterial) {
+      emitted += directLambertian(point, medium, r.dir, normal, m.color.rgb) * scale;
+      skip_sun = true;
+      skip_env = env_sampling;
+    } else if (m.kind == MetalMaterial) {
+      emitted += directMetal(point, medium, r.dir, normal, m) * scale;
+      skip_sun = true;
+    }
+    emitted *= transmittance;
+    vec3 scattered = scatter(r.dir, normal, m, color);
     if (fleq(length(scattered), 0.0)) {
       color = vec3(0.0);
       return ray3(vec3(0.0), vec3(0.0));
     }
+    color *= scale * transmittance;
+    bool glass = m.kind == GlassMaterial || m.kind == RoughGlassMaterial;
+    if (glass && dot(scattered, outer) * dot(r.dir, outer) > 0.0) {
+      // the ray is refracted into the object or out of it
+      medium = dot(r.dir, outer) < 0.0 ? i.oi : -1;
+    }
     return ray3(point, normalize(scattered));
   }
-  color = bg_color(r.dir);
+  if (!skip_env) {
+    emitted += env_color(r.dir);
+  }
+  if (!skip_sun) {
+    emitted += sun_disk(r.dir);
+  }
+  emitted *= transmittance;
   return ray3(vec3(0.0), vec3(0.0));
 }
 
+// trace_ray sums the light emitted at every step of the path,
+// attenuated by the colors of the surfaces it was scattered by.
+// The camera is assumed to be outside of all objects (in the fog)
 vec3 trace_ray(ray3 ray) {
-  vec3 resulting_color = vec3(1.0);
-  for (int i = 0; i <= MAX_DEPTH; i++) {
-    if (i == MAX_DEPTH) {
-      return vec3(0.0, 0.0, 0.0);
-    }
-    vec3 color;
-    ray = trace_step(ray, color);
-    resulting_color *= color;
+  vec3 radiance = vec3(0.0);
+  vec3 throughput = vec3(1.0);
+  bool skip_sun = false;
+  bool skip_env = false;
+  int medium = -1;
+  for (int i = 0; i < MAX_DEPTH; i++) {
+    vec3 color, emitted;
+    ray = trace_step(ray, color, emitted, skip_sun, skip_env, medium);
+    radiance += throughput * emitted;
+    throughput *= color;
     if (fleq(length(ray.dir), 0.0)) {
       break;
     }
   }
-  return resulting_color;
+  return radiance;
 }
 
 ray3 get_ray(vec2 pos, float lr) {
@@ -0,0 +1,162 @@
+package tracer
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	mgl "github.com/go-gl/mathgl/mgl32"
+
+	"github.com/xopoww/go-raytrace/scenery"
+)
+
+// addPlanes adds two unbounded objects to the scene (a tilted floor and
+// a ceiling), which the hierarchy keeps out of its bounded nodes
+func addPlanes(scene *scenery.Scene) {
+	grey := scenery.NewLambertian(color.RGBA{0x80, 0x80, 0x80, 0xff})
+	scene.AddObject(scenery.NewObject(scenery.NewPlane(mgl.Vec3{0, -1, 0}, mgl.Vec3{0.1, 1, 0.05}.Normalize()), grey))
+	scene.AddObject(scenery.NewObject(scenery.NewPlane(mgl.Vec3{0, 200, 0}, mgl.Vec3{0, -1, 0}), grey))
+}
+
+// TestBVHLeaves checks that the hierarchy built over a random scene of boxes, balls
+// and planes holds every object once, in a leaf whose bounds contain the object
+func TestBVHLeaves(t *testing.T) {
+	scene := scenery.RandomSceneWithObjects(1, 300)
+	addPlanes(scene)
+	tr := New(scene)
+	var bodies []scenery.Body
+	for _, data := range scene.Data {
+		for _, o := range data.Objects {
+			bodies = append(bodies, o.Body)
+		}
+	}
+
+	seen := make([]int, len(bodies))
+	for ni, n := range tr.bvh.Nodes {
+		if !n.IsLeaf() {
+			continue
+		}
+		for _, i := range tr.bvh.Indices[n.Offset : n.Offset+n.Count] {
+			seen[i]++
+			if b := bodies[i].Bounds(); n.Bounds().Union(b) != n.Bounds() {
+				t.Errorf("leaf %d with bounds %v does not contain object %d with bounds %v", ni, n.Bounds(), i, b)
+			}
+		}
+	}
+	for i, k := range seen {
+		if k != 1 {
+			t.Errorf("object %d is in %d leaves", i, k)
+		}
+	}
+}
+
+// TestBVHIntersectObjects checks that traversing the hierarchy finds the same
+// object at the same distance as testing every object for random rays
+func TestBVHIntersectObjects(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	for _, seed := range []int64{1, 2} {
+		scene := scenery.RandomSceneWithObjects(seed, 300)
+		if seed == 2 {
+			addPlanes(scene)
+		}
+		tr := New(scene)
+		brute := *tr
+		brute.bvh = nil
+		hits := 0
+		for k := 0; k < 2000; k++ {
+			origin := mgl.Vec3{rng.Float32() - 0.5, rng.Float32() * 0.25, rng.Float32() - 0.5}.Mul(160.0)
+			dir := randomInUnitSphere(rng).Normalize()
+			got, gotFound := tr.intersectObjects(origin, dir)
+			want, wantFound := brute.intersectObjects(origin, dir)
+			if gotFound != wantFound || got != want {
+				t.Fatalf("seed %d, ray from %v along %v: %+v (found = %v) with the BVH, %+v (found = %v) without it",
+					seed, origin, dir, got, gotFound, want, wantFound)
+			}
+			if gotFound {
+				hits++
+			}
+		}
+		if hits == 0 {
+			t.Errorf("seed %d: no ray hit anything", seed)
+		}
+	}
+}
+
+// TestBVHTies checks that equally close objects are resolved in the same way
+// with and without the hierarchy, whatever order the traversal tests them in
+func TestBVHTies(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	scene := scenery.NewScene()
+	white := scenery.NewLambertian(color.RGBA{0xff, 0xff, 0xff, 0xff})
+	for i := 0; i < 100; i++ {
+		p := mgl.Vec3{rng.Float32(), rng.Float32(), rng.Float32()}.Mul(20.0)
+		// every body is added twice
+		for k := 0; k < 2; k++ {
+			scene.AddObject(scenery.NewObject(scenery.NewBox(p, p.Add(mgl.Vec3{1, 1, 1})), white))
+			scene.AddObject(scenery.NewObject(scenery.NewBall(p, 0.5), white))
+		}
+	}
+	tr := New(scene)
+	brute := *tr
+	brute.bvh = nil
+	for k := 0; k < 2000; k++ {
+		origin := mgl.Vec3{rng.Float32(), rng.Float32(), rng.Float32()}.Mul(20.0)
+		dir := randomInUnitSphere(rng).Normalize()
+		got, gotFound := tr.intersectObjects(origin, dir)
+		want, wantFound := brute.intersectObjects(origin, dir)
+		if gotFound != wantFound || got != want {
+			t.Fatalf("ray from %v along %v: %+v (found = %v) with the BVH, %+v (found = %v) without it",
+				origin, dir, got, gotFound, want, wantFound)
+		}
+	}
+}
+
+func TestBVHMatchesBruteForce(t *testing.T) {
+	for _, seed := range []int64{1, 2, 3} {
+		scene := scenery.RandomScene(seed)
+		if seed == 3 {
+			// the infinite planes are kept out of the hierarchy
+			scene.AddObject(scenery.NewObject(
+				scenery.NewPlane(mgl.Vec3{0, -1, 0}, mgl.Vec3{0.1, 1, 0.05}.Normalize()),
+				scenery.NewLambertian(color.RGBA{0x80, 0x80, 0x80, 0xff}),
+			))
+		}
+		tr := New(scene)
+		opts := testOptions()
+		cam := testCamera(opts)
+		withBVH := tr.Render(cam, opts)
+		opts.DisableBVH = true
+		if withoutBVH := tr.Render(cam, opts); !bytes.Equal(withBVH.Pix, withoutBVH.Pix) {
+			t.Errorf("seed %d: the image rendered with the BVH differs from the one rendered without it", seed)
+		}
+	}
+}
+
+// BenchmarkTrace renders random scenes of growing size with and without the BVH
+// (same setup as the bench command)
+func BenchmarkTrace(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		scene := scenery.RandomSceneWithObjects(0, n)
+		tr := New(scene)
+		opts := DefaultOptions(64, 48)
+		opts.Samples = 1
+		opts.AntiAliasing = 1
+		cam := scenery.NewCamera(opts.Width, opts.Height)
+		cam.SetView(mgl.Vec3{60.0, 30.0, 60.0}, mgl.Vec3{0.0, 0.0, 0.0})
+		cam.Aperture = 0.0
+		for _, disable := range []bool{false, true} {
+			opts.DisableBVH = disable
+			name := fmt.Sprintf("objects=%d/bvh", n)
+			if disable {
+				name = fmt.Sprintf("objects=%d/brute", n)
+			}
+			b.Run(name, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					tr.Render(cam, opts)
+				}
+			})
+		}
+	}
+}
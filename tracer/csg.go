@@ -0,0 +1,148 @@
+package tracer
+
+import (
+	"math"
+
+	mgl "github.com/go-gl/mathgl/mgl32"
+
+	"github.com/xopoww/go-raytrace/scenery"
+)
+
+// CSG bodies: same as in the shader, the program of the body is evaluated
+// at the boundaries of its leaves along the ray
+
+func intersectLeaf(origin, dir mgl.Vec3, n *scenery.CSGNode) mgl.Vec2 {
+	origin = transformPoint(n.ToLeaf, origin)
+	dir = n.ToLeaf.Mat3().Mul3x1(dir)
+	b := &n.Body
+	var lambda mgl.Vec2
+	switch b.Kind {
+	case scenery.Box:
+		lambda = intersectBox(origin, dir, b.Min, b.Max)
+	case scenery.Cylinder, scenery.Cone:
+		lambda = intersectCone(origin, dir, b.Start, b.End, b.Radius, b.EndRadius)
+	case scenery.Capsule:
+		lambda = intersectCapsule(origin, dir, b.Start, b.End, b.Radius)
+	default:
+		lambda = intersectBall(origin, dir, b.Center, b.Radius)
+	}
+	if lambda.X() > lambda.Y() {
+		inf := float32(math.Inf(1))
+		return mgl.Vec2{inf, inf}
+	}
+	return lambda
+}
+
+// insideCSG returns whether the ray is inside the CSG body right after the ray parameter t
+// (the leaves are inside from the entry to the exit, excluding the latter)
+func insideCSG(program []scenery.CSGNode, t float32, intervals []mgl.Vec2) bool {
+	var stack [scenery.MaxCSGLeaves]bool
+	sp, leaf := 0, 0
+	for j := range program {
+		op := program[j].Operation
+		if op == scenery.CSGLeaf {
+			stack[sp] = intervals[leaf].X() <= t && t < intervals[leaf].Y()
+			sp++
+			leaf++
+			continue
+		}
+		a, b := stack[sp-2], stack[sp-1]
+		sp--
+		switch op {
+		case scenery.Union:
+			stack[sp-1] = a || b
+		case scenery.Intersection:
+			stack[sp-1] = a && b
+		default:
+			stack[sp-1] = a && !b
+		}
+	}
+	return stack[0]
+}
+
+// intersectCSG returns the first interval of the body which ends in front of the origin
+// and the index of the leaf the ray hits: the one at the entry, or the one at the exit
+// if the origin is inside
+func intersectCSG(origin, dir mgl.Vec3, program []scenery.CSGNode) (mgl.Vec2, int) {
+	inf := float32(math.Inf(1))
+	var intervals [scenery.MaxCSGLeaves]mgl.Vec2
+	var leaves [scenery.MaxCSGLeaves]int
+	count := 0
+	for j := range program {
+		if program[j].Operation == scenery.CSGLeaf {
+			intervals[count] = intersectLeaf(origin, dir, &program[j])
+			leaves[count] = j
+			count++
+		}
+	}
+
+	t := -inf
+	inside := insideCSG(program, t, intervals[:count])
+	entry, entryLeaf := t, -1
+	for k := 0; k <= 2*count; k++ {
+		next, nextLeaf := inf, -1
+		for j := 0; j < count; j++ {
+			b := inf
+			if intervals[j].X() > t {
+				b = intervals[j].X()
+			} else if intervals[j].Y() > t {
+				b = intervals[j].Y()
+			}
+			if b < next {
+				next, nextLeaf = b, leaves[j]
+			}
+		}
+		if nextLeaf < 0 {
+			break
+		}
+		now := insideCSG(program, next, intervals[:count])
+		if now && !inside {
+			entry, entryLeaf = next, nextLeaf
+		} else if inside && !now && next > floatDelta {
+			if entry > floatDelta {
+				return mgl.Vec2{entry, next}, entryLeaf
+			}
+			return mgl.Vec2{entry, next}, nextLeaf
+		}
+		inside = now
+		t = next
+	}
+	return mgl.Vec2{inf, inf}, 0
+}
+
+// normalCSG returns the normal of the CSG body at the point on the surface of the leaf
+func normalCSG(point mgl.Vec3, n *scenery.CSGNode) mgl.Vec3 {
+	point = transformPoint(n.ToLeaf, point)
+	return n.ToLeaf.Mat3().Transpose().Mul3x1(normalLeaf(point, &n.Body)).Normalize().Mul(n.Polarity)
+}
+
+// normalLeaf returns the normal of the leaf at the point in its own space
+func normalLeaf(point mgl.Vec3, b *scenery.Body) mgl.Vec3 {
+	switch b.Kind {
+	case scenery.Box:
+		return normalBox(point, b.Min, b.Max)
+	case scenery.Cylinder, scenery.Cone:
+		return normalCone(point, b.Start, b.End, b.Radius, b.EndRadius)
+	case scenery.Capsule:
+		return normalCapsule(point, b.Start, b.End)
+	}
+	return normalBall(point, b.Center)
+}
+
+// uvCSG returns the texture coordinates of the leaf at the point, they follow the leaf as in object.uv
+func uvCSG(point mgl.Vec3, n *scenery.CSGNode) (uv mgl.Vec2, tangent, bitangent mgl.Vec3) {
+	point = transformPoint(n.ToLeaf, point)
+	b := &n.Body
+	switch b.Kind {
+	case scenery.Box:
+		uv, tangent, bitangent = uvBox(point, normalBox(point, b.Min, b.Max), b.Min, b.Max)
+	case scenery.Cylinder, scenery.Cone:
+		uv, tangent, bitangent = uvCone(point, b.Start, b.End, b.Radius, b.EndRadius)
+	case scenery.Capsule:
+		uv, tangent, bitangent = uvCapsule(point, b.Start, b.End, b.Radius)
+	default:
+		uv, tangent, bitangent = uvBall(normalBall(point, b.Center))
+	}
+	toCSG := n.ToLeaf.Mat3().Inv()
+	return uv, toCSG.Mul3x1(tangent), toCSG.Mul3x1(bitangent)
+}
@@ -0,0 +1,161 @@
+package tracer
+
+import (
+	"math"
+	"math/rand"
+
+	mgl "github.com/go-gl/mathgl/mgl32"
+
+	"github.com/xopoww/go-raytrace/scenery"
+)
+
+type environment struct {
+	kind scenery.EnvironmentKind
+
+	// gradient
+	bottom mgl.Vec3
+	top    mgl.Vec3
+
+	// map
+	image     *scenery.Image
+	rotation  float32
+	intensity float32
+	// nil if the map is not importance sampled
+	cdf []float32
+
+	// sky (the image holds the sky without the sun)
+	sunDir       mgl.Vec3
+	sunRadiance  mgl.Vec3
+	sunCosRadius float32
+}
+
+func newEnvironment(env scenery.Environment) environment {
+	e := environment{
+		kind:      env.Kind,
+		bottom:    colorToVec(env.Bottom),
+		top:       colorToVec(env.Top),
+		image:     env.Image,
+		rotation:  mgl.DegToRad(env.Rotation),
+		intensity: env.Intensity,
+		cdf:       env.SamplingCDF(),
+		sunDir:    env.SunDirection(),
+	}
+	e.sunRadiance, e.sunCosRadius = env.SunDisk()
+	if e.kind != scenery.Gradient && e.image == nil {
+		// the map was not loaded, it looks black
+		e.kind = scenery.Gradient
+	}
+	return e
+}
+
+func (e *environment) sampled() bool {
+	return e.cdf != nil
+}
+
+func sinf(x float32) float32 {
+	return float32(math.Sin(float64(x)))
+}
+
+func cosf(x float32) float32 {
+	return float32(math.Cos(float64(x)))
+}
+
+// the map wraps around horizontally and is clamped vertically
+func (e *environment) texel(x, y int) mgl.Vec3 {
+	w, h := e.image.Width, e.image.Height
+	if x < 0 {
+		x += w
+	} else if x >= w {
+		x -= w
+	}
+	if y < 0 {
+		y = 0
+	} else if y >= h {
+		y = h - 1
+	}
+	return e.image.At(x, y)
+}
+
+// bilinear filtering
+func (e *environment) lookup(uv mgl.Vec2) mgl.Vec3 {
+	px := uv.X()*float32(e.image.Width) - 0.5
+	py := uv.Y()*float32(e.image.Height) - 0.5
+	x, y := int(math.Floor(float64(px))), int(math.Floor(float64(py)))
+	fx, fy := px-float32(x), py-float32(y)
+	return mix(
+		mix(e.texel(x, y), e.texel(x+1, y), fx),
+		mix(e.texel(x, y+1), e.texel(x+1, y+1), fx),
+		fy,
+	)
+}
+
+// the center of the (unrotated) map is in the -z direction, the top row is straight up
+func (e *environment) uv(dir mgl.Vec3) mgl.Vec2 {
+	dir = dir.Normalize()
+	phi := float32(math.Atan2(float64(dir.X()), float64(-dir.Z()))) - e.rotation
+	theta := float32(math.Acos(float64(mgl.Clamp(dir.Y(), -1.0, 1.0))))
+	u := phi/(2.0*math.Pi) + 0.5
+	return mgl.Vec2{u - float32(math.Floor(float64(u))), theta / math.Pi}
+}
+
+func (e *environment) dir(uv mgl.Vec2) mgl.Vec3 {
+	phi := (uv.X()-0.5)*2.0*math.Pi + e.rotation
+	theta := uv.Y() * math.Pi
+	return mgl.Vec3{sinf(theta) * sinf(phi), cosf(theta), -sinf(theta) * cosf(phi)}
+}
+
+// color of the environment without the sun disk
+func (e *environment) color(dir mgl.Vec3) mgl.Vec3 {
+	switch e.kind {
+	case scenery.EnvironmentMap, scenery.Sky:
+		return e.lookup(e.uv(dir)).Mul(e.intensity)
+	default:
+		brightness := (dir.Y()/dir.Len() + 1.0) / 2.0
+		return mix(e.bottom, e.top, brightness)
+	}
+}
+
+func (e *environment) sunDisk(dir mgl.Vec3) mgl.Vec3 {
+	if e.kind == scenery.Sky && dir.Normalize().Dot(e.sunDir) > e.sunCosRadius {
+		return e.sunRadiance
+	}
+	return mgl.Vec3{}
+}
+
+// searchCDF returns the index of the first value of cdf which is greater than u
+func searchCDF(cdf []float32, u float32) int {
+	lo, hi := 0, len(cdf)-1
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if cdf[mid] > u {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	return lo
+}
+
+func cdfStep(cdf []float32, i int) float32 {
+	if i == 0 {
+		return cdf[0]
+	}
+	return cdf[i] - cdf[i-1]
+}
+
+// sample returns a direction chosen by importance sampling of the map
+// and its probability density (with respect to the solid angle)
+func (e *environment) sample(rng *rand.Rand) (mgl.Vec3, float32) {
+	w, h := e.image.Width, e.image.Height
+	rows := e.cdf[:h]
+	y := searchCDF(rows, rng.Float32())
+	row := e.cdf[h+y*w : h+(y+1)*w]
+	x := searchCDF(row, rng.Float32())
+	uv := mgl.Vec2{
+		(float32(x) + rng.Float32()) / float32(w),
+		(float32(y) + rng.Float32()) / float32(h),
+	}
+	sinTheta := maxf(sinf(uv.Y()*math.Pi), floatDelta)
+	pdf := cdfStep(rows, y) * cdfStep(row, x) * float32(w*h) / (2.0 * math.Pi * math.Pi * sinTheta)
+	return e.dir(uv), pdf
+}
@@ -0,0 +1,938 @@
+package tracer
+
+import (
+	"image/color"
+	"math"
+	"sort"
+
+	mgl "github.com/go-gl/mathgl/mgl32"
+
+	"github.com/xopoww/go-raytrace/bvh"
+	"github.com/xopoww/go-raytrace/scenery"
+)
+
+// Helper types and functions
+
+const floatDelta = 0.0001
+
+// floating point equality test
+func fleq(f1, f2 float32) bool {
+	return float32(math.Abs(float64(f1-f2))) < floatDelta
+}
+
+// element-wise minimum of the vector
+func elmin(a mgl.Vec3) float32 {
+	return minf(a.X(), minf(a.Y(), a.Z()))
+}
+
+func argmin(a mgl.Vec3) int {
+	m := elmin(a)
+	if a.X() == m {
+		return 0
+	}
+	if a.Y() == m {
+		return 1
+	}
+	return 2
+}
+
+func minf(a, b float32) float32 {
+	if b < a {
+		return b
+	}
+	return a
+}
+
+func maxf(a, b float32) float32 {
+	if b > a {
+		return b
+	}
+	return a
+}
+
+// element-wise product of the vectors
+func mulv(a, b mgl.Vec3) mgl.Vec3 {
+	return mgl.Vec3{a[0] * b[0], a[1] * b[1], a[2] * b[2]}
+}
+
+// element-wise GLSL exp
+func expv(v mgl.Vec3) mgl.Vec3 {
+	return mgl.Vec3{
+		float32(math.Exp(float64(v[0]))),
+		float32(math.Exp(float64(v[1]))),
+		float32(math.Exp(float64(v[2]))),
+	}
+}
+
+func solveQuadratic(a, b, c float32) mgl.Vec2 {
+	if a == 0.0 {
+		k := -b / c
+		return mgl.Vec2{k, k}
+	}
+	d2 := b*b - 4*a*c
+	if d2 < 0.0 {
+		inf := float32(math.Inf(1))
+		return mgl.Vec2{inf, inf}
+	}
+	x := -b / 2.0 / a
+	if d2 == 0.0 {
+		return mgl.Vec2{x, x}
+	}
+	delta := float32(math.Sqrt(float64(d2))) / 2.0 / a
+	return mgl.Vec2{x - delta, x + delta}
+}
+
+// largestCubicRoot returns the largest real root of x^3 + a x^2 + b x + c = 0
+func largestCubicRoot(a, b, c float64) float64 {
+	p := b - a*a/3.0
+	q := 2.0*a*a*a/27.0 - a*b/3.0 + c
+	disc := q*q/4.0 + p*p*p/27.0
+	if disc >= 0.0 {
+		s := math.Sqrt(disc)
+		return math.Cbrt(-q/2.0+s) + math.Cbrt(-q/2.0-s) - a/3.0
+	}
+	// three real roots (trigonometric solution)
+	r := math.Sqrt(-p / 3.0)
+	phi := math.Acos(math.Max(-1.0, math.Min(-q/(2.0*r*r*r), 1.0)))
+	return 2.0*r*math.Cos(phi/3.0) - a/3.0
+}
+
+// relative tolerance of the quartic solver: the discriminants pushed below zero by rounding
+// are those of the tangent roots, and the resolvent roots that small are zero
+const quarticEpsilon = 1e-9
+
+// solveQuartic returns the real roots of x^4 + a x^3 + b x^2 + c x + d = 0 in increasing order
+// (Ferrari's method, the roots are refined by Newton's method). Their number is even: the tangent
+// double roots are returned twice
+func solveQuartic(a, b, c, d float64) []float64 {
+	// depressed quartic y^4 + p y^2 + q y + r = 0 for x = y - a/4
+	p := b - 3.0*a*a/8.0
+	q := c - a*b/2.0 + a*a*a/8.0
+	r := d - a*c/4.0 + a*a*b/16.0 - 3.0*a*a*a*a/256.0
+	// the magnitude of y^2
+	scale := math.Abs(p) + math.Sqrt(math.Abs(r))
+
+	roots := make([]float64, 0, 4)
+	quadratic := func(b, c float64) {
+		d2 := b*b - 4.0*c
+		if d2 < -quarticEpsilon*(b*b+4.0*math.Abs(c)) {
+			return
+		}
+		s := math.Sqrt(math.Max(d2, 0.0))
+		roots = append(roots, (-b-s)/2.0, (-b+s)/2.0)
+	}
+	// (y^2 + p/2 + m)^2 = (s y - q/(2s))^2 for s^2 = 2m, where m is a root of the resolvent cubic
+	m := largestCubicRoot(p, p*p/4.0-r, -q*q/8.0)
+	if m <= quarticEpsilon*scale {
+		// biquadratic (q is zero too): y^2 is a root of z^2 + p z + r = 0
+		d2 := p*p - 4.0*r
+		if d2 < -quarticEpsilon*scale*scale {
+			return roots
+		}
+		d2 = math.Sqrt(math.Max(d2, 0.0))
+		for _, z := range [...]float64{(-p - d2) / 2.0, (-p + d2) / 2.0} {
+			if z >= -quarticEpsilon*scale {
+				z = math.Sqrt(math.Max(z, 0.0))
+				roots = append(roots, -z, z)
+			}
+		}
+	} else {
+		s := math.Sqrt(2.0 * m)
+		quadratic(-s, p/2.0+m+q/(2.0*s))
+		quadratic(s, p/2.0+m-q/(2.0*s))
+	}
+
+	for i := range roots {
+		x := roots[i] - a/4.0
+		for j := 0; j < 2; j++ {
+			f := (((x+a)*x+b)*x+c)*x + d
+			df := ((4.0*x+3.0*a)*x+2.0*b)*x + c
+			if df != 0.0 {
+				x -= f / df
+			}
+		}
+		roots[i] = x
+	}
+	sort.Float64s(roots)
+	return roots
+}
+
+type ray3 struct {
+	origin mgl.Vec3
+	dir    mgl.Vec3
+}
+
+// Objects
+
+type object struct {
+	kind scenery.BodyKind
+
+	// box (and the bounds of the SDF bodies)
+	min mgl.Vec3
+	max mgl.Vec3
+
+	// ball (center is also the one of the disk and the torus and the point of the plane,
+	// radius is the one of the disk, the torus and at the start of the cylinder, cone and capsule)
+	center mgl.Vec3
+	radius float32
+
+	// plane and disk
+	flatNormal mgl.Vec3
+	// cylinder, cone and capsule
+	start     mgl.Vec3
+	end       mgl.Vec3
+	endRadius float32
+	// torus
+	thickness float32
+
+	// mesh (nil if not loaded)
+	mesh *scenery.TriangleMesh
+
+	// volume: the procedural density or the grid (nil if not loaded)
+	densityTexture *scenery.Texture
+	grid           *scenery.DensityGrid
+	maxDensity     float32
+
+	// csg: the program of the body (leaves are indexed by prim)
+	csg []scenery.CSGNode
+	// sdf: the program of the field
+	sdf []scenery.SDFNode
+
+	// transform from the world to the object space and the linear
+	// part of the inverse one (for the tangents)
+	toObject mgl.Mat4
+	toWorld  mgl.Mat3
+
+	material  scenery.MaterialKind
+	color     mgl.Vec3
+	fuzz      float32
+	eta       float32
+	intensity float32
+	// coefficients of the medium inside the object (the absorption
+	// includes the Beer-Lambert one of the glass)
+	absorption mgl.Vec3
+	scattering mgl.Vec3
+	phaseG     float32
+	// metal and rough glass
+	roughness  float32
+	anisotropy float32
+	iorN       mgl.Vec3
+	iorK       mgl.Vec3
+	// principled
+	metallic           float32
+	specular           float32
+	clearcoat          float32
+	clearcoatRoughness float32
+	sheen              float32
+	transmission       float32
+	emission           mgl.Vec3
+
+	// procedural textures (nil if none)
+	colorTexture     *scenery.Texture
+	roughnessTexture *scenery.Texture
+	normalMap        *scenery.Texture
+	bump             *scenery.Texture
+}
+
+func newObject(o scenery.Object) object {
+	interior := o.Material.InteriorMedium()
+	toObject := o.Transform.ToObject()
+	min, max := o.Body.Min, o.Body.Max
+	var sdf []scenery.SDFNode
+	if o.Body.Kind == scenery.SDF {
+		bounds := o.Body.Bounds()
+		min, max = bounds.Min, bounds.Max
+		sdf = o.Body.Shape.Program()
+	}
+	return object{
+		kind:   o.Body.Kind,
+		min:    min,
+		max:    max,
+		center: o.Body.Center,
+		radius: o.Body.Radius,
+		mesh:   o.Body.Mesh,
+
+		flatNormal: o.Body.Normal,
+		start:      o.Body.Start,
+		end:        o.Body.End,
+		endRadius:  o.Body.EndRadius,
+		thickness:  o.Body.Thickness,
+
+		densityTexture: o.Body.Density,
+		grid:           o.Body.Grid,
+		maxDensity:     o.Body.MaxDensity(),
+
+		csg: o.Body.CSGProgram(),
+		sdf: sdf,
+
+		toObject: toObject,
+		toWorld:  toObject.Mat3().Inv(),
+
+		material:   o.Material.Kind,
+		color:      colorToVec(o.Material.Color),
+		fuzz:       o.Material.Fuzz,
+		eta:        o.Material.Eta,
+		intensity:  o.Material.Intensity,
+		absorption: interior.Absorption,
+		scattering: interior.Scattering,
+		phaseG:     interior.Anisotropy,
+		roughness:  o.Material.Roughness,
+		anisotropy: o.Material.Anisotropy,
+		iorN:       o.Material.N,
+		iorK:       o.Material.K,
+
+		metallic:           o.Material.Metallic,
+		specular:           o.Material.Specular,
+		clearcoat:          o.Material.Clearcoat,
+		clearcoatRoughness: o.Material.ClearcoatRoughness,
+		sheen:              o.Material.Sheen,
+		transmission:       o.Material.Transmission,
+		emission:           o.Material.PrincipledEmission(),
+
+		colorTexture:     o.Material.ColorTexture,
+		roughnessTexture: o.Material.RoughnessTexture,
+		normalMap:        o.Material.NormalMap,
+		bump:             o.Material.Bump,
+	}
+}
+
+func uiToF(i uint8) float32 {
+	return float32(i) / float32(0xff)
+}
+
+func colorToVec(c color.RGBA) mgl.Vec3 {
+	return mgl.Vec3{uiToF(c.R), uiToF(c.G), uiToF(c.B)}
+}
+
+// Body intersection functions
+
+func intersectBox(origin, dir, bmin, bmax mgl.Vec3) mgl.Vec2 {
+	var tNear, tFar float32
+	for i := 0; i < 3; i++ {
+		tMin := (bmin[i] - origin[i]) / dir[i]
+		tMax := (bmax[i] - origin[i]) / dir[i]
+		t1, t2 := minf(tMin, tMax), maxf(tMin, tMax)
+		if i == 0 {
+			tNear, tFar = t1, t2
+		} else {
+			tNear, tFar = maxf(tNear, t1), minf(tFar, t2)
+		}
+	}
+	return mgl.Vec2{tNear, tFar}
+}
+
+func normalBox(point, bmin, bmax mgl.Vec3) mgl.Vec3 {
+	dMin := absv(point.Sub(bmin))
+	dMax := absv(point.Sub(bmax))
+	var (
+		norm float32
+		d    mgl.Vec3
+	)
+	if elmin(dMin) < elmin(dMax) {
+		norm = -1.0
+		d = dMin
+	} else {
+		norm = 1.0
+		d = dMax
+	}
+	var n mgl.Vec3
+	n[argmin(d)] = norm
+	return n
+}
+
+func absv(a mgl.Vec3) mgl.Vec3 {
+	return mgl.Vec3{mgl.Abs(a[0]), mgl.Abs(a[1]), mgl.Abs(a[2])}
+}
+
+func intersectBall(origin, dir, center mgl.Vec3, radius float32) mgl.Vec2 {
+	oc := origin.Sub(center)
+	c1 := dir.Dot(dir)
+	c2 := 2.0 * oc.Dot(dir)
+	c3 := oc.Dot(oc) - radius*radius
+	return solveQuadratic(c1, c2, c3)
+}
+
+func normalBall(point, center mgl.Vec3) mgl.Vec3 {
+	return point.Sub(center).Normalize()
+}
+
+// the ray enters the half-space below the plane or leaves it at the plane
+func intersectPlane(origin, dir, point, normal mgl.Vec3) mgl.Vec2 {
+	inf := float32(math.Inf(1))
+	dn := dir.Dot(normal)
+	side := origin.Sub(point).Dot(normal)
+	if dn == 0.0 {
+		if side < 0.0 {
+			return mgl.Vec2{-inf, inf}
+		}
+		return mgl.Vec2{inf, inf}
+	}
+	t := -side / dn
+	if dn < 0.0 {
+		return mgl.Vec2{t, inf}
+	}
+	return mgl.Vec2{-inf, t}
+}
+
+// the disk is flat, so the ray enters and leaves it at the same point
+func intersectDisk(origin, dir, center, normal mgl.Vec3, radius float32) mgl.Vec2 {
+	inf := float32(math.Inf(1))
+	dn := dir.Dot(normal)
+	if dn == 0.0 {
+		return mgl.Vec2{inf, inf}
+	}
+	t := center.Sub(origin).Dot(normal) / dn
+	p := origin.Add(dir.Mul(t)).Sub(center)
+	if p.Dot(p) > radius*radius {
+		return mgl.Vec2{inf, inf}
+	}
+	return mgl.Vec2{t, t}
+}
+
+// overlap returns the common part of the intervals ((inf, inf) if there is none)
+func overlap(a, b mgl.Vec2) mgl.Vec2 {
+	result := mgl.Vec2{maxf(a.X(), b.X()), minf(a.Y(), b.Y())}
+	if result.X() > result.Y() {
+		inf := float32(math.Inf(1))
+		return mgl.Vec2{inf, inf}
+	}
+	return result
+}
+
+// envelope returns the smallest interval containing both intervals, the empty ones are skipped
+func envelope(a, b mgl.Vec2) mgl.Vec2 {
+	inf := float32(math.Inf(1))
+	if a.X() > a.Y() || a.X() == inf {
+		return b
+	}
+	if b.X() > b.Y() || b.X() == inf {
+		return a
+	}
+	return mgl.Vec2{minf(a.X(), b.X()), maxf(a.Y(), b.Y())}
+}
+
+// intersectCone intersects the ray with the capped cone with the radii r0 at the start
+// and r1 at the end (the cylinder if they are equal): the part of the infinite cone between
+// the planes of the caps. Within them the cone is convex, so the result is a single interval
+func intersectCone(origin, dir, start, end mgl.Vec3, r0, r1 float32) mgl.Vec2 {
+	inf := float32(math.Inf(1))
+	miss := mgl.Vec2{inf, inf}
+	ba := end.Sub(start)
+	height := ba.Len()
+	axis := ba.Mul(1.0 / height)
+	k := (r1 - r0) / height
+	w := origin.Sub(start)
+	hd, hw := dir.Dot(axis), w.Dot(axis)
+
+	// between the planes of the caps
+	slab := mgl.Vec2{-inf, inf}
+	if hd != 0.0 {
+		t0, t1 := -hw/hd, (height-hw)/hd
+		slab = mgl.Vec2{minf(t0, t1), maxf(t0, t1)}
+	} else if hw < 0.0 || hw > height {
+		return miss
+	}
+
+	// inside the infinite cone: a t^2 + b t + c <= 0, where the radius at the point is r0 + k h
+	rw := r0 + k*hw
+	a := dir.Dot(dir) - (1.0+k*k)*hd*hd
+	b := 2.0 * (w.Dot(dir) - hw*hd - k*hd*rw)
+	c := w.Dot(w) - hw*hw - rw*rw
+	if a == 0.0 {
+		switch {
+		case b > 0.0:
+			return overlap(slab, mgl.Vec2{-inf, -c / b})
+		case b < 0.0:
+			return overlap(slab, mgl.Vec2{-c / b, inf})
+		case c <= 0.0:
+			return slab
+		}
+		return miss
+	}
+	d2 := b*b - 4.0*a*c
+	if d2 < 0.0 {
+		if a < 0.0 {
+			return slab
+		}
+		return miss
+	}
+	s := float32(math.Sqrt(float64(d2)))
+	t1, t2 := minf((-b-s)/(2.0*a), (-b+s)/(2.0*a)), maxf((-b-s)/(2.0*a), (-b+s)/(2.0*a))
+	if a > 0.0 {
+		return overlap(slab, mgl.Vec2{t1, t2})
+	}
+	// the ray crosses the other half of the double cone, which lies outside of the caps
+	return envelope(overlap(slab, mgl.Vec2{-inf, t1}), overlap(slab, mgl.Vec2{t2, inf}))
+}
+
+// coneCap returns -1 if the point is on the cap at the start of the cone,
+// 1 if it is on the one at the end and 0 if it is on the side
+func coneCap(point, start, end mgl.Vec3, r0, r1 float32) float32 {
+	ba := end.Sub(start)
+	height := ba.Len()
+	k := (r1 - r0) / height
+	w := point.Sub(start)
+	h := w.Dot(ba) / height
+	// the distances to the planes of the caps and to the side
+	dStart, dEnd := mgl.Abs(h), mgl.Abs(height-h)
+	dSide := mgl.Abs(w.Sub(ba.Mul(h/height)).Len()-(r0+k*h)) / float32(math.Sqrt(float64(1.0+k*k)))
+	// the tip of the cone has no cap
+	if r0 == 0.0 {
+		dStart = float32(math.Inf(1))
+	}
+	if r1 == 0.0 {
+		dEnd = float32(math.Inf(1))
+	}
+	switch {
+	case dStart < dEnd && dStart < dSide:
+		return -1.0
+	case dEnd < dSide:
+		return 1.0
+	}
+	return 0.0
+}
+
+func normalCone(point, start, end mgl.Vec3, r0, r1 float32) mgl.Vec3 {
+	ba := end.Sub(start)
+	height := ba.Len()
+	axis := ba.Mul(1.0 / height)
+	if c := coneCap(point, start, end, r0, r1); c != 0.0 {
+		return axis.Mul(c)
+	}
+	// the gradient of the equation of the cone
+	k := (r1 - r0) / height
+	w := point.Sub(start)
+	h := w.Dot(axis)
+	return w.Sub(axis.Mul(h)).Sub(axis.Mul(k * (r0 + k*h))).Normalize()
+}
+
+// the capsule is the union of the cylinder and the balls at its ends, which is convex
+func intersectCapsule(origin, dir, start, end mgl.Vec3, radius float32) mgl.Vec2 {
+	result := intersectCone(origin, dir, start, end, radius, radius)
+	result = envelope(result, intersectBall(origin, dir, start, radius))
+	return envelope(result, intersectBall(origin, dir, end, radius))
+}
+
+func normalCapsule(point, start, end mgl.Vec3) mgl.Vec3 {
+	ba := end.Sub(start)
+	h := mgl.Clamp(point.Sub(start).Dot(ba)/ba.Dot(ba), 0.0, 1.0)
+	return point.Sub(start.Add(ba.Mul(h))).Normalize()
+}
+
+// intersectTorus solves the quartic equation of the torus around the y axis. Its roots
+// come in pairs (entry and exit), the first interval that ends in front of the origin is returned
+func intersectTorus(origin, dir, center mgl.Vec3, radius, thickness float32) mgl.Vec2 {
+	inf := float32(math.Inf(1))
+	// the ray is normalized and moved to the bounding sphere for the precision
+	scale := dir.Len()
+	u := dir.Mul(1.0 / scale)
+	o := origin.Sub(center)
+	bound := intersectBall(o, u, mgl.Vec3{}, radius+thickness)
+	if bound.X() == inf || bound.Y() <= 0.0 {
+		return mgl.Vec2{inf, inf}
+	}
+	t0 := maxf(bound.X(), 0.0)
+	o = o.Add(u.Mul(t0))
+
+	// (|p|^2 + R^2 - r^2)^2 = 4 R^2 (x^2 + z^2)
+	ox, oy, oz := float64(o.X()), float64(o.Y()), float64(o.Z())
+	ux, uy, uz := float64(u.X()), float64(u.Y()), float64(u.Z())
+	r2 := float64(radius) * float64(radius)
+	n := ox*ux + oy*uy + oz*uz
+	k := ox*ox + oy*oy + oz*oz + r2 - float64(thickness)*float64(thickness)
+	roots := solveQuartic(
+		4.0*n,
+		4.0*n*n+2.0*k-4.0*r2*(ux*ux+uz*uz),
+		4.0*n*k-8.0*r2*(ox*ux+oz*uz),
+		k*k-4.0*r2*(ox*ox+oz*oz),
+	)
+	for i := 0; i+1 < len(roots); i += 2 {
+		exit := (t0 + float32(roots[i+1])) / scale
+		if exit > floatDelta {
+			return mgl.Vec2{(t0 + float32(roots[i])) / scale, exit}
+		}
+	}
+	return mgl.Vec2{inf, inf}
+}
+
+// the normal points from the nearest point of the ring
+func normalTorus(point, center mgl.Vec3, radius float32) mgl.Vec3 {
+	q := point.Sub(center)
+	ring := mgl.Vec3{q.X(), 0.0, q.Z()}.Normalize().Mul(radius)
+	return q.Sub(ring).Normalize()
+}
+
+// Moller-Trumbore algorithm; also returns the barycentric
+// coordinates of the hit point with respect to the second and third vertices
+func intersectTriangle(origin, dir mgl.Vec3, t *scenery.Triangle) (float32, mgl.Vec2) {
+	inf := float32(math.Inf(1))
+	e1 := t.Vertices[1].Sub(t.Vertices[0])
+	e2 := t.Vertices[2].Sub(t.Vertices[0])
+	p := dir.Cross(e2)
+	det := e1.Dot(p)
+	if det == 0.0 {
+		return inf, mgl.Vec2{}
+	}
+	s := origin.Sub(t.Vertices[0])
+	u := s.Dot(p) / det
+	q := s.Cross(e1)
+	v := dir.Dot(q) / det
+	if u < 0.0 || v < 0.0 || u+v > 1.0 {
+		return inf, mgl.Vec2{}
+	}
+	return e2.Dot(q) / det, mgl.Vec2{u, v}
+}
+
+func normalTriangle(t *scenery.Triangle, bary mgl.Vec2) mgl.Vec3 {
+	return t.Normals[0].Mul(1.0 - bary.X() - bary.Y()).
+		Add(t.Normals[1].Mul(bary.X())).
+		Add(t.Normals[2].Mul(bary.Y())).
+		Normalize()
+}
+
+// Texture coordinates: (0, 0) is the bottom-left corner of the image and (1, 1) is the top-right one.
+// The functions also return the directions in which u and v grow along the surface
+
+// the whole image is on every face, seen unmirrored from outside
+// and upright on the side faces (on the top one it faces -z)
+func uvBox(point, normal, bmin, bmax mgl.Vec3) (uv mgl.Vec2, tangent, bitangent mgl.Vec3) {
+	size := bmax.Sub(bmin)
+	p := point.Sub(bmin)
+	p = mgl.Vec3{p.X() / size.X(), p.Y() / size.Y(), p.Z() / size.Z()}
+	up := mgl.Vec3{0.0, 1.0, 0.0}
+	switch {
+	case normal.X() > 0.5:
+		return mgl.Vec2{1.0 - p.Z(), p.Y()}, mgl.Vec3{0.0, 0.0, -1.0}, up
+	case normal.X() < -0.5:
+		return mgl.Vec2{p.Z(), p.Y()}, mgl.Vec3{0.0, 0.0, 1.0}, up
+	case normal.Y() > 0.5:
+		return mgl.Vec2{p.X(), 1.0 - p.Z()}, mgl.Vec3{1.0, 0.0, 0.0}, mgl.Vec3{0.0, 0.0, -1.0}
+	case normal.Y() < -0.5:
+		return mgl.Vec2{p.X(), p.Z()}, mgl.Vec3{1.0, 0.0, 0.0}, mgl.Vec3{0.0, 0.0, 1.0}
+	case normal.Z() > 0.5:
+		return mgl.Vec2{p.X(), p.Y()}, mgl.Vec3{1.0, 0.0, 0.0}, up
+	}
+	return mgl.Vec2{1.0 - p.X(), p.Y()}, mgl.Vec3{-1.0, 0.0, 0.0}, up
+}
+
+// longitude and latitude; the middle of the image faces +z
+func uvBall(normal mgl.Vec3) (uv mgl.Vec2, tangent, bitangent mgl.Vec3) {
+	lon := math.Atan2(float64(normal.X()), float64(normal.Z()))
+	lat := math.Asin(float64(mgl.Clamp(normal.Y(), -1.0, 1.0)))
+	uv = mgl.Vec2{float32(0.5 + lon/(2.0*math.Pi)), float32(0.5 + lat/math.Pi)}
+	return uv, mgl.Vec3{normal.Z(), 0.0, -normal.X()}, mgl.Vec3{0.0, 1.0, 0.0}
+}
+
+// planeBasis returns the directions of u and v on the plane with given normal: v goes up
+// (or towards -z on the horizontal planes, as on the top face of the box)
+func planeBasis(normal mgl.Vec3) (tangent, bitangent mgl.Vec3) {
+	bitangent = mgl.Vec3{0.0, 1.0, 0.0}.Sub(normal.Mul(normal.Y()))
+	if bitangent.Len() < 0.001 {
+		bitangent = mgl.Vec3{0.0, 0.0, -normal.Y()}
+	}
+	bitangent = bitangent.Normalize()
+	return bitangent.Cross(normal), bitangent
+}
+
+// the image is repeated every unit from the point of the plane
+func uvPlane(point, origin, normal mgl.Vec3) (uv mgl.Vec2, tangent, bitangent mgl.Vec3) {
+	tangent, bitangent = planeBasis(normal)
+	p := point.Sub(origin)
+	return mgl.Vec2{p.Dot(tangent), p.Dot(bitangent)}, tangent, bitangent
+}
+
+// the whole image is on the disk
+func uvDisk(point, center, normal mgl.Vec3, radius float32) (uv mgl.Vec2, tangent, bitangent mgl.Vec3) {
+	uv, tangent, bitangent = uvPlane(point, center, normal)
+	return uv.Mul(0.5 / radius).Add(mgl.Vec2{0.5, 0.5}), tangent, bitangent
+}
+
+// the image is wrapped around the side from the start to the end (v goes from 0 to 1),
+// the caps have the whole image each
+func uvCone(point, start, end mgl.Vec3, r0, r1 float32) (uv mgl.Vec2, tangent, bitangent mgl.Vec3) {
+	ba := end.Sub(start)
+	height := ba.Len()
+	axis := ba.Mul(1.0 / height)
+	t, b := planeBasis(axis)
+	w := point.Sub(start)
+	switch coneCap(point, start, end, r0, r1) {
+	case -1.0:
+		uv = mgl.Vec2{w.Dot(t), -w.Dot(b)}.Mul(0.5 / r0).Add(mgl.Vec2{0.5, 0.5})
+		return uv, t, b.Mul(-1.0)
+	case 1.0:
+		w = point.Sub(end)
+		uv = mgl.Vec2{w.Dot(t), w.Dot(b)}.Mul(0.5 / r1).Add(mgl.Vec2{0.5, 0.5})
+		return uv, t, b
+	}
+	h := w.Dot(axis)
+	radial := w.Sub(axis.Mul(h)).Normalize()
+	phi := math.Atan2(float64(radial.Dot(b)), float64(radial.Dot(t)))
+	uv = mgl.Vec2{float32(0.5 + phi/(2.0*math.Pi)), h / height}
+	k := (r1 - r0) / height
+	return uv, axis.Cross(radial), axis.Add(radial.Mul(k)).Normalize()
+}
+
+// same as on the side of the cylinder, v goes from the pole at the start to the one at the end
+func uvCapsule(point, start, end mgl.Vec3, radius float32) (uv mgl.Vec2, tangent, bitangent mgl.Vec3) {
+	ba := end.Sub(start)
+	height := ba.Len()
+	axis := ba.Mul(1.0 / height)
+	t, b := planeBasis(axis)
+	w := point.Sub(start)
+	h := w.Dot(axis)
+	radial := w.Sub(axis.Mul(h)).Normalize()
+	phi := math.Atan2(float64(radial.Dot(b)), float64(radial.Dot(t)))
+	uv = mgl.Vec2{float32(0.5 + phi/(2.0*math.Pi)), (h + radius) / (height + 2.0*radius)}
+	return uv, axis.Cross(radial), axis
+}
+
+// u goes around the y axis as on the ball, v around the tube from its inner side
+func uvTorus(point, center mgl.Vec3, radius float32) (uv mgl.Vec2, tangent, bitangent mgl.Vec3) {
+	q := point.Sub(center)
+	radial := mgl.Vec3{q.X(), 0.0, q.Z()}.Normalize()
+	lon := math.Atan2(float64(q.X()), float64(q.Z()))
+	psi := math.Atan2(float64(q.Y()), float64(mgl.Vec2{q.X(), q.Z()}.Len()-radius))
+	uv = mgl.Vec2{float32(0.5 + lon/(2.0*math.Pi)), float32(0.5 + psi/(2.0*math.Pi))}
+	s, c := float32(math.Sin(psi)), float32(math.Cos(psi))
+	return uv, mgl.Vec3{radial.Z(), 0.0, -radial.X()}, radial.Mul(-s).Add(mgl.Vec3{0.0, c, 0.0})
+}
+
+// the directions are found from the texture coordinates of the vertices
+// (they are zero if the coordinates are degenerate)
+func uvTriangle(t *scenery.Triangle, bary mgl.Vec2) (uv mgl.Vec2, tangent, bitangent mgl.Vec3) {
+	uv = t.UVs[0].Mul(1.0 - bary.X() - bary.Y()).
+		Add(t.UVs[1].Mul(bary.X())).
+		Add(t.UVs[2].Mul(bary.Y()))
+	e1 := t.Vertices[1].Sub(t.Vertices[0])
+	e2 := t.Vertices[2].Sub(t.Vertices[0])
+	d1 := t.UVs[1].Sub(t.UVs[0])
+	d2 := t.UVs[2].Sub(t.UVs[0])
+	det := d1.X()*d2.Y() - d2.X()*d1.Y()
+	if det == 0.0 {
+		return uv, tangent, bitangent
+	}
+	tangent = e1.Mul(d2.Y()).Sub(e2.Mul(d1.Y())).Mul(1.0 / det)
+	bitangent = e2.Mul(d1.X()).Sub(e1.Mul(d2.X())).Mul(1.0 / det)
+	return uv, tangent, bitangent
+}
+
+// intersectMesh returns the distance to the closest triangle as the entry point
+// (the exit one is infinite), the index of that triangle and the barycentric
+// coordinates of the hit point. Hits closer than floatDelta are ignored
+func intersectMesh(origin, dir mgl.Vec3, m *scenery.TriangleMesh) (mgl.Vec2, int, mgl.Vec2) {
+	inf := float32(math.Inf(1))
+	closest := inf
+	prim, bary := 0, mgl.Vec2{}
+	if m == nil || len(m.BVH.Nodes) == 0 {
+		return mgl.Vec2{inf, inf}, prim, bary
+	}
+
+	invDir := mgl.Vec3{1.0 / dir.X(), 1.0 / dir.Y(), 1.0 / dir.Z()}
+	var stack [bvh.MaxDepth + 1]int32
+	sp := 0
+	stack[sp] = 0
+	sp++
+	for sp > 0 {
+		sp--
+		ni := stack[sp]
+		node := &m.BVH.Nodes[ni]
+		near, far := node.Bounds().Intersect(origin, invDir)
+		if near > far || far <= 0.0 || near > closest {
+			continue
+		}
+		if !node.IsLeaf() {
+			stack[sp] = node.Offset
+			stack[sp+1] = ni + 1
+			sp += 2
+			continue
+		}
+		for j := int(node.Offset); j < int(node.Offset+node.Count); j++ {
+			t, b := intersectTriangle(origin, dir, &m.Triangles[j])
+			if t > floatDelta && t < closest {
+				closest, prim, bary = t, j, b
+			}
+		}
+	}
+	return mgl.Vec2{closest, inf}, prim, bary
+}
+
+func transformPoint(m mgl.Mat4, p mgl.Vec3) mgl.Vec3 {
+	return m.Mul4x1(p.Vec4(1.0)).Vec3()
+}
+
+// prim is only set for meshes and CSG bodies (the index of the leaf), bary for meshes. The ray
+// is transformed into the object space without normalizing the direction, so the ray parameters
+// are the same as in the world
+func (o *object) intersect(origin, dir mgl.Vec3) (lambda mgl.Vec2, prim int, bary mgl.Vec2) {
+	origin = transformPoint(o.toObject, origin)
+	dir = o.toObject.Mat3().Mul3x1(dir)
+	switch o.kind {
+	case scenery.Box, scenery.Volume:
+		return intersectBox(origin, dir, o.min, o.max), 0, bary
+	case scenery.Ball:
+		return intersectBall(origin, dir, o.center, o.radius), 0, bary
+	case scenery.Mesh:
+		return intersectMesh(origin, dir, o.mesh)
+	case scenery.CSG:
+		lambda, prim = intersectCSG(origin, dir, o.csg)
+		return lambda, prim, bary
+	case scenery.SDF:
+		return intersectSDF(origin, dir, o.min, o.max, o.sdf), 0, bary
+	case scenery.Plane:
+		return intersectPlane(origin, dir, o.center, o.flatNormal), 0, bary
+	case scenery.Disk:
+		return intersectDisk(origin, dir, o.center, o.flatNormal, o.radius), 0, bary
+	case scenery.Cylinder, scenery.Cone:
+		return intersectCone(origin, dir, o.start, o.end, o.radius, o.endRadius), 0, bary
+	case scenery.Capsule:
+		return intersectCapsule(origin, dir, o.start, o.end, o.radius), 0, bary
+	case scenery.Torus:
+		return intersectTorus(origin, dir, o.center, o.radius, o.thickness), 0, bary
+	}
+	inf := float32(math.Inf(1))
+	return mgl.Vec2{inf, inf}, 0, bary
+}
+
+// normalLocal returns the normal at the point in the object space
+func (o *object) normalLocal(point mgl.Vec3, info hitinfo) mgl.Vec3 {
+	switch o.kind {
+	case scenery.Box, scenery.Volume:
+		return normalBox(point, o.min, o.max)
+	case scenery.Ball:
+		return normalBall(point, o.center)
+	case scenery.Mesh:
+		return normalTriangle(&o.mesh.Triangles[info.prim], info.bary)
+	case scenery.CSG:
+		return normalCSG(point, &o.csg[info.prim])
+	case scenery.SDF:
+		return normalSDF(o.sdf, point)
+	case scenery.Plane, scenery.Disk:
+		return o.flatNormal
+	case scenery.Cylinder, scenery.Cone:
+		return normalCone(point, o.start, o.end, o.radius, o.endRadius)
+	case scenery.Capsule:
+		return normalCapsule(point, o.start, o.end)
+	case scenery.Torus:
+		return normalTorus(point, o.center, o.radius)
+	}
+	return mgl.Vec3{}
+}
+
+func (o *object) normal(point mgl.Vec3, info hitinfo) mgl.Vec3 {
+	local := transformPoint(o.toObject, point)
+	// normals are transformed by the inverse transpose of the transform to the world
+	return o.toObject.Mat3().Transpose().Mul3x1(o.normalLocal(local, info)).Normalize()
+}
+
+// uv sets the texture coordinates of the hit point and the directions in which they grow.
+// They are computed in the object space, so the textures follow the transformed body
+func (o *object) uv(point mgl.Vec3, info *hitinfo) {
+	point = transformPoint(o.toObject, point)
+	normal := o.normalLocal(point, *info)
+	switch o.kind {
+	case scenery.Box, scenery.Volume:
+		info.uv, info.tangent, info.bitangent = uvBox(point, normal, o.min, o.max)
+	case scenery.Ball:
+		info.uv, info.tangent, info.bitangent = uvBall(normal)
+	case scenery.Mesh:
+		info.uv, info.tangent, info.bitangent = uvTriangle(&o.mesh.Triangles[info.prim], info.bary)
+	case scenery.CSG:
+		info.uv, info.tangent, info.bitangent = uvCSG(point, &o.csg[info.prim])
+	case scenery.SDF:
+		// projected from the faces of the bounds
+		info.uv, info.tangent, info.bitangent = uvBox(point, normal, o.min, o.max)
+	case scenery.Plane:
+		info.uv, info.tangent, info.bitangent = uvPlane(point, o.center, normal)
+	case scenery.Disk:
+		info.uv, info.tangent, info.bitangent = uvDisk(point, o.center, normal, o.radius)
+	case scenery.Cylinder, scenery.Cone:
+		info.uv, info.tangent, info.bitangent = uvCone(point, o.start, o.end, o.radius, o.endRadius)
+	case scenery.Capsule:
+		info.uv, info.tangent, info.bitangent = uvCapsule(point, o.start, o.end, o.radius)
+	case scenery.Torus:
+		info.uv, info.tangent, info.bitangent = uvTorus(point, o.center, o.radius)
+	default:
+		info.uv, info.tangent, info.bitangent = mgl.Vec2{}, mgl.Vec3{}, mgl.Vec3{}
+	}
+	info.tangent = o.toWorld.Mul3x1(info.tangent)
+	info.bitangent = o.toWorld.Mul3x1(info.bitangent)
+}
+
+// Global intersection function
+
+const maxSceneBounds = 1000.0
+
+type hitinfo struct {
+	lambda mgl.Vec2
+	oi     int
+	// meshes: index of the triangle and barycentric coordinates of the hit point,
+	// CSG bodies: index of the leaf in the program
+	prim int
+	bary mgl.Vec2
+	// texture coordinates of the hit point and the directions in which
+	// they grow along the surface (only set by object.uv)
+	uv                 mgl.Vec2
+	tangent, bitangent mgl.Vec3
+}
+
+func (t *Tracer) intersectObjects(origin, dir mgl.Vec3) (hitinfo, bool) {
+	var info hitinfo
+	smallest := float32(maxSceneBounds)
+	found := false
+	test := func(i int) {
+		lambda, prim, bary := t.objects[i].intersect(origin, dir)
+		if lambda.X() <= floatDelta {
+			// the origin is inside the body (or on its surface), the ray hits it from inside
+			lambda[0] = lambda.Y()
+		}
+		// ties (e.g. coplanar faces) go to the object with the smaller index,
+		// so that the result does not depend on the order of the tests
+		closer := lambda.X() < smallest || (found && lambda.X() == smallest && i < info.oi)
+		if lambda.X() > floatDelta && lambda.X() <= lambda.Y() && closer {
+			info.lambda = lambda
+			info.oi = i
+			info.prim = prim
+			info.bary = bary
+			smallest = lambda.X()
+			found = true
+		}
+	}
+
+	if t.bvh == nil {
+		for i := range t.objects {
+			test(i)
+		}
+		return info, found
+	}
+	if len(t.bvh.Nodes) == 0 {
+		return info, false
+	}
+
+	invDir := mgl.Vec3{1.0 / dir.X(), 1.0 / dir.Y(), 1.0 / dir.Z()}
+	var stack [bvh.MaxDepth + 1]int32
+	sp := 0
+	stack[sp] = 0
+	sp++
+	for sp > 0 {
+		sp--
+		ni := stack[sp]
+		node := &t.bvh.Nodes[ni]
+		near, far := node.Bounds().Intersect(origin, invDir)
+		// the boxes are intersected with the inverse direction, so the distance to a box
+		// can be a bit larger than the one to the body touching it; floatDelta keeps
+		// such boxes, otherwise an equally close object in them could be skipped
+		if near > far || far <= 0.0 || near > smallest+floatDelta {
+			continue
+		}
+		if !node.IsLeaf() {
+			stack[sp] = node.Offset
+			stack[sp+1] = ni + 1
+			sp += 2
+			continue
+		}
+		for _, i := range t.bvh.Indices[node.Offset : node.Offset+node.Count] {
+			test(int(i))
+		}
+	}
+	return info, found
+}
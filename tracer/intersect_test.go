@@ -0,0 +1,172 @@
+package tracer
+
+import (
+	"math"
+	"testing"
+
+	mgl "github.com/go-gl/mathgl/mgl32"
+
+	"github.com/xopoww/go-raytrace/scenery"
+)
+
+func TestSolveQuartic(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		a, b, c, d float64
+		want       []float64
+		tolerance  float64
+	}{
+		// (x - 1)(x - 2)(x - 3)(x - 4)
+		{"four roots", -10, 35, -50, 24, []float64{1, 2, 3, 4}, 1e-9},
+		// (x + 3)(x + 0.5)(x - 0.25)(x - 7)
+		{"mixed signs", -3.75, -22.125, -4.75, 2.625, []float64{-3, -0.5, 0.25, 7}, 1e-9},
+		// (x^2 - 1)(x^2 - 4)
+		{"biquadratic", 0, -5, 0, 4, []float64{-2, -1, 1, 2}, 1e-9},
+		// (x^2 + 1)(x - 1)(x + 2)
+		{"two real roots", 1, -1, 1, -2, []float64{-2, 1}, 1e-9},
+		// (x^2 + 1)(x^2 + 4)
+		{"no real roots", 0, 5, 0, 4, nil, 0},
+		// (x^2 + 2x + 2)(x^2 - 4x + 5)
+		{"no real roots, not biquadratic", -2, 1, 2, 10, nil, 0},
+		// (x - 1)^2 (x - 2)(x - 5): the tangent double root is returned twice
+		{"double root", -9, 25, -27, 10, []float64{1, 1, 2, 5}, 1e-6},
+		// (x - 1)^2 (x - 3)^2
+		{"two double roots", -8, 22, -24, 9, []float64{1, 1, 3, 3}, 1e-6},
+		// (x - 2)^4
+		{"quadruple root", -8, 24, -32, 16, []float64{2, 2, 2, 2}, 1e-3},
+		// x^2 (x - 1)(x + 1)
+		{"double zero root", 0, -1, 0, 0, []float64{-1, 0, 0, 1}, 1e-6},
+	} {
+		got := solveQuartic(tc.a, tc.b, tc.c, tc.d)
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: roots %v, want %v", tc.name, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if math.Abs(got[i]-tc.want[i]) > tc.tolerance {
+				t.Errorf("%s: roots %v, want %v", tc.name, got, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestIntersectTorus(t *testing.T) {
+	inf := float32(math.Inf(1))
+	miss := mgl.Vec2{inf, inf}
+	center := mgl.Vec3{0, 0, 0}
+	const radius, thickness = 1.0, 0.25
+	for _, tc := range []struct {
+		name        string
+		origin, dir mgl.Vec3
+		want        mgl.Vec2
+	}{
+		{"through the tube", mgl.Vec3{-3, 0, 0}, mgl.Vec3{1, 0, 0}, mgl.Vec2{1.75, 2.25}},
+		{"unnormalized", mgl.Vec3{-3, 0, 0}, mgl.Vec3{2, 0, 0}, mgl.Vec2{0.875, 1.125}},
+		{"across the tube", mgl.Vec3{1, 3, 0}, mgl.Vec3{0, -1, 0}, mgl.Vec2{2.75, 3.25}},
+		{"diagonal", mgl.Vec3{-3, 0, -3}, mgl.Vec3{1, 0, 1}.Normalize(), mgl.Vec2{3*math.Sqrt2 - 1.25, 3*math.Sqrt2 - 0.75}},
+		{"through the hole", mgl.Vec3{0, -3, 0}, mgl.Vec3{0, 1, 0}, miss},
+		{"through the hole at an angle", mgl.Vec3{-0.5, -3, 0}, mgl.Vec3{0.1, 1, 0}.Normalize(), miss},
+		{"from the hole", mgl.Vec3{0, 0, 0}, mgl.Vec3{0, 0, 1}, mgl.Vec2{0.75, 1.25}},
+		{"inside the tube", mgl.Vec3{1, 0, 0}, mgl.Vec3{1, 0, 0}, mgl.Vec2{-0.25, 0.25}},
+		{"inside the tube towards the hole", mgl.Vec3{1, 0, 0}, mgl.Vec3{-1, 0, 0}, mgl.Vec2{-0.25, 0.25}},
+		{"inside the tube along it", mgl.Vec3{0, 0, 1}, mgl.Vec3{1, 0, 0}, mgl.Vec2{-0.75, 0.75}},
+		{"behind", mgl.Vec3{3, 0, 0}, mgl.Vec3{1, 0, 0}, miss},
+		{"above", mgl.Vec3{-3, 0.5, 0}, mgl.Vec3{1, 0, 0}, miss},
+		{"tangent", mgl.Vec3{-3, 0.25, 0}, mgl.Vec3{1, 0, 0}, mgl.Vec2{2, 2}},
+		// the ray touches the inner side of the tube at x = 0 between the two intervals
+		{"tangent to the hole", mgl.Vec3{-3, 0, 0.75}, mgl.Vec3{1, 0, 0}, mgl.Vec2{2, 3}},
+		{"grazing outside", mgl.Vec3{-3, 0.2501, 0}, mgl.Vec3{1, 0, 0}, miss},
+	} {
+		got := intersectTorus(tc.origin, tc.dir, center, radius, thickness)
+		if !vec2Close(got, tc.want) {
+			t.Errorf("%s: %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	// the ray just inside the top of the tube crosses it near x = -1
+	got := intersectTorus(mgl.Vec3{-3, 0.2499, 0}, mgl.Vec3{1, 0, 0}, center, radius, thickness)
+	if got.X() > got.Y() || mgl.Abs(got.X()-2) > 0.01 || mgl.Abs(got.Y()-2) > 0.01 {
+		t.Errorf("grazing inside: %v, want an interval near 2", got)
+	}
+
+	// the rays pass through the middle of the tube at distance 4, so they must hit it
+	// no later than that; the hit points are on the surface and the normals point away from the ring
+	offset := mgl.Vec3{2, 1, 0.5}
+	for _, tc := range []struct {
+		target, dir mgl.Vec3
+	}{
+		{mgl.Vec3{1, 0, 0}, mgl.Vec3{1, 0.3, 0.2}},
+		{mgl.Vec3{0, 0, -1}, mgl.Vec3{0.2, -1, 0.4}},
+		{mgl.Vec3{-0.6, 0, 0.8}, mgl.Vec3{-1, -0.1, 0.7}},
+		{mgl.Vec3{0, 0, 1}, mgl.Vec3{0, 1, 0}},
+	} {
+		dir := tc.dir.Normalize()
+		origin := offset.Add(tc.target).Sub(dir.Mul(4))
+		lambda := intersectTorus(origin, dir, offset, radius, thickness)
+		if lambda.X() == inf || lambda.X() > 4 || lambda.Y() < lambda.X() {
+			t.Errorf("direction %v: %v, want a hit before 4", dir, lambda)
+			continue
+		}
+		for _, tt := range []float32{lambda.X(), lambda.Y()} {
+			p := origin.Add(dir.Mul(tt)).Sub(offset)
+			d := mgl.Vec2{mgl.Vec2{p.X(), p.Z()}.Len() - radius, p.Y()}.Len()
+			if mgl.Abs(d-thickness) > 1e-3 {
+				t.Errorf("direction %v: the point at %v is %v from the ring", dir, tt, d)
+			}
+			n := normalTorus(p.Add(offset), offset, radius)
+			ring := mgl.Vec3{p.X(), 0, p.Z()}.Normalize().Mul(radius)
+			if !vec3Close(n, p.Sub(ring).Normalize()) || mgl.Abs(n.Len()-1) > 1e-4 {
+				t.Errorf("direction %v: normal %v at %v", dir, n, p)
+			}
+		}
+	}
+}
+
+func TestIntersectCSGQuadrics(t *testing.T) {
+	inf := float32(math.Inf(1))
+	miss := mgl.Vec2{inf, inf}
+	// a pipe drilled across by a capsule at the height of 2
+	pipe := scenery.NewCSG(scenery.Difference,
+		scenery.CSGOperand{Body: scenery.NewCylinder(mgl.Vec3{0, 0, 0}, mgl.Vec3{0, 3, 0}, 0.5)},
+		scenery.CSGOperand{Body: scenery.NewCylinder(mgl.Vec3{0, -0.1, 0}, mgl.Vec3{0, 3.1, 0}, 0.4)},
+		scenery.CSGOperand{Body: scenery.NewCapsule(mgl.Vec3{-1, 2, 0}, mgl.Vec3{1, 2, 0}, 0.2)},
+	)
+	// a cone pointing up next to a ball
+	cone := scenery.NewCSG(scenery.Union,
+		scenery.CSGOperand{Body: scenery.NewCone(mgl.Vec3{0, 0, 0}, mgl.Vec3{0, 2, 0}, 1, 0)},
+		scenery.CSGOperand{Body: scenery.NewBall(mgl.Vec3{5, 0, 0}, 1)},
+	)
+	for _, tc := range []struct {
+		name        string
+		body        scenery.Body
+		origin, dir mgl.Vec3
+		want        mgl.Vec2
+		normal      mgl.Vec3
+	}{
+		{"through the wall", pipe, mgl.Vec3{-3, 1, 0}, mgl.Vec3{1, 0, 0}, mgl.Vec2{2.5, 2.6}, mgl.Vec3{-1, 0, 0}},
+		{"inside the hole", pipe, mgl.Vec3{0, 5, 0}, mgl.Vec3{0, -1, 0}, miss, mgl.Vec3{}},
+		{"onto the rim", pipe, mgl.Vec3{0.45, 5, 0}, mgl.Vec3{0, -1, 0}, mgl.Vec2{2, 2.8}, mgl.Vec3{0, 1, 0}},
+		{"through the drilled hole", pipe, mgl.Vec3{-3, 2, 0}, mgl.Vec3{1, 0, 0}, miss, mgl.Vec3{}},
+		{"from inside the wall", pipe, mgl.Vec3{0.45, 1, 0}, mgl.Vec3{1, 0, 0}, mgl.Vec2{-0.05, 0.05}, mgl.Vec3{1, 0, 0}},
+		{"onto the tip", cone, mgl.Vec3{0, 5, 0}, mgl.Vec3{0, -1, 0}, mgl.Vec2{3, 5}, mgl.Vec3{}},
+		{"onto the base", cone, mgl.Vec3{0, -3, 0}, mgl.Vec3{0, 1, 0}, mgl.Vec2{3, 5}, mgl.Vec3{0, -1, 0}},
+	} {
+		program := tc.body.CSGProgram()
+		got, prim := intersectCSG(tc.origin, tc.dir, program)
+		if !vec2Close(got, tc.want) {
+			t.Errorf("%s: %v, want %v", tc.name, got, tc.want)
+			continue
+		}
+		if tc.normal == (mgl.Vec3{}) {
+			continue
+		}
+		hit := got.X()
+		if hit <= floatDelta {
+			hit = got.Y()
+		}
+		if n := normalCSG(tc.origin.Add(tc.dir.Mul(hit)), &program[prim]); !vec3Close(n, tc.normal) {
+			t.Errorf("%s: normal %v, want %v", tc.name, n, tc.normal)
+		}
+	}
+}
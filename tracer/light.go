@@ -0,0 +1,116 @@
+package tracer
+
+import (
+	"math"
+	"math/rand"
+
+	mgl "github.com/go-gl/mathgl/mgl32"
+
+	"github.com/xopoww/go-raytrace/scenery"
+)
+
+type light struct {
+	kind      scenery.LightKind
+	position  mgl.Vec3
+	direction mgl.Vec3
+	radiance  mgl.Vec3
+	cosInner  float32
+	cosOuter  float32
+}
+
+func newLight(l scenery.Light) light {
+	res := light{
+		kind:      l.Kind,
+		position:  l.Position,
+		direction: l.Direction,
+		radiance:  l.Radiance(),
+	}
+	if l.Kind == scenery.SpotLight {
+		res.cosInner, res.cosOuter = l.CosAngles()
+	}
+	return res
+}
+
+// GLSL smoothstep
+func smoothstep(edge0, edge1, x float32) float32 {
+	t := mgl.Clamp((x-edge0)/(edge1-edge0), 0.0, 1.0)
+	return t * t * (3.0 - 2.0*t)
+}
+
+// lightIncoming returns the light arriving at the point in the medium mi from the light source
+// (zero if it is in shadow) and the direction to the source
+func (t *Tracer) lightIncoming(point mgl.Vec3, mi int, l *light, rng *rand.Rand) (mgl.Vec3, mgl.Vec3) {
+	var (
+		toLight mgl.Vec3
+		dist    float32
+	)
+	radiance := l.radiance
+	if l.kind == scenery.DirectionalLight {
+		toLight = l.direction.Mul(-1.0)
+		dist = maxSceneBounds
+	} else {
+		toLight = l.position.Sub(point)
+		dist = toLight.Len()
+		toLight = toLight.Mul(1.0 / dist)
+		radiance = radiance.Mul(1.0 / (dist * dist))
+		if l.kind == scenery.SpotLight {
+			radiance = radiance.Mul(smoothstep(l.cosOuter, l.cosInner, toLight.Mul(-1.0).Dot(l.direction)))
+		}
+	}
+	if radiance == (mgl.Vec3{}) {
+		return radiance, toLight
+	}
+	return mulv(radiance, t.shadowTransmittance(point, toLight, dist, mi, rng)), toLight
+}
+
+// directLambertian returns the light from the light sources reflected by
+// a lambertian surface towards the viewer (next-event estimation). If the
+// environment is importance sampled, its light is also included here.
+// mi is the medium on the side of the incident ray
+func (t *Tracer) directLambertian(point mgl.Vec3, mi int, incident, normal, albedo mgl.Vec3, rng *rand.Rand) mgl.Vec3 {
+	if incident.Dot(normal) > 0.0 {
+		normal = normal.Mul(-1.0)
+	}
+	result := mgl.Vec3{}
+	for li := range t.lights {
+		incoming, toLight := t.lightIncoming(point, mi, &t.lights[li], rng)
+		if cosTheta := normal.Dot(toLight); cosTheta > 0.0 {
+			result = result.Add(incoming.Mul(cosTheta))
+		}
+	}
+
+	if t.env.sampled() {
+		dir, pdf := t.env.sample(rng)
+		if cosTheta := normal.Dot(dir); cosTheta > 0.0 && pdf > 0.0 {
+			transmittance := t.shadowTransmittance(point, dir, maxSceneBounds, mi, rng)
+			result = result.Add(mulv(t.env.color(dir), transmittance).Mul(cosTheta / pdf))
+		}
+	}
+	return mulv(result, albedo).Mul(1.0 / math.Pi)
+}
+
+// directMetal returns the light from the light sources reflected by a metal towards
+// the viewer. The environment is not sampled here (the scattered rays find it
+// much better for smooth metals)
+func (t *Tracer) directMetal(point mgl.Vec3, mi int, incident, normal mgl.Vec3, o *object, rng *rand.Rand) mgl.Vec3 {
+	if incident.Dot(normal) > 0.0 {
+		normal = normal.Mul(-1.0)
+	}
+	f := newFrame(normal)
+	wo := f.toLocal(incident.Normalize()).Mul(-1.0)
+	alpha := ggxAlpha(o.roughness, o.anisotropy)
+	result := mgl.Vec3{}
+	for li := range t.lights {
+		incoming, toLight := t.lightIncoming(point, mi, &t.lights[li], rng)
+		wi := f.toLocal(toLight)
+		if wi.Z() <= 0.0 || wo.Z() <= 0.0 {
+			continue
+		}
+		h := wo.Add(wi).Normalize()
+		g := 1.0 / (1.0 + ggxLambda(wo, alpha) + ggxLambda(wi, alpha))
+		// the BRDF times the cosine of wi: F * D * G / (4 * cos(wo))
+		brdf := fresnelConductor(wo.Dot(h), o.iorN, o.iorK).Mul(ggxD(h, alpha) * g / (4.0 * wo.Z()))
+		result = result.Add(mulv(incoming, brdf))
+	}
+	return mulv(result, o.color)
+}
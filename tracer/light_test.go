@@ -0,0 +1,89 @@
+package tracer
+
+import (
+	"image/color"
+	"math/rand"
+	"testing"
+
+	mgl "github.com/go-gl/mathgl/mgl32"
+
+	"github.com/xopoww/go-raytrace/scenery"
+)
+
+func TestLightIncoming(t *testing.T) {
+	white := color.RGBA{0xff, 0xff, 0xff, 0xff}
+	up := mgl.Vec3{0, 1, 0}
+	for _, tc := range []struct {
+		name     string
+		light    scenery.Light
+		occluder *scenery.Body
+		point    mgl.Vec3
+		want     mgl.Vec3
+		toLight  mgl.Vec3
+	}{
+		{
+			name:    "point",
+			light:   scenery.NewPointLight(white, 10, mgl.Vec3{0, 5, 0}),
+			want:    mgl.Vec3{0.4, 0.4, 0.4},
+			toLight: up,
+		},
+		{
+			name:     "point in shadow",
+			light:    scenery.NewPointLight(white, 10, mgl.Vec3{0, 5, 0}),
+			occluder: bodyPtr(scenery.NewBox(mgl.Vec3{-1, 2, -1}, mgl.Vec3{1, 3, 1})),
+			toLight:  up,
+		},
+		{
+			// objects behind the light do not cast shadows
+			name:     "point with an object behind it",
+			light:    scenery.NewPointLight(white, 10, mgl.Vec3{0, 5, 0}),
+			occluder: bodyPtr(scenery.NewBall(mgl.Vec3{0, 8, 0}, 1)),
+			want:     mgl.Vec3{0.4, 0.4, 0.4},
+			toLight:  up,
+		},
+		{
+			name:    "spot inside the inner cone",
+			light:   scenery.NewSpotLight(white, 25, mgl.Vec3{0, 5, 0}, mgl.Vec3{0, -1, 0}, 10, 20),
+			point:   mgl.Vec3{0.5, 0, 0},
+			want:    mgl.Vec3{1, 1, 1}.Mul(25.0 / 25.25),
+			toLight: mgl.Vec3{-0.5, 5, 0}.Normalize(),
+		},
+		{
+			name:    "spot outside the outer cone",
+			light:   scenery.NewSpotLight(white, 25, mgl.Vec3{0, 5, 0}, mgl.Vec3{0, -1, 0}, 10, 20),
+			point:   mgl.Vec3{5, 0, 0},
+			toLight: mgl.Vec3{-1, 1, 0}.Normalize(),
+		},
+		{
+			name:    "directional",
+			light:   scenery.NewDirectionalLight(color.RGBA{0xff, 0x00, 0xff, 0xff}, 2, mgl.Vec3{0, -3, 0}),
+			want:    mgl.Vec3{2, 0, 2},
+			toLight: up,
+		},
+		{
+			// directional lights are infinitely far, so everything above shadows them
+			name:     "directional in shadow",
+			light:    scenery.NewDirectionalLight(white, 2, mgl.Vec3{0, -1, 0}),
+			occluder: bodyPtr(scenery.NewBall(mgl.Vec3{0, 50, 0}, 1)),
+			toLight:  up,
+		},
+	} {
+		scene := scenery.NewScene()
+		scene.AddLight(tc.light)
+		if tc.occluder != nil {
+			scene.AddObject(scenery.NewObject(*tc.occluder, scenery.NewLambertian(white)))
+		}
+		tr := New(scene)
+		incoming, toLight := tr.lightIncoming(tc.point, fogMedium, &tr.lights[0], rand.New(rand.NewSource(1)))
+		if !vec3Close(incoming, tc.want) {
+			t.Errorf("%s: incoming light %v, want %v", tc.name, incoming, tc.want)
+		}
+		if !vec3Close(toLight, tc.toLight) {
+			t.Errorf("%s: direction to the light %v, want %v", tc.name, toLight, tc.toLight)
+		}
+	}
+}
+
+func bodyPtr(b scenery.Body) *scenery.Body {
+	return &b
+}
@@ -0,0 +1,306 @@
+package tracer
+
+import (
+	"math"
+	"math/rand"
+
+	mgl "github.com/go-gl/mathgl/mgl32"
+
+	"github.com/xopoww/go-raytrace/scenery"
+)
+
+// GLSL reflect
+func reflect(incident, normal mgl.Vec3) mgl.Vec3 {
+	return incident.Sub(normal.Mul(2.0 * normal.Dot(incident)))
+}
+
+// GLSL refract
+func refract(incident, normal mgl.Vec3, eta float32) mgl.Vec3 {
+	d := normal.Dot(incident)
+	k := 1.0 - eta*eta*(1.0-d*d)
+	if k < 0.0 {
+		return mgl.Vec3{}
+	}
+	return incident.Mul(eta).Sub(normal.Mul(eta*d + float32(math.Sqrt(float64(k)))))
+}
+
+// Materials
+
+// the scattered directions have the cosine distribution
+// (the one of a perfectly diffuse surface)
+func scatterLambertian(normal mgl.Vec3, rng *rand.Rand) mgl.Vec3 {
+	scattered := normal.Add(randomUnitVector(rng))
+	if fleq(scattered.Len(), 0.0) {
+		scattered = normal
+	}
+	return scattered
+}
+
+func scatterMirror(incident, normal mgl.Vec3, fuzz, eta float32, rng *rand.Rand) mgl.Vec3 {
+	if rng.Float32() <= eta {
+		return reflect(incident, normal).Add(randomInUnitSphere(rng).Mul(fuzz))
+	}
+	return scatterLambertian(normal, rng)
+}
+
+// Schlick's approximation of the Fresnel reflectance. The cosine is the one
+// of the angle on the side of the less dense medium
+func schlick(cosTheta, eta float32) float32 {
+	r0 := (1.0 - eta) / (1.0 + eta)
+	r0 *= r0
+	return r0 + (1.0-r0)*float32(math.Pow(float64(1.0-cosTheta), 5.0))
+}
+
+// Microfacets with the GGX (Trowbridge-Reitz) distribution. The directions are
+// in the local frame of the surface: x is the tangent, y is the bitangent
+// and z is the normal
+
+type frame struct {
+	tangent, bitangent, normal mgl.Vec3
+}
+
+// the tangents go around the vertical axis
+func newFrame(normal mgl.Vec3) frame {
+	up := mgl.Vec3{0.0, 1.0, 0.0}
+	if mgl.Abs(normal.Y()) >= 0.999 {
+		up = mgl.Vec3{1.0, 0.0, 0.0}
+	}
+	tangent := up.Cross(normal).Normalize()
+	return frame{tangent, normal.Cross(tangent), normal}
+}
+
+func (f *frame) toLocal(v mgl.Vec3) mgl.Vec3 {
+	return mgl.Vec3{v.Dot(f.tangent), v.Dot(f.bitangent), v.Dot(f.normal)}
+}
+
+func (f *frame) fromLocal(v mgl.Vec3) mgl.Vec3 {
+	return f.tangent.Mul(v.X()).Add(f.bitangent.Mul(v.Y())).Add(f.normal.Mul(v.Z()))
+}
+
+// widths of the distribution along the tangent and the bitangent
+func ggxAlpha(roughness, anisotropy float32) mgl.Vec2 {
+	aspect := float32(math.Sqrt(float64(1.0 - 0.9*anisotropy)))
+	alpha := roughness * roughness
+	return mgl.Vec2{maxf(alpha/aspect, 0.001), maxf(alpha*aspect, 0.001)}
+}
+
+// distribution of the microfacet normals
+func ggxD(m mgl.Vec3, alpha mgl.Vec2) float32 {
+	s := mgl.Vec3{m.X() / alpha.X(), m.Y() / alpha.Y(), m.Z()}
+	d := s.Dot(s)
+	return 1.0 / (math.Pi * alpha.X() * alpha.Y() * d * d)
+}
+
+// Smith's masking function is 1 / (1 + lambda)
+func ggxLambda(w mgl.Vec3, alpha mgl.Vec2) float32 {
+	a2 := (alpha.X()*alpha.X()*w.X()*w.X() + alpha.Y()*alpha.Y()*w.Y()*w.Y()) / maxf(w.Z()*w.Z(), floatDelta)
+	return (float32(math.Sqrt(float64(1.0+a2))) - 1.0) / 2.0
+}
+
+// samples a normal of the microfacets visible from wo (Heitz, 2018); wo.z must be positive
+func sampleGGX(wo mgl.Vec3, alpha mgl.Vec2, rng *rand.Rand) mgl.Vec3 {
+	vh := mgl.Vec3{alpha.X() * wo.X(), alpha.Y() * wo.Y(), wo.Z()}.Normalize()
+	lensq := vh.X()*vh.X() + vh.Y()*vh.Y()
+	t1 := mgl.Vec3{1.0, 0.0, 0.0}
+	if lensq > 0.0 {
+		t1 = mgl.Vec3{-vh.Y(), vh.X(), 0.0}.Mul(1.0 / float32(math.Sqrt(float64(lensq))))
+	}
+	t2 := vh.Cross(t1)
+	r := float32(math.Sqrt(float64(rng.Float32())))
+	phi := 2.0 * math.Pi * rng.Float32()
+	p1 := r * cosf(phi)
+	p2 := r * sinf(phi)
+	s := (1.0 + vh.Z()) / 2.0
+	p2 = (1.0-s)*float32(math.Sqrt(float64(1.0-p1*p1))) + s*p2
+	nz := float32(math.Sqrt(float64(maxf(0.0, 1.0-p1*p1-p2*p2))))
+	nh := t1.Mul(p1).Add(t2.Mul(p2)).Add(vh.Mul(nz))
+	return mgl.Vec3{alpha.X() * nh.X(), alpha.Y() * nh.Y(), maxf(0.0, nh.Z())}.Normalize()
+}
+
+// Fresnel reflectance of a conductor with the complex index of refraction n + ik
+func fresnelConductor(cosTheta float32, n, k mgl.Vec3) mgl.Vec3 {
+	cos2 := float64(cosTheta * cosTheta)
+	sin2 := 1.0 - cos2
+	var result mgl.Vec3
+	for i := range result {
+		ni, ki := float64(n[i]), float64(k[i])
+		t0 := ni*ni - ki*ki - sin2
+		a2b2 := math.Sqrt(t0*t0 + 4.0*ni*ni*ki*ki)
+		t1 := a2b2 + cos2
+		a := math.Sqrt(math.Max((a2b2+t0)/2.0, 0.0))
+		t2 := 2.0 * float64(cosTheta) * a
+		rs := (t1 - t2) / (t1 + t2)
+		t3 := cos2*a2b2 + sin2*sin2
+		t4 := t2 * sin2
+		rp := rs * (t3 - t4) / (t3 + t4)
+		result[i] = float32((rp + rs) / 2.0)
+	}
+	return result
+}
+
+// the ray is either reflected or refracted with the probability of the Fresnel reflectance
+func scatterGlass(incident, normal mgl.Vec3, fuzz, eta float32, rng *rand.Rand) mgl.Vec3 {
+	incident = incident.Normalize()
+	scattered := refract(incident, normal, 1.0/eta)
+	if fleq(scattered.Len(), 0.0) {
+		// total internal reflection
+		scattered = reflect(incident, normal)
+	} else {
+		cosTheta := -scattered.Dot(normal)
+		if eta > 1.0 {
+			cosTheta = -incident.Dot(normal)
+		}
+		if rng.Float32() < schlick(cosTheta, eta) {
+			scattered = reflect(incident, normal)
+		}
+	}
+	return scattered.Add(randomInUnitSphere(rng).Mul(fuzz))
+}
+
+// the microfacet normals are sampled from the visible ones, so the weight of the
+// reflected ray is the Fresnel reflectance times the masking of the reflected ray
+func (o *object) scatterMetal(incident, normal mgl.Vec3, rng *rand.Rand) (mgl.Vec3, mgl.Vec3) {
+	f := newFrame(normal)
+	wo := f.toLocal(incident.Normalize()).Mul(-1.0)
+	alpha := ggxAlpha(o.roughness, o.anisotropy)
+	h := sampleGGX(wo, alpha, rng)
+	wi := reflect(wo.Mul(-1.0), h)
+	if wi.Z() <= 0.0 {
+		return mgl.Vec3{}, mgl.Vec3{}
+	}
+	lambdaO := ggxLambda(wo, alpha)
+	g := (1.0 + lambdaO) / (1.0 + lambdaO + ggxLambda(wi, alpha))
+	weight := mulv(o.color, fresnelConductor(wo.Dot(h), o.iorN, o.iorK)).Mul(g)
+	return f.fromLocal(wi), weight
+}
+
+// same as the glass, but the microfacet normal is used instead of the normal
+func (o *object) scatterRoughGlass(incident, normal mgl.Vec3, eta float32, rng *rand.Rand) (mgl.Vec3, mgl.Vec3) {
+	f := newFrame(normal)
+	wo := f.toLocal(incident.Normalize()).Mul(-1.0)
+	alpha := ggxAlpha(o.roughness, o.anisotropy)
+	h := sampleGGX(wo, alpha, rng)
+	wi := refract(wo.Mul(-1.0), h, 1.0/eta)
+	// total internal reflection
+	reflected := fleq(wi.Len(), 0.0)
+	if !reflected {
+		cosTheta := -wi.Dot(h)
+		if eta > 1.0 {
+			cosTheta = wo.Dot(h)
+		}
+		reflected = rng.Float32() < schlick(cosTheta, eta)
+	}
+	if reflected {
+		wi = reflect(wo.Mul(-1.0), h)
+	}
+	if (wi.Z() > 0.0) != reflected {
+		// scattered to the wrong side of the surface
+		return mgl.Vec3{}, mgl.Vec3{}
+	}
+	lambdaO := ggxLambda(wo, alpha)
+	weight := o.color.Mul((1.0 + lambdaO) / (1.0 + lambdaO + ggxLambda(wi, alpha)))
+	return f.fromLocal(wi), weight
+}
+
+// index of refraction of a dielectric with given reflectance at normal incidence
+func iorFromReflectance(f0 float32) float32 {
+	s := float32(math.Sqrt(float64(minf(f0, 0.99))))
+	return (1.0 + s) / (1.0 - s)
+}
+
+// the specular layers are chosen at least this often, otherwise
+// the highlights of the lights are sampled rarely and are noisy
+const minSpecularProbability = 0.25
+
+// principledLobe returns one of the simpler materials the principled material is a mix of:
+// a clear coat over either a metal or a dielectric base, which is a rough glass or
+// a specular layer over a diffuse one. It is chosen roughly with the probability of its
+// contribution (the reflectance for the specular layers); the returned scale
+// is its contribution divided by the probability
+func (o *object) principledLobe(incident, normal mgl.Vec3, rng *rand.Rand) (object, float32) {
+	lobe := *o
+	lobe.absorption = mgl.Vec3{}
+	cosTheta := incident.Normalize().Dot(normal)
+	if cosTheta > 0.0 && o.transmission > 0.0 {
+		// only the transmitted rays get inside
+		lobe.material = scenery.RoughGlass
+		return lobe, 1.0
+	}
+	cosTheta = mgl.Abs(cosTheta)
+
+	metal := func(roughness, anisotropy, eta float32) object {
+		lobe.material = scenery.Metal
+		lobe.color = mgl.Vec3{1.0, 1.0, 1.0}
+		lobe.roughness, lobe.anisotropy = roughness, anisotropy
+		lobe.iorN = mgl.Vec3{eta, eta, eta}
+		lobe.iorK = mgl.Vec3{}
+		return lobe
+	}
+
+	// the specular lobes have their own Fresnel reflectance, the layers
+	// under them are weighted by the transmittance of the one above
+	specularProbability := func(f, amount float32) float32 {
+		if amount > 0.0 {
+			return maxf(f, minSpecularProbability)
+		}
+		return 0.0
+	}
+
+	f := o.clearcoat * schlick(cosTheta, 1.5)
+	p := specularProbability(f, o.clearcoat)
+	if rng.Float32() < p {
+		return metal(o.clearcoatRoughness, 0.0, 1.5), o.clearcoat / p
+	}
+	scale := (1.0 - f) / (1.0 - p)
+
+	if rng.Float32() < o.metallic {
+		lobe = metal(o.roughness, o.anisotropy, 0.0)
+		lobe.iorN = mgl.Vec3{iorFromReflectance(o.color[0]), iorFromReflectance(o.color[1]), iorFromReflectance(o.color[2])}
+		return lobe, scale
+	}
+	if rng.Float32() < o.transmission {
+		lobe.material = scenery.RoughGlass
+		return lobe, scale
+	}
+	eta := iorFromReflectance(0.08 * o.specular)
+	f = schlick(cosTheta, eta)
+	p = specularProbability(f, o.specular)
+	if rng.Float32() < p {
+		return metal(o.roughness, o.anisotropy, eta), scale / p
+	}
+	scale *= (1.0 - f) / (1.0 - p)
+
+	lobe.material = scenery.Lambertian
+	// the sheen brightens the diffuse layer at grazing angles
+	sheen := o.sheen * float32(math.Pow(float64(1.0-cosTheta), 5.0))
+	lobe.color = lobe.color.Add(mgl.Vec3{sheen, sheen, sheen})
+	return lobe, scale
+}
+
+// scatter returns the scattered direction (zero if the ray is absorbed)
+// and the fraction of the light coming along it
+func (o *object) scatter(incident, normal mgl.Vec3, rng *rand.Rand) (mgl.Vec3, mgl.Vec3) {
+	switch o.material {
+	case scenery.Mirror:
+		return scatterMirror(incident, normal, o.fuzz, o.eta, rng), o.color
+	case scenery.Lambertian:
+		return scatterLambertian(normal, rng), o.color
+	case scenery.Glass, scenery.RoughGlass:
+		eta := o.eta
+		if incident.Dot(normal) > 0.0 {
+			normal = normal.Mul(-1.0)
+			eta = 1.0 / eta
+		}
+		if o.material == scenery.Glass {
+			return scatterGlass(incident, normal, o.fuzz, eta, rng), o.color
+		}
+		return o.scatterRoughGlass(incident, normal, eta, rng)
+	case scenery.Metal:
+		if incident.Dot(normal) > 0.0 {
+			normal = normal.Mul(-1.0)
+		}
+		return o.scatterMetal(incident, normal, rng)
+	default:
+		return mgl.Vec3{}, o.color
+	}
+}
@@ -0,0 +1,252 @@
+package tracer
+
+import (
+	"math"
+	"math/rand"
+
+	mgl "github.com/go-gl/mathgl/mgl32"
+
+	"github.com/xopoww/go-raytrace/bvh"
+	"github.com/xopoww/go-raytrace/scenery"
+)
+
+// Participating media. The medium a ray travels in is given by the index of the object
+// it is inside, fogMedium means the fog, which fills the bounding box of the scene.
+// Media do not nest: leaving an object always gets the ray into the fog
+
+const fogMedium = -1
+
+type medium struct {
+	absorption mgl.Vec3
+	scattering mgl.Vec3
+	g          float32
+}
+
+func newMedium(m *scenery.Medium) medium {
+	if m == nil {
+		return medium{}
+	}
+	return medium{m.Absorption, m.Scattering, m.Anisotropy}
+}
+
+func (t *Tracer) medium(mi int) medium {
+	if mi < 0 {
+		return t.fog
+	}
+	o := &t.objects[mi]
+	return medium{o.absorption, o.scattering, o.phaseG}
+}
+
+func (m medium) empty() bool {
+	return m.absorption.Add(m.scattering) == (mgl.Vec3{})
+}
+
+func (t *Tracer) heterogeneous(mi int) bool {
+	return mi >= 0 && t.objects[mi].kind == scenery.Volume
+}
+
+// density returns the density of the heterogeneous medium at the point
+func (o *object) density(point mgl.Vec3) float32 {
+	point = transformPoint(o.toObject, point)
+	if o.densityTexture != nil {
+		v := o.densityTexture.Values
+		return maxf(mixf(v[0], v[1], pattern(o.densityTexture, point, mgl.Vec2{})), 0.0)
+	}
+	p := point.Sub(o.min)
+	size := o.max.Sub(o.min)
+	return o.grid.Lookup(mgl.Vec3{p.X() / size.X(), p.Y() / size.Y(), p.Z() / size.Z()})
+}
+
+// majorant returns the maximum extinction of the heterogeneous medium
+func (o *object) majorant(extinction mgl.Vec3) float32 {
+	return o.maxDensity * maxf(maxf(extinction.X(), extinction.Y()), extinction.Z())
+}
+
+// must be large enough for the tentative collisions along the paths through the densest volumes
+const maxNullCollisions = 1024
+
+// ratioTracking estimates the transmittance of the heterogeneous medium by the product
+// of the probabilities of the null collisions at the tentative collisions sampled with the majorant
+func (t *Tracer) ratioTracking(mi int, origin, dir mgl.Vec3, dist float32, extinction mgl.Vec3, rng *rand.Rand) mgl.Vec3 {
+	result := mgl.Vec3{1.0, 1.0, 1.0}
+	o := &t.objects[mi]
+	majorant := o.majorant(extinction)
+	if majorant <= 0.0 {
+		return result
+	}
+	d := float32(0.0)
+	for k := 0; k < maxNullCollisions; k++ {
+		d -= float32(math.Log(float64(1.0-rng.Float32()))) / majorant
+		if d >= dist {
+			break
+		}
+		density := o.density(origin.Add(dir.Mul(d)))
+		result = mulv(result, mgl.Vec3{1.0, 1.0, 1.0}.Sub(extinction.Mul(density/majorant)))
+	}
+	return result
+}
+
+// deltaTracking samples the distance in the heterogeneous medium: tentative collisions are sampled
+// with the majorant, and each one is either a real scattering or a null collision, chosen by the average
+// scattering coefficient at the point. As in sampleMedium, the absorption and the colors of the medium go to the weight
+func (t *Tracer) deltaTracking(mi int, origin, dir mgl.Vec3, dist float32, m medium, rng *rand.Rand) (float32, mgl.Vec3) {
+	weight := mgl.Vec3{1.0, 1.0, 1.0}
+	o := &t.objects[mi]
+	extinction := m.absorption.Add(m.scattering)
+	majorant := o.majorant(extinction)
+	if majorant <= 0.0 {
+		return dist, weight
+	}
+	d := float32(0.0)
+	for k := 0; k < maxNullCollisions; k++ {
+		d -= float32(math.Log(float64(1.0-rng.Float32()))) / majorant
+		if d >= dist {
+			break
+		}
+		density := o.density(origin.Add(dir.Mul(d)))
+		s := m.scattering.Mul(density)
+		p := (s.X() + s.Y() + s.Z()) / (3.0 * majorant)
+		if rng.Float32() < p {
+			return d, mulv(weight, s.Mul(1.0/(p*majorant)))
+		}
+		null := mgl.Vec3{majorant, majorant, majorant}.Sub(extinction.Mul(density))
+		weight = mulv(weight, null.Mul(1.0/((1.0-p)*majorant)))
+	}
+	return dist, weight
+}
+
+// mediumSegment returns the part of the segment of the ray from 0 to dist
+// (dir must be normalized) which is in the medium
+func (t *Tracer) mediumSegment(mi int, origin, dir mgl.Vec3, dist float32) (float32, float32) {
+	if mi >= 0 {
+		return 0.0, dist
+	}
+	invDir := mgl.Vec3{1.0 / dir.X(), 1.0 / dir.Y(), 1.0 / dir.Z()}
+	near, far := t.bounds.Intersect(origin, invDir)
+	return maxf(near, 0.0), minf(far, dist)
+}
+
+// mediumTransmittance returns the transmittance of the medium along the segment of the ray from 0 to dist
+func (t *Tracer) mediumTransmittance(mi int, origin, dir mgl.Vec3, dist float32, rng *rand.Rand) mgl.Vec3 {
+	m := t.medium(mi)
+	if m.empty() {
+		return mgl.Vec3{1.0, 1.0, 1.0}
+	}
+	if t.heterogeneous(mi) {
+		return t.ratioTracking(mi, origin, dir, dist, m.absorption.Add(m.scattering), rng)
+	}
+	near, far := t.mediumSegment(mi, origin, dir, dist)
+	return expv(m.absorption.Add(m.scattering).Mul(-maxf(far-near, 0.0)))
+}
+
+// sampleMedium returns the distance at which the ray is scattered by the medium
+// (dist if it gets through to the end of the segment). The distance is sampled with
+// the average scattering coefficient, and the absorption is applied as it is,
+// so the weight (the transmittance divided by the probability of the sample, times
+// the scattering coefficient if the ray is scattered) is 1 for grey media without absorption
+func (t *Tracer) sampleMedium(mi int, origin, dir mgl.Vec3, dist float32, rng *rand.Rand) (float32, mgl.Vec3) {
+	weight := mgl.Vec3{1.0, 1.0, 1.0}
+	m := t.medium(mi)
+	if m.empty() {
+		return dist, weight
+	}
+	if t.heterogeneous(mi) {
+		return t.deltaTracking(mi, origin, dir, dist, m, rng)
+	}
+	near, far := t.mediumSegment(mi, origin, dir, dist)
+	if near >= far {
+		return dist, weight
+	}
+	s := (m.scattering.X() + m.scattering.Y() + m.scattering.Z()) / 3.0
+	d := far
+	if s > 0.0 {
+		d = near - float32(math.Log(float64(1.0-rng.Float32())))/s
+	}
+	excess := m.absorption.Add(m.scattering).Sub(mgl.Vec3{s, s, s})
+	if d < far {
+		weight = mulv(expv(excess.Mul(near-d)), m.scattering.Mul(1.0/s))
+		return d, weight
+	}
+	return dist, expv(excess.Mul(near - far))
+}
+
+// Henyey-Greenstein phase function of the angle between the directions
+// of the incident and the scattered light
+func phaseHG(cosTheta, g float32) float32 {
+	d := 1.0 + g*g - 2.0*g*cosTheta
+	return (1.0 - g*g) / (4.0 * math.Pi * d * float32(math.Sqrt(float64(d))))
+}
+
+func samplePhaseHG(dir mgl.Vec3, g float32, rng *rand.Rand) mgl.Vec3 {
+	u := rng.Float32()
+	var cosTheta float32
+	if mgl.Abs(g) < 0.001 {
+		cosTheta = 1.0 - 2.0*u
+	} else {
+		sq := (1.0 - g*g) / (1.0 + g - 2.0*g*u)
+		cosTheta = (1.0 + g*g - sq*sq) / (2.0 * g)
+	}
+	sinTheta := float32(math.Sqrt(float64(maxf(0.0, 1.0-cosTheta*cosTheta))))
+	phi := 2.0 * math.Pi * rng.Float32()
+	f := newFrame(dir)
+	return f.fromLocal(mgl.Vec3{sinTheta * cosf(phi), sinTheta * sinf(phi), cosTheta})
+}
+
+// must be greater than the number of media boundaries between the shaded point and a light
+const maxMediumCrossings = 8
+
+// shadowTransmittance returns the transmittance along the shadow ray from the point in the medium mi
+// (dir must be normalized): zero if the ray is blocked by a surface before dist, otherwise the product
+// of the transmittances of the media it travels through (the boundaries of participating media do not block it)
+func (t *Tracer) shadowTransmittance(point, dir mgl.Vec3, dist float32, mi int, rng *rand.Rand) mgl.Vec3 {
+	result := mgl.Vec3{1.0, 1.0, 1.0}
+	for k := 0; k < maxMediumCrossings; k++ {
+		i, hit := t.intersectObjects(point, dir)
+		hit = hit && i.lambda.X() < dist
+		end := dist
+		if hit {
+			end = i.lambda.X()
+		}
+		result = mulv(result, t.mediumTransmittance(mi, point, dir, end, rng))
+		if !hit {
+			return result
+		}
+		o := &t.objects[i.oi]
+		if o.material != scenery.Participating {
+			return mgl.Vec3{}
+		}
+		point = point.Add(dir.Mul(i.lambda.X()))
+		dist -= i.lambda.X()
+		mi = fogMedium
+		if dir.Dot(o.normal(point, i)) < 0.0 {
+			mi = i.oi
+		}
+	}
+	return mgl.Vec3{}
+}
+
+// directMedium returns the light from the light sources scattered by the medium towards the viewer;
+// the environment is sampled as well if it is importance sampled (as for the lambertian surfaces)
+func (t *Tracer) directMedium(point mgl.Vec3, mi int, dir mgl.Vec3, rng *rand.Rand) mgl.Vec3 {
+	g := t.medium(mi).g
+	result := mgl.Vec3{}
+	for li := range t.lights {
+		incoming, toLight := t.lightIncoming(point, mi, &t.lights[li], rng)
+		result = result.Add(incoming.Mul(phaseHG(dir.Dot(toLight), g)))
+	}
+
+	if t.env.sampled() {
+		envDir, pdf := t.env.sample(rng)
+		if pdf > 0.0 {
+			transmittance := t.shadowTransmittance(point, envDir, maxSceneBounds, mi, rng)
+			result = result.Add(mulv(t.env.color(envDir), transmittance).Mul(phaseHG(dir.Dot(envDir), g) / pdf))
+		}
+	}
+	return result
+}
+
+// sceneBounds returns the bounding box of the scene the fog fills
+// (the infinite planes are not included)
+func sceneBounds(tree *bvh.BVH) bvh.AABB {
+	return tree.Bounds()
+}
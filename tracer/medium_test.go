@@ -0,0 +1,104 @@
+package tracer
+
+import (
+	"image/color"
+	"math"
+	"math/rand"
+	"testing"
+
+	mgl "github.com/go-gl/mathgl/mgl32"
+
+	"github.com/xopoww/go-raytrace/scenery"
+)
+
+func TestLightIncomingThroughMedia(t *testing.T) {
+	white := color.RGBA{0xff, 0xff, 0xff, 0xff}
+	fog := scenery.NewMedium(mgl.Vec3{0.05, 0.05, 0.05}, mgl.Vec3{0.05, 0.05, 0.05}, 0.0)
+	smoke := scenery.NewMedium(mgl.Vec3{0.5, 0.5, 0.5}, mgl.Vec3{}, 0.0)
+	grey := func(f float64) mgl.Vec3 {
+		v := float32(f)
+		return mgl.Vec3{v, v, v}
+	}
+	for _, tc := range []struct {
+		name  string
+		fog   bool
+		smoke bool
+		// wall blocking the light
+		wall   bool
+		point  mgl.Vec3
+		inside bool
+		want   mgl.Vec3
+	}{
+		{
+			name:  "no media",
+			point: mgl.Vec3{0, 0.5, 0},
+			want:  grey(0.4),
+		},
+		{
+			// 5 units of the fog
+			name:  "fog",
+			fog:   true,
+			point: mgl.Vec3{0, 0.5, 0},
+			want:  grey(0.4 * math.Exp(-0.5)),
+		},
+		{
+			// the surface of the smoke does not block the light
+			name:  "smoke",
+			smoke: true,
+			point: mgl.Vec3{0, 0.5, 0},
+			want:  grey(0.4 * math.Exp(-0.5)),
+		},
+		{
+			// 4 units of the fog and 1 of the smoke, media do not nest
+			name:  "fog and smoke",
+			fog:   true,
+			smoke: true,
+			point: mgl.Vec3{0, 0.5, 0},
+			want:  grey(0.4 * math.Exp(-0.9)),
+		},
+		{
+			// 0.5 units of the smoke and 2.5 of the fog
+			name:   "inside the smoke",
+			fog:    true,
+			smoke:  true,
+			point:  mgl.Vec3{0, 2.5, 0},
+			inside: true,
+			want:   grey(10.0 / 9.0 * math.Exp(-0.5)),
+		},
+		{
+			name:  "fog and a wall",
+			fog:   true,
+			smoke: true,
+			wall:  true,
+			point: mgl.Vec3{0, 0.5, 0},
+		},
+	} {
+		scene := scenery.NewScene()
+		scene.AddLight(scenery.NewPointLight(white, 10, mgl.Vec3{0, 5.5, 0}))
+		// the floor and the ball far away make the bounding box of the scene the fog fills
+		scene.AddObject(scenery.NewObject(scenery.NewBox(mgl.Vec3{-10, -1, -10}, mgl.Vec3{10, 0, 10}), scenery.NewLambertian(white)))
+		scene.AddObject(scenery.NewObject(scenery.NewBall(mgl.Vec3{8, 9, 8}, 1), scenery.NewLambertian(white)))
+		if tc.fog {
+			scene.Fog = &fog
+		}
+		if tc.smoke {
+			scene.AddObject(scenery.NewObject(scenery.NewBox(mgl.Vec3{-1, 2, -1}, mgl.Vec3{1, 3, 1}), scenery.NewParticipating(smoke)))
+		}
+		if tc.wall {
+			scene.AddObject(scenery.NewObject(scenery.NewBox(mgl.Vec3{-1, 4, -1}, mgl.Vec3{1, 4.5, 1}), scenery.NewLambertian(white)))
+		}
+		tr := New(scene)
+		mi := fogMedium
+		if tc.inside {
+			for oi := range tr.objects {
+				if tr.objects[oi].material == scenery.Participating {
+					mi = oi
+				}
+			}
+		}
+		incoming, _ := tr.lightIncoming(tc.point, mi, &tr.lights[0], rand.New(rand.NewSource(1)))
+		if !vec3Close(incoming, tc.want) {
+			t.Errorf("%s: incoming light %v, want %v", tc.name, incoming, tc.want)
+		}
+	}
+}
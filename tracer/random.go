@@ -0,0 +1,35 @@
+package tracer
+
+import (
+	"math/rand"
+
+	mgl "github.com/go-gl/mathgl/mgl32"
+)
+
+func randomInUnitSphere(rng *rand.Rand) mgl.Vec3 {
+	for {
+		v := mgl.Vec3{rng.Float32(), rng.Float32(), rng.Float32()}.Mul(2.0).Sub(mgl.Vec3{1.0, 1.0, 1.0})
+		if v.Len() <= 1.0 {
+			return v
+		}
+	}
+}
+
+// uniformly distributed on the unit sphere
+func randomUnitVector(rng *rand.Rand) mgl.Vec3 {
+	for {
+		v := randomInUnitSphere(rng)
+		if l := v.Len(); l > floatDelta {
+			return v.Mul(1.0 / l)
+		}
+	}
+}
+
+func randomInUnitDisk(rng *rand.Rand) mgl.Vec2 {
+	for {
+		v := mgl.Vec2{rng.Float32(), rng.Float32()}.Mul(2.0).Sub(mgl.Vec2{1.0, 1.0})
+		if v.Len() <= 1.0 {
+			return v
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package tracer
+
+import (
+	"math"
+
+	mgl "github.com/go-gl/mathgl/mgl32"
+
+	"github.com/xopoww/go-raytrace/scenery"
+)
+
+// SDF bodies: same as in the shader, the program of the field is evaluated
+// at the points along the ray, which advances by the distances
+
+const (
+	// the ray hits the surface closer than that (in the object space)
+	sdfEpsilon = 0.0001
+	// the step of the differences for the gradient
+	sdfNormalDelta = 0.0005
+	sdfMaxSteps    = 512
+)
+
+func sdfBox(p, center, half mgl.Vec3, rounding float32) float32 {
+	q := absv(p.Sub(center)).Sub(half.Sub(mgl.Vec3{rounding, rounding, rounding}))
+	outside := mgl.Vec3{maxf(q.X(), 0.0), maxf(q.Y(), 0.0), maxf(q.Z(), 0.0)}
+	return outside.Len() + minf(maxf(q.X(), maxf(q.Y(), q.Z())), 0.0) - rounding
+}
+
+func sdfTorus(p, center mgl.Vec3, radius, thickness float32) float32 {
+	q := p.Sub(center)
+	return mgl.Vec2{mgl.Vec2{q.X(), q.Z()}.Len() - radius, q.Y()}.Len() - thickness
+}
+
+func sdfCapsule(p, start, end mgl.Vec3, radius float32) float32 {
+	pa, ba := p.Sub(start), end.Sub(start)
+	h := float32(0.0)
+	if l := ba.Dot(ba); l > 0.0 {
+		h = mgl.Clamp(pa.Dot(ba)/l, 0.0, 1.0)
+	}
+	return pa.Sub(ba.Mul(h)).Len() - radius
+}
+
+// the distance estimate of the mandelbulb from the derivative of its iterations
+func sdfMandelbulb(p mgl.Vec3, power float32, iterations int) float64 {
+	n := float64(power)
+	z := p
+	dr, r := 1.0, 0.0
+	for i := 0; i < iterations; i++ {
+		r = float64(z.Len())
+		if r > 2.0 {
+			break
+		}
+		theta, phi := 0.0, math.Atan2(float64(z.Z()), float64(z.X()))
+		if r > 0.0 {
+			theta = math.Acos(math.Max(-1.0, math.Min(float64(z.Y())/r, 1.0)))
+		}
+		dr = math.Pow(r, n-1.0)*n*dr + 1.0
+		zr := math.Pow(r, n)
+		theta, phi = theta*n, phi*n
+		z = mgl.Vec3{
+			float32(zr * math.Sin(theta) * math.Cos(phi)),
+			float32(zr * math.Cos(theta)),
+			float32(zr * math.Sin(theta) * math.Sin(phi)),
+		}.Add(p)
+	}
+	r = math.Max(r, 1e-10)
+	return 0.5 * math.Log(r) * r / dr
+}
+
+// roundf rounds halves up, as floor(x + 0.5) in the shader
+func roundf(x float32) float32 {
+	return float32(math.Floor(float64(x) + 0.5))
+}
+
+// evalSDF returns the distance from the point to the surface of the field
+func evalSDF(program []scenery.SDFNode, p mgl.Vec3) float32 {
+	var distances [scenery.MaxSDFNodes]float32
+	var points [scenery.MaxSDFNodes]mgl.Vec3
+	dp, pp := 0, 0
+	for j := range program {
+		n := &program[j]
+		switch n.Shape {
+		case scenery.SDFSphere:
+			distances[dp] = p.Sub(n.Center).Len() - n.Radius
+			dp++
+		case scenery.SDFBox:
+			distances[dp] = sdfBox(p, n.Min.Add(n.Max).Mul(0.5), n.Max.Sub(n.Min).Mul(0.5), n.Radius)
+			dp++
+		case scenery.SDFTorus:
+			distances[dp] = sdfTorus(p, n.Center, n.Radius, n.Thickness)
+			dp++
+		case scenery.SDFCapsule:
+			distances[dp] = sdfCapsule(p, n.Start, n.End, n.Radius)
+			dp++
+		case scenery.SDFMandelbulb:
+			distances[dp] = float32(sdfMandelbulb(p.Sub(n.Center), n.Power, n.Iterations))
+			dp++
+		case scenery.SDFSmoothUnion:
+			a, b, k := distances[dp-2], distances[dp-1], n.Smoothness
+			h := maxf(k-mgl.Abs(a-b), 0.0) / k
+			dp--
+			distances[dp-1] = minf(a, b) - h*h*k*0.25
+		case scenery.SDFRepeat:
+			points[pp] = p
+			pp++
+			for i := 0; i < 3; i++ {
+				c := float32(n.Count[i])
+				p[i] -= n.Period[i] * mgl.Clamp(roundf(p[i]/n.Period[i]), -c, c)
+			}
+		case scenery.SDFTwist:
+			points[pp] = p
+			pp++
+			a := float64(mgl.DegToRad(n.Angle) * p.Y())
+			c, s := float32(math.Cos(a)), float32(math.Sin(a))
+			p = mgl.Vec3{c*p.X() - s*p.Z(), p.Y(), s*p.X() + c*p.Z()}
+		case scenery.SDFEnd:
+			pp--
+			p = points[pp]
+			distances[dp-1] *= n.Scale
+		}
+	}
+	return distances[0]
+}
+
+// normalSDF returns the gradient of the field (by the differences at the vertices of a tetrahedron)
+func normalSDF(program []scenery.SDFNode, p mgl.Vec3) mgl.Vec3 {
+	var n mgl.Vec3
+	for _, k := range [...]mgl.Vec3{{1.0, -1.0, -1.0}, {-1.0, -1.0, 1.0}, {-1.0, 1.0, -1.0}, {1.0, 1.0, 1.0}} {
+		n = n.Add(k.Mul(evalSDF(program, p.Add(k.Mul(sdfNormalDelta)))))
+	}
+	return n.Normalize()
+}
+
+// intersectSDF returns the distance to the surface as the entry point (the exit one is
+// infinite, as for meshes). The sphere tracing is limited by the bounds of the body. The ray
+// starting on the surface goes to the side its direction points to and is only stopped
+// by the surface after leaving it
+func intersectSDF(origin, dir, bmin, bmax mgl.Vec3, program []scenery.SDFNode) mgl.Vec2 {
+	inf := float32(math.Inf(1))
+	bounds := intersectBox(origin, dir, bmin, bmax)
+	if bounds.X() > bounds.Y() || bounds.Y() <= 0.0 {
+		return mgl.Vec2{inf, inf}
+	}
+	scale := dir.Len()
+	t := maxf(bounds.X(), 0.0)
+	side := float32(1.0)
+	left := true
+	if bounds.X() <= 0.0 {
+		d := evalSDF(program, origin)
+		if mgl.Abs(d) < sdfEpsilon {
+			d = normalSDF(program, origin).Dot(dir)
+			left = false
+		}
+		if d < 0.0 {
+			side = -1.0
+		}
+	}
+	for i := 0; i < sdfMaxSteps && t <= bounds.Y(); i++ {
+		d := side * evalSDF(program, origin.Add(dir.Mul(t)))
+		if d < sdfEpsilon {
+			if left {
+				return mgl.Vec2{t, inf}
+			}
+		} else {
+			left = true
+		}
+		t += maxf(d, sdfEpsilon) / scale
+	}
+	return mgl.Vec2{inf, inf}
+}
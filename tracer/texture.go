@@ -0,0 +1,251 @@
+package tracer
+
+import (
+	"math"
+
+	mgl "github.com/go-gl/mathgl/mgl32"
+
+	"github.com/xopoww/go-raytrace/scenery"
+)
+
+// Textures
+
+// Bob Jenkins' One-At-A-Time hash, the same as in the shader
+func hash(x uint32) uint32 {
+	x += x << 10
+	x ^= x >> 6
+	x += x << 3
+	x ^= x >> 11
+	x += x << 15
+	return x
+}
+
+func hash3(x, y, z uint32) uint32 {
+	return hash(x ^ hash(y) ^ hash(z))
+}
+
+// gradients of the Perlin noise: the directions to the edges of a cube
+var noiseGradients = [12]mgl.Vec3{
+	{1.0, 1.0, 0.0}, {-1.0, 1.0, 0.0}, {1.0, -1.0, 0.0}, {-1.0, -1.0, 0.0},
+	{1.0, 0.0, 1.0}, {-1.0, 0.0, 1.0}, {1.0, 0.0, -1.0}, {-1.0, 0.0, -1.0},
+	{0.0, 1.0, 1.0}, {0.0, -1.0, 1.0}, {0.0, 1.0, -1.0}, {0.0, -1.0, -1.0},
+}
+
+func floorf(f float32) float32 {
+	return float32(math.Floor(float64(f)))
+}
+
+// dot product of the gradient at the corner of the cell with the offset of the point from it
+func gradientDot(corner [3]int32, p mgl.Vec3) float32 {
+	g := noiseGradients[hash3(uint32(corner[0]), uint32(corner[1]), uint32(corner[2]))%12]
+	offset := p.Sub(mgl.Vec3{float32(corner[0]), float32(corner[1]), float32(corner[2])})
+	return g.Dot(offset)
+}
+
+func mixf(a, b, t float32) float32 {
+	return a*(1.0-t) + b*t
+}
+
+// Perlin gradient noise (roughly in range [-1, 1]) with cells of size 1
+func noise(p mgl.Vec3) float32 {
+	var c [3]int32
+	var u mgl.Vec3
+	for i := range c {
+		fl := floorf(p[i])
+		c[i] = int32(fl)
+		f := p[i] - fl
+		u[i] = f * f * f * (f*(f*6.0-15.0) + 10.0)
+	}
+	corner := func(dx, dy, dz int32) float32 {
+		return gradientDot([3]int32{c[0] + dx, c[1] + dy, c[2] + dz}, p)
+	}
+	return mixf(
+		mixf(mixf(corner(0, 0, 0), corner(1, 0, 0), u[0]), mixf(corner(0, 1, 0), corner(1, 1, 0), u[0]), u[1]),
+		mixf(mixf(corner(0, 0, 1), corner(1, 0, 1), u[0]), mixf(corner(0, 1, 1), corner(1, 1, 1), u[0]), u[1]),
+		u[2],
+	)
+}
+
+const turbulenceOctaves = 5
+
+// sum of the absolute values of the noise at growing frequencies
+func turbulence(p mgl.Vec3) float32 {
+	sum := float32(0.0)
+	weight := float32(1.0)
+	for i := 0; i < turbulenceOctaves; i++ {
+		sum += weight * mgl.Abs(noise(p))
+		weight *= 0.5
+		p = p.Mul(2.0)
+	}
+	return sum
+}
+
+// x mod n for negative x as well
+func floorMod(x, n int) int {
+	x %= n
+	if x < 0 {
+		x += n
+	}
+	return x
+}
+
+func wrapTexel(x, size int, wrap scenery.WrapMode) int {
+	switch wrap {
+	case scenery.Clamp:
+		if x < 0 {
+			return 0
+		}
+		if x >= size {
+			return size - 1
+		}
+		return x
+	case scenery.MirroredRepeat:
+		x = floorMod(x, 2*size)
+		if x < size {
+			return x
+		}
+		return 2*size - 1 - x
+	}
+	return floorMod(x, size)
+}
+
+// bilinear filtering between the centers of the texels
+func imageLookup(t *scenery.Texture, uv mgl.Vec2) mgl.Vec3 {
+	img := t.Image
+	if img == nil || img.Width == 0 || img.Height == 0 {
+		// the image is not loaded
+		return mgl.Vec3{1.0, 1.0, 1.0}
+	}
+	px := uv.X()*float32(img.Width) - 0.5
+	py := (1.0-uv.Y())*float32(img.Height) - 0.5
+	x0, y0 := floorf(px), floorf(py)
+	fx, fy := px-x0, py-y0
+	texel := func(x, y int) mgl.Vec3 {
+		return img.At(wrapTexel(x, img.Width, t.Wrap), wrapTexel(y, img.Height, t.Wrap))
+	}
+	x, y := int(x0), int(y0)
+	return mix(
+		mix(texel(x, y), texel(x+1, y), fx),
+		mix(texel(x, y+1), texel(x+1, y+1), fx),
+		fy,
+	)
+}
+
+// the pattern of the texture at the point with given texture coordinates, in range [0, 1]
+func pattern(t *scenery.Texture, p mgl.Vec3, uv mgl.Vec2) float32 {
+	if t.Kind == scenery.ImageTexture {
+		c := imageLookup(t, uv.Mul(1.0/t.Scale))
+		return 0.2126*c.X() + 0.7152*c.Y() + 0.0722*c.Z()
+	}
+	p = p.Mul(1.0 / t.Scale)
+	switch t.Kind {
+	case scenery.Checker:
+		c := int32(floorf(p.X())) + int32(floorf(p.Y())) + int32(floorf(p.Z()))
+		return float32(c & 1)
+	case scenery.Noise:
+		return mgl.Clamp(0.5+0.5*noise(p), 0.0, 1.0)
+	case scenery.Marble:
+		// stripes across the x axis
+		return 0.5 + 0.5*sinf(2.0*math.Pi*(p.X()+t.Turbulence*turbulence(p)))
+	case scenery.Wood:
+		// rings around the y axis, the noise is stretched along the fibres
+		r := float32(math.Hypot(float64(p.X()), float64(p.Z())))
+		r += 0.3 * t.Turbulence * noise(mgl.Vec3{p.X() * 2.0, p.Y() * 0.2, p.Z() * 2.0})
+		return r - floorf(r)
+	default:
+		return 0.0
+	}
+}
+
+// textured returns the object with the textured parameters of the material replaced
+// with their values at the hit point. Procedural textures are evaluated in the object space
+// (so that they follow the transformed body) slightly inside the surface, so that faces lying
+// on the boundaries of the checker cells get a single color
+func (o *object) textured(point mgl.Vec3, info hitinfo) object {
+	result := *o
+	point = transformPoint(o.toObject, point)
+	normal := o.normalLocal(point, info)
+	if t := o.colorTexture; t != nil {
+		if t.Kind == scenery.ImageTexture {
+			result.color = imageLookup(t, info.uv.Mul(1.0/t.Scale))
+		} else {
+			f := pattern(t, point.Sub(normal.Mul(t.Scale*0.001)), info.uv)
+			result.color = mix(colorToVec(t.Colors[0]), colorToVec(t.Colors[1]), f)
+		}
+	}
+	if t := o.roughnessTexture; t != nil {
+		f := pattern(t, point.Sub(normal.Mul(t.Scale*0.001)), info.uv)
+		result.roughness = mixf(t.Values[0], t.Values[1], f)
+	}
+	return result
+}
+
+// shadingNormal returns the normal tilted by the bump map and the normal map of
+// the material, in the tangent space of the surface: the tangent points to growing u
+// and the bitangent to growing v. The normal is not changed if the ray would hit the
+// surface from the other side of the tilted one
+func (o *object) shadingNormal(point, normal, incident mgl.Vec3, info hitinfo) mgl.Vec3 {
+	if o.normalMap == nil && o.bump == nil {
+		return normal
+	}
+	t := info.tangent.Sub(normal.Mul(normal.Dot(info.tangent)))
+	var b mgl.Vec3
+	if t.Len() < floatDelta {
+		// the texture coordinates do not change along the surface
+		f := newFrame(normal)
+		t, b = f.tangent, f.bitangent
+	} else {
+		t = t.Normalize()
+		b = normal.Cross(t)
+		if b.Dot(info.bitangent) < 0.0 {
+			b = b.Mul(-1.0)
+		}
+	}
+
+	shading := normal
+	if tx := o.bump; tx != nil {
+		// slope of the bumps along the tangent and the bitangent,
+		// the pattern is evaluated in the object space
+		var slope mgl.Vec2
+		local := transformPoint(o.toObject, point)
+		h := pattern(tx, local, info.uv)
+		if tx.Kind == scenery.ImageTexture {
+			// differences of the heights of neighbouring texels
+			var du, dv mgl.Vec2
+			if tx.Image != nil && tx.Image.Width > 0 && tx.Image.Height > 0 {
+				du[0] = tx.Scale / float32(tx.Image.Width)
+				dv[1] = tx.Scale / float32(tx.Image.Height)
+			}
+			slope = mgl.Vec2{pattern(tx, local, info.uv.Add(du)) - h, pattern(tx, local, info.uv.Add(dv)) - h}
+		} else {
+			// differences over a hundredth of the scale (relative to the scale)
+			e := tx.Scale * 0.01
+			dt := o.toObject.Mat3().Mul3x1(t.Mul(e))
+			db := o.toObject.Mat3().Mul3x1(b.Mul(e))
+			slope = mgl.Vec2{
+				pattern(tx, local.Add(dt), info.uv) - h,
+				pattern(tx, local.Add(db), info.uv) - h,
+			}.Mul(100.0)
+		}
+		slope = slope.Mul(tx.Strength)
+		shading = normal.Sub(t.Mul(slope.X())).Sub(b.Mul(slope.Y())).Normalize()
+	}
+	if tx := o.normalMap; tx != nil {
+		n := imageLookup(tx, info.uv.Mul(1.0/tx.Scale)).Mul(2.0).Sub(mgl.Vec3{1.0, 1.0, 1.0})
+		n[0] *= tx.Strength
+		n[1] *= tx.Strength
+		// the frame follows the bumps
+		sign := normal.Cross(t).Dot(b)
+		t = t.Sub(shading.Mul(shading.Dot(t))).Normalize()
+		b = shading.Cross(t)
+		if sign < 0.0 {
+			b = b.Mul(-1.0)
+		}
+		shading = t.Mul(n.X()).Add(b.Mul(n.Y())).Add(shading.Mul(maxf(n.Z(), 0.0))).Normalize()
+	}
+
+	if shading.Dot(incident)*normal.Dot(incident) <= 0.0 {
+		return normal
+	}
+	return shading
+}
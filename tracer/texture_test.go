@@ -0,0 +1,70 @@
+package tracer
+
+import (
+	"image/color"
+	"testing"
+
+	mgl "github.com/go-gl/mathgl/mgl32"
+
+	"github.com/xopoww/go-raytrace/scenery"
+)
+
+// Procedural textures, bump maps and densities must follow the transformed objects:
+// the moved object has the same pattern at the moved point
+func TestTransformedPatterns(t *testing.T) {
+	offset := mgl.Vec3{3.7, 1.2, -2.5}
+	moved := scenery.NewTransform(offset, mgl.QuatIdent(), mgl.Vec3{1, 1, 1})
+	points := []mgl.Vec3{
+		{1, 0, 0}, {0, 1, 0}, {0, 0, -1},
+		mgl.Vec3{1, 2, 3}.Normalize(), mgl.Vec3{-2, 1, -1}.Normalize(), mgl.Vec3{0.3, -1, 0.5}.Normalize(),
+	}
+	c0, c1 := color.RGBA{0x10, 0x20, 0x30, 0xff}, color.RGBA{0xf0, 0xe0, 0xd0, 0xff}
+	ball := scenery.NewBall(mgl.Vec3{}, 1)
+
+	for _, kind := range []scenery.TextureKind{scenery.Checker, scenery.Noise, scenery.Marble, scenery.Wood} {
+		material := scenery.NewLambertian(c0)
+		material.ColorTexture = scenery.NewColorTexture(kind, 0.3, c0, c1)
+		material.Bump = scenery.NewBumpMap(kind, 0.3, 1.0)
+		plain := newObject(scenery.Object{Body: ball, Material: material})
+		transformed := newObject(scenery.Object{Body: ball, Material: material, Transform: moved})
+
+		differs := false
+		for _, p := range points {
+			var info, movedInfo hitinfo
+			plain.uv(p, &info)
+			transformed.uv(p.Add(offset), &movedInfo)
+			normal := plain.normal(p, info)
+			movedNormal := transformed.normal(p.Add(offset), movedInfo)
+
+			want := plain.textured(p, info).color
+			got := transformed.textured(p.Add(offset), movedInfo).color
+			if !vec3Close(got, want) {
+				t.Errorf("%s: color %v at %v, want %v", kind, got, p.Add(offset), want)
+			}
+			if !vec3Close(plain.textured(p.Add(offset), info).color, want) {
+				differs = true
+			}
+
+			want = plain.shadingNormal(p, normal, normal.Mul(-1.0), info)
+			got = transformed.shadingNormal(p.Add(offset), movedNormal, movedNormal.Mul(-1.0), movedInfo)
+			if !vec3Close(got, want) {
+				t.Errorf("%s: shading normal %v at %v, want %v", kind, got, p.Add(offset), want)
+			}
+		}
+		if !differs {
+			t.Errorf("%s: the pattern is the same at the moved points, the test proves nothing", kind)
+		}
+	}
+
+	volume := scenery.NewVolume(mgl.Vec3{-1, -1, -1}, mgl.Vec3{1, 1, 1}, scenery.NewValueTexture(scenery.Noise, 0.3, 0.0, 2.0))
+	smoke := scenery.NewParticipating(scenery.NewMedium(mgl.Vec3{}, mgl.Vec3{1, 1, 1}, 0.0))
+	plain := newObject(scenery.Object{Body: volume, Material: smoke})
+	transformed := newObject(scenery.Object{Body: volume, Material: smoke, Transform: moved})
+	for _, p := range points {
+		p = p.Mul(0.5)
+		want := plain.density(p)
+		if got := transformed.density(p.Add(offset)); !fleq(got, want) {
+			t.Errorf("density %f at %v, want %f", got, p.Add(offset), want)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+// Package tracer implements a CPU path tracer that mirrors the compute shader
+// from shaders/raytrace_template.glsl. It is much slower than the shader,
+// but it needs no GPU, so it can be used for offline renders and as a
+// reference implementation to test the shader against.
+package tracer
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"runtime"
+	"sync"
+
+	mgl "github.com/go-gl/mathgl/mgl32"
+
+	"github.com/xopoww/go-raytrace/bvh"
+	"github.com/xopoww/go-raytrace/scenery"
+)
+
+// Options hold the rendering quality settings. Their meaning is the same
+// as for the corresponding shader uniforms
+type Options struct {
+	Width  int
+	Height int
+
+	// number of frames averaged into the image (MONTE_CARLO_FRAME_COUNT)
+	Samples uint
+	// number of rays per pixel in each frame (ANTI_ALIASING)
+	AntiAliasing uint
+	// maximum recursion depth for ray tracing (MAX_DEPTH)
+	MaxDepth uint
+
+	// seed for the random number generators
+	Seed int64
+
+	// test every ray against every object instead of traversing the BVH
+	// (useful for benchmarks and for checking the BVH itself)
+	DisableBVH bool
+
+	// number of goroutines rendering the rows (runtime.NumCPU() if zero);
+	// it does not change the result
+	Workers int
+}
+
+// DefaultOptions returns options with the same defaults as the command line flags
+func DefaultOptions(width, height int) Options {
+	return Options{
+		Width:        width,
+		Height:       height,
+		Samples:      20,
+		AntiAliasing: 4,
+		MaxDepth:     10,
+		Seed:         0,
+	}
+}
+
+// Tracer holds the scene data prepared for rendering
+type Tracer struct {
+	objects []object
+	// nil if disabled
+	bvh *bvh.BVH
+
+	lights []light
+	env    environment
+
+	fog medium
+	// bounding box of the scene (the fog fills it)
+	bounds bvh.AABB
+}
+
+// New prepares the scene for rendering. Objects are indexed in the same
+// order as in the shader: all boxes first, then all balls, then all meshes,
+// all volumes, all CSG bodies, all SDF bodies, all planes, disks, cylinders,
+// cones, capsules, tori and all instances
+func New(scene *scenery.Scene) *Tracer {
+	t := &Tracer{
+		env: newEnvironment(scene.Environment),
+		fog: newMedium(scene.Fog),
+	}
+	for _, data := range scene.Data {
+		for _, o := range data.Objects {
+			t.objects = append(t.objects, newObject(o))
+		}
+	}
+	for _, i := range scene.Instances {
+		t.objects = append(t.objects, newObject(scene.InstanceObject(i)))
+	}
+	for _, l := range scene.AllLights() {
+		t.lights = append(t.lights, newLight(l))
+	}
+	t.bvh = scene.BVH()
+	t.bounds = sceneBounds(t.bvh)
+	return t
+}
+
+// Render renders an image of the scene as seen by the camera
+func (t *Tracer) Render(cam scenery.Camera, opts Options) *image.RGBA {
+	if opts.DisableBVH {
+		noBVH := *t
+		noBVH.bvh = nil
+		t = &noBVH
+	}
+
+	view := newView(cam)
+	img := image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height))
+
+	rows := make(chan int)
+	wg := sync.WaitGroup{}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for y := range rows {
+				// every row gets its own generator, so that the result
+				// does not depend on the scheduling of the workers
+				rng := rand.New(rand.NewSource(opts.Seed*int64(opts.Height) + int64(y)))
+				for x := 0; x < opts.Width; x++ {
+					img.Set(x, y, toRGBA(t.renderPixel(view, opts, x, opts.Height-1-y, rng)))
+				}
+			}
+		}()
+	}
+	for y := 0; y < opts.Height; y++ {
+		rows <- y
+	}
+	close(rows)
+	wg.Wait()
+
+	return img
+}
+
+// renderPixel computes the color of the pixel (px, py), where (0, 0)
+// is the bottom-left corner of the screen (as in OpenGL)
+func (t *Tracer) renderPixel(v view, opts Options, px, py int, rng *rand.Rand) mgl.Vec3 {
+	n := opts.Samples * opts.AntiAliasing
+	if n == 0 {
+		return mgl.Vec3{}
+	}
+	resultingColor := mgl.Vec3{}
+	for i := uint(0); i < n; i++ {
+		pos := mgl.Vec2{
+			(float32(px) + rng.Float32()) / float32(opts.Width),
+			(float32(py) + rng.Float32()) / float32(opts.Height),
+		}
+		r := v.getRay(pos, v.lensRadius, rng)
+		resultingColor = resultingColor.Add(t.traceRay(r, opts.MaxDepth, rng))
+	}
+	return resultingColor.Mul(1.0 / float32(n))
+}
+
+func toRGBA(c mgl.Vec3) color.RGBA {
+	var rgb [3]uint8
+	for i := range rgb {
+		f := mgl.Clamp(c[i], 0.0, 1.0)
+		rgb[i] = uint8(f*0xff + 0.5)
+	}
+	return color.RGBA{rgb[0], rgb[1], rgb[2], 0xff}
+}
+
+// view holds the camera parameters in the form used by the shader
+type view struct {
+	eye        mgl.Vec3
+	rays       [2][2]mgl.Vec3
+	lensRadius float32
+}
+
+func newView(cam scenery.Camera) view {
+	return view{
+		eye:        cam.Position,
+		rays:       cam.Rays(),
+		lensRadius: cam.Aperture / 2.0,
+	}
+}
+
+func mix(a, b mgl.Vec3, t float32) mgl.Vec3 {
+	return a.Mul(1.0 - t).Add(b.Mul(t))
+}
+
+func (v view) getRay(pos mgl.Vec2, lr float32, rng *rand.Rand) ray3 {
+	eyeShift := randomInUnitDisk(rng).Mul(lr)
+	h := v.rays[1][1].Sub(v.rays[0][1]).Normalize()
+	vv := v.rays[1][1].Sub(v.rays[1][0]).Normalize()
+	offset := h.Mul(eyeShift.X()).Add(vv.Mul(eyeShift.Y()))
+	dir := mix(
+		mix(v.rays[0][0].Sub(offset), v.rays[0][1].Sub(offset), pos.Y()),
+		mix(v.rays[1][0].Sub(offset), v.rays[1][1].Sub(offset), pos.Y()),
+		pos.X(),
+	)
+	return ray3{v.eye.Add(offset), dir}
+}
+
+// Main tracing functions
+
+// traceStep returns the scattered ray (with zero direction if the path ends),
+// the fraction of the light coming along it and the light emitted towards
+// the origin of the ray. skipSun and skipEnv tell whether the light sources (of which
+// only the sun disk can be seen) and the environment have already been sampled
+// at the origin of the ray, they are updated for the scattered one. mi is the medium
+// the ray travels in, it is updated when the ray crosses the surface of an object
+func (t *Tracer) traceStep(r ray3, skipSun, skipEnv *bool, mi *int, rng *rand.Rand) (scattered ray3, clr, emitted mgl.Vec3) {
+	i, hit := t.intersectObjects(r.origin, r.dir)
+	length := r.dir.Len()
+	unitDir := r.dir.Mul(1.0 / length)
+	dist := float32(maxSceneBounds)
+	if hit {
+		dist = i.lambda.X()
+	}
+	dist *= length
+	d, transmittance := t.sampleMedium(*mi, r.origin, unitDir, dist, rng)
+	if d < dist {
+		// the ray is scattered by the medium before it gets to the surface
+		point := r.origin.Add(unitDir.Mul(d))
+		emitted = mulv(t.directMedium(point, *mi, unitDir, rng), transmittance)
+		*skipSun, *skipEnv = true, t.env.sampled()
+		return ray3{point, samplePhaseHG(unitDir, t.medium(*mi).g, rng)}, transmittance, emitted
+	}
+
+	if hit {
+		o := &t.objects[i.oi]
+		point := r.origin.Add(r.dir.Mul(i.lambda.X()))
+		normal := o.normal(point, i)
+		if o.material == scenery.Participating {
+			// the surface of the medium is invisible
+			*mi = fogMedium
+			if r.dir.Dot(normal) < 0.0 {
+				*mi = i.oi
+			}
+			return ray3{point, r.dir}, transmittance, mgl.Vec3{}
+		}
+		o.uv(point, &i)
+		if o.colorTexture != nil || o.roughnessTexture != nil {
+			textured := o.textured(point, i)
+			o = &textured
+		}
+		if o.material == scenery.Emissive {
+			return ray3{}, mgl.Vec3{}, mulv(o.color.Mul(o.intensity), transmittance)
+		}
+		outer := normal
+		normal = o.shadingNormal(point, normal, r.dir, i)
+		scale := float32(1.0)
+		if o.material == scenery.Principled {
+			emitted = o.emission
+			var lobe object
+			lobe, scale = o.principledLobe(r.dir, normal, rng)
+			o = &lobe
+		}
+		*skipSun, *skipEnv = false, false
+		switch o.material {
+		case scenery.Lambertian:
+			emitted = emitted.Add(t.directLambertian(point, *mi, r.dir, normal, o.color, rng).Mul(scale))
+			*skipSun, *skipEnv = true, t.env.sampled()
+		case scenery.Metal:
+			emitted = emitted.Add(t.directMetal(point, *mi, r.dir, normal, o, rng).Mul(scale))
+			*skipSun = true
+		}
+		emitted = mulv(emitted, transmittance)
+		var dir mgl.Vec3
+		dir, clr = o.scatter(r.dir, normal, rng)
+		if fleq(dir.Len(), 0.0) {
+			return ray3{}, mgl.Vec3{}, emitted
+		}
+		clr = mulv(clr.Mul(scale), transmittance)
+		glass := o.material == scenery.Glass || o.material == scenery.RoughGlass
+		if glass && dir.Dot(outer)*r.dir.Dot(outer) > 0.0 {
+			// the ray is refracted into the object or out of it
+			*mi = fogMedium
+			if r.dir.Dot(outer) < 0.0 {
+				*mi = i.oi
+			}
+		}
+		return ray3{point, dir.Normalize()}, clr, emitted
+	}
+	if !*skipEnv {
+		emitted = t.env.color(r.dir)
+	}
+	if !*skipSun {
+		emitted = emitted.Add(t.env.sunDisk(r.dir))
+	}
+	return ray3{}, mgl.Vec3{}, mulv(emitted, transmittance)
+}
+
+// traceRay sums the light emitted at every step of the path, attenuated by the colors
+// of the surfaces it was scattered by. The camera is assumed to be outside of all objects (in the fog)
+func (t *Tracer) traceRay(r ray3, maxDepth uint, rng *rand.Rand) mgl.Vec3 {
+	radiance := mgl.Vec3{}
+	throughput := mgl.Vec3{1.0, 1.0, 1.0}
+	skipSun, skipEnv := false, false
+	mi := fogMedium
+	for i := uint(0); i < maxDepth; i++ {
+		var clr, emitted mgl.Vec3
+		r, clr, emitted = t.traceStep(r, &skipSun, &skipEnv, &mi, rng)
+		radiance = radiance.Add(mulv(throughput, emitted))
+		throughput = mulv(throughput, clr)
+		if fleq(r.dir.Len(), 0.0) {
+			break
+		}
+	}
+	return radiance
+}
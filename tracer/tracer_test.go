@@ -0,0 +1,199 @@
+package tracer
+
+import (
+	"bytes"
+	"image/color"
+	"math"
+	"testing"
+
+	mgl "github.com/go-gl/mathgl/mgl32"
+
+	"github.com/xopoww/go-raytrace/scenery"
+)
+
+const testEpsilon = 1e-4
+
+func vec2Close(a, b mgl.Vec2) bool {
+	for i := 0; i < 2; i++ {
+		if a[i] != b[i] && mgl.Abs(a[i]-b[i]) > testEpsilon {
+			return false
+		}
+	}
+	return true
+}
+
+func vec3Close(a, b mgl.Vec3) bool {
+	return a.Sub(b).Len() <= testEpsilon
+}
+
+func testOptions() Options {
+	opts := DefaultOptions(32, 24)
+	opts.Samples = 2
+	opts.AntiAliasing = 1
+	opts.MaxDepth = 4
+	opts.Seed = 7
+	return opts
+}
+
+func testCamera(opts Options) scenery.Camera {
+	cam := scenery.NewCamera(opts.Width, opts.Height)
+	cam.Aperture = 0.0
+	return cam
+}
+
+func TestIntersectBox(t *testing.T) {
+	bmin, bmax := mgl.Vec3{-1, -1, -1}, mgl.Vec3{1, 1, 1}
+	for _, tc := range []struct {
+		name        string
+		origin, dir mgl.Vec3
+		want        mgl.Vec2
+		hit         bool
+	}{
+		{"through", mgl.Vec3{0, 0, -5}, mgl.Vec3{0, 0, 1}, mgl.Vec2{4, 6}, true},
+		{"unnormalized", mgl.Vec3{0, 0, -5}, mgl.Vec3{0, 0, 2}, mgl.Vec2{2, 3}, true},
+		{"inside", mgl.Vec3{0, 0, 0}, mgl.Vec3{1, 0, 0}, mgl.Vec2{-1, 1}, true},
+		{"behind", mgl.Vec3{0, 0, 5}, mgl.Vec3{0, 0, 1}, mgl.Vec2{-6, -4}, true},
+		{"diagonal", mgl.Vec3{-3, -3, 0}, mgl.Vec3{1, 1, 0}, mgl.Vec2{2, 4}, true},
+		{"miss", mgl.Vec3{0, 3, -5}, mgl.Vec3{0, 0, 1}, mgl.Vec2{}, false},
+	} {
+		got := intersectBox(tc.origin, tc.dir, bmin, bmax)
+		if hit := got.X() <= got.Y(); hit != tc.hit {
+			t.Errorf("%s: %v, hit = %v, want %v", tc.name, got, hit, tc.hit)
+		} else if tc.hit && !vec2Close(got, tc.want) {
+			t.Errorf("%s: %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestIntersectBall(t *testing.T) {
+	center := mgl.Vec3{1, 0, 0}
+	inf := float32(math.Inf(1))
+	for _, tc := range []struct {
+		name        string
+		origin, dir mgl.Vec3
+		want        mgl.Vec2
+	}{
+		{"through", mgl.Vec3{1, 0, -5}, mgl.Vec3{0, 0, 1}, mgl.Vec2{3, 7}},
+		{"unnormalized", mgl.Vec3{1, 0, -5}, mgl.Vec3{0, 0, 4}, mgl.Vec2{0.75, 1.75}},
+		{"inside", center, mgl.Vec3{0, 1, 0}, mgl.Vec2{-2, 2}},
+		{"tangent", mgl.Vec3{3, 0, -5}, mgl.Vec3{0, 0, 1}, mgl.Vec2{5, 5}},
+		{"miss", mgl.Vec3{4, 0, -5}, mgl.Vec3{0, 0, 1}, mgl.Vec2{inf, inf}},
+	} {
+		if got := intersectBall(tc.origin, tc.dir, center, 2); !vec2Close(got, tc.want) {
+			t.Errorf("%s: %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestNormals(t *testing.T) {
+	bmin, bmax := mgl.Vec3{-1, -1, -1}, mgl.Vec3{1, 2, 1}
+	for _, tc := range []struct {
+		point, want mgl.Vec3
+	}{
+		{mgl.Vec3{1, 0.5, 0.2}, mgl.Vec3{1, 0, 0}},
+		{mgl.Vec3{-1, 0.5, 0.2}, mgl.Vec3{-1, 0, 0}},
+		{mgl.Vec3{0.3, 2, -0.4}, mgl.Vec3{0, 1, 0}},
+		{mgl.Vec3{0.3, -1, -0.4}, mgl.Vec3{0, -1, 0}},
+		{mgl.Vec3{0.3, 0.5, 1}, mgl.Vec3{0, 0, 1}},
+		{mgl.Vec3{0.3, 0.5, -1}, mgl.Vec3{0, 0, -1}},
+	} {
+		if got := normalBox(tc.point, bmin, bmax); !vec3Close(got, tc.want) {
+			t.Errorf("normalBox(%v) = %v, want %v", tc.point, got, tc.want)
+		}
+	}
+
+	center := mgl.Vec3{1, 2, 3}
+	for _, dir := range []mgl.Vec3{{1, 0, 0}, {0, -1, 0}, {1, 1, 1}} {
+		want := dir.Normalize()
+		if got := normalBall(center.Add(want.Mul(2)), center); !vec3Close(got, want) {
+			t.Errorf("normalBall in direction %v = %v, want %v", dir, got, want)
+		}
+	}
+
+	tri := scenery.Triangle{
+		Vertices: [3]mgl.Vec3{{0, 0, 0}, {1, 0, 0}, {0, 1, 0}},
+		Normals:  [3]mgl.Vec3{{0, 0, 1}, {1, 0, 0}, {0, 1, 0}},
+	}
+	if got := normalTriangle(&tri, mgl.Vec2{0, 0}); !vec3Close(got, mgl.Vec3{0, 0, 1}) {
+		t.Errorf("normalTriangle at the first vertex = %v", got)
+	}
+	if got, want := normalTriangle(&tri, mgl.Vec2{0.5, 0.5}), (mgl.Vec3{1, 1, 0}).Normalize(); !vec3Close(got, want) {
+		t.Errorf("normalTriangle in the middle of the edge = %v, want %v", got, want)
+	}
+}
+
+func TestIntersectObjects(t *testing.T) {
+	scene := scenery.NewScene()
+	white := scenery.NewLambertian(color.RGBA{0xff, 0xff, 0xff, 0xff})
+	scene.AddObject(scenery.NewObject(scenery.NewBox(mgl.Vec3{-1, -1, -1}, mgl.Vec3{1, 1, 1}), white))
+	scene.AddObject(scenery.NewObject(scenery.NewBall(mgl.Vec3{0, 0, 5}, 1), white))
+	tr := New(scene)
+	for _, tc := range []struct {
+		name        string
+		origin, dir mgl.Vec3
+		oi          int
+		lambda      mgl.Vec2
+		found       bool
+	}{
+		{"box", mgl.Vec3{0, 0, -5}, mgl.Vec3{0, 0, 1}, 0, mgl.Vec2{4, 6}, true},
+		{"ball", mgl.Vec3{0, 0, 10}, mgl.Vec3{0, 0, -1}, 1, mgl.Vec2{4, 6}, true},
+		{"ball behind the box", mgl.Vec3{0, 0, 2}, mgl.Vec3{0, 0, 1}, 1, mgl.Vec2{2, 4}, true},
+		{"miss", mgl.Vec3{0, 3, -5}, mgl.Vec3{0, 0, 1}, 0, mgl.Vec2{}, false},
+		// rays starting inside a body hit it from inside, at the exit point
+		{"inside the box", mgl.Vec3{0, 0, 0}, mgl.Vec3{0, 0, 1}, 0, mgl.Vec2{1, 1}, true},
+		{"inside the ball", mgl.Vec3{0, 0, 5}, mgl.Vec3{0, 0, 1}, 1, mgl.Vec2{1, 1}, true},
+		{"inside the ball towards the box", mgl.Vec3{0, 0, 4.5}, mgl.Vec3{0, 0, -1}, 1, mgl.Vec2{0.5, 0.5}, true},
+		{"on the surface of the box", mgl.Vec3{0, 0, -1}, mgl.Vec3{0, 0, 1}, 0, mgl.Vec2{2, 2}, true},
+		{"inside the box behind the ray", mgl.Vec3{0, 0, 1.5}, mgl.Vec3{0, 0, -1}, 0, mgl.Vec2{0.5, 2.5}, true},
+	} {
+		info, found := tr.intersectObjects(tc.origin, tc.dir)
+		if found != tc.found {
+			t.Errorf("%s: found = %v, want %v", tc.name, found, tc.found)
+		} else if found && (info.oi != tc.oi || !vec2Close(info.lambda, tc.lambda)) {
+			t.Errorf("%s: object %d at %v, want %d at %v", tc.name, info.oi, info.lambda, tc.oi, tc.lambda)
+		}
+	}
+}
+
+func TestIntersectObjectsTie(t *testing.T) {
+	// equally close objects go to the one with the smaller index,
+	// whichever order they are tested in
+	white := scenery.NewLambertian(color.RGBA{0xff, 0xff, 0xff, 0xff})
+	scene := scenery.NewScene()
+	for i := 0; i < 3; i++ {
+		scene.AddObject(scenery.NewObject(scenery.NewBox(mgl.Vec3{-1, -1, -1}, mgl.Vec3{1, 1, 1}), white))
+	}
+	// the ray enters the ball at the same point as the boxes
+	scene.AddObject(scenery.NewObject(scenery.NewBall(mgl.Vec3{0, 0, 0}, 1), white))
+	tr := New(scene)
+	for _, bvh := range []bool{true, false} {
+		tt := *tr
+		if !bvh {
+			tt.bvh = nil
+		}
+		info, found := tt.intersectObjects(mgl.Vec3{0, 0, -5}, mgl.Vec3{0, 0, 1})
+		if !found || info.oi != 0 || info.lambda.X() != 4 {
+			t.Errorf("bvh = %v: object %d at %v (found = %v), want 0 at 4", bvh, info.oi, info.lambda, found)
+		}
+	}
+}
+
+func TestRenderDeterministic(t *testing.T) {
+	opts := testOptions()
+	cam := testCamera(opts)
+	tr := New(scenery.RandomScene(3))
+
+	opts.Workers = 1
+	want := tr.Render(cam, opts)
+	for _, workers := range []int{1, 3, 8} {
+		opts.Workers = workers
+		if got := tr.Render(cam, opts); !bytes.Equal(got.Pix, want.Pix) {
+			t.Errorf("the image rendered by %d workers differs from the one rendered by 1", workers)
+		}
+	}
+
+	opts.Seed++
+	if got := tr.Render(cam, opts); bytes.Equal(got.Pix, want.Pix) {
+		t.Errorf("the image does not depend on the seed")
+	}
+}